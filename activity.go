@@ -0,0 +1,460 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	errors "github.com/fiverr/go_errors"
+	"gopkg.in/redis.v5"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// withActivity records every request in the activity of the user making it: the owner of the API
+// key when one is sent, otherwise the user_id param, which withSession sets from the session.
+// Anonymous requests are not recorded. Entries are only queued here, so a slow store never
+// delays the response.
+func withActivity(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		route := routePattern(req)
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, req)
+		if route == "unmatched" {
+			return
+		}
+		userID := activityUserID(req)
+		if userID == "" {
+			return
+		}
+		queueActivity(ActivityEvent{UserID: userID, ActivityEntry: ActivityEntry{Route: route, Method: req.Method,
+			Time: time.Now().UTC(), Status: recorder.status, IP: clientIP(req), UserAgent: req.UserAgent()}})
+	})
+}
+
+var (
+	// activityQueue buffers entries for the activity workers, sized from config in main
+	activityQueue  chan ActivityEvent
+	activityWorker *Worker
+)
+
+// queueActivity hands the entry to the activity workers. When the queue is full the entry is
+// dropped and counted on the activity worker rather than blocking the request.
+func queueActivity(event ActivityEvent) {
+	select {
+	case activityQueue <- event:
+	default:
+		activityWorker.Drop()
+	}
+}
+
+// startActivityWorkers starts the goroutines draining the activity queue into the store.
+func startActivityWorkers() {
+	activityQueue = make(chan ActivityEvent, config.Activity.QueueSize)
+	activityWorker = registerWorker("activity", func() int { return len(activityQueue) })
+	for i := 0; i < config.Activity.Workers; i++ {
+		go func() {
+			for {
+				activityWorker.WaitWhilePaused()
+				event := <-activityQueue
+				event.Country = geoResolve(event.IP)
+				err := recordActivity(event.UserID, event.ActivityEntry)
+				if err != nil {
+					fmt.Println(err)
+				}
+				activityWorker.Done(err)
+			}
+		}()
+	}
+}
+
+// activityUserID returns the identity a request is recorded under, scoped to its tenant.
+func activityUserID(req *http.Request) string {
+	if secret := req.Header.Get(apiKeyHeader); secret != "" {
+		key, err := lookupAPIKey(sharedRedis(), hashSecret(secret))
+		if err != nil {
+			return ""
+		}
+		return tenantID(key.Tenant, key.UserID)
+	}
+	return tenantID(requestTenant(req), getParamValue(req, "user_id"))
+}
+
+// recordActivity stores the entry in the configured activity store, counts the request towards
+// the top users and publishes it to the admin activity stream, which need Redis and are skipped
+// in demo mode.
+func recordActivity(userID string, entry ActivityEntry) error {
+	if err := activities.Record(userID, entry); err != nil {
+		return err
+	}
+	if demoMode {
+		return nil
+	}
+	event, err := json.Marshal(ActivityEvent{UserID: userID, ActivityEntry: entry})
+	if err != nil {
+		return errors.Wrap(err, "cannot create json activity event")
+	}
+	key := userRequestsKey(entry.Time)
+	_, err = sharedRedis().Pipelined(func(pipe *redis.Pipeline) error {
+		pipe.Publish(activityEventsChannel, string(event))
+		pipe.ZIncrBy(key, 1, userID)
+		pipe.Expire(key, userRequestsRetention+24*time.Hour)
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "cannot set key in Redis")
+	}
+	return nil
+}
+
+// ActivityEntry is a single request recorded by an ActivityStore. Entries are scored by the request
+// time in Unix nanoseconds.
+type ActivityEntry struct {
+	Route     string    `json:"route"`
+	Method    string    `json:"method"`
+	Time      time.Time `json:"time"`
+	Status    int       `json:"status,omitempty"`
+	IP        string    `json:"ip,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	Country   string    `json:"country,omitempty"`
+}
+
+// parseActivity decodes an activity member. Members are JSON entries; entries recorded before
+// client metadata was captured have the form "route=..., method=...".
+func parseActivity(z redis.Z) ActivityEntry {
+	var entry ActivityEntry
+	member := fmt.Sprintf("%v", z.Member)
+	if strings.HasPrefix(member, "{") && json.Unmarshal([]byte(member), &entry) == nil {
+		return entry
+	}
+	entry.Time = time.Unix(0, int64(z.Score)).UTC()
+	if i := strings.LastIndex(member, ", method="); i >= 0 {
+		entry.Method = member[i+len(", method="):]
+		member = member[:i]
+	}
+	entry.Route = strings.TrimPrefix(member, "route=")
+	return entry
+}
+
+var geoIPClient = &http.Client{Timeout: 2 * time.Second}
+
+// geoResolve returns the country of ip from the configured geo IP service, caching answers in
+// Redis for a day. It returns "" when geo resolution is disabled or fails.
+func geoResolve(ip string) string {
+	if config.Activity.GeoIPURL == "" || ip == "" {
+		return ""
+	}
+	client := sharedRedis()
+	if country, err := client.Get("geoip:" + ip).Result(); err == nil {
+		return country
+	}
+	resp, err := geoIPClient.Get(strings.Replace(config.Activity.GeoIPURL, "{ip}", url.PathEscape(ip), -1))
+	if err != nil {
+		return ""
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return ""
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64))
+	if err != nil {
+		return ""
+	}
+	country := strings.TrimSpace(string(body))
+	client.Set("geoip:"+ip, country, 24*time.Hour)
+	return country
+}
+
+const (
+	// activityUsersKey is the set of users with recorded activity, walked by the cleanup job.
+	activityUsersKey = "activity_users"
+	// activityKeysMigratedKey is set once the activity of every user moved to activityKey.
+	activityKeysMigratedKey = "activity_keys_migrated"
+)
+
+// activityKey is the sorted set of the user's activity. The prefix keeps user ids from naming
+// other keys, such as the outbox or the API keys.
+func activityKey(userID string) string {
+	return "activity:" + userID
+}
+
+// migrateActivityKeys moves the activity sets, once kept under the bare user id, of the users
+// known to the cleanup job to activityKey, merging them with entries recorded there since. Keys
+// of such ids that are not sorted sets belong to something else and are left alone.
+func migrateActivityKeys(client *redis.Client) error {
+	if done, err := client.Exists(activityKeysMigratedKey).Result(); err != nil {
+		return errors.Wrap(err, "cannot get key from Redis")
+	} else if done {
+		return nil
+	}
+	var cursor uint64
+	for {
+		var userIDs []string
+		var err error
+		userIDs, cursor, err = client.SScan(activityUsersKey, cursor, "", 100).Result()
+		if err != nil {
+			return errors.Wrap(err, "cannot get key from Redis")
+		}
+		for _, userID := range userIDs {
+			if kind, err := client.Type(userID).Result(); err != nil || kind != "zset" {
+				continue
+			}
+			key := activityKey(userID)
+			_, err = client.Pipelined(func(pipe *redis.Pipeline) error {
+				pipe.ZUnionStore(key, redis.ZStore{Aggregate: "MAX"}, key, userID)
+				pipe.Del(userID)
+				return nil
+			})
+			if err != nil {
+				return errors.Wrap(err, "cannot migrate the activity of user "+userID)
+			}
+		}
+		if cursor == 0 {
+			break
+		}
+	}
+	if err := client.Set(activityKeysMigratedKey, time.Now().UTC().Format(time.RFC3339), 0).Err(); err != nil {
+		return errors.Wrap(err, "cannot set key in Redis")
+	}
+	return nil
+}
+
+// activityRetention returns the configured retention window, 0 when activity is kept forever.
+func activityRetention() (time.Duration, error) {
+	if config.Activity.Retention == "" {
+		return 0, nil
+	}
+	return parseWindow(config.Activity.Retention)
+}
+
+// addActivityRetention queues the commands trimming the user's activity to the configured maximum
+// number of entries and retention window, and expiring the whole set once the user is idle for
+// the window.
+func addActivityRetention(pipe *redis.Pipeline, userID string, retention time.Duration) {
+	pipe.SAdd(activityUsersKey, userID)
+	key := activityKey(userID)
+	if max := config.Activity.MaxEntries; max > 0 {
+		pipe.ZRemRangeByRank(key, 0, -max-1)
+	}
+	if retention > 0 {
+		cutoff := time.Now().Add(-retention).UnixNano()
+		pipe.ZRemRangeByScore(key, "-inf", "("+strconv.FormatInt(cutoff, 10))
+		pipe.Expire(key, retention)
+	}
+}
+
+// cleanupActivity applies the retention policy to every user with activity, forgetting users
+// whose activity expired.
+func cleanupActivity() error {
+	client := sharedRedis()
+	var cursor uint64
+	for {
+		var userIDs []string
+		var err error
+		userIDs, cursor, err = client.SScan(activityUsersKey, cursor, "", 100).Result()
+		if err != nil {
+			return errors.Wrap(err, "cannot get key from Redis")
+		}
+		retention, err := activityRetention()
+		if err != nil {
+			return err
+		}
+		for _, userID := range userIDs {
+			_, err = client.Pipelined(func(pipe *redis.Pipeline) error {
+				addActivityRetention(pipe, userID, retention)
+				return nil
+			})
+			if err != nil {
+				return errors.Wrap(err, "cannot set key in Redis")
+			}
+			if count, err := client.ZCard(activityKey(userID)).Result(); err == nil && count == 0 {
+				client.SRem(activityUsersKey, userID)
+			}
+		}
+		if cursor == 0 {
+			return nil
+		}
+	}
+}
+
+// clearActivity removes the user's whole activity history.
+func clearActivity(client *redis.Client, userID string) error {
+	_, err := client.Pipelined(func(pipe *redis.Pipeline) error {
+		pipe.Del(activityKey(userID))
+		pipe.SRem(activityUsersKey, userID)
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "cannot delete key in Redis")
+	}
+	return nil
+}
+
+// allActivity returns the user's complete activity history, newest first.
+func allActivity(client *redis.Client, userID string) ([]ActivityEntry, error) {
+	resultSet, err := client.ZRevRangeWithScores(activityKey(userID), 0, -1).Result()
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot get key from Redis")
+	}
+	entries := make([]ActivityEntry, 0, len(resultSet))
+	for _, z := range resultSet {
+		entries = append(entries, parseActivity(z))
+	}
+	return entries, nil
+}
+
+// ActivityFilter narrows the activity returned by ActivityStore.Page. Empty fields match everything.
+type ActivityFilter struct {
+	Route  string
+	Method string
+	From   time.Time
+	To     time.Time
+}
+
+// parseActivityTime parses an RFC 3339 time or a plain date such as 2006-01-02.
+func parseActivityTime(name string, value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return time.Time{}, errors.New(name + " must be an RFC 3339 time or a date such as 2006-01-02")
+	}
+	return t, nil
+}
+
+// parseActivityFilter reads the route, method, from and to params.
+func parseActivityFilter(req *http.Request) (ActivityFilter, error) {
+	var err error
+	f := ActivityFilter{Route: getParamValue(req, "route"), Method: strings.ToUpper(getParamValue(req, "method"))}
+	if value := getParamValue(req, "from"); value != "" {
+		if f.From, err = parseActivityTime("from", value); err != nil {
+			return f, err
+		}
+	}
+	if value := getParamValue(req, "to"); value != "" {
+		if f.To, err = parseActivityTime("to", value); err != nil {
+			return f, err
+		}
+	}
+	if !f.From.IsZero() && !f.To.IsZero() && f.To.Before(f.From) {
+		return f, errors.New("to must not be before from")
+	}
+	return f, nil
+}
+
+// scoreRange returns the sorted set score range of the filter's time range.
+func (f ActivityFilter) scoreRange() redis.ZRangeBy {
+	r := redis.ZRangeBy{Min: "-inf", Max: "+inf"}
+	if !f.From.IsZero() {
+		r.Min = strconv.FormatInt(f.From.UnixNano(), 10)
+	}
+	if !f.To.IsZero() {
+		r.Max = strconv.FormatInt(f.To.UnixNano(), 10)
+	}
+	return r
+}
+
+func (f ActivityFilter) matches(entry ActivityEntry) bool {
+	// routes recorded before the activity middleware have no leading slash
+	route := strings.Trim(entry.Route, "/")
+	return (f.Route == "" || strings.EqualFold(route, strings.Trim(f.Route, "/"))) && (f.Method == "" || entry.Method == f.Method)
+}
+
+// redisActivityPage returns a page of the user's activity matching the filter, newest first. The
+// time range is a score range query; route and method are matched on the entries in that range.
+func redisActivityPage(client *redis.Client, userID string, f ActivityFilter, offset int64, limit int64) (int64, []ActivityEntry, error) {
+	var total int64
+	entries := make([]ActivityEntry, 0)
+	scores := f.scoreRange()
+	if f.Route == "" && f.Method == "" {
+		var err error
+		if total, err = client.ZCount(activityKey(userID), scores.Min, scores.Max).Result(); err != nil {
+			return 0, nil, errors.Wrap(err, "cannot get key from Redis")
+		}
+		scores.Offset, scores.Count = offset, limit
+		resultSet, err := client.ZRevRangeByScoreWithScores(activityKey(userID), scores).Result()
+		if err != nil {
+			return 0, nil, errors.Wrap(err, "cannot get key from Redis")
+		}
+		for _, z := range resultSet {
+			entries = append(entries, parseActivity(z))
+		}
+	} else {
+		resultSet, err := client.ZRevRangeByScoreWithScores(activityKey(userID), scores).Result()
+		if err != nil {
+			return 0, nil, errors.Wrap(err, "cannot get key from Redis")
+		}
+		for _, z := range resultSet {
+			if entry := parseActivity(z); f.matches(entry) {
+				if total >= offset && total < offset+limit {
+					entries = append(entries, entry)
+				}
+				total++
+			}
+		}
+	}
+	return total, entries, nil
+}
+
+// activityPage returns a page of the user's activity from the configured store as JSON.
+func activityPage(userID string, f ActivityFilter, offset int64, limit int64) (string, error) {
+	total, entries, err := activities.Page(userID, f, offset, limit)
+	if err != nil {
+		return "", err
+	}
+	buf, err := json.Marshal(map[string]interface{}{"total": total, "offset": offset, "limit": limit, "activity": entries})
+	if err != nil {
+		return "", errors.Wrap(err, "cannot create json result of activity")
+	}
+	return string(buf), nil
+}
+
+// userActivity handles GET /users/{id}/activity/export?format=json|csv, the user's full activity
+// history for data portability requests.
+func userActivity(w http.ResponseWriter, req *http.Request, userID string, rest []string) {
+	if req.Method != "GET" || len(rest) != 1 || rest[0] != "export" {
+		msg := "Unsupported request for " + req.URL.Path + " " + req.Method
+		fmt.Fprintf(w, "%s", errors.New(msg))
+		return
+	}
+	if !authorizeUser(w, req, userID) {
+		return
+	}
+	format := getParamValue(req, "format")
+	if format != "" && format != "json" && format != "csv" {
+		fmt.Fprintf(w, "%s", errors.New("format must be json or csv"))
+		return
+	}
+	entries, err := activities.All(userID)
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="activity-`+userID+`.csv"`)
+		out := csv.NewWriter(w)
+		out.Write([]string{"time", "route", "method", "status", "ip", "user_agent", "country"})
+		for _, entry := range entries {
+			out.Write([]string{entry.Time.Format(time.RFC3339Nano), entry.Route, entry.Method, strconv.Itoa(entry.Status),
+				entry.IP, entry.UserAgent, entry.Country})
+		}
+		out.Flush()
+		if err = out.Error(); err != nil {
+			fmt.Println(errors.Wrap(err, "cannot write activity export"))
+		}
+		return
+	}
+	w.Header().Set("Content-Disposition", `attachment; filename="activity-`+userID+`.json"`)
+	buf, err := json.Marshal(map[string]interface{}{"user_id": userID, "total": len(entries), "activity": entries})
+	if err != nil {
+		fmt.Fprintf(w, "%s", errors.Wrap(err, "cannot create json result of activity"))
+		return
+	}
+	fmt.Fprintf(w, "%s", buf)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"gopkg.in/redis.v5"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestClearActivityKeepsOtherKeys(t *testing.T) {
+	useMemoryRepository(t)
+	useRedis(t)
+	savedActivities := activities
+	activities = &redisActivityStore{}
+	defer func() { activities = savedActivities }()
+	if err := sharedRedis().LPush(outboxKey, `{"id":"1"}`).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeToRedis([]pendingActivity{{userID: "outbox", entry: ActivityEntry{Route: "/book", Method: "GET", Time: time.Now().UTC()}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	w := serve(http.HandlerFunc(activity), "DELETE", "/activity?user_id=outbox", map[string]string{adminTokenHdr: testAdminToken})
+	if w.Code != http.StatusOK {
+		t.Fatalf("DELETE /activity = %d %q", w.Code, w.Body.String())
+	}
+	if n, err := sharedRedis().ZCard(activityKey("outbox")).Result(); err != nil || n != 0 {
+		t.Errorf("activity of user outbox after clearing = %d, %v", n, err)
+	}
+	if n, err := sharedRedis().LLen(outboxKey).Result(); err != nil || n != 1 {
+		t.Errorf("outbox after clearing the activity of user outbox = %d, %v", n, err)
+	}
+}
+
+func TestMigrateActivityKeys(t *testing.T) {
+	useMemoryRepository(t)
+	useRedis(t)
+	client := sharedRedis()
+	client.SAdd(activityUsersKey, "alice", "outbox")
+	client.ZAdd("alice", redis.Z{Score: 1, Member: "old"})
+	client.ZAdd(activityKey("alice"), redis.Z{Score: 2, Member: "new"})
+	client.LPush(outboxKey, `{"id":"1"}`)
+
+	if err := migrateActivityKeys(client); err != nil {
+		t.Fatal(err)
+	}
+	if members, err := client.ZRange(activityKey("alice"), 0, -1).Result(); err != nil || len(members) != 2 {
+		t.Errorf("migrated activity of alice = %v, %v", members, err)
+	}
+	if exists, _ := client.Exists("alice").Result(); exists {
+		t.Error("bare activity key of alice was not removed")
+	}
+	if n, err := client.LLen(outboxKey).Result(); err != nil || n != 1 {
+		t.Errorf("outbox after the migration = %d, %v", n, err)
+	}
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	errors "github.com/fiverr/go_errors"
+	"gopkg.in/olivere/elastic.v5"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ActivityStore records user activity and answers the /activity queries.
+type ActivityStore interface {
+	Record(userID string, entry ActivityEntry) error
+	// Page returns the total number of entries matching the filter and a page of them, newest first.
+	Page(userID string, f ActivityFilter, offset int64, limit int64) (int64, []ActivityEntry, error)
+	All(userID string) ([]ActivityEntry, error)
+	Clear(userID string) error
+	// Cleanup applies the retention policy.
+	Cleanup() error
+}
+
+// activities is the store selected by config, set up in main.
+var activities ActivityStore
+
+// newActivityStore creates the activity backend selected by config: "redis", "elasticsearch" or
+// "memory".
+func newActivityStore(backend string) (ActivityStore, error) {
+	switch backend {
+	case "", "redis":
+		if err := migrateActivityKeys(sharedRedis()); err != nil {
+			return nil, err
+		}
+		store := &redisActivityStore{}
+		store.startFlushing()
+		return store, nil
+	case "elasticsearch":
+		return &esActivityStore{}, nil
+	case "memory":
+		return newMemoryActivityStore(), nil
+	default:
+		return nil, errors.New("unknown activity backend " + backend)
+	}
+}
+
+// redisActivityStore keeps each user's activity in a sorted set under activityKey. Entries are
+// buffered and written in pipelined batches by writeToRedis.
+type redisActivityStore struct {
+	mu      sync.Mutex
+	pending []pendingActivity
+}
+
+// pendingActivity is an entry waiting in the Redis store's buffer.
+type pendingActivity struct {
+	userID string
+	entry  ActivityEntry
+}
+
+// startFlushing flushes the buffer every configured flush interval so quiet periods do not
+// leave entries waiting.
+func (s *redisActivityStore) startFlushing() {
+	interval := parseDuration(config.Activity.FlushInterval, 100*time.Millisecond)
+	go func() {
+		for range time.Tick(interval) {
+			if err := s.flush(); err != nil {
+				fmt.Println(err)
+			}
+		}
+	}()
+}
+
+// flush writes the buffered entries in one batch.
+func (s *redisActivityStore) flush() error {
+	s.mu.Lock()
+	batch := s.pending
+	s.pending = nil
+	s.mu.Unlock()
+	if len(batch) == 0 {
+		return nil
+	}
+	return writeToRedis(batch)
+}
+
+func (s *redisActivityStore) Record(userID string, entry ActivityEntry) error {
+	s.mu.Lock()
+	s.pending = append(s.pending, pendingActivity{userID: userID, entry: entry})
+	full := len(s.pending) >= config.Activity.BatchSize
+	s.mu.Unlock()
+	if full {
+		return s.flush()
+	}
+	return nil
+}
+
+func (s *redisActivityStore) Page(userID string, f ActivityFilter, offset int64, limit int64) (int64, []ActivityEntry, error) {
+	return redisActivityPage(sharedRedis(), userID, f, offset, limit)
+}
+
+func (s *redisActivityStore) All(userID string) ([]ActivityEntry, error) {
+	return allActivity(sharedRedis(), userID)
+}
+
+// Clear also drops the user's entries still waiting in the buffer.
+func (s *redisActivityStore) Clear(userID string) error {
+	s.mu.Lock()
+	pending := s.pending[:0]
+	for _, p := range s.pending {
+		if p.userID != userID {
+			pending = append(pending, p)
+		}
+	}
+	s.pending = pending
+	s.mu.Unlock()
+	return clearActivity(sharedRedis(), userID)
+}
+
+func (s *redisActivityStore) Cleanup() error {
+	return cleanupActivity()
+}
+
+const (
+	activityMapping = `
+{
+	"settings":{
+		"number_of_shards": 1,
+		"number_of_replicas": 0
+	},
+	"mappings":{
+		"activity":{
+			"properties": {
+				"user_id": { "type": "keyword" },
+				"route": { "type": "keyword" },
+				"method": { "type": "keyword" },
+				"time": { "type": "date" },
+				"status": { "type": "integer" },
+				"ip": { "type": "keyword" },
+				"user_agent": { "type": "keyword" },
+				"country": { "type": "keyword" }
+			}
+		}
+	}
+}`
+	ACTIVITY_INDEX = "activity"
+	ACTIVITY_TYPE  = "activity"
+)
+
+// esActivityStore indexes activity entries as ActivityEvent documents, so they can be searched
+// and aggregated like any other index. With an ILM policy configured, retention is left to it.
+type esActivityStore struct {
+	// indexReady is set once the activity index is known to exist, to skip the check per request
+	indexReady int32
+}
+
+func ensureActivityIndex(client *elastic.Client, ctx context.Context) error {
+	exists, err := client.IndexExists(ACTIVITY_INDEX).Do(ctx)
+	if err != nil {
+		return errors.Wrap(err, "cannot check activity index")
+	}
+	if !exists {
+		if _, err = client.CreateIndex(ACTIVITY_INDEX).BodyString(activityMapping).Do(ctx); err != nil {
+			return errors.Wrap(err, "cannot create activity index")
+		}
+		if policy := config.Activity.ILMPolicy; policy != "" {
+			_, err = client.IndexPutSettings(ACTIVITY_INDEX).BodyJson(map[string]interface{}{"index.lifecycle.name": policy}).Do(ctx)
+			if err != nil {
+				return errors.Wrap(err, "cannot set the ILM policy of the activity index")
+			}
+		}
+	}
+	return nil
+}
+
+func (s *esActivityStore) Record(userID string, entry ActivityEntry) error {
+	client, ctx, err := connectElasticSearch()
+	if err != nil {
+		return err
+	}
+	if atomic.LoadInt32(&s.indexReady) == 0 {
+		if err = ensureActivityIndex(client, ctx); err != nil {
+			return err
+		}
+		atomic.StoreInt32(&s.indexReady, 1)
+	}
+	_, err = client.Index().Index(ACTIVITY_INDEX).Type(typeName(ACTIVITY_TYPE)).
+		BodyJson(ActivityEvent{UserID: userID, ActivityEntry: entry}).Do(ctx)
+	if err != nil {
+		return errors.Wrap(err, "cannot index activity")
+	}
+	return nil
+}
+
+// query matches the user's entries passing the filter.
+func (s *esActivityStore) query(userID string, f ActivityFilter) elastic.Query {
+	query := elastic.NewBoolQuery().Filter(elastic.NewTermQuery("user_id", userID))
+	if f.Route != "" {
+		route := strings.Trim(f.Route, "/")
+		query = query.Filter(elastic.NewTermsQuery("route", route, "/"+route, "/"+route+"/"))
+	}
+	if f.Method != "" {
+		query = query.Filter(elastic.NewTermQuery("method", f.Method))
+	}
+	if !f.From.IsZero() || !f.To.IsZero() {
+		timeRange := elastic.NewRangeQuery("time")
+		if !f.From.IsZero() {
+			timeRange = timeRange.Gte(f.From.Format(time.RFC3339Nano))
+		}
+		if !f.To.IsZero() {
+			timeRange = timeRange.Lte(f.To.Format(time.RFC3339Nano))
+		}
+		query = query.Filter(timeRange)
+	}
+	return query
+}
+
+func decodeActivityHit(hit *elastic.SearchHit) (ActivityEntry, error) {
+	var event ActivityEvent
+	if err := json.Unmarshal(*hit.Source, &event); err != nil {
+		return ActivityEntry{}, errors.Wrap(err, "cannot decode activity")
+	}
+	return event.ActivityEntry, nil
+}
+
+func (s *esActivityStore) Page(userID string, f ActivityFilter, offset int64, limit int64) (int64, []ActivityEntry, error) {
+	client, ctx, err := connectElasticSearch()
+	if err != nil {
+		return 0, nil, err
+	}
+	entries := make([]ActivityEntry, 0)
+	searchResult, err := client.Search().Index(ACTIVITY_INDEX).Query(s.query(userID, f)).Sort("time", false).Sort(idSortField(), true).
+		From(int(offset)).Size(int(limit)).Do(ctx)
+	if err != nil {
+		if elastic.IsNotFound(err) {
+			return 0, entries, nil
+		}
+		return 0, nil, errors.Wrap(err, "cannot search activity")
+	}
+	for _, hit := range searchResult.Hits.Hits {
+		entry, err := decodeActivityHit(hit)
+		if err != nil {
+			return 0, nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return searchResult.Hits.TotalHits, entries, nil
+}
+
+func (s *esActivityStore) All(userID string) ([]ActivityEntry, error) {
+	client, ctx, err := connectElasticSearch()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]ActivityEntry, 0)
+	scroll := client.Scroll(ACTIVITY_INDEX).Query(s.query(userID, ActivityFilter{})).Sort("time", false).Size(500)
+	defer scroll.Clear(ctx)
+	for {
+		res, err := scroll.Do(ctx)
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			if elastic.IsNotFound(err) {
+				return entries, nil
+			}
+			return nil, errors.Wrap(err, "cannot scroll activity")
+		}
+		for _, hit := range res.Hits.Hits {
+			entry, err := decodeActivityHit(hit)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+		}
+	}
+}
+
+func (s *esActivityStore) Clear(userID string) error {
+	client, ctx, err := connectElasticSearch()
+	if err != nil {
+		return err
+	}
+	_, err = client.DeleteByQuery(ACTIVITY_INDEX).Query(elastic.NewTermQuery("user_id", userID)).Refresh("true").Do(ctx)
+	if err != nil && !elastic.IsNotFound(err) {
+		return errors.Wrap(err, "cannot delete activity")
+	}
+	return nil
+}
+
+// Cleanup deletes entries older than the retention window, unless an ILM policy manages the
+// index. The per-user cap on entries only applies to the Redis store.
+func (s *esActivityStore) Cleanup() error {
+	if config.Activity.ILMPolicy != "" || config.Activity.Retention == "" {
+		return nil
+	}
+	retention, err := parseWindow(config.Activity.Retention)
+	if err != nil {
+		return err
+	}
+	client, ctx, err := connectElasticSearch()
+	if err != nil {
+		return err
+	}
+	cutoff := time.Now().Add(-retention).UTC().Format(time.RFC3339Nano)
+	_, err = client.DeleteByQuery(ACTIVITY_INDEX).Query(elastic.NewRangeQuery("time").Lt(cutoff)).Do(ctx)
+	if err != nil && !elastic.IsNotFound(err) {
+		return errors.Wrap(err, "cannot delete expired activity")
+	}
+	return nil
+}
+
+// memoryActivityStore keeps activity in process, for demo mode. Entries are lost on restart.
+type memoryActivityStore struct {
+	mu      sync.Mutex
+	entries map[string][]ActivityEntry
+}
+
+func newMemoryActivityStore() *memoryActivityStore {
+	return &memoryActivityStore{entries: make(map[string][]ActivityEntry)}
+}
+
+// Record keeps the user's entries ordered newest first, capped at MaxEntries.
+func (s *memoryActivityStore) Record(userID string, entry ActivityEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries := s.entries[userID]
+	i := sort.Search(len(entries), func(i int) bool { return !entries[i].Time.After(entry.Time) })
+	entries = append(entries, ActivityEntry{})
+	copy(entries[i+1:], entries[i:])
+	entries[i] = entry
+	if max := config.Activity.MaxEntries; max > 0 && int64(len(entries)) > max {
+		entries = entries[:max]
+	}
+	s.entries[userID] = entries
+	return nil
+}
+
+func (s *memoryActivityStore) Page(userID string, f ActivityFilter, offset int64, limit int64) (int64, []ActivityEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var total int64
+	entries := make([]ActivityEntry, 0)
+	for _, entry := range s.entries[userID] {
+		if (!f.From.IsZero() && entry.Time.Before(f.From)) || (!f.To.IsZero() && entry.Time.After(f.To)) || !f.matches(entry) {
+			continue
+		}
+		if total >= offset && total < offset+limit {
+			entries = append(entries, entry)
+		}
+		total++
+	}
+	return total, entries, nil
+}
+
+func (s *memoryActivityStore) All(userID string) ([]ActivityEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]ActivityEntry(nil), s.entries[userID]...), nil
+}
+
+func (s *memoryActivityStore) Clear(userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, userID)
+	return nil
+}
+
+func (s *memoryActivityStore) Cleanup() error {
+	if config.Activity.Retention == "" {
+		return nil
+	}
+	retention, err := parseWindow(config.Activity.Retention)
+	if err != nil {
+		return err
+	}
+	cutoff := time.Now().Add(-retention)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for userID, entries := range s.entries {
+		i := sort.Search(len(entries), func(i int) bool { return entries[i].Time.Before(cutoff) })
+		if i == 0 {
+			delete(s.entries, userID)
+		} else {
+			s.entries[userID] = entries[:i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	errors "github.com/fiverr/go_errors"
+	"net/http"
+	"strings"
+)
+
+const activityEventsChannel = "activity_events"
+
+// ActivityEvent is an activity entry broadcast to /admin/activity/stream subscribers.
+type ActivityEvent struct {
+	UserID string `json:"user_id"`
+	ActivityEntry
+}
+
+// activityStream streams the activity of the tenant's users as Server-Sent Events, optionally only
+// that of user_id or of a route such as /book.
+func activityStream(w http.ResponseWriter, req *http.Request) {
+	if !isAdmin(req) {
+		http.Error(w, "admin token required", http.StatusUnauthorized)
+		return
+	}
+	if req.Method != "GET" {
+		msg := "Unsupported request for /admin/activity/stream " + req.Method
+		fmt.Fprintf(w, "%s", errors.New(msg))
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		fmt.Fprintf(w, "%s", errors.New("streaming is not supported"))
+		return
+	}
+	tenant := requestTenant(req)
+	userID, route := tenantParam(req, "user_id"), getParamValue(req, "route")
+	client, err := connectRedis()
+	if err != nil {
+		err = errors.Wrap(err, "cannot connect to Redis")
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	defer client.Close()
+	pubsub, err := client.Subscribe(activityEventsChannel)
+	if err != nil {
+		err = errors.Wrap(err, "cannot subscribe to activity events")
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	// closing the subscription unblocks ReceiveMessage once the client goes away
+	go func() {
+		<-req.Context().Done()
+		pubsub.Close()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	flusher.Flush()
+	for {
+		msg, err := pubsub.ReceiveMessage()
+		if err != nil {
+			return
+		}
+		var event ActivityEvent
+		if err = json.Unmarshal([]byte(msg.Payload), &event); err != nil {
+			continue
+		}
+		if !tenantOwns(tenant, event.UserID) || (userID != "" && event.UserID != userID) || (route != "" && strings.Trim(event.Route, "/") != strings.Trim(route, "/")) {
+			continue
+		}
+		fmt.Fprintf(w, "event: activity\ndata: %s\n\n", msg.Payload)
+		flusher.Flush()
+	}
+}
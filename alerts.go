@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	errors "github.com/fiverr/go_errors"
+	"gopkg.in/olivere/elastic.v5"
+	"net/http"
+)
+
+const (
+	alertsMapping = `
+{
+	"settings":{
+		"number_of_shards": 1,
+		"number_of_replicas": 0
+	},
+	"mappings":{
+		"alert":{
+			"properties": {
+				"query": { "type": "percolator" },
+				"user_id": { "type": "keyword" },
+				"tenant": { "type": "keyword" },
+				"webhook_url": { "type": "keyword" },
+				"title":    { "type": "text" },
+				"author_name":     { "type": "text" },
+				"price":      { "type": "scaled_float", "scaling_factor": 100 },
+				"currency": {"type": "keyword"},
+				"base_price": {"type": "scaled_float", "scaling_factor": 100},
+				"ebook_available": {"type": "boolean"},
+				"formats": {"type": "keyword"},
+				"publish_date": {"type": "date"},
+				"publisher": {"type": "keyword"},
+				"author_id": {"type": "keyword"},
+				"page_count": {"type": "integer"},
+				"language": {"type": "keyword"},
+				"rating_avg": {"type": "float"}
+			}
+		}
+	}
+}`
+	ALERTS_INDEX = "alerts"
+	ALERTS_TYPE  = "alert"
+)
+
+// Alert is a saved search stored as a percolator document.
+type Alert struct {
+	Query      interface{} `json:"query"`
+	UserID     string      `json:"user_id"`
+	WebhookURL string      `json:"webhook_url"`
+}
+
+func ensureAlertsIndex(client *elastic.Client, ctx context.Context) error {
+	exists, err := client.IndexExists(ALERTS_INDEX).Do(ctx)
+	if err != nil {
+		return errors.Wrap(err, "cannot check alerts index")
+	}
+	if !exists {
+		if _, err = client.CreateIndex(ALERTS_INDEX).BodyString(alertsMapping).Do(ctx); err != nil {
+			return errors.Wrap(err, "cannot create alerts index")
+		}
+	}
+	return nil
+}
+
+func addAlert(client *elastic.Client, ctx context.Context, userID string, webhookURL string, query elastic.Query) (string, error) {
+	if err := ensureAlertsIndex(client, ctx); err != nil {
+		return "", err
+	}
+	src, err := query.Source()
+	if err != nil {
+		return "", errors.Wrap(err, "cannot serialize alert query")
+	}
+	put, err := client.Index().Index(ALERTS_INDEX).Type(typeName(ALERTS_TYPE)).
+		BodyJson(Alert{Query: src, UserID: userID, WebhookURL: webhookURL}).Do(ctx)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot add the alert")
+	}
+	return fmt.Sprintf("Created alert %s for user %s\n", put.Id, userID), nil
+}
+
+func deleteAlert(client *elastic.Client, ctx context.Context, userID string, id string) (string, error) {
+	get, err := client.Get().Index(ALERTS_INDEX).Type(typeName(ALERTS_TYPE)).Id(id).Do(ctx)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot get the alert")
+	}
+	var alert Alert
+	if err = json.Unmarshal(*get.Source, &alert); err != nil {
+		return "", errors.Wrap(err, "cannot decode the alert")
+	}
+	if alert.UserID != userID {
+		return "", errors.New("alert " + id + " does not belong to user " + userID)
+	}
+	if _, err = client.Delete().Index(ALERTS_INDEX).Type(typeName(ALERTS_TYPE)).Id(id).Do(ctx); err != nil {
+		return "", errors.Wrap(err, "cannot delete the alert")
+	}
+	return fmt.Sprintf("Deleted alert %s\n", id), nil
+}
+
+func listAlerts(client *elastic.Client, ctx context.Context, userID string) (string, error) {
+	searchResult, err := client.Search().Index(ALERTS_INDEX).Type(typeName(ALERTS_TYPE)).
+		Query(elastic.NewTermQuery("user_id", userID)).Size(100).Do(ctx)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot list alerts")
+	}
+	alerts := make(map[string]json.RawMessage)
+	for _, hit := range searchResult.Hits.Hits {
+		alerts[hit.Id] = *hit.Source
+	}
+	buf, err := json.Marshal(alerts)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot create json result of alerts")
+	}
+	return string(buf), nil
+}
+
+// percolateBook finds the saved searches matching a newly indexed book and notifies their owners.
+func percolateBook(client *elastic.Client, ctx context.Context, id string, book Book) error {
+	query := elastic.NewPercolatorQuery().Field("query").DocumentType(typeName(ALERTS_TYPE)).Document(book)
+	searchResult, err := client.Search().Index(ALERTS_INDEX).Type(typeName(ALERTS_TYPE)).Query(query).Size(1000).Do(ctx)
+	if err != nil {
+		if elastic.IsNotFound(err) {
+			// no alerts were ever created
+			return nil
+		}
+		return errors.Wrap(err, "cannot percolate the book")
+	}
+	notifications := make([]Notification, 0, len(searchResult.Hits.Hits))
+	for _, hit := range searchResult.Hits.Hits {
+		var alert Alert
+		if err = json.Unmarshal(*hit.Source, &alert); err != nil {
+			continue
+		}
+		notifications = append(notifications, Notification{
+			Type:       "saved_search_match",
+			UserID:     alert.UserID,
+			WebhookURL: alert.WebhookURL,
+			Payload:    map[string]interface{}{"alert_id": hit.Id, "book_id": id, "book": book},
+		})
+	}
+	notifyAsync(notifications)
+	return nil
+}
+
+// alerts manages a user's saved-search alerts, with the admin token or the user's own API key
+// or session.
+func alerts(w http.ResponseWriter, req *http.Request) {
+	if !requireElasticsearch(w, req) {
+		return
+	}
+	var err error
+	var result string
+	userId := tenantParam(req, "user_id")
+	if userId == "" {
+		fmt.Fprintf(w, "%s", errors.New("user_id is required"))
+		return
+	}
+	if !authorizeUser(w, req, userId) {
+		return
+	}
+	client, ctx, err := connectElasticSearch()
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	switch req.Method {
+	case "GET":
+		result, err = listAlerts(client, ctx, userId)
+	case "PUT":
+		webhookURL := getParamValue(req, "webhook_url")
+		if webhookURL == "" {
+			err = errors.New("webhook_url is required")
+			break
+		}
+		if err = checkWebhookURL(webhookURL); err != nil {
+			break
+		}
+		var params SearchParams
+		params, err = parseSearchParams(req)
+		if err != nil {
+			break
+		}
+		result, err = addAlert(client, ctx, userId, webhookURL, buildSearchQuery(params))
+	case "DELETE":
+		result, err = deleteAlert(client, ctx, userId, getParamValue(req, "id"))
+	default:
+		msg := "Unsupported request for /alerts " + req.Method
+		err = errors.New(msg)
+	}
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+	} else {
+		fmt.Fprintf(w, "%s", result)
+	}
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	errors "github.com/fiverr/go_errors"
+	"gopkg.in/redis.v5"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	apiKeysKey    = "apikeys"
+	scopeRead     = "read"
+	scopeWrite    = "write"
+	scopeKeys     = "keys"
+	apiKeyHeader  = "X-API-Key"
+	adminTokenHdr = "X-Admin-Token"
+)
+
+var allScopes = []string{scopeRead, scopeWrite, scopeKeys}
+
+// APIKey is the stored description of an API key. The secret itself is only kept hashed.
+type APIKey struct {
+	ID         string    `json:"id"`
+	UserID     string    `json:"user_id"`
+	Scopes     []string  `json:"scopes"`
+	AllowedIPs []string  `json:"allowed_ips,omitempty"`
+	Tenant     string    `json:"tenant,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	SecretHash string    `json:"-"`
+}
+
+// APIKeyUsage is returned by the portal alongside each key.
+type APIKeyUsage struct {
+	APIKey
+	Requests int64  `json:"requests"`
+	LastUsed string `json:"last_used,omitempty"`
+}
+
+// userAPIKeysKey lists the keys of a user, scoped to the tenant of the keys.
+func userAPIKeysKey(userID string) string {
+	return "apikeys:user:" + userID
+}
+
+func apiKeyUsageKey(id string) string {
+	return "apikeys:usage:" + id
+}
+
+func randomToken(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", errors.Wrap(err, "cannot generate random token")
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func hasScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// storeAPIKey saves the key under a freshly generated secret, which is returned to the caller.
+func storeAPIKey(client *redis.Client, key APIKey) (string, error) {
+	secret, err := randomToken(24)
+	if err != nil {
+		return "", err
+	}
+	key.SecretHash = hashSecret(secret)
+	if err = saveAPIKey(client, key); err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// saveAPIKey writes the key description under its existing secret hash.
+func saveAPIKey(client *redis.Client, key APIKey) error {
+	buf, err := json.Marshal(key)
+	if err != nil {
+		return errors.Wrap(err, "cannot create json api key")
+	}
+	if err = client.HSet(apiKeysKey, key.SecretHash, string(buf)).Err(); err != nil {
+		return errors.Wrap(err, "cannot set key in Redis")
+	}
+	if err = client.HSet(userAPIKeysKey(tenantID(key.Tenant, key.UserID)), key.ID, key.SecretHash).Err(); err != nil {
+		return errors.Wrap(err, "cannot set key in Redis")
+	}
+	return nil
+}
+
+func lookupAPIKey(client *redis.Client, secretHash string) (*APIKey, error) {
+	value, err := client.HGet(apiKeysKey, secretHash).Result()
+	if err == redis.Nil {
+		return nil, errors.New("invalid API key")
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot get key from Redis")
+	}
+	var key APIKey
+	if err = json.Unmarshal([]byte(value), &key); err != nil {
+		return nil, errors.Wrap(err, "cannot decode api key")
+	}
+	key.SecretHash = secretHash
+	return &key, nil
+}
+
+func userAPIKey(client *redis.Client, userID string, id string) (*APIKey, error) {
+	secretHash, err := client.HGet(userAPIKeysKey(userID), id).Result()
+	if err == redis.Nil {
+		return nil, errors.New("no API key " + id + " for user " + userID)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot get key from Redis")
+	}
+	return lookupAPIKey(client, secretHash)
+}
+
+func removeAPIKey(client *redis.Client, key *APIKey) error {
+	if err := client.HDel(apiKeysKey, key.SecretHash).Err(); err != nil {
+		return errors.Wrap(err, "cannot delete key in Redis")
+	}
+	if err := client.HDel(userAPIKeysKey(tenantID(key.Tenant, key.UserID)), key.ID).Err(); err != nil {
+		return errors.Wrap(err, "cannot delete key in Redis")
+	}
+	return nil
+}
+
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// ipAllowed checks the request address against a key's IP or CIDR restrictions.
+func ipAllowed(allowed []string, ip string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	parsed := net.ParseIP(ip)
+	for _, a := range allowed {
+		if a == ip {
+			return true
+		}
+		if _, network, err := net.ParseCIDR(a); err == nil && parsed != nil && network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticateAPIKey resolves the request's API key, enforcing its IP restrictions and recording usage.
+// It returns nil without error when the request carries no API key.
+func authenticateAPIKey(client *redis.Client, req *http.Request) (*APIKey, error) {
+	secret := req.Header.Get(apiKeyHeader)
+	if secret == "" {
+		return nil, nil
+	}
+	key, err := lookupAPIKey(client, hashSecret(secret))
+	if err != nil {
+		return nil, err
+	}
+	if !ipAllowed(key.AllowedIPs, clientIP(req)) {
+		return nil, errors.New("API key is not allowed from " + clientIP(req))
+	}
+	client.HIncrBy(apiKeyUsageKey(key.ID), "requests", 1)
+	client.HSet(apiKeyUsageKey(key.ID), "last_used", time.Now().UTC().Format(time.RFC3339))
+	return key, nil
+}
+
+// isAdmin reports whether the request carries the configured admin token.
+func isAdmin(req *http.Request) bool {
+	token := req.Header.Get(adminTokenHdr)
+	return config.AdminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(config.AdminToken)) == 1
+}
+
+// authorizeUser reports whether the request may act on the user's own data: with the admin
+// token, one of the user's API keys or a session of the user. The user id is scoped to the
+// tenant like the keys and sessions are compared. Otherwise it writes a 401 or 403.
+func authorizeUser(w http.ResponseWriter, req *http.Request, userID string) bool {
+	if status, err := userAccess(req, userID); err != nil {
+		http.Error(w, err.Error(), status)
+		return false
+	}
+	return true
+}
+
+// userAccess checks the request like authorizeUser without writing a response, returning
+// the status to answer with and why the request may not act on the user.
+func userAccess(req *http.Request, userID string) (int, error) {
+	if isAdmin(req) {
+		return http.StatusOK, nil
+	}
+	if req.Header.Get(apiKeyHeader) != "" {
+		key, err := authenticateAPIKey(sharedRedis(), req)
+		if err != nil || key == nil {
+			return http.StatusUnauthorized, errors.New("a valid API key is required")
+		}
+		if tenantID(key.Tenant, key.UserID) != userID {
+			return http.StatusForbidden, errors.New("API key cannot access user " + userID)
+		}
+		return http.StatusOK, nil
+	}
+	sessionUser := sessionUserID(req)
+	if sessionUser == "" {
+		return http.StatusUnauthorized, errors.New("an API key, a session or the admin token is required")
+	}
+	if sessionUser != userID {
+		return http.StatusForbidden, errors.New("session cannot access user " + userID)
+	}
+	return http.StatusOK, nil
+}
+
+// withAPIKey validates an API key when one is sent, requiring the read scope for GET requests
+// and the write scope otherwise. Requests without a key are passed through unchanged. The tenant
+// of the key is applied by withTenant.
+func withAPIKey(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get(apiKeyHeader) == "" {
+			handler(w, req)
+			return
+		}
+		client, err := connectRedis()
+		if err != nil {
+			err = errors.Wrap(err, "cannot connect to Redis")
+			fmt.Fprintf(w, "%s", err)
+			return
+		}
+		key, err := authenticateAPIKey(client, req)
+		client.Close()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		scope := scopeWrite
+		if req.Method == "GET" {
+			scope = scopeRead
+		}
+		if !hasScope(key.Scopes, scope) {
+			http.Error(w, "API key is missing the "+scope+" scope", http.StatusForbidden)
+			return
+		}
+		handler(w, req)
+	}
+}
+
+func splitList(value string) []string {
+	list := make([]string, 0)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func listAPIKeys(client *redis.Client, userID string) (string, error) {
+	ids, err := client.HGetAll(userAPIKeysKey(userID)).Result()
+	if err != nil {
+		return "", errors.Wrap(err, "cannot get key from Redis")
+	}
+	keys := make([]APIKeyUsage, 0, len(ids))
+	for _, secretHash := range ids {
+		key, err := lookupAPIKey(client, secretHash)
+		if err != nil {
+			continue
+		}
+		usage, _ := client.HGetAll(apiKeyUsageKey(key.ID)).Result()
+		var requests int64
+		fmt.Sscan(usage["requests"], &requests)
+		keys = append(keys, APIKeyUsage{APIKey: *key, Requests: requests, LastUsed: usage["last_used"]})
+	}
+	buf, err := json.Marshal(keys)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot create json result of api keys")
+	}
+	return string(buf), nil
+}
+
+// apiKeys is the self-service portal under /users/{id}/api-keys. Callers authenticate with one
+// of the user's own keys holding the keys scope, or with the admin token to bootstrap a first key.
+func apiKeys(w http.ResponseWriter, req *http.Request, userID string, rest []string) {
+	var err error
+	var result string
+	client, err := connectRedis()
+	if err != nil {
+		err = errors.Wrap(err, "cannot connect to Redis")
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	defer client.Close()
+
+	callerScopes := allScopes
+	tenant := strings.ToLower(strings.TrimSpace(getParamValue(req, "tenant")))
+	if tenant == "" {
+		tenant = requestTenant(req)
+	}
+	if !isAdmin(req) {
+		caller, err := authenticateAPIKey(client, req)
+		if err != nil || caller == nil {
+			http.Error(w, "a valid API key is required", http.StatusUnauthorized)
+			return
+		}
+		if caller.UserID != userID || !hasScope(caller.Scopes, scopeKeys) {
+			http.Error(w, "API key cannot manage keys of user "+userID, http.StatusForbidden)
+			return
+		}
+		callerScopes = caller.Scopes
+		// only the admin picks the tenant of a key, users' keys stay in their own
+		tenant = caller.Tenant
+	}
+
+	// the keys of a user are kept per tenant, like the rest of the user's data
+	keysUserID := tenantID(tenant, userID)
+	switch {
+	case len(rest) == 0 && req.Method == "GET":
+		result, err = listAPIKeys(client, keysUserID)
+	case len(rest) == 0 && req.Method == "PUT":
+		scopes := splitList(getParamValue(req, "scopes"))
+		if len(scopes) == 0 {
+			scopes = []string{scopeRead}
+		}
+		for _, scope := range scopes {
+			// new keys can never be granted more than the caller holds
+			if !hasScope(callerScopes, scope) {
+				err = errors.New("cannot grant scope " + scope)
+				break
+			}
+		}
+		if tenant != "" && !knownTenant(tenant) {
+			err = errors.New("unknown tenant " + tenant)
+		}
+		if err != nil {
+			break
+		}
+		var id string
+		id, err = randomToken(8)
+		if err != nil {
+			break
+		}
+		key := APIKey{ID: id, UserID: userID, Scopes: scopes, AllowedIPs: splitList(getParamValue(req, "allowed_ips")), Tenant: tenant, CreatedAt: time.Now().UTC()}
+		var secret string
+		secret, err = storeAPIKey(client, key)
+		if err == nil {
+			result = fmt.Sprintf("Created API key %s: %s\n", id, secret)
+		}
+	case len(rest) == 1 && req.Method == "POST":
+		var key *APIKey
+		key, err = userAPIKey(client, keysUserID, rest[0])
+		if err != nil {
+			break
+		}
+		key.AllowedIPs = splitList(getParamValue(req, "allowed_ips"))
+		err = saveAPIKey(client, *key)
+		if err == nil {
+			result = fmt.Sprintf("Updated IP restrictions of API key %s\n", key.ID)
+		}
+	case len(rest) == 2 && rest[1] == "rotate" && req.Method == "POST":
+		var key *APIKey
+		key, err = userAPIKey(client, keysUserID, rest[0])
+		if err != nil {
+			break
+		}
+		if err = removeAPIKey(client, key); err != nil {
+			break
+		}
+		var secret string
+		secret, err = storeAPIKey(client, *key)
+		if err == nil {
+			result = fmt.Sprintf("Rotated API key %s: %s\n", key.ID, secret)
+		}
+	case len(rest) == 1 && req.Method == "DELETE":
+		var key *APIKey
+		key, err = userAPIKey(client, keysUserID, rest[0])
+		if err == nil {
+			err = removeAPIKey(client, key)
+		}
+		if err == nil {
+			client.Del(apiKeyUsageKey(key.ID))
+			result = fmt.Sprintf("Deleted API key %s\n", key.ID)
+		}
+	default:
+		msg := "Unsupported request for " + req.URL.Path + " " + req.Method
+		err = errors.New(msg)
+	}
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+	} else {
+		fmt.Fprintf(w, "%s", result)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	errors "github.com/fiverr/go_errors"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// assetKinds are the artifact directories served under /assets/.
+var assetKinds = map[string]bool{"covers": true, "exports": true}
+
+// assetETag derives a strong validator from the blob size and modification time.
+func assetETag(modTime time.Time, size int64) string {
+	return `"` + strconv.FormatInt(modTime.UnixNano(), 36) + "-" + strconv.FormatInt(size, 36) + `"`
+}
+
+// maxCoverBytes is the largest cover image accepted on upload.
+const maxCoverBytes = 10 << 20
+
+// uploadCover stores the request body as a cover and queues the generation of its thumbnails.
+func uploadCover(w http.ResponseWriter, req *http.Request, name string) {
+	if !isAdmin(req) {
+		http.Error(w, "admin token required", http.StatusUnauthorized)
+		return
+	}
+	contentType := req.Header.Get("Content-Type")
+	if !strings.HasPrefix(contentType, "image/") {
+		fmt.Fprintf(w, "%s", errors.New("cover Content-Type must be an image type"))
+		return
+	}
+	err := blobs.Put(req.Context(), name, http.MaxBytesReader(w, req.Body, maxCoverBytes), contentType)
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	queueThumbnails(name)
+	fmt.Fprintf(w, "Uploaded cover %s\n", name)
+}
+
+// assets serves covers and export artifacts. http.ServeContent takes care of range requests and
+// of If-Modified-Since / If-None-Match conditional GETs. In origin mode responses carry long-lived
+// cache headers so a CDN can front them directly. Covers are uploaded with PUT and served resized
+// with ?size=small|medium|large, falling back to the original until the thumbnail exists.
+func assets(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" && req.Method != "HEAD" && req.Method != "PUT" {
+		msg := "Unsupported request for /assets " + req.Method
+		fmt.Fprintf(w, "%s", errors.New(msg))
+		return
+	}
+	// path is /assets/{kind}/{name}
+	name := path.Clean("/" + strings.TrimPrefix(req.URL.Path, "/assets/"))
+	parts := strings.SplitN(strings.TrimPrefix(name, "/"), "/", 2)
+	if len(parts) != 2 || !assetKinds[parts[0]] {
+		http.NotFound(w, req)
+		return
+	}
+	name = strings.TrimPrefix(name, "/")
+	if req.Method == "PUT" {
+		if parts[0] != "covers" {
+			fmt.Fprintf(w, "%s", errors.New("Unsupported request for /assets/"+parts[0]+" PUT"))
+			return
+		}
+		uploadCover(w, req, name)
+		return
+	}
+	blobName := name
+	if size := getParamValue(req, "size"); size != "" && parts[0] == "covers" {
+		if _, ok := thumbnailWidths[size]; !ok {
+			http.Error(w, "size must be small, medium or large", http.StatusBadRequest)
+			return
+		}
+		blobName = thumbnailName(name, size)
+	}
+	blob, err := blobs.Get(req.Context(), blobName)
+	if err == errBlobNotFound && blobName != name {
+		// the thumbnail is not generated yet
+		blob, err = blobs.Get(req.Context(), name)
+	}
+	if err == errBlobNotFound {
+		http.NotFound(w, req)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer blob.Close()
+
+	w.Header().Set("ETag", assetETag(blob.ModTime, blob.Size))
+	if blob.ContentType != "" {
+		w.Header().Set("Content-Type", blob.ContentType)
+	}
+	if config.Assets.OriginMode {
+		maxAge := parseDuration(config.Assets.MaxAge, 365*24*time.Hour)
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d, immutable", int64(maxAge.Seconds())))
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	http.ServeContent(w, req, path.Base(name), blob.ModTime, blob.Content)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	errors "github.com/fiverr/go_errors"
+	"net/http"
+	"time"
+)
+
+// auditLogKey is a list of audit entries, newest first.
+const auditLogKey = "audit_log"
+
+// AuditEntry records an administrative action taken on user data.
+type AuditEntry struct {
+	Action  string                 `json:"action"`
+	Target  string                 `json:"target"`
+	Actor   string                 `json:"actor"`
+	Details map[string]interface{} `json:"details,omitempty"`
+	Time    time.Time              `json:"time"`
+}
+
+// recordAudit appends an entry to the audit log.
+func recordAudit(entry AuditEntry) error {
+	client, err := connectRedis()
+	if err != nil {
+		return errors.Wrap(err, "cannot connect to Redis")
+	}
+	defer client.Close()
+	entry.Time = time.Now().UTC()
+	buf, err := json.Marshal(entry)
+	if err != nil {
+		return errors.Wrap(err, "cannot create json audit entry")
+	}
+	if err = client.LPush(auditLogKey, string(buf)).Err(); err != nil {
+		return errors.Wrap(err, "cannot set key in Redis")
+	}
+	return nil
+}
+
+// auditLog handles GET /admin/audit?offset=&limit=, newest entries first.
+func auditLog(w http.ResponseWriter, req *http.Request) {
+	if !isAdmin(req) {
+		http.Error(w, "admin token required", http.StatusUnauthorized)
+		return
+	}
+	if req.Method != "GET" {
+		msg := "Unsupported request for /admin/audit " + req.Method
+		fmt.Fprintf(w, "%s", errors.New(msg))
+		return
+	}
+	offset, limit, err := parsePage(req, 50)
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	client, err := connectRedis()
+	if err != nil {
+		fmt.Fprintf(w, "%s", errors.Wrap(err, "cannot connect to Redis"))
+		return
+	}
+	defer client.Close()
+	members, err := client.LRange(auditLogKey, offset, offset+limit-1).Result()
+	if err != nil {
+		fmt.Fprintf(w, "%s", errors.Wrap(err, "cannot get key from Redis"))
+		return
+	}
+	total, err := client.LLen(auditLogKey).Result()
+	if err != nil {
+		fmt.Fprintf(w, "%s", errors.Wrap(err, "cannot get key from Redis"))
+		return
+	}
+	entries := make([]json.RawMessage, 0, len(members))
+	for _, member := range members {
+		entries = append(entries, json.RawMessage(member))
+	}
+	buf, err := json.Marshal(map[string]interface{}{"total": total, "offset": offset, "limit": limit, "entries": entries})
+	if err != nil {
+		fmt.Fprintf(w, "%s", errors.Wrap(err, "cannot create json result of audit log"))
+		return
+	}
+	fmt.Fprintf(w, "%s", buf)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	errors "github.com/fiverr/go_errors"
+	"gopkg.in/olivere/elastic.v5"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	authorsMapping = `
+{
+	"settings":{
+		"number_of_shards": 1,
+		"number_of_replicas": 0
+	},
+	"mappings":{
+		"author":{
+			"properties": {
+				"name": { "type": "text", "fields": { "raw": { "type": "keyword" } } },
+				"bio": { "type": "text" },
+				"birth_year": { "type": "integer" },
+				"nationality": { "type": "keyword" }
+			}
+		}
+	}
+}`
+	AUTHORS_INDEX = "authors"
+	AUTHOR_TYPE   = "author"
+)
+
+// Author is the profile of a book author, referenced from books by author_id.
+type Author struct {
+	Name        string `json:"name"`
+	Bio         string `json:"bio"`
+	BirthYear   int    `json:"birth_year,omitempty"`
+	Nationality string `json:"nationality,omitempty"`
+}
+
+func ensureAuthorsIndex(client *elastic.Client, ctx context.Context) error {
+	exists, err := client.IndexExists(AUTHORS_INDEX).Do(ctx)
+	if err != nil {
+		return errors.Wrap(err, "cannot check authors index")
+	}
+	if !exists {
+		if _, err = client.CreateIndex(AUTHORS_INDEX).BodyString(authorsMapping).Do(ctx); err != nil {
+			return errors.Wrap(err, "cannot create authors index")
+		}
+	}
+	return nil
+}
+
+// getAuthor returns the author with the given id, or nil when there is none.
+func getAuthor(client *elastic.Client, ctx context.Context, id string) (*Author, error) {
+	get, err := client.Get().Index(AUTHORS_INDEX).Type(typeName(AUTHOR_TYPE)).Id(id).Do(ctx)
+	if err != nil {
+		if elastic.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "cannot get the author")
+	}
+	if !get.Found {
+		return nil, nil
+	}
+	var author Author
+	if err = json.Unmarshal(*get.Source, &author); err != nil {
+		return nil, errors.Wrap(err, "cannot decode the author")
+	}
+	return &author, nil
+}
+
+func addAuthor(client *elastic.Client, ctx context.Context, id string, author Author) (string, error) {
+	if err := ensureAuthorsIndex(client, ctx); err != nil {
+		return "", err
+	}
+	put, err := client.Index().Index(AUTHORS_INDEX).Type(typeName(AUTHOR_TYPE)).Id(id).BodyJson(author).
+		Refresh("wait_for").Do(ctx)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot index the author")
+	}
+	return fmt.Sprintf("Indexed author %s to index %s\n", put.Id, put.Index), nil
+}
+
+func deleteAuthor(client *elastic.Client, ctx context.Context, id string) (string, error) {
+	res, err := client.Delete().Index(AUTHORS_INDEX).Type(typeName(AUTHOR_TYPE)).Id(id).Do(ctx)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot delete the author")
+	}
+	return fmt.Sprintf("Deleted author %s\n", res.Id), nil
+}
+
+// authorBooks returns up to 100 books referencing the author by author_id, oldest first. Only the
+// books of the catalog the author id is scoped to are returned.
+func authorBooks(client *elastic.Client, ctx context.Context, id string) ([]BookHit, error) {
+	query := elastic.NewBoolQuery().Must(elastic.NewTermQuery("author_id", id)).Filter(tenantQuery(idTenant(id)))
+	searchResult, err := client.Search().Index(booksIndex()).Query(query).
+		Sort("publish_date", true).Size(100).Do(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot search books of author "+id)
+	}
+	return bookHits(searchResult), nil
+}
+
+// authorProfile returns the author together with the books referencing it by author_id.
+func authorProfile(client *elastic.Client, ctx context.Context, id string) (string, error) {
+	author, err := getAuthor(client, ctx, id)
+	if err != nil || author == nil {
+		return "", err
+	}
+	hits, err := authorBooks(client, ctx, id)
+	if err != nil {
+		return "", err
+	}
+	buf, err := json.Marshal(map[string]interface{}{"id": id, "author": author, "books": hits})
+	if err != nil {
+		return "", errors.Wrap(err, "cannot create json result of author")
+	}
+	return string(buf), nil
+}
+
+// authors handles GET, PUT and DELETE on /authors/{id}.
+func authors(w http.ResponseWriter, req *http.Request) {
+	if !requireElasticsearch(w, req) {
+		return
+	}
+	var err error
+	var result string
+	id := strings.Trim(strings.TrimPrefix(req.URL.Path, "/authors/"), "/")
+	if id == "" || strings.Contains(id, "/") {
+		fmt.Fprintf(w, "%s", errors.New("Unsupported route "+req.URL.Path))
+		return
+	}
+	id = tenantID(requestTenant(req), id)
+	client, ctx, err := connectElasticSearch()
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	switch req.Method {
+	case "GET":
+		result, err = authorProfile(client, ctx, id)
+		if err == nil && result == "" {
+			http.NotFound(w, req)
+			return
+		}
+	case "PUT":
+		author := Author{Name: normalizeText(getParamValue(req, "name")), Bio: getParamValue(req, "bio"),
+			Nationality: strings.ToUpper(getParamValue(req, "nationality"))}
+		if author.Name == "" {
+			err = errors.New("name is required")
+			break
+		}
+		if value := getParamValue(req, "birth_year"); value != "" {
+			author.BirthYear, err = strconv.Atoi(value)
+			if err != nil {
+				err = errors.Wrap(err, "conversion from string to int for field birth_year failed")
+				break
+			}
+		}
+		result, err = addAuthor(client, ctx, id, author)
+	case "DELETE":
+		result, err = deleteAuthor(client, ctx, id)
+	default:
+		msg := "Unsupported request for /authors " + req.Method
+		err = errors.New(msg)
+	}
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+	} else {
+		fmt.Fprintf(w, "%s", result)
+	}
+}
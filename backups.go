@@ -0,0 +1,207 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	errors "github.com/fiverr/go_errors"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+)
+
+// backupsKey is a hash of backup name to its Backup record.
+const backupsKey = "backups"
+
+// Backup is a copy of the catalog taken by the backup job: an "ndjson" export in the backup
+// storage or a "snapshot" in the Elasticsearch snapshot repository.
+type Backup struct {
+	Name      string    `json:"name"`
+	Mode      string    `json:"mode"`
+	Books     int64     `json:"books,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// backupBlobs is where ndjson backups are stored, set up in main: the backup storage when
+// configured, otherwise the shared blob store.
+var backupBlobs BlobStore
+
+// exportBooks writes every book of the index to w as gzipped NDJSON, one {"_id", "_source"}
+// object per line, and returns the number of books written.
+func exportBooks(w io.Writer) (int64, error) {
+	client, ctx, err := connectElasticSearch()
+	if err != nil {
+		return 0, err
+	}
+	gz := gzip.NewWriter(w)
+	encoder := json.NewEncoder(gz)
+	var written int64
+	scroll := client.Scroll(booksIndex()).Size(500)
+	defer scroll.Clear(ctx)
+	for {
+		res, err := scroll.Do(ctx)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return written, errors.Wrap(err, "cannot scroll books")
+		}
+		for _, hit := range res.Hits.Hits {
+			if err = encoder.Encode(map[string]interface{}{"_id": hit.Id, "_source": hit.Source}); err != nil {
+				return written, errors.Wrap(err, "cannot write backup")
+			}
+			written++
+		}
+	}
+	if err = gz.Close(); err != nil {
+		return written, errors.Wrap(err, "cannot write backup")
+	}
+	return written, nil
+}
+
+// runBackup takes a backup in the configured mode, records it and applies the retention rules.
+func runBackup() error {
+	if config.Books.Backend != "" && config.Books.Backend != "elasticsearch" {
+		return errors.New("backups need the elasticsearch books backend")
+	}
+	backup := Backup{Mode: config.Backups.Mode, CreatedAt: time.Now().UTC()}
+	stamp := backup.CreatedAt.Format("20060102-150405")
+	switch backup.Mode {
+	case "snapshot":
+		backup.Name = booksIndex() + "-" + stamp
+		if _, err := createSnapshot(backup.Name, true); err != nil {
+			return err
+		}
+	case "ndjson":
+		backup.Name = "backups/" + booksIndex() + "-" + stamp + ".ndjson.gz"
+		ctx := context.Background()
+		// the export is streamed to the store instead of buffered whole
+		r, w := io.Pipe()
+		written := make(chan int64, 1)
+		go func() {
+			n, err := exportBooks(w)
+			w.CloseWithError(err)
+			written <- n
+		}()
+		if err := backupBlobs.Put(ctx, backup.Name, r, "application/x-ndjson"); err != nil {
+			r.CloseWithError(err)
+			<-written
+			backupBlobs.Delete(ctx, backup.Name)
+			return errors.Wrap(err, "cannot store backup "+backup.Name)
+		}
+		backup.Books = <-written
+	default:
+		return errors.New("unknown backup mode " + backup.Mode)
+	}
+	buf, err := json.Marshal(backup)
+	if err != nil {
+		return errors.Wrap(err, "cannot create json backup record")
+	}
+	client := sharedRedis()
+	if err = client.HSet(backupsKey, backup.Name, string(buf)).Err(); err != nil {
+		return errors.Wrap(err, "cannot set key in Redis")
+	}
+	return pruneBackups()
+}
+
+// listBackups returns the recorded backups, newest first.
+func listBackups() ([]Backup, error) {
+	values, err := sharedRedis().HGetAll(backupsKey).Result()
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot get key from Redis")
+	}
+	backups := make([]Backup, 0, len(values))
+	for _, value := range values {
+		var backup Backup
+		if err = json.Unmarshal([]byte(value), &backup); err != nil {
+			return nil, errors.Wrap(err, "cannot parse backup record")
+		}
+		backups = append(backups, backup)
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].CreatedAt.After(backups[j].CreatedAt) })
+	return backups, nil
+}
+
+// deleteBackup removes a backup from where it is stored and from the records.
+func deleteBackup(backup Backup) error {
+	if backup.Mode == "snapshot" {
+		client, ctx, err := connectElasticSearch()
+		if err != nil {
+			return err
+		}
+		_, err = client.PerformRequest(ctx, "DELETE", snapshotRepositoryPath()+"/"+url.PathEscape(backup.Name), nil, nil, http.StatusNotFound)
+		if err != nil {
+			return errors.Wrap(err, "cannot delete snapshot "+backup.Name)
+		}
+	} else if err := backupBlobs.Delete(context.Background(), backup.Name); err != nil && err != errBlobNotFound {
+		return err
+	}
+	if err := sharedRedis().HDel(backupsKey, backup.Name).Err(); err != nil {
+		return errors.Wrap(err, "cannot delete key in Redis")
+	}
+	return nil
+}
+
+// pruneBackups deletes the backups beyond the newest Keep and those older than MaxAge. The
+// newest backup is always kept.
+func pruneBackups() error {
+	backups, err := listBackups()
+	if err != nil {
+		return err
+	}
+	var maxAge time.Duration
+	if config.Backups.MaxAge != "" {
+		if maxAge, err = parseWindow(config.Backups.MaxAge); err != nil {
+			return err
+		}
+	}
+	for i, backup := range backups {
+		tooMany := config.Backups.Keep > 0 && i >= config.Backups.Keep
+		tooOld := maxAge > 0 && time.Since(backup.CreatedAt) > maxAge
+		if i == 0 || !(tooMany || tooOld) {
+			continue
+		}
+		if err = deleteBackup(backup); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// adminBackups handles /admin/backups: GET lists the backups, newest first, and POST takes one
+// now, outside of the backup job's schedule.
+func adminBackups(w http.ResponseWriter, req *http.Request) {
+	if !requireElasticsearch(w, req) {
+		return
+	}
+	if !isAdmin(req) {
+		http.Error(w, "admin token required", http.StatusUnauthorized)
+		return
+	}
+	switch req.Method {
+	case "GET":
+		backups, err := listBackups()
+		if err != nil {
+			fmt.Fprintf(w, "%s", err)
+			return
+		}
+		buf, err := json.Marshal(backups)
+		if err != nil {
+			fmt.Fprintf(w, "%s", errors.Wrap(err, "cannot create json result of backups"))
+			return
+		}
+		fmt.Fprintf(w, "%s", buf)
+	case "POST":
+		if err := runBackup(); err != nil {
+			fmt.Fprintf(w, "%s", err)
+			return
+		}
+		fmt.Fprintf(w, "Backup taken\n")
+	default:
+		msg := "Unsupported request for /admin/backups " + req.Method
+		fmt.Fprintf(w, "%s", errors.New(msg))
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	errors "github.com/fiverr/go_errors"
+	"gopkg.in/redis.v5"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	salesKeyPrefix = "sales:"
+	// daily sales buckets are kept long enough to cover the month period
+	salesRetention = 31 * 24 * time.Hour
+)
+
+// bestsellerPeriods maps the period filter to the number of daily buckets it covers.
+var bestsellerPeriods = map[string]int{"day": 1, "week": 7, "month": 30}
+
+// Bestseller is a book ranked by the number of copies sold over a period.
+type Bestseller struct {
+	ID    string `json:"id"`
+	Title string `json:"title"`
+	Sold  int64  `json:"sold"`
+}
+
+// salesKey is the daily bucket of the sales of a tenant's books, each tenant ranking its own.
+func salesKey(tenant string, t time.Time) string {
+	return salesKeyPrefix + tenantID(tenant, t.UTC().Format("20060102"))
+}
+
+// recordSale adds quantity copies of the book to today's sales ranking of its catalog.
+func recordSale(client *redis.Client, id string, quantity int64) error {
+	key := salesKey(idTenant(id), time.Now())
+	if err := client.ZIncrBy(key, float64(quantity), id).Err(); err != nil {
+		return errors.Wrap(err, "cannot increment sales counter in Redis")
+	}
+	if err := client.Expire(key, salesRetention+24*time.Hour).Err(); err != nil {
+		return errors.Wrap(err, "cannot set sales counter expiry in Redis")
+	}
+	return nil
+}
+
+// topSellers sums the tenant's daily sales buckets of the last days and returns the n best selling
+// books.
+func topSellers(client *redis.Client, tenant string, days int, n int64) ([]Bestseller, error) {
+	keys := make([]string, 0, days)
+	now := time.Now()
+	for i := 0; i < days; i++ {
+		keys = append(keys, salesKey(tenant, now.AddDate(0, 0, -i)))
+	}
+	dest := fmt.Sprintf("sales:union:%d", now.UnixNano())
+	if err := client.ZUnionStore(dest, redis.ZStore{}, keys...).Err(); err != nil {
+		return nil, errors.Wrap(err, "cannot sum sales counters in Redis")
+	}
+	defer client.Del(dest)
+	resultSet, err := client.ZRevRangeWithScores(dest, 0, n-1).Result()
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot get key from Redis")
+	}
+	sellers := make([]Bestseller, 0, len(resultSet))
+	ids := make([]string, 0, len(resultSet))
+	for _, zItem := range resultSet {
+		id := fmt.Sprintf("%v", zItem.Member)
+		sellers = append(sellers, Bestseller{ID: id, Sold: int64(zItem.Score)})
+		ids = append(ids, id)
+	}
+	titles, err := bookTitles(ids)
+	if err != nil {
+		return nil, err
+	}
+	for i := range sellers {
+		sellers[i].Title = titles[sellers[i].ID]
+	}
+	return sellers, nil
+}
+
+// bestsellers handles GET /books/bestsellers?period=day|week|month&n=10.
+func bestsellers(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		msg := "Unsupported request for /books/bestsellers " + req.Method
+		fmt.Fprintf(w, "%s", errors.New(msg))
+		return
+	}
+	period := getParamValue(req, "period")
+	if period == "" {
+		period = "week"
+	}
+	days, ok := bestsellerPeriods[period]
+	if !ok {
+		fmt.Fprintf(w, "%s", errors.New("period must be one of day, week or month"))
+		return
+	}
+	n := int64(10)
+	if value := getParamValue(req, "n"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed <= 0 {
+			fmt.Fprintf(w, "%s", errors.New("n must be a positive integer"))
+			return
+		}
+		n = parsed
+	}
+	client, err := connectRedis()
+	if err != nil {
+		err = errors.Wrap(err, "cannot connect to Redis")
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	defer client.Close()
+	sellers, err := topSellers(client, requestTenant(req), days, n)
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	buf, err := json.Marshal(sellers)
+	if err != nil {
+		fmt.Fprintf(w, "%s", errors.Wrap(err, "cannot create json result of bestsellers"))
+		return
+	}
+	fmt.Fprintf(w, "%s", buf)
+}
+
+// sales ingests an external sales feed: POST /sales?book_id=X&quantity=N, admin only.
+func sales(w http.ResponseWriter, req *http.Request) {
+	if !isAdmin(req) {
+		http.Error(w, "admin token required", http.StatusUnauthorized)
+		return
+	}
+	if req.Method != "POST" {
+		msg := "Unsupported request for /sales " + req.Method
+		fmt.Fprintf(w, "%s", errors.New(msg))
+		return
+	}
+	id := tenantParam(req, "book_id")
+	if id == "" {
+		fmt.Fprintf(w, "%s", errors.New("book_id is required"))
+		return
+	}
+	quantity := int64(1)
+	if value := getParamValue(req, "quantity"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed <= 0 {
+			fmt.Fprintf(w, "%s", errors.New("quantity must be a positive integer"))
+			return
+		}
+		quantity = parsed
+	}
+	client, err := connectRedis()
+	if err != nil {
+		err = errors.Wrap(err, "cannot connect to Redis")
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	defer client.Close()
+	if err = recordSale(client, id, quantity); err != nil {
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	fmt.Fprintf(w, "Recorded %d sales of book %s\n", quantity, id)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	errors "github.com/fiverr/go_errors"
+	"net/http"
+	"strings"
+)
+
+// books dispatches the /books/... routes to their handlers.
+func books(w http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, "/books/"), "/"), "/")
+	tenant := requestTenant(req)
+	switch parts[0] {
+	case "trending":
+		trending(w, req)
+	case "bestsellers":
+		bestsellers(w, req)
+	case "recent":
+		recent(w, req)
+	case "random":
+		random(w, req)
+	case "facets":
+		facets(w, req)
+	case "merge":
+		mergeDuplicates(w, req)
+	case "isbn":
+		if len(parts) != 2 {
+			http.NotFound(w, req)
+			return
+		}
+		isbnLookup(w, req, parts[1])
+	case "favorites":
+		if len(parts) != 2 {
+			http.NotFound(w, req)
+			return
+		}
+		favoriteCount(w, req, tenantID(tenant, parts[1]))
+	case "enrich":
+		if len(parts) != 2 {
+			http.NotFound(w, req)
+			return
+		}
+		enrich(w, req, parts[1])
+	default:
+		// per-book resources are /books/{id}/{resource}
+		if len(parts) == 2 && parts[1] == "reviews" {
+			reviews(w, req, tenantID(tenant, parts[0]))
+			return
+		}
+		if len(parts) == 2 && parts[1] == "holds" {
+			holds(w, req, tenantID(tenant, parts[0]))
+			return
+		}
+		if len(parts) == 2 && (parts[1] == "borrow" || parts[1] == "return") {
+			lending(w, req, tenantID(tenant, parts[0]), parts[1])
+			return
+		}
+		fmt.Fprintf(w, "%s", errors.New("Unsupported route "+req.URL.Path))
+	}
+}
@@ -0,0 +1,4 @@
+// Package bookservicepb holds the gRPC API of the book service, generated from bookservice.proto.
+package bookservicepb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative bookservice.proto
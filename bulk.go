@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	errors "github.com/fiverr/go_errors"
+	"gopkg.in/olivere/elastic.v5"
+	"time"
+)
+
+// bulkIndexer is the shared bulk processor book writes are queued on, nil unless bulk indexing
+// is enabled. Add blocks while every worker is busy flushing, which pushes back on writers.
+var bulkIndexer *elastic.BulkProcessor
+
+// startBulkIndexer starts the shared bulk processor when enabled by config.
+func startBulkIndexer() error {
+	if !config.Bulk.Enabled {
+		return nil
+	}
+	client, ctx, err := connectElasticSearch()
+	if err != nil {
+		return err
+	}
+	worker := registerWorker("bulk_indexing", nil)
+	bulkIndexer, err = client.BulkProcessor().Name("books").
+		Workers(config.Bulk.Workers).
+		BulkActions(config.Bulk.Actions).
+		BulkSize(config.Bulk.SizeBytes).
+		FlushInterval(parseDuration(config.Bulk.FlushInterval, time.Second)).
+		After(bulkIndexed(worker)).
+		Do(ctx)
+	if err != nil {
+		return errors.Wrap(err, "cannot start the bulk processor")
+	}
+	return nil
+}
+
+// bulkIndexed records the outcome of every document of a flushed batch on the worker.
+func bulkIndexed(worker *Worker) elastic.BulkAfterFunc {
+	return func(executionID int64, requests []elastic.BulkableRequest, response *elastic.BulkResponse, err error) {
+		if err != nil {
+			err = errors.Wrap(err, fmt.Sprintf("bulk request %d failed", executionID))
+			fmt.Println(err)
+			for range requests {
+				worker.Done(err)
+			}
+			return
+		}
+		for _, item := range response.Failed() {
+			reason := "unknown error"
+			if item.Error != nil {
+				reason = item.Error.Reason
+			}
+			itemErr := errors.New("cannot index book " + item.Id + ": " + reason)
+			fmt.Println(itemErr)
+			worker.Done(itemErr)
+		}
+		for range response.Succeeded() {
+			worker.Done(nil)
+		}
+	}
+}
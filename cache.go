@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	errors "github.com/fiverr/go_errors"
+	"net/http"
+	"time"
+)
+
+// CachePolicy declares how responses of a route are cached and which cache tags its writes invalidate.
+type CachePolicy struct {
+	Cacheable   bool     `json:"cacheable"`
+	TTL         string   `json:"ttl"`
+	Tags        []string `json:"tags"`
+	Invalidates []string `json:"invalidates"`
+}
+
+func cacheTagKey(tag string) string {
+	return "cache_tag:" + tag
+}
+
+func cacheQueryKey(key string) string {
+	return "cache_query:" + key
+}
+
+// cachedHeaders are the response headers stored with a cached body and replayed on a hit.
+var cachedHeaders = []string{"Content-Type", "X-Next-Cursor", "X-Total-Count", "X-Total-Relation", "Warning"}
+
+// CachedResponse is a response stored in the cache.
+type CachedResponse struct {
+	Header map[string]string `json:"header,omitempty"`
+	Body   string            `json:"body"`
+	// Tenant is the tenant the response was served for, so it can be recomputed for the same one
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// decodeCachedResponse decodes a cache entry. Entries stored as a bare body are not trusted.
+func decodeCachedResponse(entry string) (*CachedResponse, error) {
+	var cached CachedResponse
+	if err := json.Unmarshal([]byte(entry), &cached); err != nil {
+		return nil, errors.Wrap(err, "cannot decode cached response")
+	}
+	return &cached, nil
+}
+
+// responseRecorder captures the status and body written by a handler while passing them through.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// withCache applies the cache policy configured for route. Cacheable GET responses are stored in
+// Redis under the route and query, and tagged so the outbox relay can invalidate them once a book
+// write is confirmed, whichever API it came from. Requests carrying a
+// user_id bypass the cache so their search history and recently viewed books are still recorded.
+// The response_cache feature flag turns cache reads and fills off.
+func withCache(route string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		policy, ok := config.CachePolicies[route]
+		if !ok {
+			handler(w, req)
+			return
+		}
+		if !policy.Cacheable || req.Method != "GET" || getParamValue(req, "user_id") != "" || !flagEnabled("response_cache", req) {
+			handler(w, req)
+			return
+		}
+
+		client, err := connectRedis()
+		if err != nil {
+			handler(w, req)
+			return
+		}
+		defer client.Close()
+		// tenants share the cache, so their catalogs are told apart in the key
+		sum := sha256.Sum256([]byte(requestTenant(req) + "\n" + req.URL.Query().Encode()))
+		key := "cache:" + route + ":" + hex.EncodeToString(sum[:])
+		if entry, err := client.Get(key).Result(); err == nil {
+			if cached, err := decodeCachedResponse(entry); err == nil {
+				for name, value := range cached.Header {
+					w.Header().Set(name, value)
+				}
+				w.Header().Set("X-Cache", "HIT")
+				fmt.Fprintf(w, "%s", cached.Body)
+				return
+			}
+		}
+
+		w.Header().Set("X-Cache", "MISS")
+		recorder := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		handler(recorder, req)
+		if recorder.status != http.StatusOK || !cacheableBody(recorder.body.Bytes()) {
+			return
+		}
+		cached := CachedResponse{Header: make(map[string]string), Body: recorder.body.String(), Tenant: requestTenant(req)}
+		for _, name := range cachedHeaders {
+			if value := w.Header().Get(name); value != "" {
+				cached.Header[name] = value
+			}
+		}
+		entry, err := json.Marshal(cached)
+		if err != nil {
+			fmt.Println(errors.Wrap(err, "cannot encode cached response"))
+			return
+		}
+		ttl := parseDuration(policy.TTL, time.Minute)
+		if err = client.Set(key, entry, ttl).Err(); err != nil {
+			fmt.Println(err)
+			return
+		}
+		// the query is kept next to the entry so the consistency checker can recompute it
+		client.Set(cacheQueryKey(key), req.URL.RawQuery, ttl)
+		for _, tag := range policy.Tags {
+			client.SAdd(cacheTagKey(tag), key)
+			client.Expire(cacheTagKey(tag), ttl)
+		}
+	}
+}
+
+// cacheableBody reports whether a response body of a cached route is a result rather than an
+// error. Handlers write errors as text with status 200, while results are empty or start like
+// JSON; /search pages list the books space separated, so they are not valid JSON as a whole.
+func cacheableBody(body []byte) bool {
+	body = bytes.TrimSpace(body)
+	return len(body) == 0 || body[0] == '{' || body[0] == '['
+}
+
+// bookWriteCacheTags returns the cache tags invalidated by book writes, those of every policy,
+// since writes from any API change the same catalog.
+func bookWriteCacheTags() []string {
+	var tags []string
+	seen := make(map[string]bool)
+	for _, policy := range config.CachePolicies {
+		for _, tag := range policy.Invalidates {
+			if !seen[tag] {
+				seen[tag] = true
+				tags = append(tags, tag)
+			}
+		}
+	}
+	return tags
+}
+
+// invalidateCacheTags drops every cached response tagged with one of tags.
+func invalidateCacheTags(tags []string) error {
+	client, err := connectRedis()
+	if err != nil {
+		return errors.Wrap(err, "cannot connect to Redis")
+	}
+	defer client.Close()
+	for _, tag := range tags {
+		keys, err := client.SMembers(cacheTagKey(tag)).Result()
+		if err != nil {
+			return errors.Wrap(err, "cannot get key from Redis")
+		}
+		client.Del(append(keys, cacheTagKey(tag))...)
+	}
+	return nil
+}
@@ -0,0 +1,19 @@
+package main
+
+import "testing"
+
+func TestCacheableBody(t *testing.T) {
+	tests := map[string]bool{
+		``:                                    true,
+		`{"title":"Dune"}`:                    true,
+		`[{"title":"Dune"}]`:                  true,
+		`[{"title":"Dune"} {"title":"Emma"}]`: true,
+		"cannot connect to Redis":             false,
+		"Unsupported request for /book PATCH": false,
+	}
+	for body, want := range tests {
+		if got := cacheableBody([]byte(body)); got != want {
+			t.Errorf("cacheableBody(%q) = %v, want %v", body, got, want)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	errors "github.com/fiverr/go_errors"
+	"gopkg.in/redis.v5"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cartTTL is how long an untouched cart is kept.
+const cartTTL = 7 * 24 * time.Hour
+
+// cartKey is a hash of book id to quantity.
+func cartKey(userID string) string {
+	return "cart:" + userID
+}
+
+// cartItems returns the books in the cart, ordered by book id.
+func cartItems(client *redis.Client, userID string) ([]OrderItem, error) {
+	values, err := client.HGetAll(cartKey(userID)).Result()
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot get key from Redis")
+	}
+	items := make([]OrderItem, 0, len(values))
+	for bookID, value := range values {
+		quantity, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || quantity <= 0 {
+			continue
+		}
+		items = append(items, OrderItem{BookID: bookID, Quantity: quantity})
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].BookID < items[j].BookID })
+	return items, nil
+}
+
+// getCart returns the cart items with their current titles and prices, and the total in the
+// base currency.
+func getCart(client *redis.Client, userID string, coupon string) (string, error) {
+	items, err := cartItems(client, userID)
+	if err != nil {
+		return "", err
+	}
+	var total Price
+	if len(items) > 0 {
+		if err = priceOrderItems(items, coupon); err != nil {
+			return "", err
+		}
+		for _, item := range items {
+			total += item.BaseUnitPrice * Price(item.Quantity)
+		}
+	}
+	buf, err := json.Marshal(map[string]interface{}{"items": items, "total": total,
+		"currency": strings.ToUpper(config.ExchangeRates.BaseCurrency)})
+	if err != nil {
+		return "", errors.Wrap(err, "cannot create json result of cart")
+	}
+	return string(buf), nil
+}
+
+// updateCart adds quantity copies of the book to the cart, or sets its quantity when replace is
+// true, and extends the cart expiry.
+func updateCart(client *redis.Client, userID string, bookID string, quantity int64, replace bool) (string, error) {
+	_, err := client.TxPipelined(func(pipe *redis.Pipeline) error {
+		if replace {
+			pipe.HSet(cartKey(userID), bookID, strconv.FormatInt(quantity, 10))
+		} else {
+			pipe.HIncrBy(cartKey(userID), bookID, quantity)
+		}
+		pipe.Expire(cartKey(userID), cartTTL)
+		return nil
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "cannot set key in Redis")
+	}
+	return fmt.Sprintf("Updated book %s in the cart of user %s\n", bookID, userID), nil
+}
+
+// cart handles /users/{id}/cart: GET returns the cart, DELETE clears it, and on
+// /users/{id}/cart/{book_id} POST adds ?quantity= copies (1 by default), PUT sets the quantity
+// and DELETE removes the book.
+func cart(w http.ResponseWriter, req *http.Request, userID string, rest []string) {
+	var err error
+	var result string
+	client, err := connectRedis()
+	if err != nil {
+		err = errors.Wrap(err, "cannot connect to Redis")
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	defer client.Close()
+	bookID := ""
+	if len(rest) > 0 {
+		bookID = tenantID(requestTenant(req), rest[0])
+	}
+	quantity := int64(1)
+	if value := getParamValue(req, "quantity"); value != "" {
+		quantity, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || quantity <= 0 {
+			fmt.Fprintf(w, "%s", errors.New("quantity must be a positive integer"))
+			return
+		}
+	}
+	switch {
+	case req.Method == "GET" && bookID == "":
+		result, err = getCart(client, userID, strings.ToUpper(getParamValue(req, "coupon")))
+	case req.Method == "DELETE" && bookID == "":
+		if err = client.Del(cartKey(userID)).Err(); err != nil {
+			err = errors.Wrap(err, "cannot delete key in Redis")
+		} else {
+			result = fmt.Sprintf("Cleared the cart of user %s\n", userID)
+		}
+	case req.Method == "POST" && bookID != "":
+		result, err = updateCart(client, userID, bookID, quantity, false)
+	case req.Method == "PUT" && bookID != "":
+		result, err = updateCart(client, userID, bookID, quantity, true)
+	case req.Method == "DELETE" && bookID != "":
+		if err = client.HDel(cartKey(userID), bookID).Err(); err != nil {
+			err = errors.Wrap(err, "cannot delete key in Redis")
+		} else {
+			result = fmt.Sprintf("Removed book %s from the cart of user %s\n", bookID, userID)
+		}
+	default:
+		msg := "Unsupported request for " + req.URL.Path + " " + req.Method
+		err = errors.New(msg)
+	}
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+	} else {
+		fmt.Fprintf(w, "%s", result)
+	}
+}
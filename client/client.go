@@ -0,0 +1,332 @@
+// Package client is a Go client for the book service HTTP API, so services calling it do not
+// hand-roll requests. Calls take a context, and requests failing with a network error or a 5xx
+// or 429 status are retried with exponential backoff.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client calls the book service at BaseURL.
+type Client struct {
+	BaseURL string
+	// APIKey is sent as X-API-Key when set
+	APIKey string
+	// MaxRetries is the number of retries after a failed attempt
+	MaxRetries int
+	// Backoff is the wait before the first retry, doubled on each further retry
+	Backoff    time.Duration
+	HTTPClient *http.Client
+}
+
+// New returns a client for the service at baseURL, such as "http://localhost:8080".
+func New(baseURL string, apiKey string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		APIKey:     apiKey,
+		MaxRetries: 3,
+		Backoff:    100 * time.Millisecond,
+		HTTPClient: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Error is a failure reported by the service. The service answers most failures with status 200
+// and the error message as the body, so Status is often 200.
+type Error struct {
+	Status  int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("book service: %s (status %d)", e.Message, e.Status)
+}
+
+// Book is a book as stored by the service. Prices are decimal amounts such as 12.99.
+type Book struct {
+	Title          string    `json:"title"`
+	AuthorName     string    `json:"author_name"`
+	AuthorID       string    `json:"author_id"`
+	Price          float64   `json:"price"`
+	Currency       string    `json:"currency"`
+	BasePrice      float64   `json:"base_price"`
+	EbookAvailable bool      `json:"ebook_available"`
+	Formats        []string  `json:"formats"`
+	PublishDate    time.Time `json:"publish_date"`
+	Genre          string    `json:"genre"`
+	Publisher      string    `json:"publisher"`
+	ISBN           string    `json:"isbn"`
+	Description    string    `json:"description"`
+	CoverURL       string    `json:"cover_url"`
+	PageCount      int       `json:"page_count"`
+	Language       string    `json:"language"`
+	WorkID         string    `json:"work_id"`
+	RatingAvg      float64   `json:"rating_avg"`
+	RatingCount    int64     `json:"rating_count"`
+	IndexedAt      time.Time `json:"indexed_at"`
+}
+
+// SearchParams are the /search params. Zero values are left out.
+type SearchParams struct {
+	Query      string
+	Title      string
+	AuthorName string
+	// PriceRange is "from-to", such as "5-12.99"
+	PriceRange      string
+	DisplayCurrency string
+	Language        string
+	Publisher       string
+	Formats         []string
+	Sort            string
+	MinRating       float64
+	Cursor          string
+}
+
+// SearchPage is a page of search results. NextCursor is "" on the last page.
+type SearchPage struct {
+	Books      []Book
+	NextCursor string
+	// Truncated is set when the service cut the page at its response size limit
+	Truncated bool
+}
+
+// ActivityEntry is a request the user made.
+type ActivityEntry struct {
+	Route     string    `json:"route"`
+	Method    string    `json:"method"`
+	Time      time.Time `json:"time"`
+	Status    int       `json:"status,omitempty"`
+	IP        string    `json:"ip,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	Country   string    `json:"country,omitempty"`
+}
+
+// ActivityPage is a page of a user's activity, newest first.
+type ActivityPage struct {
+	Total    int64           `json:"total"`
+	Offset   int64           `json:"offset"`
+	Limit    int64           `json:"limit"`
+	Activity []ActivityEntry `json:"activity"`
+}
+
+// do sends the request, retrying failures that may be transient, and returns the response body
+// and headers.
+func (c *Client) do(ctx context.Context, method string, path string, params url.Values) ([]byte, http.Header, error) {
+	u := c.BaseURL + path
+	if len(params) > 0 {
+		u += "?" + params.Encode()
+	}
+	backoff := c.Backoff
+	for attempt := 0; ; attempt++ {
+		body, header, err := c.send(ctx, method, u)
+		if err == nil || attempt >= c.MaxRetries || !retryable(err) {
+			return body, header, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (c *Client) send(ctx context.Context, method string, u string) ([]byte, http.Header, error) {
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req = req.WithContext(ctx)
+	if c.APIKey != "" {
+		req.Header.Set("X-API-Key", c.APIKey)
+	}
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode >= 400 {
+		return nil, nil, &Error{Status: resp.StatusCode, Message: strings.TrimSpace(string(body))}
+	}
+	return body, resp.Header, nil
+}
+
+// retryable reports whether a failed request may succeed when sent again.
+func retryable(err error) bool {
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return false
+	}
+	var serviceErr *Error
+	if errors.As(err, &serviceErr) {
+		return serviceErr.Status >= 500 || serviceErr.Status == http.StatusTooManyRequests
+	}
+	return true
+}
+
+// expectJSON returns the body when it is a JSON document, and the body as an error otherwise.
+func expectJSON(body []byte) ([]byte, error) {
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) > 0 && trimmed[0] != '{' && trimmed[0] != '[' {
+		return nil, &Error{Status: http.StatusOK, Message: string(trimmed)}
+	}
+	return trimmed, nil
+}
+
+// bookWritten are the messages the service answers successful book writes with.
+var bookWritten = []string{"Indexed book", "Queued book", "Stored book", "New version of book", "Delete document", "Deleted book"}
+
+func expectWritten(body []byte) (string, error) {
+	message := strings.TrimSpace(string(body))
+	for _, prefix := range bookWritten {
+		if strings.HasPrefix(message, prefix) {
+			return message, nil
+		}
+	}
+	return "", &Error{Status: http.StatusOK, Message: message}
+}
+
+// AddBook creates or replaces the book with the given id and returns the service's message.
+func (c *Client) AddBook(ctx context.Context, id string, book Book) (string, error) {
+	params := url.Values{"id": {id}}
+	set := func(name string, value string) {
+		if value != "" {
+			params.Set(name, value)
+		}
+	}
+	set("title", book.Title)
+	set("author_name", book.AuthorName)
+	set("author_id", book.AuthorID)
+	if book.Price != 0 {
+		set("price", strconv.FormatFloat(book.Price, 'f', 2, 64))
+	}
+	set("currency", book.Currency)
+	set("formats", strings.Join(book.Formats, ","))
+	if book.EbookAvailable {
+		set("ebook_available", "true")
+	}
+	if !book.PublishDate.IsZero() {
+		set("publish_date", book.PublishDate.Format(time.RFC3339))
+	}
+	set("genre", book.Genre)
+	set("publisher", book.Publisher)
+	set("isbn", book.ISBN)
+	set("description", book.Description)
+	set("cover_url", book.CoverURL)
+	if book.PageCount > 0 {
+		set("page_count", strconv.Itoa(book.PageCount))
+	}
+	set("language", book.Language)
+	set("work_id", book.WorkID)
+	body, _, err := c.do(ctx, "PUT", "/book", params)
+	if err != nil {
+		return "", err
+	}
+	return expectWritten(body)
+}
+
+// GetBook returns the book, or nil when it does not exist.
+func (c *Client) GetBook(ctx context.Context, id string) (*Book, error) {
+	body, _, err := c.do(ctx, "GET", "/book", url.Values{"id": {id}})
+	if err != nil {
+		return nil, err
+	}
+	body, err = expectJSON(body)
+	if err != nil || len(body) == 0 {
+		return nil, err
+	}
+	var book Book
+	if err = json.Unmarshal(body, &book); err != nil {
+		return nil, err
+	}
+	return &book, nil
+}
+
+// UpdateTitle changes the title of the book.
+func (c *Client) UpdateTitle(ctx context.Context, id string, title string) (string, error) {
+	body, _, err := c.do(ctx, "POST", "/book", url.Values{"id": {id}, "title": {title}})
+	if err != nil {
+		return "", err
+	}
+	return expectWritten(body)
+}
+
+// DeleteBook deletes the book, returning "" when it did not exist.
+func (c *Client) DeleteBook(ctx context.Context, id string) (string, error) {
+	body, _, err := c.do(ctx, "DELETE", "/book", url.Values{"id": {id}})
+	if err != nil {
+		return "", err
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		return "", nil
+	}
+	return expectWritten(body)
+}
+
+// Search returns a page of books matching p.
+func (c *Client) Search(ctx context.Context, p SearchParams) (*SearchPage, error) {
+	params := url.Values{}
+	for name, value := range map[string]string{"q": p.Query, "title": p.Title, "author_name": p.AuthorName,
+		"price_range": p.PriceRange, "display_currency": p.DisplayCurrency, "language": p.Language,
+		"publisher": p.Publisher, "format": strings.Join(p.Formats, ","), "sort": p.Sort, "cursor": p.Cursor} {
+		if value != "" {
+			params.Set(name, value)
+		}
+	}
+	if p.MinRating > 0 {
+		params.Set("min_rating", strconv.FormatFloat(p.MinRating, 'f', -1, 64))
+	}
+	body, header, err := c.do(ctx, "GET", "/search", params)
+	if err != nil {
+		return nil, err
+	}
+	body, err = expectJSON(body)
+	if err != nil {
+		return nil, err
+	}
+	page := &SearchPage{Books: make([]Book, 0), NextCursor: header.Get("X-Next-Cursor"),
+		Truncated: strings.Contains(header.Get("Warning"), "response truncated")}
+	// results are written as the books' documents between brackets, separated by spaces
+	body = bytes.TrimSuffix(bytes.TrimPrefix(body, []byte("[")), []byte("]"))
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	for decoder.More() {
+		var book Book
+		if err = decoder.Decode(&book); err != nil {
+			return nil, err
+		}
+		page.Books = append(page.Books, book)
+	}
+	return page, nil
+}
+
+// GetActivity returns a page of the user's activity.
+func (c *Client) GetActivity(ctx context.Context, userID string, offset int64, limit int64) (*ActivityPage, error) {
+	params := url.Values{"user_id": {userID}, "offset": {strconv.FormatInt(offset, 10)}}
+	if limit > 0 {
+		params.Set("limit", strconv.FormatInt(limit, 10))
+	}
+	body, _, err := c.do(ctx, "GET", "/activity", params)
+	if err != nil {
+		return nil, err
+	}
+	if body, err = expectJSON(body); err != nil {
+		return nil, err
+	}
+	var page ActivityPage
+	if err = json.Unmarshal(body, &page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
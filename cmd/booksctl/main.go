@@ -0,0 +1,287 @@
+// Command booksctl is an operator CLI for the book service HTTP API.
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/orensul/book_service/client"
+	"github.com/spf13/cobra"
+)
+
+var (
+	serviceURL string
+	apiKey     string
+)
+
+func newClient() *client.Client {
+	return client.New(serviceURL, apiKey)
+}
+
+// printJSON writes v indented to stdout.
+func printJSON(v interface{}) error {
+	buf, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(buf))
+	return nil
+}
+
+func addCmd() *cobra.Command {
+	var book client.Book
+	var publishDate string
+	cmd := &cobra.Command{
+		Use:   "add <id>",
+		Short: "Create or replace a book",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if publishDate != "" {
+				t, err := time.Parse(time.RFC3339, publishDate)
+				if err != nil {
+					return fmt.Errorf("publish-date must be RFC 3339, such as 2020-01-02T00:00:00Z")
+				}
+				book.PublishDate = t
+			}
+			message, err := newClient().AddBook(cmd.Context(), args[0], book)
+			if err != nil {
+				return err
+			}
+			fmt.Println(message)
+			return nil
+		},
+	}
+	flags := cmd.Flags()
+	flags.StringVar(&book.Title, "title", "", "title")
+	flags.StringVar(&book.AuthorName, "author-name", "", "author name")
+	flags.StringVar(&book.AuthorID, "author-id", "", "id of an existing author")
+	flags.Float64Var(&book.Price, "price", 0, "price, such as 12.99")
+	flags.StringVar(&book.Currency, "currency", "", "currency of the price")
+	flags.StringSliceVar(&book.Formats, "formats", nil, "formats, such as paperback,ebook")
+	flags.StringVar(&publishDate, "publish-date", "", "publish date in RFC 3339")
+	flags.StringVar(&book.Genre, "genre", "", "genre")
+	flags.StringVar(&book.Publisher, "publisher", "", "publisher")
+	flags.StringVar(&book.ISBN, "isbn", "", "ISBN-10 or ISBN-13")
+	flags.StringVar(&book.Description, "description", "", "description")
+	flags.IntVar(&book.PageCount, "page-count", 0, "number of pages")
+	flags.StringVar(&book.Language, "language", "", "ISO 639 language code")
+	flags.StringVar(&book.WorkID, "work-id", "", "work the book is an edition of")
+	return cmd
+}
+
+func getCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "get <id>",
+		Short: "Show a book",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			book, err := newClient().GetBook(cmd.Context(), args[0])
+			if err != nil {
+				return err
+			}
+			if book == nil {
+				return fmt.Errorf("book %s does not exist", args[0])
+			}
+			return printJSON(book)
+		},
+	}
+}
+
+func deleteCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "delete <id>",
+		Short: "Delete a book",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			message, err := newClient().DeleteBook(cmd.Context(), args[0])
+			if err != nil {
+				return err
+			}
+			if message == "" {
+				return fmt.Errorf("book %s does not exist", args[0])
+			}
+			fmt.Println(message)
+			return nil
+		},
+	}
+}
+
+func searchCmd() *cobra.Command {
+	var p client.SearchParams
+	var all bool
+	cmd := &cobra.Command{
+		Use:   "search [query]",
+		Short: "Search books",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) == 1 {
+				p.Query = args[0]
+			}
+			c := newClient()
+			for {
+				page, err := c.Search(cmd.Context(), p)
+				if err != nil {
+					return err
+				}
+				for _, book := range page.Books {
+					if err = printJSON(book); err != nil {
+						return err
+					}
+				}
+				if !all || page.NextCursor == "" {
+					if page.NextCursor != "" {
+						fmt.Fprintf(os.Stderr, "more results with --cursor %s\n", page.NextCursor)
+					}
+					return nil
+				}
+				p.Cursor = page.NextCursor
+			}
+		},
+	}
+	flags := cmd.Flags()
+	flags.StringVar(&p.Title, "title", "", "match the title")
+	flags.StringVar(&p.AuthorName, "author-name", "", "match the author name")
+	flags.StringVar(&p.PriceRange, "price-range", "", "price range, such as 5-12.99")
+	flags.StringVar(&p.DisplayCurrency, "display-currency", "", "currency to show prices in")
+	flags.StringVar(&p.Language, "language", "", "ISO 639 language code")
+	flags.StringVar(&p.Publisher, "publisher", "", "exact publisher name")
+	flags.StringSliceVar(&p.Formats, "format", nil, "formats the books are available in")
+	flags.StringVar(&p.Sort, "sort", "", "rating to order by rating")
+	flags.Float64Var(&p.MinRating, "min-rating", 0, "minimum average rating")
+	flags.StringVar(&p.Cursor, "cursor", "", "cursor of the page to start from")
+	flags.BoolVar(&all, "all", false, "follow cursors through all pages")
+	return cmd
+}
+
+// importRecord is a line of an import file: the book's fields and its id.
+type importRecord struct {
+	ID string `json:"id"`
+	client.Book
+}
+
+func importCmd() *cobra.Command {
+	var stopOnError bool
+	cmd := &cobra.Command{
+		Use:   "import <file>...",
+		Short: "Bulk import books from JSON lines files, one book with its id per line",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c := newClient()
+			imported, failed := 0, 0
+			for _, path := range args {
+				f, err := os.Open(path)
+				if err != nil {
+					return err
+				}
+				scanner := bufio.NewScanner(f)
+				scanner.Buffer(make([]byte, 64*1024), 1<<20)
+				for line := 1; scanner.Scan(); line++ {
+					text := strings.TrimSpace(scanner.Text())
+					if text == "" {
+						continue
+					}
+					var record importRecord
+					err = json.Unmarshal([]byte(text), &record)
+					if err == nil && record.ID == "" {
+						err = fmt.Errorf("id is required")
+					}
+					if err == nil {
+						_, err = c.AddBook(cmd.Context(), record.ID, record.Book)
+					}
+					if err != nil {
+						failed++
+						fmt.Fprintf(os.Stderr, "%s:%d: %s\n", path, line, err)
+						if stopOnError {
+							f.Close()
+							return fmt.Errorf("import stopped after %d books", imported)
+						}
+						continue
+					}
+					imported++
+				}
+				err = scanner.Err()
+				f.Close()
+				if err != nil {
+					return err
+				}
+			}
+			fmt.Printf("imported %d books, %d failed\n", imported, failed)
+			if failed > 0 {
+				return fmt.Errorf("%d books failed to import", failed)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&stopOnError, "stop-on-error", false, "stop at the first book that fails")
+	return cmd
+}
+
+func activityCmd() *cobra.Command {
+	var follow bool
+	var interval time.Duration
+	var limit int64
+	cmd := &cobra.Command{
+		Use:   "activity <user_id>",
+		Short: "Show a user's latest activity, or follow it with -f",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c := newClient()
+			var last time.Time
+			for {
+				page, err := c.GetActivity(cmd.Context(), args[0], 0, limit)
+				if err != nil {
+					return err
+				}
+				// pages are newest first, print oldest first like tail
+				for i := len(page.Activity) - 1; i >= 0; i-- {
+					entry := page.Activity[i]
+					if !entry.Time.After(last) {
+						continue
+					}
+					fmt.Printf("%s %s %s %d %s\n", entry.Time.Format(time.RFC3339), entry.Method, entry.Route, entry.Status, entry.IP)
+					last = entry.Time
+				}
+				if !follow {
+					return nil
+				}
+				select {
+				case <-cmd.Context().Done():
+					return nil
+				case <-time.After(interval):
+				}
+			}
+		},
+	}
+	flags := cmd.Flags()
+	flags.BoolVarP(&follow, "follow", "f", false, "keep polling for new activity")
+	flags.DurationVar(&interval, "interval", 2*time.Second, "polling interval with --follow")
+	flags.Int64Var(&limit, "limit", 20, "number of entries fetched per poll")
+	return cmd
+}
+
+func main() {
+	root := &cobra.Command{
+		Use:          "booksctl",
+		Short:        "Manage the book service from the command line",
+		SilenceUsage: true,
+	}
+	defaultURL := os.Getenv("BOOKS_URL")
+	if defaultURL == "" {
+		defaultURL = "http://localhost:8080"
+	}
+	root.PersistentFlags().StringVar(&serviceURL, "url", defaultURL, "book service URL, or set BOOKS_URL")
+	root.PersistentFlags().StringVar(&apiKey, "api-key", os.Getenv("BOOKS_API_KEY"), "API key, or set BOOKS_API_KEY")
+	root.AddCommand(addCmd(), getCmd(), deleteCmd(), searchCmd(), importCmd(), activityCmd())
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if err := root.ExecuteContext(ctx); err != nil {
+		os.Exit(1)
+	}
+}
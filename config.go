@@ -0,0 +1,452 @@
+package main
+
+import (
+	"encoding/json"
+	errors "github.com/fiverr/go_errors"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the service settings that can be overridden from a JSON config file.
+type Config struct {
+	ExchangeRates ExchangeRatesConfig `json:"exchange_rates"`
+	Dedup         DedupConfig         `json:"dedup"`
+	AdminToken    string              `json:"admin_token"`
+	Books         BooksConfig         `json:"books"`
+	Assets        AssetsConfig        `json:"assets"`
+	Storage       StorageConfig       `json:"storage"`
+	GoogleBooks   GoogleBooksConfig   `json:"google_books"`
+	OpenLibrary   OpenLibraryConfig   `json:"open_library"`
+	Moderation    ModerationConfig    `json:"moderation"`
+	Activity      ActivityConfig      `json:"activity"`
+	Sessions      SessionsConfig      `json:"sessions"`
+	Bulk          BulkConfig          `json:"bulk"`
+	Scheduler     SchedulerConfig     `json:"scheduler"`
+	GRPC          GRPCConfig          `json:"grpc"`
+	Validation    ValidationConfig    `json:"validation"`
+	Maintenance   MaintenanceConfig   `json:"maintenance"`
+	// MaxResponseBytes caps the size of search responses, 0 disables the limit.
+	MaxResponseBytes int `json:"max_response_bytes"`
+	// MaxBodyBytes caps the body of write requests, 0 disables the limit.
+	MaxBodyBytes int64 `json:"max_body_bytes"`
+	// CachePolicies maps a route such as "/search" to its response cache policy.
+	CachePolicies map[string]CachePolicy `json:"cache_policies"`
+	// Environment names the deployment, such as "staging", for feature flags limited to some.
+	Environment string `json:"environment"`
+	// Flags gates behaviors by name. Overrides set on /admin/flags win over them.
+	Flags map[string]FlagConfig `json:"flags"`
+	// Tenants are the bookstores sharing the deployment, selected by the API key or session, or
+	// with the X-Tenant header by admin requests. Their books, users, views and sales are kept
+	// apart from each other and from the default catalog on every route; gRPC serves the default
+	// catalog only.
+	Tenants []string `json:"tenants"`
+	// Elasticsearch configures the connection to the cluster.
+	Elasticsearch ElasticsearchConfig `json:"elasticsearch"`
+	// Redis configures the connection to the Redis server.
+	Redis RedisConfig `json:"redis"`
+	// Snapshots configures the repository of the Elasticsearch snapshots on /admin/snapshots.
+	Snapshots SnapshotsConfig `json:"snapshots"`
+	// Backups configures the scheduled catalog backups listed on /admin/backups.
+	Backups BackupsConfig `json:"backups"`
+	// Search sets the page size and depth limits of book searches.
+	Search SearchConfig `json:"search"`
+	// Webhooks restricts where notifications are delivered.
+	Webhooks WebhooksConfig `json:"webhooks"`
+}
+
+// WebhooksConfig lists the AllowedHosts webhooks may be delivered to although they resolve to a
+// loopback, link-local or private address, such as a receiver on the internal network. Webhooks
+// of other hosts with such addresses are refused when given and when delivered.
+type WebhooksConfig struct {
+	AllowedHosts []string `json:"allowed_hosts"`
+}
+
+// SearchConfig limits the pages of book searches on every API. Searches return DefaultPageSize
+// books unless the request asks for a limit, capped at MaxPageSize. Cursors beyond MaxOffset are
+// refused, as deep pages are expensive for the cluster; the defaults keep the cursor plus the page
+// within the 10,000 hits of the default index.max_result_window. 0 disables a maximum.
+type SearchConfig struct {
+	DefaultPageSize int `json:"default_page_size"`
+	MaxPageSize     int `json:"max_page_size"`
+	MaxOffset       int `json:"max_offset"`
+}
+
+// BackupsConfig configures the backup job, scheduled like the other jobs under the "backup" name
+// and run daily once Enabled. Mode "ndjson" exports the books to Storage, an S3 compatible bucket
+// for instance, or to the shared storage when its Backend is empty; mode "snapshot" takes an
+// Elasticsearch snapshot in the Snapshots repository, which can itself be of type "s3". Backups
+// beyond the newest Keep, or older than MaxAge such as "30d", are deleted; 0 and "" keep them.
+type BackupsConfig struct {
+	Enabled bool          `json:"enabled"`
+	Mode    string        `json:"mode"`
+	Storage StorageConfig `json:"storage"`
+	Keep    int           `json:"keep"`
+	MaxAge  string        `json:"max_age"`
+}
+
+// SnapshotsConfig is the Elasticsearch snapshot repository books are snapshotted to: its name,
+// type, such as "fs" or "s3", and settings, such as the location of an "fs" repository, which
+// must be listed in path.repo of every node.
+type SnapshotsConfig struct {
+	Repository string                 `json:"repository"`
+	Type       string                 `json:"type"`
+	Settings   map[string]interface{} `json:"settings"`
+}
+
+// RedisConfig configures the connection to the Redis server at Addr, as host:port. PoolSize caps
+// the connections of each client, 0 keeps the client's default of 10 per CPU. With TLS the
+// server is verified against CACert, or the system roots when empty, and ClientCert and
+// ClientKey are presented when set.
+type RedisConfig struct {
+	Addr               string `json:"addr"`
+	Password           string `json:"password"`
+	DB                 int    `json:"db"`
+	PoolSize           int    `json:"pool_size"`
+	DialTimeout        string `json:"dial_timeout"`
+	ReadTimeout        string `json:"read_timeout"`
+	WriteTimeout       string `json:"write_timeout"`
+	TLS                bool   `json:"tls"`
+	CACert             string `json:"ca_cert"`
+	ClientCert         string `json:"client_cert"`
+	ClientKey          string `json:"client_key"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+}
+
+// ElasticsearchConfig configures the connection to the cluster at URL, or at the nodes of URLs
+// which fail over to each other. Nodes are health checked every HealthcheckInterval; with Sniff the
+// client also discovers the other nodes of the cluster every SniffInterval, which needs the nodes
+// to be reachable at their published addresses. Index names the books index, or an alias of it,
+// such as "books_staging" for a staging deployment sharing the cluster. With StrictMapping the
+// service refuses to start when the mapping of the index drifted from the one the code expects,
+// instead of only warning. Searches count matching books exactly unless TrackTotalHits caps the
+// count, trading exact totals for speed on large catalogs; capped totals are reported as lower
+// bounds. Secured clusters take Username and Password for basic auth, or an
+// APIKey, the base64 encoded id:api_key pair, which wins over them. CACert is a PEM bundle to
+// verify the cluster with instead of the system roots, ClientCert and ClientKey a certificate for
+// clusters requiring one. InsecureSkipVerify turns certificate checks off, for development clusters
+// only.
+type ElasticsearchConfig struct {
+	URL                 string   `json:"url"`
+	URLs                []string `json:"urls"`
+	Sniff               bool     `json:"sniff"`
+	SniffInterval       string   `json:"sniff_interval"`
+	HealthcheckInterval string   `json:"healthcheck_interval"`
+	Index               string   `json:"index"`
+	StrictMapping       bool     `json:"strict_mapping"`
+	TrackTotalHits      int      `json:"track_total_hits"`
+	Username            string   `json:"username"`
+	Password            string   `json:"password"`
+	APIKey              string   `json:"api_key"`
+	CACert              string   `json:"ca_cert"`
+	ClientCert          string   `json:"client_cert"`
+	ClientKey           string   `json:"client_key"`
+	InsecureSkipVerify  bool     `json:"insecure_skip_verify"`
+}
+
+// ExchangeRatesConfig configures the job refreshing currency exchange rates into Redis.
+type ExchangeRatesConfig struct {
+	ProviderURL     string `json:"provider_url"`
+	BaseCurrency    string `json:"base_currency"`
+	RefreshInterval string `json:"refresh_interval"`
+	// StaticRates, when set, is used as the rate table instead of calling the provider.
+	StaticRates map[string]float64 `json:"static_rates"`
+}
+
+// DedupConfig configures collapsing of identical writes sent by the same user.
+type DedupConfig struct {
+	Enabled bool     `json:"enabled"`
+	Window  string   `json:"window"`
+	OptOut  []string `json:"opt_out"`
+}
+
+// BooksConfig selects the book repository: "elasticsearch", "postgres" for deployments without
+// Elasticsearch, or "memory" for development and tests without a cluster. With "postgres" the
+// books are served as usual, but the features kept in Elasticsearch indexes of their own, such
+// as authors, reviews, alerts, lists, loans, orders, live search and the admin index tools,
+// answer 501 Not Implemented.
+type BooksConfig struct {
+	Backend     string `json:"backend"`
+	PostgresURL string `json:"postgres_url"`
+}
+
+// AssetsConfig configures serving of covers and export artifacts under /assets/.
+type AssetsConfig struct {
+	OriginMode bool   `json:"origin_mode"`
+	MaxAge     string `json:"max_age"`
+}
+
+// StorageConfig selects where binary artifacts are stored: "local", "s3" or "gcs".
+type StorageConfig struct {
+	Backend  string `json:"backend"`
+	Dir      string `json:"dir"`
+	Bucket   string `json:"bucket"`
+	Prefix   string `json:"prefix"`
+	Region   string `json:"region"`
+	Endpoint string `json:"endpoint"`
+}
+
+// GoogleBooksConfig configures metadata enrichment from the Google Books API.
+type GoogleBooksConfig struct {
+	URL                string `json:"url"`
+	APIKey             string `json:"api_key"`
+	RateLimitPerMinute int    `json:"rate_limit_per_minute"`
+}
+
+// OpenLibraryConfig configures the Open Library importer.
+type OpenLibraryConfig struct {
+	URL string `json:"url"`
+}
+
+// ModerationConfig configures the review moderation queue. Reviews containing a banned term are
+// flagged and held for moderation; with RequireApproval every new review is held.
+type ModerationConfig struct {
+	RequireApproval bool     `json:"require_approval"`
+	BannedTerms     []string `json:"banned_terms"`
+}
+
+// ActivityConfig configures paging through a user's activity on /activity and how long it is
+// kept. MaxEntries caps the entries kept per user and Retention drops older entries, 0 and ""
+// keep everything. GeoIPURL, when set, resolves client IPs to a country; "{ip}" in it is
+// replaced by the address and the service must answer with the country as plain text. Backend
+// is "redis", "elasticsearch" or "memory"; ILMPolicy names the lifecycle policy of the
+// Elasticsearch index. The Redis backend writes entries in batches of BatchSize, or every
+// FlushInterval. Requests queue their entry for Workers goroutines; entries beyond QueueSize are
+// dropped and counted.
+type ActivityConfig struct {
+	Backend         string `json:"backend"`
+	ILMPolicy       string `json:"ilm_policy"`
+	DefaultLimit    int    `json:"default_limit"`
+	MaxLimit        int    `json:"max_limit"`
+	MaxEntries      int64  `json:"max_entries"`
+	Retention       string `json:"retention"`
+	CleanupInterval string `json:"cleanup_interval"`
+	GeoIPURL        string `json:"geoip_url"`
+	BatchSize       int    `json:"batch_size"`
+	FlushInterval   string `json:"flush_interval"`
+	QueueSize       int    `json:"queue_size"`
+	Workers         int    `json:"workers"`
+}
+
+// SessionsConfig configures user sessions. With Required, user_id params are only honoured
+// through a session, and /users/{id} routes need a session or API key of the user, or the admin
+// token.
+type SessionsConfig struct {
+	TTL      string `json:"ttl"`
+	Required bool   `json:"required"`
+}
+
+// BulkConfig configures routing single book writes through a shared bulk processor, flushed
+// every Actions requests, SizeBytes of payload or FlushInterval, whichever comes first.
+type BulkConfig struct {
+	Enabled       bool   `json:"enabled"`
+	Workers       int    `json:"workers"`
+	Actions       int    `json:"actions"`
+	SizeBytes     int    `json:"size_bytes"`
+	FlushInterval string `json:"flush_interval"`
+}
+
+// SchedulerConfig maps recurring job names to their schedule: "@every 1h", "@hourly", "@daily",
+// a five field cron expression such as "30 2 * * *", or "off". Jobs left out keep their default.
+type SchedulerConfig struct {
+	Jobs map[string]string `json:"jobs"`
+}
+
+// GRPCConfig configures the gRPC API served next to the HTTP API. An empty Addr disables it.
+type GRPCConfig struct {
+	Addr string `json:"addr"`
+}
+
+// ValidationConfig configures checks on written books. RequiredFields are the params a book must
+// be written with, such as "title"; see bookFieldSet for the fields that can be required. Rules
+// are business rules every write must pass. FoldQuotes replaces typographic quotes in titles and
+// names with ASCII ones. Duplicates configures detection of new books matching existing ones.
+type ValidationConfig struct {
+	RequiredFields []string         `json:"required_fields"`
+	Rules          []BookRule       `json:"rules"`
+	FoldQuotes     bool             `json:"fold_quotes"`
+	Duplicates     DuplicatesConfig `json:"duplicates"`
+}
+
+// DuplicatesConfig configures duplicate detection on book creation. Mode is "off", "warn" or
+// "reject", and can be overridden per request with the duplicates param. A new book is a
+// duplicate of one whose title and author are at least Similarity alike, from 0 to 1.
+type DuplicatesConfig struct {
+	Mode       string  `json:"mode"`
+	Similarity float64 `json:"similarity"`
+}
+
+// MaintenanceConfig starts the service in read-only maintenance mode when Enabled. Rejected writes
+// tell clients to retry after RetryAfter.
+type MaintenanceConfig struct {
+	Enabled    bool   `json:"enabled"`
+	RetryAfter string `json:"retry_after"`
+}
+
+var config = defaultConfig()
+
+func bound(v float64) *float64 {
+	return &v
+}
+
+func defaultConfig() Config {
+	return Config{
+		ExchangeRates: ExchangeRatesConfig{
+			ProviderURL:     "https://open.er-api.com/v6/latest/USD",
+			BaseCurrency:    "USD",
+			RefreshInterval: "1h",
+		},
+		Dedup: DedupConfig{
+			Enabled: true,
+			Window:  "5s",
+		},
+		Books: BooksConfig{
+			Backend: "elasticsearch",
+		},
+		Assets: AssetsConfig{
+			MaxAge: "8760h",
+		},
+		Storage: StorageConfig{
+			Backend: "local",
+			Dir:     "assets",
+		},
+		GoogleBooks: GoogleBooksConfig{
+			URL:                "https://www.googleapis.com/books/v1/volumes",
+			RateLimitPerMinute: 60,
+		},
+		OpenLibrary: OpenLibraryConfig{
+			URL: "https://openlibrary.org/search.json",
+		},
+		Activity: ActivityConfig{
+			Backend:         "redis",
+			DefaultLimit:    3,
+			MaxLimit:        1000,
+			MaxEntries:      10000,
+			Retention:       "90d",
+			CleanupInterval: "1h",
+			BatchSize:       100,
+			FlushInterval:   "100ms",
+			QueueSize:       10000,
+			Workers:         4,
+		},
+		Sessions: SessionsConfig{
+			TTL: "24h",
+		},
+		Bulk: BulkConfig{
+			Workers:       2,
+			Actions:       1000,
+			SizeBytes:     5 << 20,
+			FlushInterval: "1s",
+		},
+		GRPC: GRPCConfig{
+			Addr: ":9090",
+		},
+		Validation: ValidationConfig{
+			RequiredFields: []string{"title", "author_name"},
+			Rules: []BookRule{
+				{Name: "price_range", Field: "price", Min: bound(0), Max: bound(10000)},
+				{Name: "publish_date_ahead", Field: "publish_date", MaxAhead: "730d"},
+			},
+			Duplicates: DuplicatesConfig{
+				Mode:       "warn",
+				Similarity: 0.85,
+			},
+		},
+		Maintenance: MaintenanceConfig{
+			RetryAfter: "5m",
+		},
+		MaxResponseBytes: 1 << 20,
+		MaxBodyBytes:     1 << 20,
+		Flags: map[string]FlagConfig{
+			"response_cache": {Enabled: true},
+		},
+		Elasticsearch: ElasticsearchConfig{
+			URL:                 "http://10.200.10.1:9200",
+			SniffInterval:       "15m",
+			HealthcheckInterval: "60s",
+			Index:               "books",
+		},
+		Redis: RedisConfig{
+			Addr:         "localhost:6379",
+			DialTimeout:  "5s",
+			ReadTimeout:  "3s",
+			WriteTimeout: "3s",
+		},
+		Snapshots: SnapshotsConfig{
+			Repository: "books_backups",
+			Type:       "fs",
+			Settings:   map[string]interface{}{"location": "books_backups"},
+		},
+		Backups: BackupsConfig{
+			Mode:   "ndjson",
+			Keep:   14,
+			MaxAge: "30d",
+		},
+		Search: SearchConfig{
+			DefaultPageSize: 10,
+			MaxPageSize:     100,
+			MaxOffset:       9900,
+		},
+	}
+}
+
+// loadConfig reads the JSON config file at path on top of the defaults.
+func loadConfig(path string) (Config, error) {
+	c := defaultConfig()
+	if path == "" {
+		return c, nil
+	}
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return c, errors.Wrap(err, "cannot read config file")
+	}
+	if err = json.Unmarshal(buf, &c); err != nil {
+		return c, errors.Wrap(err, "cannot parse config file")
+	}
+	for _, field := range c.Validation.RequiredFields {
+		if _, ok := bookFieldSet[field]; !ok {
+			return c, errors.New("unknown required field " + field + " in validation config")
+		}
+	}
+	for _, tenant := range c.Tenants {
+		if tenant == "" || tenant != strings.ToLower(strings.TrimSpace(tenant)) || strings.Contains(tenant, ":") {
+			return c, errors.New("tenant " + tenant + " must be a non empty lower case name without colons")
+		}
+	}
+	if c.Backups.Mode != "ndjson" && c.Backups.Mode != "snapshot" {
+		return c, errors.New("unknown backups mode " + c.Backups.Mode + ", must be ndjson or snapshot")
+	}
+	if c.Search.DefaultPageSize <= 0 || (c.Search.MaxPageSize > 0 && c.Search.DefaultPageSize > c.Search.MaxPageSize) {
+		return c, errors.New("search default_page_size must be positive and at most max_page_size")
+	}
+	if !knownDuplicateMode(c.Validation.Duplicates.Mode) {
+		return c, errors.New("unknown duplicates mode " + c.Validation.Duplicates.Mode + " in validation config")
+	}
+	return c, nil
+}
+
+// parseWindow parses a duration that may also be given in days, such as "7d".
+func parseWindow(value string) (time.Duration, error) {
+	if strings.HasSuffix(value, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(value, "d"))
+		if err != nil {
+			return 0, errors.Wrap(err, "invalid window "+value)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, errors.Wrap(err, "invalid window "+value)
+	}
+	return d, nil
+}
+
+// parseDuration parses a duration setting, falling back to def when it is empty or invalid.
+func parseDuration(value string, def time.Duration) time.Duration {
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return def
+	}
+	return d
+}
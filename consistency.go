@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	errors "github.com/fiverr/go_errors"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+const defaultConsistencySample = 100
+
+// CacheDrift is a cached /book response that no longer matches the index.
+type CacheDrift struct {
+	Key      string `json:"key"`
+	BookID   string `json:"book_id"`
+	Repaired bool   `json:"repaired"`
+}
+
+// ConsistencyReport is the outcome of comparing a sample of cached books with the index.
+type ConsistencyReport struct {
+	Sampled int          `json:"sampled"`
+	Drifted []CacheDrift `json:"drifted"`
+}
+
+// checkCacheConsistency samples up to n cached /book responses, recomputes each from the index
+// and reports those that differ. With repair the stale entries are dropped from the cache.
+func checkCacheConsistency(n int, repair bool) (*ConsistencyReport, error) {
+	redisClient, err := connectRedis()
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot connect to Redis")
+	}
+	defer redisClient.Close()
+	report := &ConsistencyReport{Drifted: make([]CacheDrift, 0)}
+	var cursor uint64
+	for report.Sampled < n {
+		var keys []string
+		keys, cursor, err = redisClient.Scan(cursor, "cache:/book:*", int64(n)).Result()
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot get key from Redis")
+		}
+		for _, key := range keys {
+			if report.Sampled >= n {
+				break
+			}
+			entry, err := redisClient.Get(key).Result()
+			if err != nil {
+				continue
+			}
+			cached, err := decodeCachedResponse(entry)
+			if err != nil {
+				continue
+			}
+			rawQuery, err := redisClient.Get(cacheQueryKey(key)).Result()
+			if err != nil {
+				// entries cached before queries were kept cannot be recomputed
+				continue
+			}
+			query, err := url.ParseQuery(rawQuery)
+			if err != nil || query.Get("id") == "" {
+				continue
+			}
+			report.Sampled++
+			bookID := tenantID(cached.Tenant, query.Get("id"))
+			fresh, err := getBook(bookID, query.Get("display_currency"), query.Get("coupon"))
+			if err != nil {
+				return nil, err
+			}
+			if fresh == cached.Body {
+				continue
+			}
+			drift := CacheDrift{Key: key, BookID: bookID}
+			if repair {
+				if err = redisClient.Del(key, cacheQueryKey(key)).Err(); err != nil {
+					return nil, errors.Wrap(err, "cannot delete key in Redis")
+				}
+				drift.Repaired = true
+			}
+			report.Drifted = append(report.Drifted, drift)
+		}
+		if cursor == 0 {
+			break
+		}
+	}
+	return report, nil
+}
+
+// repairCacheDrift is the scheduled consistency check, dropping stale cache entries.
+func repairCacheDrift() error {
+	report, err := checkCacheConsistency(defaultConsistencySample, true)
+	if err != nil {
+		return err
+	}
+	if len(report.Drifted) > 0 {
+		fmt.Printf("dropped %d stale cached books out of %d sampled\n", len(report.Drifted), report.Sampled)
+	}
+	return nil
+}
+
+// consistency handles /admin/consistency?sample=: GET reports cached books that drifted from the
+// index, POST also drops the stale entries.
+func consistency(w http.ResponseWriter, req *http.Request) {
+	if !isAdmin(req) {
+		http.Error(w, "admin token required", http.StatusUnauthorized)
+		return
+	}
+	if req.Method != "GET" && req.Method != "POST" {
+		msg := "Unsupported request for /admin/consistency " + req.Method
+		fmt.Fprintf(w, "%s", errors.New(msg))
+		return
+	}
+	n := defaultConsistencySample
+	if value := getParamValue(req, "sample"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			fmt.Fprintf(w, "%s", errors.New("sample must be a positive integer"))
+			return
+		}
+		n = parsed
+	}
+	report, err := checkCacheConsistency(n, req.Method == "POST")
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	buf, err := json.Marshal(report)
+	if err != nil {
+		fmt.Fprintf(w, "%s", errors.Wrap(err, "cannot create json result of consistency check"))
+		return
+	}
+	fmt.Fprintf(w, "%s", buf)
+}
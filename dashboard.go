@@ -0,0 +1,305 @@
+package main
+
+import (
+	"crypto/subtle"
+	"embed"
+	"encoding/json"
+	"fmt"
+	errors "github.com/fiverr/go_errors"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	dashboardPath   = "/admin/ui/"
+	dashboardCookie = "admin_token"
+)
+
+//go:embed dashboard/*.html
+var dashboardFiles embed.FS
+
+var dashboardFuncs = template.FuncMap{
+	"join": strings.Join,
+	"rfc3339": func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.Format(time.RFC3339)
+	},
+}
+
+// dashboardTemplates holds a template per page, each rendered inside the shared layout.
+var dashboardTemplates = func() map[string]*template.Template {
+	templates := make(map[string]*template.Template)
+	for _, page := range []string{"login", "books", "book", "activity"} {
+		templates[page] = template.Must(template.New(page).Funcs(dashboardFuncs).
+			ParseFS(dashboardFiles, "dashboard/layout.html", "dashboard/"+page+".html"))
+	}
+	return templates
+}()
+
+// dashboardRow is a book listed on the dashboard.
+type dashboardRow struct {
+	ID   string
+	Book Book
+}
+
+// dashboardData is what the dashboard pages render; each page uses the fields it needs.
+type dashboardData struct {
+	Error   string
+	Message string
+
+	// books page
+	Stats *AggsRes
+	Query string
+	Total int64
+	// TotalAtLeast is set when Total is a lower bound
+	TotalAtLeast bool
+	Books        []dashboardRow
+	Prev         int
+	Next         int
+
+	// book page
+	ID     string
+	Exists bool
+	Book   Book
+
+	// activity page
+	UserID   string
+	Route    string
+	Activity []ActivityEntry
+}
+
+// dashboardAdmin reports whether the request carries the admin token, in the header like the
+// other admin routes or in the cookie set by the dashboard's sign in form.
+func dashboardAdmin(req *http.Request) bool {
+	if isAdmin(req) {
+		return true
+	}
+	cookie, err := req.Cookie(dashboardCookie)
+	return err == nil && config.AdminToken != "" &&
+		subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(config.AdminToken)) == 1
+}
+
+func renderDashboard(w http.ResponseWriter, page string, data dashboardData) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := dashboardTemplates[page].ExecuteTemplate(w, "layout", data); err != nil {
+		fmt.Println(errors.Wrap(err, "cannot render dashboard page "+page))
+	}
+}
+
+// dashboard handles /admin/ui/, a small web UI for catalog staff to search and edit books, view
+// the /store stats and inspect user activity. Pages are server rendered from embedded templates
+// and sign in with the admin token, kept in a cookie.
+func dashboard(w http.ResponseWriter, req *http.Request) {
+	page := strings.Trim(strings.TrimPrefix(req.URL.Path, dashboardPath), "/")
+	if page == "login" {
+		dashboardLogin(w, req)
+		return
+	}
+	if !dashboardAdmin(req) {
+		http.Redirect(w, req, dashboardPath+"login", http.StatusSeeOther)
+		return
+	}
+	switch page {
+	case "":
+		dashboardBooks(w, req)
+	case "book":
+		dashboardBook(w, req)
+	case "activity":
+		dashboardActivity(w, req)
+	case "logout":
+		if req.Method != "POST" {
+			http.Error(w, "Unsupported request for /admin/ui/logout "+req.Method, http.StatusMethodNotAllowed)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: dashboardCookie, Path: dashboardPath, MaxAge: -1})
+		http.Redirect(w, req, dashboardPath+"login", http.StatusSeeOther)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func dashboardLogin(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET":
+		renderDashboard(w, "login", dashboardData{})
+	case "POST":
+		token := req.PostFormValue("token")
+		if config.AdminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(config.AdminToken)) != 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			renderDashboard(w, "login", dashboardData{Error: "invalid admin token"})
+			return
+		}
+		// SameSite keeps other sites from posting edits with the cookie
+		http.SetCookie(w, &http.Cookie{Name: dashboardCookie, Value: token, Path: dashboardPath,
+			HttpOnly: true, Secure: req.TLS != nil, SameSite: http.SameSiteStrictMode})
+		http.Redirect(w, req, dashboardPath, http.StatusSeeOther)
+	default:
+		http.Error(w, "Unsupported request for /admin/ui/login "+req.Method, http.StatusMethodNotAllowed)
+	}
+}
+
+// dashboardBooks shows the store stats and a page of books matching the q param, both of the
+// tenant's catalog.
+func dashboardBooks(w http.ResponseWriter, req *http.Request) {
+	tenant := requestTenant(req)
+	data := dashboardData{Query: strings.TrimSpace(getParamValue(req, "q")), Prev: -1, Next: -1}
+	if stats, err := storeBook(strings.ToUpper(config.ExchangeRates.BaseCurrency), tenant); err != nil {
+		data.Error = err.Error()
+	} else {
+		var parsed AggsRes
+		if err = json.Unmarshal([]byte(stats), &parsed); err == nil {
+			data.Stats = &parsed
+		}
+	}
+	if data.Query != "" {
+		from := 0
+		if cursor := getParamValue(req, "cursor"); cursor != "" {
+			var err error
+			from, err = strconv.Atoi(cursor)
+			if err != nil || from < 0 {
+				err = errors.New("invalid cursor " + cursor)
+			} else {
+				err = checkSearchOffset(from)
+			}
+			if err != nil {
+				data.Error = err.Error()
+				renderDashboard(w, "books", data)
+				return
+			}
+		}
+		hits, err := bookRepo.Search(SearchParams{Query: data.Query, PriceRange: Range{-1, -1}, From: from, Tenant: tenant})
+		if err != nil {
+			data.Error = err.Error()
+		}
+		data.Total = hits.Total
+		data.TotalAtLeast = hits.TotalRelation == totalLowerBound
+		for _, hit := range hits.Hits {
+			book, err := decodeBook(hit.Source)
+			if err != nil {
+				data.Error = err.Error()
+				continue
+			}
+			data.Books = append(data.Books, dashboardRow{ID: hit.ID, Book: book})
+		}
+		if from > 0 {
+			data.Prev = from - config.Search.DefaultPageSize
+			if data.Prev < 0 {
+				data.Prev = 0
+			}
+		}
+		if next := from + len(hits.Hits); int64(next) < hits.Total && checkSearchOffset(next) == nil {
+			data.Next = next
+		}
+	}
+	renderDashboard(w, "books", data)
+}
+
+// bookFromForm validates the book fields of the edit form like the /book PUT params.
+func bookFromForm(req *http.Request) (Book, error) {
+	return bookFromParams(func(name string) string { return sanitizeText(req.PostFormValue(name)) })
+}
+
+// dashboardBook shows the edit form of the id param's book, or an empty one for a new book, and
+// saves or deletes it on POST. Books of another catalog than the tenant's cannot be edited.
+func dashboardBook(w http.ResponseWriter, req *http.Request) {
+	var data dashboardData
+	tenant := requestTenant(req)
+	switch req.Method {
+	case "GET":
+		data.ID = tenantID(tenant, getParamValue(req, "id"))
+		if data.ID == "" {
+			break
+		}
+		if !tenantOwns(tenant, data.ID) {
+			data.Error = "book " + data.ID + " is not in the catalog"
+			break
+		}
+		source, err := bookRepo.Get(data.ID)
+		if err != nil {
+			data.Error = err.Error()
+		} else if source == "" {
+			data.Error = "book " + data.ID + " does not exist"
+		} else if data.Book, err = decodeBook(source); err != nil {
+			data.Error = err.Error()
+		} else {
+			data.Exists = true
+		}
+	case "POST":
+		data.ID = tenantID(tenant, strings.TrimSpace(req.PostFormValue("id")))
+		if data.ID == "" {
+			data.Error = "id is required"
+			break
+		}
+		if !tenantOwns(tenant, data.ID) {
+			data.Error = "book " + data.ID + " is not in the catalog"
+			break
+		}
+		if req.PostFormValue("action") == "delete" {
+			result, err := removeBook(data.ID)
+			if err != nil {
+				data.Error = err.Error()
+				data.Exists = true
+				break
+			}
+			if result == "" {
+				result = "book " + data.ID + " does not exist"
+			}
+			data = dashboardData{Message: result}
+			break
+		}
+		book, err := bookFromForm(req)
+		data.Book = book
+		if err != nil {
+			data.Error = err.Error()
+			break
+		}
+		book.Tenant = tenant
+		book.AuthorID = tenantID(tenant, book.AuthorID)
+		book.WorkID = tenantID(tenant, book.WorkID)
+		result, err := putBook(data.ID, book)
+		if err != nil {
+			data.Error = err.Error()
+			break
+		}
+		data.Message = result
+		data.Exists = true
+	default:
+		http.Error(w, "Unsupported request for /admin/ui/book "+req.Method, http.StatusMethodNotAllowed)
+		return
+	}
+	renderDashboard(w, "book", data)
+}
+
+// dashboardActivity shows a page of the user_id param's activity, optionally for one route.
+func dashboardActivity(w http.ResponseWriter, req *http.Request) {
+	data := dashboardData{UserID: strings.TrimSpace(getParamValue(req, "user_id")), Route: getParamValue(req, "route"), Prev: -1, Next: -1}
+	if data.UserID != "" {
+		limit := int64(config.Activity.DefaultLimit)
+		offset, limit, err := parsePage(req, limit)
+		if err != nil {
+			data.Error = err.Error()
+		} else {
+			var total int64
+			total, data.Activity, err = activities.Page(tenantID(requestTenant(req), data.UserID), ActivityFilter{Route: data.Route}, offset, limit)
+			if err != nil {
+				data.Error = err.Error()
+			}
+			data.Total = total
+			if offset > 0 {
+				data.Prev = int(offset - limit)
+				if data.Prev < 0 {
+					data.Prev = 0
+				}
+			}
+			if offset+int64(len(data.Activity)) < total {
+				data.Next = int(offset + int64(len(data.Activity)))
+			}
+		}
+	}
+	renderDashboard(w, "activity", data)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDashboardStats(t *testing.T) {
+	useMemoryRepository(t)
+	putTestBook(t, "1", Book{Title: "Dune", AuthorName: "Frank Herbert", Price: priceFromFloat(10)})
+	putTestBook(t, "2", Book{Title: "Emma", AuthorName: "Jane Austen", Price: priceFromFloat(20)})
+
+	w := serve(http.HandlerFunc(dashboard), "GET", dashboardPath, map[string]string{adminTokenHdr: testAdminToken})
+	body := w.Body.String()
+	if strings.Contains(body, "unknown currency") {
+		t.Fatalf("dashboard stats failed: %q", body)
+	}
+	for _, want := range []string{"<h1>Store</h1>", "<tr><th>Books</th><td>2</td></tr>", "<td>15 USD</td>"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("dashboard books page lacks %q: %q", want, body)
+		}
+	}
+}
+
+// TestDashboardPages renders every page, since the templates are only parsed, not executed,
+// when the service starts.
+func TestDashboardPages(t *testing.T) {
+	useMemoryRepository(t)
+	savedActivities := activities
+	activities = newMemoryActivityStore()
+	defer func() { activities = savedActivities }()
+	putTestBook(t, "1", Book{Title: "Dune", AuthorName: "Frank Herbert", Price: priceFromFloat(10)})
+	if err := activities.Record("alice", ActivityEntry{Route: "/book", Method: "GET", Time: time.Now().UTC()}); err != nil {
+		t.Fatal(err)
+	}
+
+	admin := map[string]string{adminTokenHdr: testAdminToken}
+	pages := []struct {
+		target string
+		header map[string]string
+		want   string
+	}{
+		{dashboardPath + "login", nil, "<h1>Sign in</h1>"},
+		{dashboardPath + "?q=dune", admin, `<a href="/admin/ui/book?id=1">1</a>`},
+		{dashboardPath + "book?id=1", admin, "Edit book 1"},
+		{dashboardPath + "book", admin, "New book"},
+		{dashboardPath + "activity?user_id=alice", admin, "<td>/book</td>"},
+	}
+	for _, page := range pages {
+		w := serve(http.HandlerFunc(dashboard), "GET", page.target, page.header)
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), page.want) {
+			t.Errorf("GET %s = %d %q, want %q", page.target, w.Code, w.Body.String(), page.want)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	errors "github.com/fiverr/go_errors"
+	"gopkg.in/olivere/elastic.v5"
+	"net/http"
+	"strconv"
+)
+
+// defaultMaxTitleWords is the number of distinct title words above which a title is reported
+// as suspiciously long. Titles are analyzed text, so their length is measured in words.
+const defaultMaxTitleWords = 30
+
+// dataQualityExamples is the number of book ids listed for each issue.
+const dataQualityExamples = 10
+
+// DataQualityIssue is the number of books with a problem, and some of their ids to start with.
+type DataQualityIssue struct {
+	Count    int64    `json:"count"`
+	Examples []string `json:"examples"`
+}
+
+// DataQualityReport counts the books with each catalog data problem.
+type DataQualityReport struct {
+	Total  int64                       `json:"total"`
+	Issues map[string]DataQualityIssue `json:"issues"`
+}
+
+// dataQualityQueries matches the books with each issue. Books with an author_id have their
+// author_name filled in, so only books with neither miss an author. Unset publish dates are
+// stored as year 1, and count like the epoch.
+func dataQualityQueries(maxTitleWords int) map[string]elastic.Query {
+	return map[string]elastic.Query{
+		"missing_author":     elastic.NewBoolQuery().MustNot(elastic.NewExistsQuery("author_name"), elastic.NewExistsQuery("author_id")),
+		"zero_price":         elastic.NewBoolQuery().Should(elastic.NewTermQuery("price", 0), elastic.NewBoolQuery().MustNot(elastic.NewExistsQuery("price"))),
+		"epoch_publish_date": elastic.NewRangeQuery("publish_date").Lte("1970-01-01T00:00:00Z"),
+		"long_title":         elastic.NewScriptQuery(elastic.NewScript("doc['title'].values.size() > params.max").Param("max", maxTitleWords)),
+	}
+}
+
+// dataQuality computes the report on the tenant's catalog with one search, an aggregation per issue.
+func dataQuality(tenant string, maxTitleWords int) (*DataQualityReport, error) {
+	client, ctx, err := connectElasticSearch()
+	if err != nil {
+		return nil, err
+	}
+	service := client.Search().Index(booksIndex()).Query(tenantQuery(tenant)).Size(0)
+	queries := dataQualityQueries(maxTitleWords)
+	for name, query := range queries {
+		examples := elastic.NewTopHitsAggregation().Size(dataQualityExamples).FetchSource(false)
+		service = service.Aggregation(name, elastic.NewFilterAggregation().Filter(query).SubAggregation("examples", examples))
+	}
+	searchResult, err := service.Do(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot aggregate data quality")
+	}
+	report := &DataQualityReport{Total: searchResult.Hits.TotalHits, Issues: make(map[string]DataQualityIssue)}
+	for name := range queries {
+		issue := DataQualityIssue{Examples: make([]string, 0)}
+		if filter, found := searchResult.Aggregations.Filter(name); found {
+			issue.Count = filter.DocCount
+			if examples, found := filter.TopHits("examples"); found && examples.Hits != nil {
+				for _, hit := range examples.Hits.Hits {
+					issue.Examples = append(issue.Examples, hit.Id)
+				}
+			}
+		}
+		report.Issues[name] = issue
+	}
+	return report, nil
+}
+
+// adminDataQuality handles GET /admin/data-quality, counts of books with missing authors, zero
+// prices, epoch publish dates or titles longer than the max_title_words param, to drive catalog
+// cleanup.
+func adminDataQuality(w http.ResponseWriter, req *http.Request) {
+	if !requireElasticsearch(w, req) {
+		return
+	}
+	if !isAdmin(req) {
+		http.Error(w, "admin token required", http.StatusUnauthorized)
+		return
+	}
+	if req.Method != "GET" {
+		msg := "Unsupported request for /admin/data-quality " + req.Method
+		fmt.Fprintf(w, "%s", errors.New(msg))
+		return
+	}
+	maxTitleWords := defaultMaxTitleWords
+	if value := getParamValue(req, "max_title_words"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			fmt.Fprintf(w, "%s", errors.New("max_title_words must be a positive integer"))
+			return
+		}
+		maxTitleWords = n
+	}
+	report, err := dataQuality(requestTenant(req), maxTitleWords)
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	buf, err := json.Marshal(report)
+	if err != nil {
+		fmt.Fprintf(w, "%s", errors.Wrap(err, "cannot create json result of data quality"))
+		return
+	}
+	fmt.Fprintf(w, "%s", buf)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	errors "github.com/fiverr/go_errors"
+	"net/http"
+	"time"
+)
+
+// pendingWrite marks a write that is still being processed by the first request.
+const pendingWrite = "\x00pending"
+
+// writeFingerprint hashes everything that makes a write request distinct for a user.
+func writeFingerprint(userID string, req *http.Request) string {
+	sum := sha256.Sum256([]byte(userID + "\n" + req.Method + "\n" + req.URL.Path + "\n" + req.URL.Query().Encode()))
+	return hex.EncodeToString(sum[:])
+}
+
+// dedupEnabled reports whether duplicate detection applies to the given user key.
+func dedupEnabled(userID string) bool {
+	if userID == "" || !config.Dedup.Enabled {
+		return false
+	}
+	for _, key := range config.Dedup.OptOut {
+		if key == userID {
+			return false
+		}
+	}
+	return true
+}
+
+// claimWrite records the write in Redis for the dedup window. When an identical write from the
+// same user is already recorded it returns the earlier response and duplicate set to true.
+func claimWrite(userID string, req *http.Request) (string, bool, error) {
+	client, err := connectRedis()
+	if err != nil {
+		return "", false, errors.Wrap(err, "cannot connect to Redis")
+	}
+	defer client.Close()
+	key := "dedup:" + userID + ":" + writeFingerprint(userID, req)
+	window := parseDuration(config.Dedup.Window, 5*time.Second)
+	claimed, err := client.SetNX(key, pendingWrite, window).Result()
+	if err != nil {
+		return "", false, errors.Wrap(err, "cannot set key in Redis")
+	}
+	if claimed {
+		return "", false, nil
+	}
+	previous, err := client.Get(key).Result()
+	if err != nil {
+		// the window expired between the two calls, so this is not a duplicate anymore
+		return "", false, nil
+	}
+	if previous == pendingWrite {
+		return "duplicate request is still being processed", true, nil
+	}
+	return previous, true, nil
+}
+
+// completeWrite stores the response of a claimed write so duplicates can replay it.
+func completeWrite(userID string, req *http.Request, result string) error {
+	client, err := connectRedis()
+	if err != nil {
+		return errors.Wrap(err, "cannot connect to Redis")
+	}
+	defer client.Close()
+	key := "dedup:" + userID + ":" + writeFingerprint(userID, req)
+	window := parseDuration(config.Dedup.Window, 5*time.Second)
+	if err = client.Set(key, result, window).Err(); err != nil {
+		return errors.Wrap(err, "cannot set key in Redis")
+	}
+	return nil
+}
+
+// releaseWrite forgets a claimed write that failed, so the client can retry it right away.
+func releaseWrite(userID string, req *http.Request) error {
+	client, err := connectRedis()
+	if err != nil {
+		return errors.Wrap(err, "cannot connect to Redis")
+	}
+	defer client.Close()
+	if err = client.Del("dedup:" + userID + ":" + writeFingerprint(userID, req)).Err(); err != nil {
+		return errors.Wrap(err, "cannot delete key in Redis")
+	}
+	return nil
+}
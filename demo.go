@@ -0,0 +1,27 @@
+package main
+
+import "fmt"
+
+// demoSyntheticBooks is the number of synthetic books added to the sample ones in demo mode,
+// unless -seed-synthetic is set.
+const demoSyntheticBooks = 200
+
+// demoMode runs the service on in-process backends with a prepopulated catalog, needing neither
+// Elasticsearch nor Redis, for workshops and local frontend development. Features kept in Redis,
+// such as discounts, exchange rates, caching and usage stats, are off, and nothing is persisted.
+var demoMode bool
+
+// demoConfig switches config to the in-process backends.
+func demoConfig(c Config) Config {
+	c.Books.Backend = "memory"
+	c.Activity.Backend = "memory"
+	c.Storage.Backend = "local"
+	c.Bulk.Enabled = false
+	c.CachePolicies = nil
+	if c.AdminToken == "" {
+		// lets the admin routes and dashboard be tried out
+		c.AdminToken = "demo"
+		fmt.Println("demo mode: admin token is \"demo\"")
+	}
+	return c
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	errors "github.com/fiverr/go_errors"
+	"gopkg.in/olivere/elastic.v5"
+	"net/http"
+	"net/url"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DiagnosticsReport summarizes the service setup for support triage.
+type DiagnosticsReport struct {
+	GeneratedAt  time.Time              `json:"generated_at"`
+	GoVersion    string                 `json:"go_version"`
+	Dependencies map[string]string      `json:"dependencies"`
+	Config       Config                 `json:"config"`
+	Backends     map[string]string      `json:"backends"`
+	Dialect      esDialect              `json:"dialect"`
+	Indices      map[string]IndexStatus `json:"indices"`
+	Features     map[string]bool        `json:"features"`
+	// MappingDrift is set when the books index exists, see checkMappingDrift
+	MappingDrift *MappingDrift `json:"mapping_drift,omitempty"`
+}
+
+// IndexStatus reports whether an index exists and which fields its mapping declares.
+type IndexStatus struct {
+	Exists bool     `json:"exists"`
+	Fields []string `json:"fields,omitempty"`
+	Error  string   `json:"error,omitempty"`
+}
+
+const redacted = "[redacted]"
+
+var (
+	diagnosticsMu     sync.Mutex
+	diagnosticsReport *DiagnosticsReport
+)
+
+// redactConfig returns a copy of the config that is safe to show, without secrets.
+func redactConfig(c Config) Config {
+	if c.AdminToken != "" {
+		c.AdminToken = redacted
+	}
+	if c.GoogleBooks.APIKey != "" {
+		c.GoogleBooks.APIKey = redacted
+	}
+	if c.Elasticsearch.Password != "" {
+		c.Elasticsearch.Password = redacted
+	}
+	if c.Elasticsearch.APIKey != "" {
+		c.Elasticsearch.APIKey = redacted
+	}
+	if c.Redis.Password != "" {
+		c.Redis.Password = redacted
+	}
+	if c.Books.PostgresURL != "" {
+		c.Books.PostgresURL = redactURLPassword(c.Books.PostgresURL)
+	}
+	return c
+}
+
+// redactURLPassword masks the password in the userinfo of the URL. Values that do not parse as
+// a URL, such as key=value connection strings, are redacted whole.
+func redactURLPassword(value string) string {
+	u, err := url.Parse(value)
+	if err != nil || u.Scheme == "" {
+		return redacted
+	}
+	return u.Redacted()
+}
+
+// buildDiagnostics collects the diagnostics report, probing Elasticsearch and Redis.
+func buildDiagnostics() *DiagnosticsReport {
+	report := &DiagnosticsReport{
+		GeneratedAt:  time.Now().UTC(),
+		GoVersion:    runtime.Version(),
+		Dependencies: make(map[string]string),
+		Config:       redactConfig(config),
+		Backends:     make(map[string]string),
+		Dialect:      dialect,
+		Indices:      make(map[string]IndexStatus),
+		Features: map[string]bool{
+			"dedup":              config.Dedup.Enabled,
+			"assets_origin_mode": config.Assets.OriginMode,
+			"admin_token":        config.AdminToken != "",
+		},
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, dep := range info.Deps {
+			report.Dependencies[dep.Path] = dep.Version
+		}
+	}
+
+	client, ctx, err := connectElasticSearch()
+	if err != nil {
+		report.Backends["elasticsearch"] = "unavailable: " + err.Error()
+	} else {
+		// with several nodes each is reported, so an outage shows before the failover runs out
+		nodes := config.Elasticsearch.nodes()
+		for _, url := range nodes {
+			name := "elasticsearch"
+			if len(nodes) > 1 {
+				name += " " + url
+			}
+			version, err := client.ElasticsearchVersion(url)
+			if err != nil {
+				report.Backends[name] = "unavailable: " + err.Error()
+			} else {
+				report.Backends[name] = version
+			}
+		}
+		for _, index := range []string{booksIndex(), ALERTS_INDEX} {
+			status := IndexStatus{}
+			status.Exists, err = client.IndexExists(index).Do(ctx)
+			if err != nil {
+				status.Error = err.Error()
+			} else if status.Exists {
+				status.Fields, err = mappingFields(client, ctx, index)
+				if err != nil {
+					status.Error = err.Error()
+				} else if index == booksIndex() {
+					drift, err := mappingDrift(status.Fields)
+					if err != nil {
+						status.Error = err.Error()
+					} else {
+						report.MappingDrift = &drift
+					}
+				}
+			}
+			report.Indices[index] = status
+		}
+	}
+
+	redisClient, err := connectRedis()
+	if err != nil {
+		report.Backends["redis"] = "unavailable: " + err.Error()
+	} else {
+		defer redisClient.Close()
+		report.Backends["redis"] = "unknown version"
+		info, err := redisClient.Info("server").Result()
+		if err == nil {
+			for _, line := range strings.Split(info, "\n") {
+				if strings.HasPrefix(line, "redis_version:") {
+					report.Backends["redis"] = strings.TrimSpace(strings.TrimPrefix(line, "redis_version:"))
+				}
+			}
+		}
+	}
+	return report
+}
+
+// logDiagnostics prints a console banner with the startup diagnostics report, once, and returns
+// the report.
+func logDiagnostics() *DiagnosticsReport {
+	report := buildDiagnostics()
+	diagnosticsMu.Lock()
+	diagnosticsReport = report
+	diagnosticsMu.Unlock()
+	buf, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		fmt.Println(errors.Wrap(err, "cannot create json diagnostics report"))
+		return report
+	}
+	fmt.Println("==== book_service startup diagnostics ====")
+	for name, status := range report.Backends {
+		fmt.Printf("%-14s %s\n", name, status)
+	}
+	fmt.Printf("%s\n", buf)
+	fmt.Println("==========================================")
+	return report
+}
+
+// diagnostics serves the startup report; refresh=true collects a fresh one.
+func diagnostics(w http.ResponseWriter, req *http.Request) {
+	if !isAdmin(req) {
+		http.Error(w, "admin token required", http.StatusUnauthorized)
+		return
+	}
+	if req.Method != "GET" {
+		msg := "Unsupported request for /admin/diagnostics " + req.Method
+		fmt.Fprintf(w, "%s", errors.New(msg))
+		return
+	}
+	diagnosticsMu.Lock()
+	report := diagnosticsReport
+	diagnosticsMu.Unlock()
+	if report == nil || getParamValue(req, "refresh") == "true" {
+		report = buildDiagnostics()
+	}
+	buf, err := json.Marshal(report)
+	if err != nil {
+		fmt.Fprintf(w, "%s", errors.Wrap(err, "cannot create json diagnostics report"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "%s", buf)
+}
+
+// mappingFields lists the top-level fields declared in the mapping of an index, as "name:type".
+func mappingFields(client *elastic.Client, ctx context.Context, index string) ([]string, error) {
+	res, err := client.GetMapping().Index(index).Do(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot get mapping of "+index)
+	}
+	fields := make([]string, 0)
+	for _, indexMapping := range res {
+		m, _ := indexMapping.(map[string]interface{})
+		mappings, _ := m["mappings"].(map[string]interface{})
+		for _, typeMapping := range mappings {
+			t, _ := typeMapping.(map[string]interface{})
+			properties, _ := t["properties"].(map[string]interface{})
+			for name, property := range properties {
+				p, _ := property.(map[string]interface{})
+				fieldType, _ := p["type"].(string)
+				fields = append(fields, name+":"+fieldType)
+			}
+		}
+	}
+	sort.Strings(fields)
+	return fields, nil
+}
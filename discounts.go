@@ -0,0 +1,319 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	errors "github.com/fiverr/go_errors"
+	"gopkg.in/redis.v5"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// discountsKey is a hash of discount id to its JSON rule.
+const discountsKey = "discounts"
+
+// Discount is a price reduction applied when books are returned. Discounts without a code apply
+// automatically, the others only when their coupon code is passed with ?coupon=.
+type Discount struct {
+	ID string `json:"id"`
+	// Type is "percentage", with Value the percent off, or "fixed", with Value the amount off in
+	// the book's currency
+	Type  string `json:"type"`
+	Value Price  `json:"value"`
+	// Scope is "all", "book", "author" or "genre"; Target is the book id, author name or genre
+	Scope     string    `json:"scope"`
+	Target    string    `json:"target,omitempty"`
+	Code      string    `json:"code,omitempty"`
+	ValidFrom time.Time `json:"valid_from"`
+	ValidTo   time.Time `json:"valid_to"`
+}
+
+var discountScopes = map[string]bool{"all": true, "book": true, "author": true, "genre": true}
+
+// parseDiscount reads a discount rule from the request params.
+func parseDiscount(req *http.Request) (Discount, error) {
+	d := Discount{
+		ID:     getParamValue(req, "id"),
+		Type:   getParamValue(req, "type"),
+		Scope:  getParamValue(req, "scope"),
+		Target: getParamValue(req, "target"),
+		Code:   strings.ToUpper(getParamValue(req, "code")),
+	}
+	if d.ID == "" {
+		return d, errors.New("id is required")
+	}
+	var err error
+	if d.Value, err = parsePrice(getParamValue(req, "value")); err != nil {
+		return d, err
+	}
+	if d.Type != "percentage" && d.Type != "fixed" {
+		return d, errors.New("type must be percentage or fixed")
+	}
+	if d.Type == "percentage" && (d.Value <= 0 || d.Value > 100*100) {
+		return d, errors.New("a percentage discount must be between 0 and 100")
+	}
+	if d.Scope == "" {
+		d.Scope = "all"
+	}
+	if !discountScopes[d.Scope] {
+		return d, errors.New("scope must be all, book, author or genre")
+	}
+	if d.Scope != "all" && d.Target == "" {
+		return d, errors.New("target is required for scope " + d.Scope)
+	}
+	for param, t := range map[string]*time.Time{"valid_from": &d.ValidFrom, "valid_to": &d.ValidTo} {
+		if value := getParamValue(req, param); value != "" {
+			if *t, err = time.Parse(time.RFC3339, value); err != nil {
+				return d, errors.Wrap(err, "conversion from string to time for field "+param+" failed")
+			}
+		}
+	}
+	if !d.ValidTo.IsZero() && d.ValidTo.Before(d.ValidFrom) {
+		return d, errors.New("valid_to must be after valid_from")
+	}
+	return d, nil
+}
+
+// active reports whether the discount is valid at t.
+func (d Discount) active(t time.Time) bool {
+	return !t.Before(d.ValidFrom) && (d.ValidTo.IsZero() || t.Before(d.ValidTo))
+}
+
+// appliesTo reports whether the discount covers the book.
+func (d Discount) appliesTo(id string, doc map[string]interface{}) bool {
+	switch d.Scope {
+	case "book":
+		return d.Target == id
+	case "author":
+		name, _ := doc["author_name"].(string)
+		return strings.EqualFold(d.Target, name)
+	case "genre":
+		genre, _ := doc["genre"].(string)
+		return strings.EqualFold(d.Target, genre)
+	}
+	return true
+}
+
+// apply returns the price after the discount, never below zero.
+func (d Discount) apply(price Price) Price {
+	if d.Type == "percentage" {
+		price = price - priceFromFloat(price.Float()*d.Value.Float()/100)
+	} else {
+		price = price - d.Value
+	}
+	if price < 0 {
+		return 0
+	}
+	return price
+}
+
+func loadDiscounts(client *redis.Client) ([]Discount, error) {
+	values, err := client.HGetAll(discountsKey).Result()
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot get key from Redis")
+	}
+	discounts := make([]Discount, 0, len(values))
+	for _, value := range values {
+		var d Discount
+		if err = json.Unmarshal([]byte(value), &d); err != nil {
+			continue
+		}
+		discounts = append(discounts, d)
+	}
+	sort.Slice(discounts, func(i, j int) bool { return discounts[i].ID < discounts[j].ID })
+	return discounts, nil
+}
+
+// activeDiscounts returns the automatic discounts valid now, plus the one with the coupon code.
+// Demo mode has no discounts.
+func activeDiscounts(coupon string) ([]Discount, error) {
+	if demoMode {
+		return nil, nil
+	}
+	client, err := connectRedis()
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot connect to Redis")
+	}
+	defer client.Close()
+	discounts, err := loadDiscounts(client)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	active := make([]Discount, 0, len(discounts))
+	for _, d := range discounts {
+		if d.active(now) && (d.Code == "" || strings.EqualFold(d.Code, coupon)) {
+			active = append(active, d)
+		}
+	}
+	return active, nil
+}
+
+// bestDiscount returns the lowest price the discounts give the book, and the id of that discount,
+// or the price itself and an empty id when none applies.
+func bestDiscount(id string, doc map[string]interface{}, price Price, discounts []Discount) (Price, string) {
+	best, bestID := price, ""
+	for _, d := range discounts {
+		if d.appliesTo(id, doc) {
+			if discounted := d.apply(price); discounted < best {
+				best, bestID = discounted, d.ID
+			}
+		}
+	}
+	return best, bestID
+}
+
+// applyDiscounts adds the best discounted price among the discounts to a book source. Discounts
+// do not stack.
+func applyDiscounts(id string, source string, discounts []Discount) (string, error) {
+	if len(discounts) == 0 {
+		return source, nil
+	}
+	var book Book
+	doc := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(source), &doc); err != nil {
+		return "", errors.Wrap(err, "cannot decode book for discounts")
+	}
+	if err := json.Unmarshal([]byte(source), &book); err != nil {
+		return "", errors.Wrap(err, "cannot decode book for discounts")
+	}
+	best, bestID := bestDiscount(id, doc, book.Price, discounts)
+	if bestID == "" {
+		return source, nil
+	}
+	doc["discounted_price"] = best
+	doc["discount_id"] = bestID
+	buf, err := json.Marshal(doc)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot encode book with discounts")
+	}
+	return string(buf), nil
+}
+
+// adminDiscounts handles /admin/discounts: GET lists the rules, PUT creates or replaces one and
+// DELETE ?id= removes one.
+func adminDiscounts(w http.ResponseWriter, req *http.Request) {
+	if !isAdmin(req) {
+		http.Error(w, "admin token required", http.StatusUnauthorized)
+		return
+	}
+	var err error
+	var result string
+	client, err := connectRedis()
+	if err != nil {
+		err = errors.Wrap(err, "cannot connect to Redis")
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	defer client.Close()
+	switch req.Method {
+	case "GET":
+		var discounts []Discount
+		discounts, err = loadDiscounts(client)
+		if err == nil {
+			var buf []byte
+			buf, err = json.Marshal(discounts)
+			result = string(buf)
+		}
+	case "PUT":
+		var d Discount
+		d, err = parseDiscount(req)
+		if err != nil {
+			break
+		}
+		var buf []byte
+		if buf, err = json.Marshal(d); err != nil {
+			err = errors.Wrap(err, "cannot create json discount")
+			break
+		}
+		if err = client.HSet(discountsKey, d.ID, string(buf)).Err(); err != nil {
+			err = errors.Wrap(err, "cannot set key in Redis")
+			break
+		}
+		result = fmt.Sprintf("Saved discount %s\n", d.ID)
+	case "DELETE":
+		id := getParamValue(req, "id")
+		if err = client.HDel(discountsKey, id).Err(); err != nil {
+			err = errors.Wrap(err, "cannot delete key in Redis")
+			break
+		}
+		result = fmt.Sprintf("Deleted discount %s\n", id)
+	default:
+		msg := "Unsupported request for /admin/discounts " + req.Method
+		err = errors.New(msg)
+	}
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+	} else {
+		fmt.Fprintf(w, "%s", result)
+	}
+}
+
+// coupons handles GET /coupons/{code}?book_id=, telling whether the coupon is valid now and,
+// with a book, the price after it.
+func coupons(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		msg := "Unsupported request for /coupons " + req.Method
+		fmt.Fprintf(w, "%s", errors.New(msg))
+		return
+	}
+	code := strings.ToUpper(strings.Trim(strings.TrimPrefix(req.URL.Path, "/coupons/"), "/"))
+	if code == "" {
+		http.NotFound(w, req)
+		return
+	}
+	client, err := connectRedis()
+	if err != nil {
+		fmt.Fprintf(w, "%s", errors.Wrap(err, "cannot connect to Redis"))
+		return
+	}
+	discounts, err := loadDiscounts(client)
+	client.Close()
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	var coupon *Discount
+	for i := range discounts {
+		if discounts[i].Code == code {
+			coupon = &discounts[i]
+		}
+	}
+	response := map[string]interface{}{"code": code, "valid": coupon != nil && coupon.active(time.Now())}
+	if coupon != nil {
+		response["discount"] = coupon
+	}
+	if bookID := tenantParam(req, "book_id"); bookID != "" && response["valid"] == true {
+		source, err := getBook(bookID, "", "")
+		if err != nil {
+			fmt.Fprintf(w, "%s", err)
+			return
+		}
+		if source == "" {
+			http.NotFound(w, req)
+			return
+		}
+		var book Book
+		doc := make(map[string]interface{})
+		if err = json.Unmarshal([]byte(source), &doc); err == nil {
+			err = json.Unmarshal([]byte(source), &book)
+		}
+		if err != nil {
+			fmt.Fprintf(w, "%s", errors.Wrap(err, "cannot decode the book"))
+			return
+		}
+		response["applies"] = coupon.appliesTo(bookID, doc)
+		response["price"] = book.Price
+		if response["applies"] == true {
+			response["discounted_price"] = coupon.apply(book.Price)
+		}
+	}
+	buf, err := json.Marshal(response)
+	if err != nil {
+		fmt.Fprintf(w, "%s", errors.Wrap(err, "cannot create json result of coupon"))
+		return
+	}
+	fmt.Fprintf(w, "%s", buf)
+}
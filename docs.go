@@ -0,0 +1,54 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	errors "github.com/fiverr/go_errors"
+	"net/http"
+)
+
+// openAPISpec is the OpenAPI 3 document of the HTTP API. Keep it in sync when adding or changing
+// routes or params.
+//
+//go:embed api/openapi.yaml
+var openAPISpec []byte
+
+// swaggerUI loads Swagger UI from a CDN and points it at the spec served next to it.
+const swaggerUI = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Book service API</title>
+<link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+<div id="swagger-ui"></div>
+<script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+<script>
+window.onload = function() {
+	SwaggerUIBundle({url: "/docs/openapi.yaml", dom_id: "#swagger-ui"});
+};
+</script>
+</body>
+</html>
+`
+
+// docs handles /docs with Swagger UI and /docs/openapi.yaml with the spec, so integrators can
+// explore the API and generate clients.
+func docs(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		msg := "Unsupported request for /docs " + req.Method
+		fmt.Fprintf(w, "%s", errors.New(msg))
+		return
+	}
+	switch req.URL.Path {
+	case "/docs", "/docs/":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, swaggerUI)
+	case "/docs/openapi.yaml":
+		w.Header().Set("Content-Type", "application/yaml")
+		w.Write(openAPISpec)
+	default:
+		http.NotFound(w, req)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	errors "github.com/fiverr/go_errors"
+	"sort"
+	"strings"
+)
+
+// MappingDrift lists how the live books mapping differs from the mapping the code expects.
+// Unexpected fields are only reported, as extra fields do not break anything.
+type MappingDrift struct {
+	Missing    []string `json:"missing,omitempty"`
+	Mismatched []string `json:"mismatched,omitempty"`
+	Unexpected []string `json:"unexpected,omitempty"`
+}
+
+// Drifted reports whether fields the code relies on are missing or typed differently.
+func (d MappingDrift) Drifted() bool {
+	return len(d.Missing) > 0 || len(d.Mismatched) > 0
+}
+
+func (d MappingDrift) String() string {
+	problems := make([]string, 0, 2)
+	if len(d.Missing) > 0 {
+		problems = append(problems, "missing "+strings.Join(d.Missing, ", "))
+	}
+	if len(d.Mismatched) > 0 {
+		problems = append(problems, "mismatched "+strings.Join(d.Mismatched, ", "))
+	}
+	return strings.Join(problems, "; ")
+}
+
+// expectedMappingTypes returns the field types declared by the mapping of the code, by name.
+func expectedMappingTypes() (map[string]string, error) {
+	var expected struct {
+		Mappings map[string]struct {
+			Properties map[string]struct {
+				Type string `json:"type"`
+			} `json:"properties"`
+		} `json:"mappings"`
+	}
+	if err := json.Unmarshal([]byte(mapping), &expected); err != nil {
+		return nil, errors.Wrap(err, "cannot parse the expected mapping")
+	}
+	types := make(map[string]string)
+	for _, typeMapping := range expected.Mappings {
+		for name, property := range typeMapping.Properties {
+			types[name] = property.Type
+		}
+	}
+	return types, nil
+}
+
+// mappingDrift compares the live fields, as listed by mappingFields, with the expected mapping.
+func mappingDrift(fields []string) (MappingDrift, error) {
+	var drift MappingDrift
+	expected, err := expectedMappingTypes()
+	if err != nil {
+		return drift, err
+	}
+	live := make(map[string]string)
+	for _, field := range fields {
+		if i := strings.LastIndex(field, ":"); i >= 0 {
+			live[field[:i]] = field[i+1:]
+		}
+	}
+	for name, fieldType := range expected {
+		found, ok := live[name]
+		switch {
+		case !ok:
+			drift.Missing = append(drift.Missing, name)
+		case found != fieldType:
+			drift.Mismatched = append(drift.Mismatched, fmt.Sprintf("%s (expected %s, found %s)", name, fieldType, found))
+		}
+	}
+	for name := range live {
+		if _, ok := expected[name]; !ok {
+			drift.Unexpected = append(drift.Unexpected, name)
+		}
+	}
+	sort.Strings(drift.Missing)
+	sort.Strings(drift.Mismatched)
+	sort.Strings(drift.Unexpected)
+	return drift, nil
+}
+
+// checkMappingDrift compares the live books mapping with the expected one on startup, from the
+// diagnostics report. Drift is logged, and returned as an error in strict mode so the service
+// refuses to start on a mapping it would misread.
+func checkMappingDrift(report *DiagnosticsReport) error {
+	if report == nil || report.MappingDrift == nil || !report.MappingDrift.Drifted() {
+		return nil
+	}
+	msg := "mapping of " + booksIndex() + " drifted from the expected mapping: " + report.MappingDrift.String()
+	if config.Elasticsearch.StrictMapping {
+		return errors.New(msg + ", migrate the index or turn strict_mapping off to start")
+	}
+	fmt.Println("WARNING: " + msg)
+	return nil
+}
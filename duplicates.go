@@ -0,0 +1,124 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// duplicateModes are the strictness levels of duplicate detection: "off" skips it, "warn" lists
+// the candidates in the X-Duplicate-Candidates header and "reject" refuses the new book.
+var duplicateModes = []string{"off", "warn", "reject"}
+
+func knownDuplicateMode(mode string) bool {
+	for _, m := range duplicateModes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// duplicateKey reduces a title or author name to lower case words without punctuation.
+func duplicateKey(value string) string {
+	return strings.Join(strings.FieldsFunc(strings.ToLower(value), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}), " ")
+}
+
+// editDistance is the Levenshtein distance between a and b, in runes.
+func editDistance(a, b []rune) int {
+	row := make([]int, len(b)+1)
+	for j := range row {
+		row[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		diagonal := row[0]
+		row[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			next := row[j-1] + 1
+			if row[j]+1 < next {
+				next = row[j] + 1
+			}
+			if diagonal+cost < next {
+				next = diagonal + cost
+			}
+			diagonal, row[j] = row[j], next
+		}
+	}
+	return row[len(b)]
+}
+
+// similarity scores how alike two keys are, from 0 to 1 for identical ones.
+func similarity(a, b string) float64 {
+	ra, rb := []rune(a), []rune(b)
+	longest := len(ra)
+	if len(rb) > longest {
+		longest = len(rb)
+	}
+	if longest == 0 {
+		return 1
+	}
+	return 1 - float64(editDistance(ra, rb))/float64(longest)
+}
+
+// findDuplicates returns the ids of books whose title and author are both at least as similar
+// to the new book's as the configured similarity. Books already stored under id are not new, so
+// nothing is returned for them.
+func findDuplicates(id string, book Book) ([]string, error) {
+	if book.Title == "" {
+		return nil, nil
+	}
+	exists, err := bookRepo.Exists(id)
+	if err != nil || exists {
+		return nil, err
+	}
+	hits, err := bookRepo.Search(SearchParams{Title: book.Title, AuthorName: book.AuthorName, PriceRange: Range{-1, -1}, Tenant: book.Tenant})
+	if err != nil {
+		return nil, err
+	}
+	title, author := duplicateKey(book.Title), duplicateKey(book.AuthorName)
+	var candidates []string
+	for _, hit := range hits.Hits {
+		if hit.ID == id {
+			continue
+		}
+		other, err := decodeBook(hit.Source)
+		if err != nil {
+			return nil, err
+		}
+		minimum := config.Validation.Duplicates.Similarity
+		if similarity(title, duplicateKey(other.Title)) >= minimum &&
+			(author == "" || similarity(author, duplicateKey(other.AuthorName)) >= minimum) {
+			candidates = append(candidates, hit.ID)
+		}
+	}
+	return candidates, nil
+}
+
+// checkDuplicates runs duplicate detection for a new book in mode, or the configured mode when
+// empty. The candidate ids are returned in every mode but "off"; in "reject" mode they also
+// fail the write with a *ValidationError.
+func checkDuplicates(id string, book Book, mode string) ([]string, error) {
+	if mode == "" {
+		mode = config.Validation.Duplicates.Mode
+	}
+	if !knownDuplicateMode(mode) {
+		var verr ValidationError
+		verr.Add("duplicates", "must be one of "+strings.Join(duplicateModes, ", "))
+		return nil, verr.Err()
+	}
+	if mode == "off" {
+		return nil, nil
+	}
+	candidates, err := findDuplicates(id, book)
+	if err != nil || len(candidates) == 0 || mode != "reject" {
+		return candidates, err
+	}
+	var verr ValidationError
+	verr.Add("title", "duplicates existing books "+strings.Join(candidates, ", "))
+	return candidates, verr.Err()
+}
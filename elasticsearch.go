@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	errors "github.com/fiverr/go_errors"
+	"io/ioutil"
+	"net/http"
+)
+
+// esAuthTransport authenticates every request to the cluster with basic auth or an API key.
+type esAuthTransport struct {
+	next     http.RoundTripper
+	username string
+	password string
+	apiKey   string
+}
+
+func (t esAuthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// clone before modifying, as required from a RoundTripper
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header, len(req.Header)+1)
+	for name, values := range req.Header {
+		r.Header[name] = values
+	}
+	if t.apiKey != "" {
+		r.Header.Set("Authorization", "ApiKey "+t.apiKey)
+	} else {
+		r.SetBasicAuth(t.username, t.password)
+	}
+	return t.next.RoundTrip(r)
+}
+
+// loadTLSConfig builds a TLS config verifying servers against the PEM bundle at caCert, or the
+// system roots when empty, and presenting the clientCert and clientKey pair when set.
+func loadTLSConfig(caCert string, clientCert string, clientKey string, insecureSkipVerify bool) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: insecureSkipVerify}
+	if caCert != "" {
+		pem, err := ioutil.ReadFile(caCert)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot read CA certificate")
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + caCert)
+		}
+	}
+	if clientCert != "" || clientKey != "" {
+		cert, err := tls.LoadX509KeyPair(clientCert, clientKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot load client certificate")
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// newElasticsearchHTTPClient builds the HTTP client of the cluster from config: TLS verified
+// against CACert when set, credentials added to each request and newer clusters bridged by
+// compatTransport.
+func newElasticsearchHTTPClient(c ElasticsearchConfig) (*http.Client, error) {
+	tlsConfig, err := loadTLSConfig(c.CACert, c.ClientCert, c.ClientKey, c.InsecureSkipVerify)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot configure elastic search TLS")
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	var next http.RoundTripper = transport
+	if c.APIKey != "" || c.Username != "" {
+		next = esAuthTransport{next: next, username: c.Username, password: c.Password, apiKey: c.APIKey}
+	}
+	return &http.Client{Transport: compatTransport{next}}, nil
+}
+
+// nodes returns the URLs of the configured nodes, URLs when set and URL otherwise.
+func (c ElasticsearchConfig) nodes() []string {
+	if len(c.URLs) > 0 {
+		return c.URLs
+	}
+	return []string{c.URL}
+}
+
+// booksIndex is the index, or alias of the index, books are read from and written to. Naming it
+// per environment lets staging and production share a cluster.
+func booksIndex() string {
+	return config.Elasticsearch.Index
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	errors "github.com/fiverr/go_errors"
+	"gopkg.in/redis.v5"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const googleBooksCacheTTL = 24 * time.Hour
+
+// googleVolumes is the part of the Google Books volumes response we use.
+type googleVolumes struct {
+	TotalItems int `json:"totalItems"`
+	Items      []struct {
+		VolumeInfo struct {
+			Title         string   `json:"title"`
+			Authors       []string `json:"authors"`
+			PublishedDate string   `json:"publishedDate"`
+			Description   string   `json:"description"`
+			ImageLinks    struct {
+				Thumbnail string `json:"thumbnail"`
+			} `json:"imageLinks"`
+		} `json:"volumeInfo"`
+	} `json:"items"`
+}
+
+var googleBooksClient = &http.Client{Timeout: 10 * time.Second}
+
+// allowGoogleBooksCall enforces the per-minute rate limit on Google Books API calls across instances.
+func allowGoogleBooksCall(client *redis.Client) (bool, error) {
+	key := "google_books:rate:" + time.Now().UTC().Format("200601021504")
+	count, err := client.Incr(key).Result()
+	if err != nil {
+		return false, errors.Wrap(err, "cannot increment rate limit counter in Redis")
+	}
+	client.Expire(key, 2*time.Minute)
+	return count <= int64(config.GoogleBooks.RateLimitPerMinute), nil
+}
+
+// fetchGoogleVolumes queries Google Books by ISBN, caching responses in Redis.
+func fetchGoogleVolumes(client *redis.Client, isbn string) (*googleVolumes, error) {
+	cacheKey := "google_books:isbn:" + isbn
+	body, err := client.Get(cacheKey).Bytes()
+	if err != nil {
+		allowed, err := allowGoogleBooksCall(client)
+		if err != nil {
+			return nil, err
+		}
+		if !allowed {
+			return nil, errors.New("Google Books rate limit reached, retry in a minute")
+		}
+		params := url.Values{"q": {"isbn:" + isbn}}
+		if config.GoogleBooks.APIKey != "" {
+			params.Set("key", config.GoogleBooks.APIKey)
+		}
+		resp, err := googleBooksClient.Get(config.GoogleBooks.URL + "?" + params.Encode())
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot query Google Books")
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, errors.New("Google Books returned " + resp.Status)
+		}
+		body, err = ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot read Google Books response")
+		}
+		client.Set(cacheKey, body, googleBooksCacheTTL)
+	}
+	var volumes googleVolumes
+	if err = json.Unmarshal(body, &volumes); err != nil {
+		return nil, errors.Wrap(err, "cannot decode Google Books response")
+	}
+	return &volumes, nil
+}
+
+// parseGoogleDate parses the publishedDate formats used by Google Books: 2004, 2004-05 or 2004-05-01.
+func parseGoogleDate(value string) (time.Time, bool) {
+	for _, layout := range []string{"2006-01-02", "2006-01", "2006"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// enrichBook fills in the fields missing from book with the Google Books volume info.
+func enrichBook(book *Book, volumes *googleVolumes) {
+	if len(volumes.Items) == 0 {
+		return
+	}
+	info := volumes.Items[0].VolumeInfo
+	if book.Title == "" {
+		book.Title = info.Title
+	}
+	if book.AuthorName == "" && len(info.Authors) > 0 {
+		book.AuthorName = strings.Join(info.Authors, ", ")
+	}
+	if book.PublishDate.IsZero() {
+		if t, ok := parseGoogleDate(info.PublishedDate); ok {
+			book.PublishDate = t
+		}
+	}
+	if book.Description == "" {
+		book.Description = info.Description
+	}
+	if book.CoverURL == "" {
+		book.CoverURL = strings.Replace(info.ImageLinks.Thumbnail, "http://", "https://", 1)
+	}
+}
+
+// enrich handles POST /books/enrich/{isbn}: the book with that ISBN (or a new one with the ISBN
+// as its id) is completed with Google Books metadata and indexed.
+func enrich(w http.ResponseWriter, req *http.Request, rawISBN string) {
+	if !requireElasticsearch(w, req) {
+		return
+	}
+	if req.Method != "POST" {
+		msg := "Unsupported request for /books/enrich " + req.Method
+		fmt.Fprintf(w, "%s", errors.New(msg))
+		return
+	}
+	isbn, err := normalizeISBN(rawISBN)
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	redisClient, err := connectRedis()
+	if err != nil {
+		fmt.Fprintf(w, "%s", errors.Wrap(err, "cannot connect to Redis"))
+		return
+	}
+	defer redisClient.Close()
+	volumes, err := fetchGoogleVolumes(redisClient, isbn)
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	if len(volumes.Items) == 0 {
+		fmt.Fprintf(w, "%s", errors.New("Google Books has no volume with ISBN "+isbn))
+		return
+	}
+
+	client, ctx, err := connectElasticSearch()
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	tenant := requestTenant(req)
+	hits, err := findBooksByISBN(client, ctx, isbn, tenant)
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	id := tenantID(tenant, isbn)
+	book := Book{ISBN: isbn, IndexedAt: time.Now().UTC(), Tenant: tenant}
+	if len(hits) > 0 {
+		id = hits[0].ID
+		if err = json.Unmarshal(hits[0].Book, &book); err != nil {
+			fmt.Fprintf(w, "%s", errors.Wrap(err, "cannot decode the book"))
+			return
+		}
+	}
+	enrichBook(&book, volumes)
+	if book.WorkID == "" {
+		book.WorkID = id
+	}
+	result, err := addBook(id, book)
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	if err = appendOutbox(OutboxEvent{Type: "imported", BookID: id}); err != nil {
+		fmt.Println(err)
+	}
+	fmt.Fprintf(w, "%s", result)
+}
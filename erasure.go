@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	errors "github.com/fiverr/go_errors"
+	"gopkg.in/olivere/elastic.v5"
+	"gopkg.in/redis.v5"
+	"net/http"
+)
+
+const maxErasedReviews = 10000
+
+// eraseFavorites removes the user's favorites, keeping the per-book favorite counts in step.
+func eraseFavorites(client *redis.Client, userID string) (int, error) {
+	ids, err := client.SMembers(favoritesKey(userID)).Result()
+	if err != nil {
+		return 0, errors.Wrap(err, "cannot get key from Redis")
+	}
+	for _, bookID := range ids {
+		if _, err = removeFavorite(client, userID, bookID); err != nil {
+			return 0, err
+		}
+	}
+	return len(ids), nil
+}
+
+// eraseReviews deletes every review written by the user and refreshes the ratings of the books.
+func eraseReviews(client *elastic.Client, ctx context.Context, userID string) (int, error) {
+	searchResult, err := client.Search().Index(REVIEWS_INDEX).Query(elastic.NewTermQuery("user_id", userID)).
+		FetchSourceContext(elastic.NewFetchSourceContext(true).Include("book_id")).Size(maxErasedReviews).Do(ctx)
+	if err != nil {
+		if elastic.IsNotFound(err) {
+			return 0, nil
+		}
+		return 0, errors.Wrap(err, "cannot search reviews")
+	}
+	for _, hit := range searchResult.Hits.Hits {
+		var review Review
+		if err = json.Unmarshal(*hit.Source, &review); err != nil {
+			return 0, errors.Wrap(err, "cannot decode the review")
+		}
+		if _, err = deleteReview(client, ctx, review.BookID, userID); err != nil {
+			return 0, err
+		}
+	}
+	return len(searchResult.Hits.Hits), nil
+}
+
+// erasePriceWatches removes the user's price watches from the watches of each book.
+func erasePriceWatches(client *redis.Client, userID string) (int, error) {
+	bookIDs, err := client.SMembers(userPriceWatchesKey(userID)).Result()
+	if err != nil {
+		return 0, errors.Wrap(err, "cannot get key from Redis")
+	}
+	for _, bookID := range bookIDs {
+		if err = unwatchPrice(client, userID, bookID); err != nil {
+			return 0, err
+		}
+	}
+	return len(bookIDs), nil
+}
+
+// eraseAPIKeys revokes every API key of the user and drops their usage counts.
+func eraseAPIKeys(client *redis.Client, userID string) (int, error) {
+	keys, err := client.HGetAll(userAPIKeysKey(userID)).Result()
+	if err != nil {
+		return 0, errors.Wrap(err, "cannot get key from Redis")
+	}
+	for id, secretHash := range keys {
+		if err = client.HDel(apiKeysKey, secretHash).Err(); err != nil {
+			return 0, errors.Wrap(err, "cannot delete key in Redis")
+		}
+		if err = client.Del(apiKeyUsageKey(id)).Err(); err != nil {
+			return 0, errors.Wrap(err, "cannot delete key in Redis")
+		}
+	}
+	if err = client.Del(userAPIKeysKey(userID)).Err(); err != nil {
+		return 0, errors.Wrap(err, "cannot delete key in Redis")
+	}
+	return len(keys), nil
+}
+
+// eraseSessions signs the user out everywhere. Sessions are keyed by the hash of their token
+// alone, so they are found by scanning.
+func eraseSessions(client *redis.Client, userID string) (int, error) {
+	erased := 0
+	var cursor uint64
+	for {
+		keys, next, err := client.Scan(cursor, sessionKey("*"), 100).Result()
+		if err != nil {
+			return 0, errors.Wrap(err, "cannot get key from Redis")
+		}
+		for _, key := range keys {
+			value, err := client.Get(key).Result()
+			if err == redis.Nil {
+				continue
+			}
+			if err != nil {
+				return 0, errors.Wrap(err, "cannot get key from Redis")
+			}
+			var session Session
+			if err = json.Unmarshal([]byte(value), &session); err != nil || tenantID(session.Tenant, session.UserID) != userID {
+				continue
+			}
+			if err = client.Del(key).Err(); err != nil {
+				return 0, errors.Wrap(err, "cannot delete key in Redis")
+			}
+			erased++
+		}
+		if cursor = next; cursor == 0 {
+			return erased, nil
+		}
+	}
+}
+
+// eraseAlerts deletes the user's alerts.
+func eraseAlerts(client *elastic.Client, ctx context.Context, userID string) (int64, error) {
+	res, err := client.DeleteByQuery(ALERTS_INDEX).Query(elastic.NewTermQuery("user_id", userID)).Refresh("true").Do(ctx)
+	if err != nil {
+		if elastic.IsNotFound(err) {
+			return 0, nil
+		}
+		return 0, errors.Wrap(err, "cannot delete alerts")
+	}
+	return res.Deleted, nil
+}
+
+// eraseUserData removes everything kept about the user: activity, search history, recently
+// viewed books, saved searches, cart, favorites, price watches, sessions, API keys, alerts and
+// reviews, returning what was removed.
+func eraseUserData(userID string) (map[string]interface{}, error) {
+	redisClient, err := connectRedis()
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot connect to Redis")
+	}
+	defer redisClient.Close()
+	if err = activities.Clear(userID); err != nil {
+		return nil, err
+	}
+	err = redisClient.Del(searchHistoryKey(userID), recentlyViewedKey(userID), savedSearchesKey(userID), cartKey(userID)).Err()
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot delete key in Redis")
+	}
+	favorites, err := eraseFavorites(redisClient, userID)
+	if err != nil {
+		return nil, err
+	}
+	priceWatches, err := erasePriceWatches(redisClient, userID)
+	if err != nil {
+		return nil, err
+	}
+	sessions, err := eraseSessions(redisClient, userID)
+	if err != nil {
+		return nil, err
+	}
+	apiKeys, err := eraseAPIKeys(redisClient, userID)
+	if err != nil {
+		return nil, err
+	}
+	// alerts and reviews are kept in Elasticsearch, so there are none with the postgres books backend
+	var alerts int64
+	reviews := 0
+	if !booksInPostgres() {
+		client, ctx, err := connectElasticSearch()
+		if err != nil {
+			return nil, err
+		}
+		if alerts, err = eraseAlerts(client, ctx, userID); err != nil {
+			return nil, err
+		}
+		if reviews, err = eraseReviews(client, ctx, userID); err != nil {
+			return nil, err
+		}
+	}
+	return map[string]interface{}{"activity": true, "search_history": true, "recently_viewed": true,
+		"saved_searches": true, "cart": true, "favorites": favorites, "price_watches": priceWatches,
+		"sessions": sessions, "api_keys": apiKeys, "alerts": alerts, "reviews": reviews}, nil
+}
+
+// userData handles DELETE /users/{id}/data, erasing the user's personal data on request. Erasures
+// are admin only and recorded in the audit log.
+func userData(w http.ResponseWriter, req *http.Request, userID string) {
+	if !isAdmin(req) {
+		http.Error(w, "admin token required", http.StatusUnauthorized)
+		return
+	}
+	if req.Method != "DELETE" {
+		msg := "Unsupported request for " + req.URL.Path + " " + req.Method
+		fmt.Fprintf(w, "%s", errors.New(msg))
+		return
+	}
+	erased, err := eraseUserData(userID)
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	err = recordAudit(AuditEntry{Action: "erase_user_data", Target: userID, Actor: "admin@" + clientIP(req), Details: erased})
+	if err != nil {
+		fmt.Println(err)
+	}
+	buf, err := json.Marshal(map[string]interface{}{"user_id": userID, "erased": erased})
+	if err != nil {
+		fmt.Fprintf(w, "%s", errors.Wrap(err, "cannot create json result of erasure"))
+		return
+	}
+	fmt.Fprintf(w, "%s", buf)
+}
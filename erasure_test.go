@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEraseUserData(t *testing.T) {
+	useMemoryRepository(t)
+	useRedis(t)
+	// alerts and reviews are kept in Elasticsearch, which the postgres books backend goes without
+	config.Books.Backend = "postgres"
+	savedActivities := activities
+	activities = &redisActivityStore{}
+	defer func() { activities = savedActivities }()
+	client := sharedRedis()
+	now := time.Now().UTC()
+
+	if err := writeToRedis([]pendingActivity{{userID: "alice", entry: ActivityEntry{Route: "/book", Method: "GET", Time: now}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := recordSearch("alice", SearchHistoryEntry{Query: "dune", Time: now}); err != nil {
+		t.Fatal(err)
+	}
+	if err := recordRecentlyViewed("alice", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := saveSearch(client, "alice", "dune", SavedSearch{Query: "dune"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.HSet(cartKey("alice"), "1", "2").Err(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := addFavorite(client, "alice", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := watchPrice(client, "alice", "1", PriceWatch{TargetPrice: priceFromFloat(5)}); err != nil {
+		t.Fatal(err)
+	}
+	aliceSession, err := createSession(client, "alice", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobSession, err := createSession(client, "bob", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = storeAPIKey(client, APIKey{ID: "key1", UserID: "alice", Scopes: allScopes, CreatedAt: now}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = eraseUserData("alice"); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{activityKey("alice"), searchHistoryKey("alice"), recentlyViewedKey("alice"),
+		savedSearchesKey("alice"), cartKey("alice"), favoritesKey("alice"), userPriceWatchesKey("alice"),
+		userAPIKeysKey("alice"), apiKeysKey} {
+		if exists, err := client.Exists(key).Result(); err != nil || exists {
+			t.Errorf("key %s after the erasure: exists %v, %v", key, exists, err)
+		}
+	}
+	if watching, err := client.HExists(priceWatchesKey("1"), "alice").Result(); err != nil || watching {
+		t.Errorf("price watches of book 1 after the erasure: alice %v, %v", watching, err)
+	}
+	if session, err := lookupSession(client, aliceSession); err != nil || session != nil {
+		t.Errorf("session of alice after the erasure = %v, %v", session, err)
+	}
+	if session, err := lookupSession(client, bobSession); err != nil || session == nil {
+		t.Errorf("session of bob after the erasure of alice = %v, %v", session, err)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	errors "github.com/fiverr/go_errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// esDialect describes the API differences of the cluster we talk to. The elastic.v5 client speaks
+// the ES 5 API, so newer clusters are bridged by compatTransport and by typeName.
+type esDialect struct {
+	Distribution string `json:"distribution"`
+	Version      string `json:"version"`
+	Major        int    `json:"major"`
+}
+
+// dialect defaults to ES 5 until detectDialect has run.
+var dialect = esDialect{Distribution: "elasticsearch", Version: "5", Major: 5}
+
+// typeless reports whether the cluster has dropped mapping types (ES 7+ and every OpenSearch).
+func (d esDialect) typeless() bool {
+	return d.Distribution == "opensearch" || d.Major >= 7
+}
+
+// typeName returns the document type to address for t in the cluster's dialect.
+func typeName(t string) string {
+	if dialect.typeless() {
+		return "_doc"
+	}
+	return t
+}
+
+// detectDialect reads the cluster version from the root endpoint of the first node answering.
+func detectDialect() (esDialect, error) {
+	var resp *http.Response
+	var err error
+	for _, url := range config.Elasticsearch.nodes() {
+		if resp, err = esHttpClient.Get(url); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return dialect, errors.Wrap(err, "cannot detect elastic search version")
+	}
+	defer resp.Body.Close()
+	var info struct {
+		Version struct {
+			Number       string `json:"number"`
+			Distribution string `json:"distribution"`
+		} `json:"version"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return dialect, errors.Wrap(err, "cannot decode elastic search version")
+	}
+	d := esDialect{Distribution: "elasticsearch", Version: info.Version.Number}
+	if info.Version.Distribution != "" {
+		d.Distribution = info.Version.Distribution
+	}
+	d.Major, err = strconv.Atoi(strings.SplitN(d.Version, ".", 2)[0])
+	if err != nil {
+		return dialect, errors.New("cannot parse elastic search version " + d.Version)
+	}
+	if d.Distribution == "elasticsearch" && (d.Major < 5 || d.Major > 7) {
+		return d, errors.New(fmt.Sprintf("unsupported elastic search version %s", d.Version))
+	}
+	return d, nil
+}
+
+// idSortField returns the field sorting documents by id, which breaks ties between equal sort
+// values so that paging never repeats or skips documents. ES 5 only sorts on _uid, type#id.
+func idSortField() string {
+	if dialect.Distribution == "elasticsearch" && dialect.Major < 6 {
+		return "_uid"
+	}
+	return "_id"
+}
+
+// totalRelation tells whether a hits total of the cluster is exact or the lower bound it stopped
+// counting at. Clusters before ES 7 always count exactly; newer ones count up to
+// track_total_hits, set by compatTransport.
+func totalRelation(total int64) string {
+	limit := config.Elasticsearch.TrackTotalHits
+	if dialect.typeless() && limit > 0 && total >= int64(limit) {
+		return totalLowerBound
+	}
+	return totalExact
+}
+
+// compatTransport rewrites requests of the ES 5 client for newer clusters: typed mappings need
+// include_type_name and hits.total must stay a plain number for the client to decode it. Since
+// newer clusters stop counting hits at 10,000 by default, searches also set track_total_hits.
+type compatTransport struct {
+	next http.RoundTripper
+}
+
+func (t compatTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !dialect.typeless() {
+		return t.next.RoundTrip(req)
+	}
+	// clone before modifying, as required from a RoundTripper
+	r := new(http.Request)
+	*r = *req
+	u := *req.URL
+	r.URL = &u
+	q := u.Query()
+	p := strings.TrimSuffix(u.Path, "/")
+	switch {
+	case strings.HasSuffix(p, "/_search") || strings.HasSuffix(p, "/_msearch") || strings.Contains(p, "/_search/scroll"):
+		q.Set("rest_total_hits_as_int", "true")
+		// scrolls always count exactly and refuse a limit
+		if strings.HasSuffix(p, "/_search") && q.Get("scroll") == "" {
+			if limit := config.Elasticsearch.TrackTotalHits; limit > 0 {
+				q.Set("track_total_hits", strconv.Itoa(limit))
+			} else {
+				q.Set("track_total_hits", "true")
+			}
+		}
+	case strings.Contains(p, "/_mapping") || (req.Method == "PUT" && strings.Count(p, "/") == 1):
+		q.Set("include_type_name", "true")
+	}
+	u.RawQuery = q.Encode()
+	return t.next.RoundTrip(r)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	errors "github.com/fiverr/go_errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// snapshotRepositoryPath is the snapshot API path of the configured repository.
+func snapshotRepositoryPath() string {
+	return "/_snapshot/" + url.PathEscape(config.Snapshots.Repository)
+}
+
+// registerSnapshotRepository creates or updates the configured snapshot repository.
+func registerSnapshotRepository() (string, error) {
+	client, ctx, err := connectElasticSearch()
+	if err != nil {
+		return "", err
+	}
+	body := map[string]interface{}{"type": config.Snapshots.Type, "settings": config.Snapshots.Settings}
+	res, err := client.PerformRequest(ctx, "PUT", snapshotRepositoryPath(), nil, body)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot register snapshot repository "+config.Snapshots.Repository)
+	}
+	return string(res.Body), nil
+}
+
+// createSnapshot snapshots the books index under name, or a name from the current time when
+// empty. With wait the call returns once the snapshot is complete.
+func createSnapshot(name string, wait bool) (string, error) {
+	client, ctx, err := connectElasticSearch()
+	if err != nil {
+		return "", err
+	}
+	if name == "" {
+		name = booksIndex() + "-" + time.Now().UTC().Format("20060102-150405")
+	}
+	params := url.Values{"wait_for_completion": {fmt.Sprint(wait)}}
+	body := map[string]interface{}{"indices": booksIndex(), "include_global_state": false}
+	res, err := client.PerformRequest(ctx, "PUT", snapshotRepositoryPath()+"/"+url.PathEscape(name), params, body)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot create snapshot "+name)
+	}
+	return string(res.Body), nil
+}
+
+// listSnapshots returns the snapshots of the configured repository.
+func listSnapshots() (string, error) {
+	client, ctx, err := connectElasticSearch()
+	if err != nil {
+		return "", err
+	}
+	res, err := client.PerformRequest(ctx, "GET", snapshotRepositoryPath()+"/_all", nil, nil)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot list snapshots")
+	}
+	return string(res.Body), nil
+}
+
+// restoreSnapshot restores the books index of a snapshot. Without replace it is restored next to
+// the live index, as restored_<index>, to be inspected or swapped in; with replace the live index
+// is closed and overwritten.
+func restoreSnapshot(name string, replace bool) (string, error) {
+	client, ctx, err := connectElasticSearch()
+	if err != nil {
+		return "", err
+	}
+	body := map[string]interface{}{"indices": booksIndex(), "include_global_state": false}
+	if replace {
+		// only closed indices can be restored over
+		if _, err = client.CloseIndex(booksIndex()).Do(ctx); err != nil {
+			return "", errors.Wrap(err, "cannot close "+booksIndex()+" before the restore")
+		}
+	} else {
+		body["rename_pattern"] = "(.+)"
+		body["rename_replacement"] = "restored_$1"
+	}
+	params := url.Values{"wait_for_completion": {"true"}}
+	res, err := client.PerformRequest(ctx, "POST", snapshotRepositoryPath()+"/"+url.PathEscape(name)+"/_restore", params, body)
+	if err != nil {
+		if replace {
+			// leave the live index serving rather than closed after a failed restore
+			client.OpenIndex(booksIndex()).Do(ctx)
+		}
+		return "", errors.Wrap(err, "cannot restore snapshot "+name)
+	}
+	return string(res.Body), nil
+}
+
+// adminSnapshots handles the Elasticsearch snapshots of the books index, in the repository set in
+// config:
+//
+//	PUT /admin/snapshots/repository registers the repository
+//	GET /admin/snapshots lists the snapshots
+//	POST /admin/snapshots?name=&wait= snapshots the books index
+//	POST /admin/snapshots/{name}/restore?replace= restores one
+func adminSnapshots(w http.ResponseWriter, req *http.Request) {
+	if !requireElasticsearch(w, req) {
+		return
+	}
+	if !isAdmin(req) {
+		http.Error(w, "admin token required", http.StatusUnauthorized)
+		return
+	}
+	var result string
+	var err error
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, "/admin/snapshots"), "/"), "/")
+	switch {
+	case parts[0] == "" && req.Method == "GET":
+		result, err = listSnapshots()
+	case parts[0] == "" && req.Method == "POST":
+		result, err = createSnapshot(strings.TrimSpace(getParamValue(req, "name")), getParamValue(req, "wait") == "true")
+	case len(parts) == 1 && parts[0] == "repository" && req.Method == "PUT":
+		result, err = registerSnapshotRepository()
+	case len(parts) == 2 && parts[1] == "restore" && req.Method == "POST":
+		result, err = restoreSnapshot(parts[0], getParamValue(req, "replace") == "true")
+		if err == nil {
+			if auditErr := recordAudit(AuditEntry{Action: "restore_snapshot", Target: parts[0], Actor: "admin@" + clientIP(req),
+				Details: map[string]interface{}{"replace": getParamValue(req, "replace") == "true"}}); auditErr != nil {
+				fmt.Println(auditErr)
+			}
+		}
+	default:
+		msg := "Unsupported request for " + req.URL.Path + " " + req.Method
+		err = errors.New(msg)
+	}
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "%s", result)
+}
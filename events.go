@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	errors "github.com/fiverr/go_errors"
+	"net/http"
+	"time"
+)
+
+const catalogEventsChannel = "catalog_events"
+
+// CatalogEvent is broadcast to /events subscribers whenever a book changes.
+type CatalogEvent struct {
+	Type string    `json:"type"`
+	ID   string    `json:"id"`
+	Time time.Time `json:"time"`
+}
+
+func publishCatalogEvent(eventType string, id string) error {
+	client, err := connectRedis()
+	if err != nil {
+		return errors.Wrap(err, "cannot connect to Redis")
+	}
+	defer client.Close()
+	buf, err := json.Marshal(CatalogEvent{Type: eventType, ID: id, Time: time.Now().UTC()})
+	if err != nil {
+		return errors.Wrap(err, "cannot create json catalog event")
+	}
+	if err = client.Publish(catalogEventsChannel, string(buf)).Err(); err != nil {
+		return errors.Wrap(err, "cannot publish catalog event")
+	}
+	return nil
+}
+
+// events streams the changes of the tenant's catalog to the client as Server-Sent Events.
+func events(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		msg := "Unsupported request for /events " + req.Method
+		fmt.Fprintf(w, "%s", errors.New(msg))
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		fmt.Fprintf(w, "%s", errors.New("streaming is not supported"))
+		return
+	}
+	client, err := connectRedis()
+	if err != nil {
+		err = errors.Wrap(err, "cannot connect to Redis")
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	defer client.Close()
+	pubsub, err := client.Subscribe(catalogEventsChannel)
+	if err != nil {
+		err = errors.Wrap(err, "cannot subscribe to catalog events")
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	// closing the subscription unblocks ReceiveMessage once the client goes away
+	go func() {
+		<-req.Context().Done()
+		pubsub.Close()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	flusher.Flush()
+	tenant := requestTenant(req)
+	for {
+		msg, err := pubsub.ReceiveMessage()
+		if err != nil {
+			return
+		}
+		var event CatalogEvent
+		// only the events of the tenant's books are streamed
+		if err = json.Unmarshal([]byte(msg.Payload), &event); err != nil || !tenantOwns(tenant, event.ID) {
+			continue
+		}
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, msg.Payload)
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	errors "github.com/fiverr/go_errors"
+	"gopkg.in/redis.v5"
+	"net/http"
+	"sort"
+)
+
+func favoritesKey(userID string) string {
+	return "favorites:" + userID
+}
+
+// favoriteCountsKey is a hash of book id to the number of users who favorited it.
+const favoriteCountsKey = "favorite_counts"
+
+// addFavorite adds the book to the user's favorites, counting it once per user.
+func addFavorite(client *redis.Client, userID string, bookID string) (string, error) {
+	added, err := client.SAdd(favoritesKey(userID), bookID).Result()
+	if err != nil {
+		return "", errors.Wrap(err, "cannot set key in Redis")
+	}
+	if added > 0 {
+		if err = client.HIncrBy(favoriteCountsKey, bookID, 1).Err(); err != nil {
+			return "", errors.Wrap(err, "cannot set key in Redis")
+		}
+	}
+	return fmt.Sprintf("Added book %s to the favorites of user %s\n", bookID, userID), nil
+}
+
+func removeFavorite(client *redis.Client, userID string, bookID string) (string, error) {
+	removed, err := client.SRem(favoritesKey(userID), bookID).Result()
+	if err != nil {
+		return "", errors.Wrap(err, "cannot delete key in Redis")
+	}
+	if removed > 0 {
+		if err = client.HIncrBy(favoriteCountsKey, bookID, -1).Err(); err != nil {
+			return "", errors.Wrap(err, "cannot set key in Redis")
+		}
+	}
+	return fmt.Sprintf("Removed book %s from the favorites of user %s\n", bookID, userID), nil
+}
+
+// listFavorites returns the full documents of the user's favorite books.
+func listFavorites(client *redis.Client, userID string) (string, error) {
+	ids, err := client.SMembers(favoritesKey(userID)).Result()
+	if err != nil {
+		return "", errors.Wrap(err, "cannot get key from Redis")
+	}
+	sort.Strings(ids)
+	books, err := hydrateBooks(ids)
+	if err != nil {
+		return "", err
+	}
+	buf, err := json.Marshal(books)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot create json result of favorites")
+	}
+	return string(buf), nil
+}
+
+// favorites handles GET /users/{id}/favorites and POST/DELETE /users/{id}/favorites/{book_id}.
+func favorites(w http.ResponseWriter, req *http.Request, userID string, rest []string) {
+	var err error
+	var result string
+	client, err := connectRedis()
+	if err != nil {
+		err = errors.Wrap(err, "cannot connect to Redis")
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	defer client.Close()
+	bookID := ""
+	if len(rest) > 0 {
+		bookID = tenantID(requestTenant(req), rest[0])
+	}
+	switch {
+	case req.Method == "GET" && bookID == "":
+		result, err = listFavorites(client, userID)
+	case req.Method == "POST" && bookID != "":
+		result, err = addFavorite(client, userID, bookID)
+	case req.Method == "DELETE" && bookID != "":
+		result, err = removeFavorite(client, userID, bookID)
+	default:
+		msg := "Unsupported request for " + req.URL.Path + " " + req.Method
+		err = errors.New(msg)
+	}
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+	} else {
+		fmt.Fprintf(w, "%s", result)
+	}
+}
+
+// favoriteCount handles GET /books/favorites/{id}, the number of users who favorited the book.
+func favoriteCount(w http.ResponseWriter, req *http.Request, bookID string) {
+	if req.Method != "GET" {
+		msg := "Unsupported request for /books/favorites " + req.Method
+		fmt.Fprintf(w, "%s", errors.New(msg))
+		return
+	}
+	client, err := connectRedis()
+	if err != nil {
+		fmt.Fprintf(w, "%s", errors.Wrap(err, "cannot connect to Redis"))
+		return
+	}
+	defer client.Close()
+	count, err := client.HGet(favoriteCountsKey, bookID).Int64()
+	if err != nil && err != redis.Nil {
+		fmt.Fprintf(w, "%s", errors.Wrap(err, "cannot get key from Redis"))
+		return
+	}
+	buf, err := json.Marshal(map[string]interface{}{"book_id": bookID, "favorites": count})
+	if err != nil {
+		fmt.Fprintf(w, "%s", errors.Wrap(err, "cannot create json result of favorite count"))
+		return
+	}
+	fmt.Fprintf(w, "%s", buf)
+}
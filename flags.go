@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	errors "github.com/fiverr/go_errors"
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	flagsKey = "feature_flags"
+	// flagsRefresh is how long Redis overrides are cached before being read again
+	flagsRefresh = 10 * time.Second
+)
+
+// FlagConfig gates a behavior. An enabled flag applies in the listed environments, or all of
+// them when none are listed, to Percent of the traffic, or all of it when Percent is 0.
+type FlagConfig struct {
+	Enabled      bool     `json:"enabled"`
+	Percent      int      `json:"percent,omitempty"`
+	Environments []string `json:"environments,omitempty"`
+}
+
+// FlagStatus is a flag's effective config and whether it comes from a Redis override.
+type FlagStatus struct {
+	Name     string `json:"name"`
+	Override bool   `json:"override"`
+	FlagConfig
+}
+
+var (
+	flagsMu       sync.Mutex
+	flagOverrides map[string]FlagConfig
+	flagsLoadedAt time.Time
+)
+
+// loadFlagOverrides returns the flags overridden at runtime, read from Redis at most every
+// flagsRefresh. When Redis fails, the last overrides read are kept.
+func loadFlagOverrides() map[string]FlagConfig {
+	flagsMu.Lock()
+	defer flagsMu.Unlock()
+	if demoMode || time.Since(flagsLoadedAt) < flagsRefresh {
+		return flagOverrides
+	}
+	flagsLoadedAt = time.Now()
+	fields, err := sharedRedis().HGetAll(flagsKey).Result()
+	if err != nil {
+		fmt.Println(errors.Wrap(err, "cannot get feature flags from Redis"))
+		return flagOverrides
+	}
+	overrides := make(map[string]FlagConfig, len(fields))
+	for name, value := range fields {
+		var flag FlagConfig
+		if err = json.Unmarshal([]byte(value), &flag); err != nil {
+			fmt.Println(errors.Wrap(err, "cannot decode feature flag "+name))
+			continue
+		}
+		overrides[name] = flag
+	}
+	flagOverrides = overrides
+	return flagOverrides
+}
+
+// flagConfig returns the effective config of the flag, the Redis override winning over config.
+func flagConfig(name string) (FlagConfig, bool, bool) {
+	if flag, ok := loadFlagOverrides()[name]; ok {
+		return flag, true, true
+	}
+	flag, ok := config.Flags[name]
+	return flag, false, ok
+}
+
+// flagSubject identifies who the request is bucketed as for percentage rollouts, so the same
+// user keeps seeing the same behavior.
+func flagSubject(req *http.Request) string {
+	if userID := getParamValue(req, "user_id"); userID != "" {
+		return userID
+	}
+	if secret := req.Header.Get(apiKeyHeader); secret != "" {
+		return hashSecret(secret)
+	}
+	return clientIP(req)
+}
+
+// flagBucket places the subject in one of 100 buckets, independently for each flag.
+func flagBucket(name string, subject string) int {
+	h := fnv.New32a()
+	h.Write([]byte(name + ":" + subject))
+	return int(h.Sum32() % 100)
+}
+
+// flagEnabled reports whether the flag is on for the request. Unknown flags are off.
+func flagEnabled(name string, req *http.Request) bool {
+	flag, _, ok := flagConfig(name)
+	if !ok || !flag.Enabled {
+		return false
+	}
+	if len(flag.Environments) > 0 {
+		inEnvironment := false
+		for _, env := range flag.Environments {
+			inEnvironment = inEnvironment || env == config.Environment
+		}
+		if !inEnvironment {
+			return false
+		}
+	}
+	return flag.Percent <= 0 || flag.Percent >= 100 || flagBucket(name, flagSubject(req)) < flag.Percent
+}
+
+// listFlags returns the effective config of every flag, in config or overridden.
+func listFlags() []FlagStatus {
+	overrides := loadFlagOverrides()
+	statuses := make([]FlagStatus, 0, len(config.Flags)+len(overrides))
+	for name, flag := range config.Flags {
+		if _, ok := overrides[name]; !ok {
+			statuses = append(statuses, FlagStatus{Name: name, FlagConfig: flag})
+		}
+	}
+	for name, flag := range overrides {
+		statuses = append(statuses, FlagStatus{Name: name, Override: true, FlagConfig: flag})
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+// expireFlags makes the next check read the overrides again, so changes apply at once on this
+// instance. Other instances pick them up within flagsRefresh.
+func expireFlags() {
+	flagsMu.Lock()
+	flagsLoadedAt = time.Time{}
+	flagsMu.Unlock()
+}
+
+// adminFlags handles /admin/flags: GET lists the flags, PUT ?name=&enabled=&percent=&environments=
+// overrides one at runtime and DELETE ?name= drops the override, going back to config.
+func adminFlags(w http.ResponseWriter, req *http.Request) {
+	if !isAdmin(req) {
+		http.Error(w, "admin token required", http.StatusUnauthorized)
+		return
+	}
+	name := getParamValue(req, "name")
+	switch req.Method {
+	case "GET":
+	case "PUT":
+		if name == "" {
+			fmt.Fprintf(w, "%s", errors.New("name is required"))
+			return
+		}
+		var flag FlagConfig
+		var err error
+		if flag.Enabled, err = strconv.ParseBool(getParamValue(req, "enabled")); err != nil {
+			fmt.Fprintf(w, "%s", errors.New("enabled must be true or false"))
+			return
+		}
+		if value := getParamValue(req, "percent"); value != "" {
+			flag.Percent, err = strconv.Atoi(value)
+			if err != nil || flag.Percent < 0 || flag.Percent > 100 {
+				fmt.Fprintf(w, "%s", errors.New("percent must be an integer between 0 and 100"))
+				return
+			}
+		}
+		for _, env := range strings.Split(getParamValue(req, "environments"), ",") {
+			if env = strings.TrimSpace(env); env != "" {
+				flag.Environments = append(flag.Environments, env)
+			}
+		}
+		buf, err := json.Marshal(flag)
+		if err != nil {
+			fmt.Fprintf(w, "%s", errors.Wrap(err, "cannot create json feature flag"))
+			return
+		}
+		if err = sharedRedis().HSet(flagsKey, name, string(buf)).Err(); err != nil {
+			fmt.Fprintf(w, "%s", errors.Wrap(err, "cannot set key in Redis"))
+			return
+		}
+		expireFlags()
+	case "DELETE":
+		if name == "" {
+			fmt.Fprintf(w, "%s", errors.New("name is required"))
+			return
+		}
+		if err := sharedRedis().HDel(flagsKey, name).Err(); err != nil {
+			fmt.Fprintf(w, "%s", errors.Wrap(err, "cannot delete key from Redis"))
+			return
+		}
+		expireFlags()
+	default:
+		msg := "Unsupported request for /admin/flags " + req.Method
+		fmt.Fprintf(w, "%s", errors.New(msg))
+		return
+	}
+	buf, err := json.Marshal(listFlags())
+	if err != nil {
+		fmt.Fprintf(w, "%s", errors.Wrap(err, "cannot create json result of feature flags"))
+		return
+	}
+	fmt.Fprintf(w, "%s", buf)
+}
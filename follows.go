@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	errors "github.com/fiverr/go_errors"
+	"gopkg.in/redis.v5"
+	"net/http"
+)
+
+func followingKey(userID string) string {
+	return "following:" + userID
+}
+
+func authorFollowersKey(authorID string) string {
+	return "author_followers:" + authorID
+}
+
+// followWebhooksKey is a hash of user id to the webhook notified about followed authors.
+const followWebhooksKey = "follow_webhooks"
+
+func followAuthor(client *redis.Client, userID string, authorID string, webhookURL string) (string, error) {
+	_, err := client.TxPipelined(func(pipe *redis.Pipeline) error {
+		pipe.SAdd(followingKey(userID), authorID)
+		pipe.SAdd(authorFollowersKey(authorID), userID)
+		if webhookURL != "" {
+			pipe.HSet(followWebhooksKey, userID, webhookURL)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "cannot set key in Redis")
+	}
+	return fmt.Sprintf("User %s follows author %s\n", userID, authorID), nil
+}
+
+func unfollowAuthor(client *redis.Client, userID string, authorID string) (string, error) {
+	_, err := client.TxPipelined(func(pipe *redis.Pipeline) error {
+		pipe.SRem(followingKey(userID), authorID)
+		pipe.SRem(authorFollowersKey(authorID), userID)
+		return nil
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "cannot delete key in Redis")
+	}
+	return fmt.Sprintf("User %s no longer follows author %s\n", userID, authorID), nil
+}
+
+func listFollowing(client *redis.Client, userID string) (string, error) {
+	authorIDs, err := client.SMembers(followingKey(userID)).Result()
+	if err != nil {
+		return "", errors.Wrap(err, "cannot get key from Redis")
+	}
+	webhookURL, err := client.HGet(followWebhooksKey, userID).Result()
+	if err != nil && err != redis.Nil {
+		return "", errors.Wrap(err, "cannot get key from Redis")
+	}
+	buf, err := json.Marshal(map[string]interface{}{"authors": authorIDs, "webhook_url": webhookURL})
+	if err != nil {
+		return "", errors.Wrap(err, "cannot create json result of followed authors")
+	}
+	return string(buf), nil
+}
+
+// notifyFollowers queues a notification to every follower of the author of a new book.
+func notifyFollowers(bookID string, book Book) error {
+	client, err := connectRedis()
+	if err != nil {
+		return errors.Wrap(err, "cannot connect to Redis")
+	}
+	defer client.Close()
+	followers, err := client.SMembers(authorFollowersKey(book.AuthorID)).Result()
+	if err != nil {
+		return errors.Wrap(err, "cannot get key from Redis")
+	}
+	if len(followers) == 0 {
+		return nil
+	}
+	webhooks, err := client.HMGet(followWebhooksKey, followers...).Result()
+	if err != nil {
+		return errors.Wrap(err, "cannot get key from Redis")
+	}
+	notifications := make([]Notification, 0, len(followers))
+	for i, userID := range followers {
+		webhookURL, _ := webhooks[i].(string)
+		notifications = append(notifications, Notification{
+			Type:       "followed_author_new_book",
+			UserID:     userID,
+			WebhookURL: webhookURL,
+			Payload:    map[string]interface{}{"author_id": book.AuthorID, "book_id": bookID, "book": book},
+		})
+	}
+	notifyAsync(notifications)
+	return nil
+}
+
+// following handles /users/{id}/following: GET lists the followed authors, PUT and DELETE on
+// /users/{id}/following/{author_id} follow and unfollow an author.
+func following(w http.ResponseWriter, req *http.Request, userID string, rest []string) {
+	var err error
+	var result string
+	client, err := connectRedis()
+	if err != nil {
+		err = errors.Wrap(err, "cannot connect to Redis")
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	defer client.Close()
+	authorID := ""
+	if len(rest) > 0 {
+		authorID = tenantID(requestTenant(req), rest[0])
+	}
+	switch {
+	case req.Method == "GET" && authorID == "":
+		result, err = listFollowing(client, userID)
+	case req.Method == "PUT" && authorID != "":
+		result, err = followAuthor(client, userID, authorID, getParamValue(req, "webhook_url"))
+	case req.Method == "DELETE" && authorID != "":
+		result, err = unfollowAuthor(client, userID, authorID)
+	default:
+		msg := "Unsupported request for " + req.URL.Path + " " + req.Method
+		err = errors.New(msg)
+	}
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+	} else {
+		fmt.Fprintf(w, "%s", result)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	errors "github.com/fiverr/go_errors"
+	"gopkg.in/olivere/elastic.v5"
+	"net/http"
+	"strings"
+)
+
+// knownFormats are the editions a book can be available in.
+var knownFormats = []string{"hardcover", "paperback", "ebook", "audiobook"}
+
+// parseFormats parses a comma separated list of formats, rejecting unknown ones and dropping duplicates.
+func parseFormats(value string) ([]string, error) {
+	formats := make([]string, 0)
+	for _, format := range splitList(strings.ToLower(value)) {
+		known := false
+		for _, k := range knownFormats {
+			known = known || k == format
+		}
+		if !known {
+			return nil, errors.New("unknown format " + format + ", expected one of " + strings.Join(knownFormats, ", "))
+		}
+		if !hasFormat(formats, format) {
+			formats = append(formats, format)
+		}
+	}
+	return formats, nil
+}
+
+func hasFormat(formats []string, format string) bool {
+	for _, f := range formats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// formatsQuery matches books available in any of the formats. Books written before formats existed
+// only have ebook_available, so it still counts as the ebook format.
+func formatsQuery(formats []string) elastic.Query {
+	values := make([]interface{}, 0, len(formats))
+	for _, format := range formats {
+		values = append(values, format)
+	}
+	q := elastic.NewBoolQuery().Should(elastic.NewTermsQuery("formats", values...)).MinimumNumberShouldMatch(1)
+	if hasFormat(formats, "ebook") {
+		q = q.Should(elastic.NewTermQuery("ebook_available", true))
+	}
+	return q
+}
+
+// facets handles GET /books/facets, counting the books in each format among those matching the
+// /search params.
+func facets(w http.ResponseWriter, req *http.Request) {
+	if !requireElasticsearch(w, req) {
+		return
+	}
+	if req.Method != "GET" {
+		msg := "Unsupported request for /books/facets " + req.Method
+		fmt.Fprintf(w, "%s", errors.New(msg))
+		return
+	}
+	params, err := parseSearchParams(req)
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	client, ctx, err := connectElasticSearch()
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	agg := elastic.NewTermsAggregation().Field("formats").Size(len(knownFormats))
+	searchResult, err := client.Search().Index(booksIndex()).Query(buildSearchQuery(params)).
+		Aggregation("formats", agg).Size(0).Do(ctx)
+	if err != nil {
+		fmt.Fprintf(w, "%s", errors.Wrap(err, "cannot aggregate book formats"))
+		return
+	}
+	counts := make(map[string]int64)
+	for _, format := range knownFormats {
+		counts[format] = 0
+	}
+	if terms, found := searchResult.Aggregations.Terms("formats"); found {
+		for _, bucket := range terms.Buckets {
+			counts[fmt.Sprint(bucket.Key)] = bucket.DocCount
+		}
+	}
+	buf, err := json.Marshal(map[string]interface{}{"total": searchResult.Hits.TotalHits, "formats": counts})
+	if err != nil {
+		fmt.Fprintf(w, "%s", errors.Wrap(err, "cannot create json result of facets"))
+		return
+	}
+	fmt.Fprintf(w, "%s", buf)
+}
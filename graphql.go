@@ -0,0 +1,386 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	errors "github.com/fiverr/go_errors"
+	"github.com/graphql-go/graphql"
+	"net/http"
+)
+
+// graphqlSchema is the read-only schema served on /graphql, set up in main.
+var graphqlSchema graphql.Schema
+
+// toGraphQL converts a document to the map the default resolvers read fields from, so fields are
+// named like in the JSON API.
+func toGraphQL(doc []byte, id string) (map[string]interface{}, error) {
+	m := make(map[string]interface{})
+	if err := json.Unmarshal(doc, &m); err != nil {
+		return nil, errors.Wrap(err, "cannot decode document for graphql")
+	}
+	if id != "" {
+		m["id"] = id
+	}
+	return m, nil
+}
+
+// graphqlBook returns the book as a graphql object, or nil when it does not exist.
+func graphqlBook(id string) (interface{}, error) {
+	source, err := bookRepo.Get(id)
+	if err != nil || source == "" {
+		return nil, err
+	}
+	return toGraphQL([]byte(source), id)
+}
+
+func graphqlAuthor(id string) (interface{}, error) {
+	if booksInPostgres() {
+		return nil, errElasticsearchOnly
+	}
+	client, ctx, err := connectElasticSearch()
+	if err != nil {
+		return nil, err
+	}
+	author, err := getAuthor(client, ctx, id)
+	if err != nil || author == nil {
+		return nil, err
+	}
+	buf, err := json.Marshal(author)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create json author")
+	}
+	return toGraphQL(buf, id)
+}
+
+// graphqlTenant returns the tenant resolved by withTenant for the request the query came with.
+// Ids nested in the documents are already scoped, so only the arguments of the root fields need it.
+func graphqlTenant(p graphql.ResolveParams) string {
+	if p.Context != nil {
+		if tenant, ok := p.Context.Value(tenantContextKey{}).(string); ok {
+			return tenant
+		}
+	}
+	return ""
+}
+
+// graphqlRequestKey holds the HTTP request of the query in the resolver context, so
+// resolvers of per-user fields can authorize it.
+type graphqlRequestKey struct{}
+
+// graphqlAuthorize checks that the query may read the user's data, like authorizeUser does
+// for the REST routes.
+func graphqlAuthorize(p graphql.ResolveParams, userID string) error {
+	var req *http.Request
+	if p.Context != nil {
+		req, _ = p.Context.Value(graphqlRequestKey{}).(*http.Request)
+	}
+	if req == nil {
+		return errors.New("an API key, a session or the admin token is required")
+	}
+	_, err := userAccess(req, userID)
+	return err
+}
+
+// graphqlPage returns the offset and limit arguments of a paged field like parsePage does,
+// capping the limit at max when max is positive.
+func graphqlPage(p graphql.ResolveParams, max int) (int, int, error) {
+	offset, limit := p.Args["offset"].(int), p.Args["limit"].(int)
+	if offset < 0 {
+		return 0, 0, errors.New("offset must be a non-negative integer")
+	}
+	if limit <= 0 {
+		return 0, 0, errors.New("limit must be a positive integer")
+	}
+	if max > 0 && limit > max {
+		limit = max
+	}
+	return offset, limit, nil
+}
+
+// sourceString reads a string field of the parent object.
+func sourceString(p graphql.ResolveParams, field string) string {
+	if m, ok := p.Source.(map[string]interface{}); ok {
+		if value, ok := m[field].(string); ok {
+			return value
+		}
+	}
+	return ""
+}
+
+// newGraphQLSchema builds the schema. Types reference each other, book to author to the author's
+// books, so they are declared first and their fields resolved lazily.
+func newGraphQLSchema() (graphql.Schema, error) {
+	var bookType, authorType, reviewType *graphql.Object
+
+	authorType = graphql.NewObject(graphql.ObjectConfig{
+		Name: "Author",
+		Fields: graphql.FieldsThunk(func() graphql.Fields {
+			return graphql.Fields{
+				"id":          {Type: graphql.String},
+				"name":        {Type: graphql.String},
+				"bio":         {Type: graphql.String},
+				"birth_year":  {Type: graphql.Int},
+				"nationality": {Type: graphql.String},
+				"books": {
+					Type: graphql.NewList(bookType),
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						client, ctx, err := connectElasticSearch()
+						if err != nil {
+							return nil, err
+						}
+						hits, err := authorBooks(client, ctx, sourceString(p, "id"))
+						if err != nil {
+							return nil, err
+						}
+						result := make([]interface{}, 0, len(hits))
+						for _, hit := range hits {
+							book, err := toGraphQL(hit.Book, hit.ID)
+							if err != nil {
+								return nil, err
+							}
+							result = append(result, book)
+						}
+						return result, nil
+					},
+				},
+			}
+		}),
+	})
+
+	reviewType = graphql.NewObject(graphql.ObjectConfig{
+		Name: "Review",
+		Fields: graphql.FieldsThunk(func() graphql.Fields {
+			return graphql.Fields{
+				"book_id":    {Type: graphql.String},
+				"user_id":    {Type: graphql.String},
+				"rating":     {Type: graphql.Int},
+				"text":       {Type: graphql.String},
+				"created_at": {Type: graphql.String},
+				"book": {
+					Type: bookType,
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return graphqlBook(sourceString(p, "book_id"))
+					},
+				},
+			}
+		}),
+	})
+
+	bookType = graphql.NewObject(graphql.ObjectConfig{
+		Name: "Book",
+		Fields: graphql.FieldsThunk(func() graphql.Fields {
+			return graphql.Fields{
+				"id":              {Type: graphql.String},
+				"title":           {Type: graphql.String},
+				"author_name":     {Type: graphql.String},
+				"author_id":       {Type: graphql.String},
+				"price":           {Type: graphql.Float},
+				"currency":        {Type: graphql.String},
+				"ebook_available": {Type: graphql.Boolean},
+				"formats":         {Type: graphql.NewList(graphql.String)},
+				"publish_date":    {Type: graphql.String},
+				"genre":           {Type: graphql.String},
+				"publisher":       {Type: graphql.String},
+				"isbn":            {Type: graphql.String},
+				"description":     {Type: graphql.String},
+				"cover_url":       {Type: graphql.String},
+				"page_count":      {Type: graphql.Int},
+				"language":        {Type: graphql.String},
+				"work_id":         {Type: graphql.String},
+				"rating_avg":      {Type: graphql.Float},
+				"rating_count":    {Type: graphql.Int},
+				"author": {
+					Type: authorType,
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						if id := sourceString(p, "author_id"); id != "" {
+							return graphqlAuthor(id)
+						}
+						return nil, nil
+					},
+				},
+				"reviews": {
+					Type: graphql.NewList(reviewType),
+					Args: graphql.FieldConfigArgument{
+						"sort":   {Type: graphql.String, DefaultValue: "newest"},
+						"offset": {Type: graphql.Int, DefaultValue: 0},
+						"limit":  {Type: graphql.Int, DefaultValue: 10},
+					},
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						if booksInPostgres() {
+							return nil, errElasticsearchOnly
+						}
+						offset, limit, err := graphqlPage(p, maxReviewsLimit)
+						if err != nil {
+							return nil, err
+						}
+						client, ctx, err := connectElasticSearch()
+						if err != nil {
+							return nil, err
+						}
+						page, err := listReviews(client, ctx, sourceString(p, "id"), p.Args["sort"].(string), offset, limit)
+						if err != nil {
+							return nil, err
+						}
+						var result struct {
+							Reviews []map[string]interface{} `json:"reviews"`
+						}
+						if err = json.Unmarshal([]byte(page), &result); err != nil {
+							return nil, errors.Wrap(err, "cannot decode reviews")
+						}
+						return result.Reviews, nil
+					},
+				},
+			}
+		}),
+	})
+
+	activityType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Activity",
+		Fields: graphql.Fields{
+			"route":  {Type: graphql.String},
+			"method": {Type: graphql.String},
+			"time":   {Type: graphql.String},
+			"status": {Type: graphql.Int},
+		},
+	})
+	activityPageType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "ActivityPage",
+		Fields: graphql.Fields{
+			"total":    {Type: graphql.Int},
+			"activity": {Type: graphql.NewList(activityType)},
+		},
+	})
+	searchResultType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "SearchResult",
+		Fields: graphql.Fields{
+			"total":          {Type: graphql.Int},
+			"total_relation": {Type: graphql.String},
+			"next_cursor":    {Type: graphql.Int},
+			"books":          {Type: graphql.NewList(bookType)},
+		},
+	})
+
+	query := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"book": {
+				Type: bookType,
+				Args: graphql.FieldConfigArgument{"id": {Type: graphql.NewNonNull(graphql.String)}},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return graphqlBook(tenantID(graphqlTenant(p), p.Args["id"].(string)))
+				},
+			},
+			"author": {
+				Type: authorType,
+				Args: graphql.FieldConfigArgument{"id": {Type: graphql.NewNonNull(graphql.String)}},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return graphqlAuthor(tenantID(graphqlTenant(p), p.Args["id"].(string)))
+				},
+			},
+			"search": {
+				Type: searchResultType,
+				Args: graphql.FieldConfigArgument{
+					"q":           {Type: graphql.String, DefaultValue: ""},
+					"title":       {Type: graphql.String, DefaultValue: ""},
+					"author_name": {Type: graphql.String, DefaultValue: ""},
+					"cursor":      {Type: graphql.Int, DefaultValue: 0},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					params := SearchParams{Query: p.Args["q"].(string), Title: p.Args["title"].(string),
+						AuthorName: p.Args["author_name"].(string), PriceRange: Range{-1, -1}, From: p.Args["cursor"].(int),
+						Tenant: graphqlTenant(p)}
+					if err := checkSearchOffset(params.From); err != nil {
+						return nil, err
+					}
+					hits, err := bookRepo.Search(params)
+					if err != nil {
+						return nil, err
+					}
+					result := map[string]interface{}{"total": hits.Total, "total_relation": hits.TotalRelation, "next_cursor": -1}
+					found := make([]interface{}, 0, len(hits.Hits))
+					for _, hit := range hits.Hits {
+						book, err := toGraphQL([]byte(hit.Source), hit.ID)
+						if err != nil {
+							return nil, err
+						}
+						found = append(found, book)
+					}
+					result["books"] = found
+					if next := params.From + len(hits.Hits); int64(next) < hits.Total && checkSearchOffset(next) == nil {
+						result["next_cursor"] = next
+					}
+					return result, nil
+				},
+			},
+			"activity": {
+				Type: activityPageType,
+				Args: graphql.FieldConfigArgument{
+					"user_id": {Type: graphql.NewNonNull(graphql.String)},
+					"offset":  {Type: graphql.Int, DefaultValue: 0},
+					"limit":   {Type: graphql.Int, DefaultValue: config.Activity.DefaultLimit},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					userID := tenantID(graphqlTenant(p), p.Args["user_id"].(string))
+					if err := graphqlAuthorize(p, userID); err != nil {
+						return nil, err
+					}
+					offset, limit, err := graphqlPage(p, config.Activity.MaxLimit)
+					if err != nil {
+						return nil, err
+					}
+					total, entries, err := activities.Page(userID, ActivityFilter{}, int64(offset), int64(limit))
+					if err != nil {
+						return nil, err
+					}
+					buf, err := json.Marshal(map[string]interface{}{"total": total, "activity": entries})
+					if err != nil {
+						return nil, errors.Wrap(err, "cannot create json result of activity")
+					}
+					return toGraphQL(buf, "")
+				},
+			},
+		},
+	})
+	return graphql.NewSchema(graphql.SchemaConfig{Query: query})
+}
+
+// graphqlQuery handles /graphql: GET ?query=&variables= or POST {"query", "variables",
+// "operationName"}, resolving books, authors, reviews and activity in one request.
+func graphqlQuery(w http.ResponseWriter, req *http.Request) {
+	var params struct {
+		Query         string                 `json:"query"`
+		Variables     map[string]interface{} `json:"variables"`
+		OperationName string                 `json:"operationName"`
+	}
+	switch req.Method {
+	case "GET":
+		params.Query = getParamValue(req, "query")
+		params.OperationName = getParamValue(req, "operationName")
+		if variables := getParamValue(req, "variables"); variables != "" {
+			if err := json.Unmarshal([]byte(variables), &params.Variables); err != nil {
+				fmt.Fprintf(w, "%s", errors.Wrap(err, "cannot decode graphql variables"))
+				return
+			}
+		}
+	case "POST":
+		if err := decodeStrictJSON(req.Body, &params); err != nil {
+			fmt.Fprintf(w, "%s", errors.Wrap(err, "cannot decode graphql request"))
+			return
+		}
+	default:
+		msg := "Unsupported request for /graphql " + req.Method
+		fmt.Fprintf(w, "%s", errors.New(msg))
+		return
+	}
+	result := graphql.Do(graphql.Params{Schema: graphqlSchema, RequestString: params.Query,
+		VariableValues: params.Variables, OperationName: params.OperationName,
+		Context: context.WithValue(req.Context(), graphqlRequestKey{}, req)})
+	buf, err := json.Marshal(result)
+	if err != nil {
+		fmt.Fprintf(w, "%s", errors.Wrap(err, "cannot create json result of graphql query"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "%s", buf)
+}
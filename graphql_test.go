@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useGraphQL serves the test's queries from a fresh schema and memory activity store.
+func useGraphQL(t *testing.T) {
+	t.Helper()
+	useMemoryRepository(t)
+	schema, err := newGraphQLSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+	savedSchema, savedActivities := graphqlSchema, activities
+	graphqlSchema, activities = schema, newMemoryActivityStore()
+	t.Cleanup(func() {
+		graphqlSchema, activities = savedSchema, savedActivities
+	})
+}
+
+func TestGraphQLActivity(t *testing.T) {
+	useGraphQL(t)
+	if err := activities.Record("alice", ActivityEntry{Route: "/book", Method: "GET", Time: time.Now().UTC()}); err != nil {
+		t.Fatal(err)
+	}
+	handler := http.HandlerFunc(graphqlQuery)
+	query := func(args string) string {
+		return "/graphql?query=" + url.QueryEscape(`{ activity(`+args+`) { total activity { route } } }`)
+	}
+
+	w := serve(handler, "GET", query(`user_id: "alice"`), nil)
+	if body := w.Body.String(); strings.Contains(body, "/book") || !strings.Contains(body, "admin token is required") {
+		t.Errorf("activity without credentials = %q", body)
+	}
+
+	admin := map[string]string{adminTokenHdr: testAdminToken}
+	w = serve(handler, "GET", query(`user_id: "alice"`), admin)
+	if body := w.Body.String(); !strings.Contains(body, `"route":"/book"`) {
+		t.Errorf("activity with the admin token = %q", body)
+	}
+
+	for args, want := range map[string]string{
+		`user_id: "alice", offset: -1`: "offset must be a non-negative integer",
+		`user_id: "alice", limit: -5`:  "limit must be a positive integer",
+	} {
+		w = serve(handler, "GET", query(args), admin)
+		if body := w.Body.String(); strings.Contains(body, "/book") || !strings.Contains(body, want) {
+			t.Errorf("activity(%s) = %q", args, body)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	errors "github.com/fiverr/go_errors"
+	"github.com/orensul/book_service/bookservicepb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// grpcServer implements bookservicepb.BookServiceServer on the same repository and write path
+// as the HTTP handlers.
+type grpcServer struct {
+	bookservicepb.UnimplementedBookServiceServer
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339Nano)
+}
+
+func toProtoBook(id string, book Book) *bookservicepb.Book {
+	return &bookservicepb.Book{Id: id, Title: book.Title, AuthorName: book.AuthorName, AuthorId: book.AuthorID,
+		Price: book.Price.String(), Currency: book.Currency, BasePrice: book.BasePrice.String(), Formats: book.Formats,
+		PublishDate: formatTime(book.PublishDate), Genre: book.Genre, Publisher: book.Publisher, Isbn: book.ISBN,
+		Description: book.Description, CoverUrl: book.CoverURL, PageCount: int32(book.PageCount), Language: book.Language,
+		WorkId: book.WorkID, RatingAvg: book.RatingAvg, RatingCount: book.RatingCount, IndexedAt: formatTime(book.IndexedAt)}
+}
+
+// fromProtoBook validates the client fields of a book like the /book PUT params, sanitized like
+// withInputLimits does for HTTP.
+func fromProtoBook(b *bookservicepb.Book) (Book, error) {
+	fields := map[string]string{"title": b.Title, "author_name": b.AuthorName, "author_id": b.AuthorId,
+		"genre": b.Genre, "publisher": b.Publisher, "description": b.Description, "cover_url": b.CoverUrl,
+		"work_id": b.WorkId, "formats": strings.Join(b.Formats, ","), "price": b.Price, "currency": b.Currency,
+		"isbn": b.Isbn, "language": b.Language, "publish_date": b.PublishDate}
+	if b.PageCount != 0 {
+		fields["page_count"] = strconv.Itoa(int(b.PageCount))
+	}
+	return bookFromParams(func(name string) string { return sanitizeText(fields[name]) })
+}
+
+// decodeBook decodes a stored book document.
+func decodeBook(source string) (Book, error) {
+	var book Book
+	if err := json.Unmarshal([]byte(source), &book); err != nil {
+		return book, errors.Wrap(err, "cannot decode the book")
+	}
+	return book, nil
+}
+
+// grpcError maps an error of the shared code to a status: validation errors are invalid
+// arguments, and others a failed precondition since the service does not tell them apart.
+func grpcError(err error) error {
+	if _, invalid := err.(*ValidationError); invalid {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	return status.Error(codes.FailedPrecondition, err.Error())
+}
+
+func (s *grpcServer) GetBook(ctx context.Context, req *bookservicepb.GetBookRequest) (*bookservicepb.Book, error) {
+	source, err := bookRepo.Get(req.Id)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	if source == "" {
+		return nil, status.Error(codes.NotFound, "book "+req.Id+" does not exist")
+	}
+	book, err := decodeBook(source)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return toProtoBook(req.Id, book), nil
+}
+
+func (s *grpcServer) PutBook(ctx context.Context, req *bookservicepb.PutBookRequest) (*bookservicepb.WriteReply, error) {
+	if req.Book == nil || req.Book.Id == "" {
+		return nil, status.Error(codes.InvalidArgument, "book.id is required")
+	}
+	book, err := fromProtoBook(req.Book)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	result, err := putBook(req.Book.Id, book)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &bookservicepb.WriteReply{Message: result}, nil
+}
+
+func (s *grpcServer) UpdateTitle(ctx context.Context, req *bookservicepb.UpdateTitleRequest) (*bookservicepb.WriteReply, error) {
+	result, err := retitleBook(req.Id, sanitizeText(req.Title))
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &bookservicepb.WriteReply{Message: result}, nil
+}
+
+func (s *grpcServer) DeleteBook(ctx context.Context, req *bookservicepb.DeleteBookRequest) (*bookservicepb.WriteReply, error) {
+	result, err := removeBook(req.Id)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	if result == "" {
+		return nil, status.Error(codes.NotFound, "book "+req.Id+" does not exist")
+	}
+	return &bookservicepb.WriteReply{Message: result}, nil
+}
+
+func (s *grpcServer) Search(ctx context.Context, req *bookservicepb.SearchRequest) (*bookservicepb.SearchReply, error) {
+	p := SearchParams{Query: req.Query, Title: req.Title, AuthorName: req.AuthorName, Publisher: strings.TrimSpace(req.Publisher),
+		Sort: req.Sort, MinRating: req.MinRating, CollapseEditions: req.CollapseEditions, From: int(req.Cursor)}
+	var err error
+	if p.PriceRange, err = parsePriceRange(req.PriceRange); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if p.Formats, err = parseFormats(strings.Join(req.Formats, ",")); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if req.Language != "" {
+		if p.Language, err = normalizeLanguage(req.Language); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+	if p.Sort != "" && p.Sort != "rating" {
+		return nil, status.Error(codes.InvalidArgument, "sort must be rating")
+	}
+	if err = checkSearchOffset(p.From); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	hits, err := bookRepo.Search(p)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	reply := &bookservicepb.SearchReply{Total: hits.Total, NextCursor: -1}
+	for _, hit := range hits.Hits {
+		book, err := decodeBook(hit.Source)
+		if err != nil {
+			return nil, grpcError(err)
+		}
+		reply.Books = append(reply.Books, toProtoBook(hit.ID, book))
+	}
+	if next := p.From + len(hits.Hits); int64(next) < hits.Total && checkSearchOffset(next) == nil {
+		reply.NextCursor = int32(next)
+	}
+	return reply, nil
+}
+
+func (s *grpcServer) ListActivity(ctx context.Context, req *bookservicepb.ListActivityRequest) (*bookservicepb.ListActivityReply, error) {
+	if req.UserId == "" {
+		return nil, status.Error(codes.InvalidArgument, "user_id is required")
+	}
+	limit := req.Limit
+	if limit <= 0 {
+		limit = int64(config.Activity.DefaultLimit)
+	}
+	if max := int64(config.Activity.MaxLimit); max > 0 && limit > max {
+		limit = max
+	}
+	total, entries, err := activities.Page(req.UserId, ActivityFilter{Route: req.Route, Method: req.Method}, req.Offset, limit)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	reply := &bookservicepb.ListActivityReply{Total: total}
+	for _, entry := range entries {
+		reply.Activity = append(reply.Activity, &bookservicepb.ActivityEntry{Route: entry.Route, Method: entry.Method,
+			Time: formatTime(entry.Time), Status: int32(entry.Status), Ip: entry.IP, UserAgent: entry.UserAgent, Country: entry.Country})
+	}
+	return reply, nil
+}
+
+// grpcWrites are the methods rejected in maintenance mode.
+var grpcWrites = map[string]bool{
+	"/bookservice.BookService/PutBook":     true,
+	"/bookservice.BookService/UpdateTitle": true,
+	"/bookservice.BookService/DeleteBook":  true,
+}
+
+// maintenanceInterceptor rejects writes as unavailable while in maintenance mode, like
+// withMaintenance on the HTTP API.
+func maintenanceInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if grpcWrites[info.FullMethod] && maintenanceStatus().Enabled {
+		return nil, status.Error(codes.Unavailable, maintenanceMessage)
+	}
+	return handler(ctx, req)
+}
+
+// grpcRequestIDs returns the book, author, work and user ids named by a request.
+func grpcRequestIDs(req interface{}) []string {
+	var ids []string
+	if r, ok := req.(interface{ GetId() string }); ok {
+		ids = append(ids, r.GetId())
+	}
+	if r, ok := req.(interface{ GetUserId() string }); ok {
+		ids = append(ids, r.GetUserId())
+	}
+	if r, ok := req.(interface{ GetBook() *bookservicepb.Book }); ok {
+		ids = append(ids, r.GetBook().GetId(), r.GetBook().GetAuthorId(), r.GetBook().GetWorkId())
+	}
+	return ids
+}
+
+// tenantInterceptor keeps the gRPC API, which has no API keys nor tenant, to the default catalog:
+// requests naming the ids of a tenant are denied, and searches only match the default catalog.
+func tenantInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	for _, id := range grpcRequestIDs(req) {
+		if idTenant(id) != "" {
+			return nil, status.Error(codes.PermissionDenied, "ids of a tenant are not served over gRPC: "+id)
+		}
+	}
+	return handler(ctx, req)
+}
+
+// serveGRPC serves the gRPC API on addr, next to the HTTP API.
+func serveGRPC(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errors.Wrap(err, "cannot listen for gRPC on "+addr)
+	}
+	server := grpc.NewServer(grpc.ChainUnaryInterceptor(maintenanceInterceptor, tenantInterceptor))
+	bookservicepb.RegisterBookServiceServer(server, &grpcServer{})
+	fmt.Println("serving gRPC on " + addr)
+	return server.Serve(listener)
+}
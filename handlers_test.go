@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testAdminToken = "test-admin-token"
+
+// useMemoryRepository serves the test from a fresh memory repository in demo mode, so the
+// handlers need neither Elasticsearch nor Redis.
+func useMemoryRepository(t *testing.T) {
+	t.Helper()
+	savedConfig, savedDemoMode, savedRepo := config, demoMode, bookRepo
+	c := defaultConfig()
+	c.AdminToken = testAdminToken
+	config = demoConfig(c)
+	demoMode = true
+	bookRepo = newMemoryBookRepository()
+	t.Cleanup(func() {
+		config, demoMode, bookRepo = savedConfig, savedDemoMode, savedRepo
+	})
+}
+
+// useRedis points the Redis clients at a scratch database, flushed for the test, and skips the
+// test when Redis is not running.
+func useRedis(t *testing.T) {
+	t.Helper()
+	savedDB := config.Redis.DB
+	config.Redis.DB = 15
+	client, err := connectRedis()
+	if err != nil {
+		client.Close()
+		config.Redis.DB = savedDB
+		t.Skip("Redis is not available:", err)
+	}
+	if err = client.FlushDb().Err(); err != nil {
+		t.Fatal(err)
+	}
+	sharedRedisOnce.Do(func() {})
+	savedClient := sharedRedisClient
+	sharedRedisClient = client
+	t.Cleanup(func() {
+		client.FlushDb()
+		client.Close()
+		sharedRedisClient, config.Redis.DB = savedClient, savedDB
+	})
+}
+
+// serve runs the handler on a request to target and returns the recorded response.
+func serve(handler http.Handler, method string, target string, header map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, nil)
+	for name, value := range header {
+		req.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+// putTestBook stores a book through the repository, as a PUT on /book would.
+func putTestBook(t *testing.T, id string, book Book) {
+	t.Helper()
+	if _, err := bookRepo.Put(id, book); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBookLifecycle(t *testing.T) {
+	useMemoryRepository(t)
+	handler := http.HandlerFunc(book)
+
+	w := serve(handler, "PUT", "/book?id=1&title=Dune&author_name=Frank+Herbert&price=9.99", nil)
+	if !strings.Contains(w.Body.String(), "Stored book 1") {
+		t.Fatalf("PUT /book = %q", w.Body.String())
+	}
+
+	w = serve(handler, "GET", "/book?id=1", nil)
+	var got Book
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("GET /book = %q: %v", w.Body.String(), err)
+	}
+	if got.Title != "Dune" || got.AuthorName != "Frank Herbert" || got.Price != priceFromFloat(9.99) {
+		t.Errorf("GET /book = %+v", got)
+	}
+
+	w = serve(handler, "POST", "/book?id=1&title=Dune+Messiah", nil)
+	if !strings.Contains(w.Body.String(), "is now 2") {
+		t.Fatalf("POST /book = %q", w.Body.String())
+	}
+	source, err := bookRepo.Get("1")
+	if err != nil || !strings.Contains(source, "Dune Messiah") {
+		t.Errorf("book after POST = %q, %v", source, err)
+	}
+
+	w = serve(handler, "DELETE", "/book?id=1", nil)
+	if !strings.Contains(w.Body.String(), "Deleted book 1") {
+		t.Fatalf("DELETE /book = %q", w.Body.String())
+	}
+	if w = serve(handler, "GET", "/book?id=1", nil); w.Body.String() != "" {
+		t.Errorf("GET /book after DELETE = %q", w.Body.String())
+	}
+}
+
+func TestBookValidation(t *testing.T) {
+	useMemoryRepository(t)
+	w := serve(http.HandlerFunc(book), "PUT", "/book?id=1&title=Dune", nil)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("PUT /book without author_name = %d %q", w.Code, w.Body.String())
+	}
+	if source, _ := bookRepo.Get("1"); source != "" {
+		t.Errorf("invalid book was stored: %q", source)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	useMemoryRepository(t)
+	putTestBook(t, "1", Book{Title: "Dune", AuthorName: "Frank Herbert", Price: priceFromFloat(9.99)})
+	putTestBook(t, "2", Book{Title: "Emma", AuthorName: "Jane Austen", Price: priceFromFloat(5)})
+	putTestBook(t, "3", Book{Title: "Dune Messiah", AuthorName: "Frank Herbert", Price: priceFromFloat(12)})
+
+	w := serve(http.HandlerFunc(search), "GET", "/search?author_name=herbert", nil)
+	if total := w.Header().Get("X-Total-Count"); total != "2" {
+		t.Errorf("X-Total-Count = %q, want 2", total)
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, `"title":"Dune"`) || !strings.Contains(body, `"title":"Dune Messiah"`) || strings.Contains(body, "Emma") {
+		t.Errorf("GET /search = %q", body)
+	}
+
+	w = serve(http.HandlerFunc(search), "GET", "/search?price_range=0-10", nil)
+	if total := w.Header().Get("X-Total-Count"); total != "2" {
+		t.Errorf("X-Total-Count with price_range = %q, want 2", total)
+	}
+	if strings.Contains(w.Body.String(), "Messiah") {
+		t.Errorf("GET /search with price_range = %q", w.Body.String())
+	}
+}
+
+func TestStore(t *testing.T) {
+	useMemoryRepository(t)
+	putTestBook(t, "1", Book{Title: "Dune", AuthorName: "Frank Herbert", Price: priceFromFloat(10)})
+	putTestBook(t, "2", Book{Title: "Dune Messiah", AuthorName: "Frank Herbert", Price: priceFromFloat(20)})
+	putTestBook(t, "3", Book{Title: "Emma", AuthorName: "Jane Austen", Price: priceFromFloat(30)})
+
+	w := serve(http.HandlerFunc(store), "GET", "/store", nil)
+	var stats AggsRes
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+		t.Fatalf("GET /store = %q: %v", w.Body.String(), err)
+	}
+	if stats.Books != 3 || stats.Authors != 2 || stats.AvgPrice != priceFromFloat(20) || stats.Currency != "USD" {
+		t.Errorf("GET /store = %+v", stats)
+	}
+}
+
+func TestElasticsearchOnlyRoutesWithPostgres(t *testing.T) {
+	useMemoryRepository(t)
+	config.Books.Backend = "postgres"
+	routes := map[string]http.HandlerFunc{
+		"/authors/a1":       authors,
+		"/books/1/reviews":  books,
+		"/books/recent":     books,
+		"/alerts?user_id=1": alerts,
+		"/lists":            lists,
+		"/search/live?q=du": liveSearch,
+	}
+	for target, handler := range routes {
+		if w := serve(handler, "GET", target, nil); w.Code != http.StatusNotImplemented {
+			t.Errorf("GET %s with postgres = %d %q", target, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestGetBooksFromRepository(t *testing.T) {
+	useMemoryRepository(t)
+	putTestBook(t, "1", Book{Title: "Dune", AuthorName: "Frank Herbert"})
+	putTestBook(t, "2", Book{Title: "Emma", AuthorName: "Jane Austen"})
+	titles, err := bookTitles([]string{"2", "missing", "1"})
+	if err != nil || len(titles) != 2 || titles["1"] != "Dune" || titles["2"] != "Emma" {
+		t.Errorf("bookTitles = %v, %v", titles, err)
+	}
+	docs, err := hydrateBooks([]string{"2", "missing", "1"})
+	if err != nil || len(docs) != 2 || !strings.Contains(string(docs[0]), "Emma") {
+		t.Errorf("hydrateBooks = %s, %v", docs, err)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	errors "github.com/fiverr/go_errors"
+	"gopkg.in/redis.v5"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// SearchHistoryEntry is a single /search query recorded for a user.
+type SearchHistoryEntry struct {
+	Query           string    `json:"q,omitempty"`
+	Title           string    `json:"title,omitempty"`
+	AuthorName      string    `json:"author_name,omitempty"`
+	PriceRange      string    `json:"price_range,omitempty"`
+	DisplayCurrency string    `json:"display_currency,omitempty"`
+	Time            time.Time `json:"time"`
+}
+
+func searchHistoryKey(userID string) string {
+	return "search_history:" + userID
+}
+
+// recordSearch adds the query to the user's search history, scored by time.
+func recordSearch(userID string, entry SearchHistoryEntry) error {
+	client, err := connectRedis()
+	if err != nil {
+		return errors.Wrap(err, "cannot connect to Redis")
+	}
+	defer client.Close()
+	buf, err := json.Marshal(entry)
+	if err != nil {
+		return errors.Wrap(err, "cannot create json search history entry")
+	}
+	score := float64(entry.Time.UnixNano())
+	if err = client.ZAdd(searchHistoryKey(userID), redis.Z{Score: score, Member: string(buf)}).Err(); err != nil {
+		return errors.Wrap(err, "cannot set key in Redis")
+	}
+	return nil
+}
+
+// getSearchHistory returns a page of the user's searches, newest first.
+func getSearchHistory(client *redis.Client, userID string, offset int64, limit int64) (string, error) {
+	members, err := client.ZRevRange(searchHistoryKey(userID), offset, offset+limit-1).Result()
+	if err != nil {
+		return "", errors.Wrap(err, "cannot get key from Redis")
+	}
+	total, err := client.ZCard(searchHistoryKey(userID)).Result()
+	if err != nil {
+		return "", errors.Wrap(err, "cannot get key from Redis")
+	}
+	entries := make([]json.RawMessage, 0, len(members))
+	for _, member := range members {
+		entries = append(entries, json.RawMessage(member))
+	}
+	buf, err := json.Marshal(map[string]interface{}{"total": total, "offset": offset, "limit": limit, "searches": entries})
+	if err != nil {
+		return "", errors.Wrap(err, "cannot create json result of search history")
+	}
+	return string(buf), nil
+}
+
+// parsePage reads the offset and limit params, applying the default limit when missing.
+func parsePage(req *http.Request, defaultLimit int64) (int64, int64, error) {
+	offset, limit := int64(0), defaultLimit
+	if value := getParamValue(req, "offset"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed < 0 {
+			return 0, 0, errors.New("offset must be a non-negative integer")
+		}
+		offset = parsed
+	}
+	if value := getParamValue(req, "limit"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed <= 0 {
+			return 0, 0, errors.New("limit must be a positive integer")
+		}
+		limit = parsed
+	}
+	return offset, limit, nil
+}
+
+// searchHistory handles GET and DELETE on /users/{id}/search-history.
+func searchHistory(w http.ResponseWriter, req *http.Request, userID string) {
+	var err error
+	var result string
+	client, err := connectRedis()
+	if err != nil {
+		err = errors.Wrap(err, "cannot connect to Redis")
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	defer client.Close()
+	switch req.Method {
+	case "GET":
+		var offset, limit int64
+		offset, limit, err = parsePage(req, 20)
+		if err == nil {
+			result, err = getSearchHistory(client, userID, offset, limit)
+		}
+	case "DELETE":
+		err = client.Del(searchHistoryKey(userID)).Err()
+		if err != nil {
+			err = errors.Wrap(err, "cannot delete key in Redis")
+		} else {
+			result = fmt.Sprintf("Cleared search history of user %s\n", userID)
+		}
+	default:
+		msg := "Unsupported request for " + req.URL.Path + " " + req.Method
+		err = errors.New(msg)
+	}
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+	} else {
+		fmt.Fprintf(w, "%s", result)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	errors "github.com/fiverr/go_errors"
+	"gopkg.in/olivere/elastic.v5"
+	"gopkg.in/redis.v5"
+	"net/http"
+	"time"
+)
+
+// holdsKey is the queue of users waiting for a copy of a book, scored by when they placed the hold.
+func holdsKey(bookID string) string {
+	return "holds:" + bookID
+}
+
+// holdWebhooksKey is a hash of user id to the webhook notified when the hold is fulfilled.
+func holdWebhooksKey(bookID string) string {
+	return "hold_webhooks:" + bookID
+}
+
+// copyAvailable reports whether a copy of the book can be borrowed right now.
+func copyAvailable(client *redis.Client, bookID string) (bool, error) {
+	copies, err := client.Get(libraryCopiesKey(bookID)).Int64()
+	if err == redis.Nil {
+		return false, errors.New("the library has no copies of book " + bookID)
+	}
+	if err != nil {
+		return false, errors.Wrap(err, "cannot get key from Redis")
+	}
+	lent, err := client.Get(libraryLentKey(bookID)).Int64()
+	if err != nil && err != redis.Nil {
+		return false, errors.Wrap(err, "cannot get key from Redis")
+	}
+	return lent < copies, nil
+}
+
+// placeHold queues the user for the next copy of the book. Holds are only taken while every copy
+// is lent out.
+func placeHold(client *redis.Client, bookID string, userID string, webhookURL string) (string, error) {
+	available, err := copyAvailable(client, bookID)
+	if err != nil {
+		return "", err
+	}
+	if available {
+		return "", errors.New("a copy of book " + bookID + " is available, borrow it instead")
+	}
+	score := float64(time.Now().UnixNano())
+	if err = client.ZAddNX(holdsKey(bookID), redis.Z{Score: score, Member: userID}).Err(); err != nil {
+		return "", errors.Wrap(err, "cannot set key in Redis")
+	}
+	if webhookURL != "" {
+		if err = client.HSet(holdWebhooksKey(bookID), userID, webhookURL).Err(); err != nil {
+			return "", errors.Wrap(err, "cannot set key in Redis")
+		}
+	}
+	position, err := client.ZRank(holdsKey(bookID), userID).Result()
+	if err != nil {
+		return "", errors.Wrap(err, "cannot get key from Redis")
+	}
+	return fmt.Sprintf("User %s is number %d in line for book %s\n", userID, position+1, bookID), nil
+}
+
+func cancelHold(client *redis.Client, bookID string, userID string) error {
+	_, err := client.TxPipelined(func(pipe *redis.Pipeline) error {
+		pipe.ZRem(holdsKey(bookID), userID)
+		pipe.HDel(holdWebhooksKey(bookID), userID)
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "cannot delete key in Redis")
+	}
+	return nil
+}
+
+// assignNextHolder lends a returned copy to the first user in line and notifies them. Holders who
+// cannot borrow it, for example because they borrowed another copy meanwhile, are skipped.
+func assignNextHolder(client *elastic.Client, ctx context.Context, redisClient *redis.Client, bookID string) error {
+	for {
+		holders, err := redisClient.ZRange(holdsKey(bookID), 0, 0).Result()
+		if err != nil {
+			return errors.Wrap(err, "cannot get key from Redis")
+		}
+		if len(holders) == 0 {
+			return nil
+		}
+		userID := holders[0]
+		webhookURL, _ := redisClient.HGet(holdWebhooksKey(bookID), userID).Result()
+		if err = cancelHold(redisClient, bookID, userID); err != nil {
+			return err
+		}
+		loan, err := borrowBook(client, ctx, redisClient, bookID, userID, defaultLoanDays)
+		if err == errNoCopyAvailable {
+			// another request took the copy first, keep the holder in line
+			redisClient.ZAdd(holdsKey(bookID), redis.Z{Score: 0, Member: userID})
+			if webhookURL != "" {
+				redisClient.HSet(holdWebhooksKey(bookID), userID, webhookURL)
+			}
+			return nil
+		}
+		if err != nil {
+			fmt.Println(errors.Wrap(err, "cannot lend book "+bookID+" to holder "+userID))
+			continue
+		}
+		notifyAsync([]Notification{{
+			Type:       "hold_ready",
+			UserID:     userID,
+			WebhookURL: webhookURL,
+			Payload:    map[string]interface{}{"book_id": bookID, "loan": json.RawMessage(loan)},
+		}})
+		return nil
+	}
+}
+
+// holds handles /books/{id}/holds: GET ?user_id= returns the queue length and the user's place,
+// POST ?user_id=&webhook_url= places a hold and DELETE ?user_id= cancels it.
+func holds(w http.ResponseWriter, req *http.Request, bookID string) {
+	var err error
+	var result string
+	userID := tenantParam(req, "user_id")
+	if userID == "" && req.Method != "GET" {
+		fmt.Fprintf(w, "%s", errors.New("user_id is required"))
+		return
+	}
+	client, err := connectRedis()
+	if err != nil {
+		err = errors.Wrap(err, "cannot connect to Redis")
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	defer client.Close()
+	switch req.Method {
+	case "GET":
+		var waiting int64
+		waiting, err = client.ZCard(holdsKey(bookID)).Result()
+		if err != nil {
+			err = errors.Wrap(err, "cannot get key from Redis")
+			break
+		}
+		response := map[string]interface{}{"book_id": bookID, "waiting": waiting}
+		if userID != "" {
+			if position, rankErr := client.ZRank(holdsKey(bookID), userID).Result(); rankErr == nil {
+				response["position"] = position + 1
+			}
+		}
+		var buf []byte
+		buf, err = json.Marshal(response)
+		result = string(buf)
+	case "POST":
+		result, err = placeHold(client, bookID, userID, getParamValue(req, "webhook_url"))
+	case "DELETE":
+		if err = cancelHold(client, bookID, userID); err == nil {
+			result = fmt.Sprintf("Cancelled the hold of user %s on book %s\n", userID, bookID)
+		}
+	default:
+		msg := "Unsupported request for /books/{id}/holds " + req.Method
+		err = errors.New(msg)
+	}
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+	} else {
+		fmt.Fprintf(w, "%s", result)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	errors "github.com/fiverr/go_errors"
+	"gopkg.in/olivere/elastic.v5"
+	"net/http"
+	"strings"
+)
+
+// normalizeISBN strips hyphens and spaces from an ISBN and validates its ISBN-10 or ISBN-13 checksum.
+func normalizeISBN(isbn string) (string, error) {
+	isbn = strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(isbn))
+	switch len(isbn) {
+	case 10:
+		sum := 0
+		for i, c := range isbn {
+			var digit int
+			switch {
+			case c >= '0' && c <= '9':
+				digit = int(c - '0')
+			case c == 'X' && i == 9:
+				digit = 10
+			default:
+				return "", errors.New("invalid ISBN-10 " + isbn)
+			}
+			sum += (10 - i) * digit
+		}
+		if sum%11 != 0 {
+			return "", errors.New("invalid ISBN-10 checksum " + isbn)
+		}
+	case 13:
+		sum := 0
+		for i, c := range isbn {
+			if c < '0' || c > '9' {
+				return "", errors.New("invalid ISBN-13 " + isbn)
+			}
+			weight := 1
+			if i%2 == 1 {
+				weight = 3
+			}
+			sum += weight * int(c-'0')
+		}
+		if sum%10 != 0 {
+			return "", errors.New("invalid ISBN-13 checksum " + isbn)
+		}
+	default:
+		return "", errors.New("ISBN must have 10 or 13 digits: " + isbn)
+	}
+	return isbn, nil
+}
+
+// findBooksByISBN returns the books of the tenant with exactly the given (normalized) ISBN.
+func findBooksByISBN(client *elastic.Client, ctx context.Context, isbn string, tenant string) ([]BookHit, error) {
+	query := elastic.NewBoolQuery().Must(elastic.NewTermQuery("isbn", isbn)).Filter(tenantQuery(tenant))
+	searchResult, err := client.Search().Index(booksIndex()).Query(query).Size(10).Do(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot search books by ISBN")
+	}
+	return bookHits(searchResult), nil
+}
+
+// isbnLookup handles GET /books/isbn/{isbn}.
+func isbnLookup(w http.ResponseWriter, req *http.Request, rawISBN string) {
+	if !requireElasticsearch(w, req) {
+		return
+	}
+	if req.Method != "GET" {
+		msg := "Unsupported request for /books/isbn " + req.Method
+		fmt.Fprintf(w, "%s", errors.New(msg))
+		return
+	}
+	isbn, err := normalizeISBN(rawISBN)
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	client, ctx, err := connectElasticSearch()
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	hits, err := findBooksByISBN(client, ctx, isbn, requestTenant(req))
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	if len(hits) == 0 {
+		http.NotFound(w, req)
+		return
+	}
+	buf, err := json.Marshal(hits)
+	if err != nil {
+		fmt.Fprintf(w, "%s", errors.Wrap(err, "cannot create json result of ISBN lookup"))
+		return
+	}
+	fmt.Fprintf(w, "%s", buf)
+}
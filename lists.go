@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	errors "github.com/fiverr/go_errors"
+	"gopkg.in/olivere/elastic.v5"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	listsMapping = `
+{
+	"settings":{
+		"number_of_shards": 1,
+		"number_of_replicas": 0
+	},
+	"mappings":{
+		"list":{
+			"properties": {
+				"user_id": { "type": "keyword" },
+				"name": { "type": "text" },
+				"description": { "type": "text" },
+				"public": { "type": "boolean" },
+				"share_token": { "type": "keyword" },
+				"tenant": { "type": "keyword" },
+				"entries": {
+					"properties": {
+						"book_id": { "type": "keyword" },
+						"note": { "type": "text" }
+					}
+				},
+				"created_at": { "type": "date" },
+				"updated_at": { "type": "date" }
+			}
+		}
+	}
+}`
+	LISTS_INDEX = "lists"
+	LIST_TYPE   = "list"
+
+	maxListEntries = 500
+)
+
+// ListEntry is a book in a reading list, in list order.
+type ListEntry struct {
+	BookID string `json:"book_id"`
+	Note   string `json:"note,omitempty"`
+}
+
+// ReadingList is a user's named, ordered collection of books. Private lists can still be read by
+// anyone holding the share token.
+type ReadingList struct {
+	UserID      string      `json:"user_id"`
+	Name        string      `json:"name"`
+	Description string      `json:"description,omitempty"`
+	Public      bool        `json:"public"`
+	ShareToken  string      `json:"share_token"`
+	Entries     []ListEntry `json:"entries"`
+	CreatedAt   time.Time   `json:"created_at"`
+	UpdatedAt   time.Time   `json:"updated_at"`
+	// Tenant is the catalog of the list's user and books, empty for the default one
+	Tenant string `json:"tenant,omitempty"`
+}
+
+func ensureListsIndex(client *elastic.Client, ctx context.Context) error {
+	exists, err := client.IndexExists(LISTS_INDEX).Do(ctx)
+	if err != nil {
+		return errors.Wrap(err, "cannot check lists index")
+	}
+	if !exists {
+		if _, err = client.CreateIndex(LISTS_INDEX).BodyString(listsMapping).Do(ctx); err != nil {
+			return errors.Wrap(err, "cannot create lists index")
+		}
+	}
+	return nil
+}
+
+// getList returns the list with the given id, or nil when there is none.
+func getList(client *elastic.Client, ctx context.Context, id string) (*ReadingList, error) {
+	get, err := client.Get().Index(LISTS_INDEX).Type(typeName(LIST_TYPE)).Id(id).Do(ctx)
+	if err != nil {
+		if elastic.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "cannot get the list")
+	}
+	if !get.Found {
+		return nil, nil
+	}
+	var list ReadingList
+	if err = json.Unmarshal(*get.Source, &list); err != nil {
+		return nil, errors.Wrap(err, "cannot decode the list")
+	}
+	return &list, nil
+}
+
+// getOwnList returns the list when it belongs to the user.
+func getOwnList(client *elastic.Client, ctx context.Context, userID string, id string) (*ReadingList, error) {
+	list, err := getList(client, ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if list == nil || list.UserID != userID {
+		return nil, errors.New("user " + userID + " has no list " + id)
+	}
+	return list, nil
+}
+
+func saveList(client *elastic.Client, ctx context.Context, id string, list *ReadingList) (string, error) {
+	if err := ensureListsIndex(client, ctx); err != nil {
+		return "", err
+	}
+	list.UpdatedAt = time.Now().UTC()
+	service := client.Index().Index(LISTS_INDEX).Type(typeName(LIST_TYPE)).BodyJson(list).Refresh("wait_for")
+	if id != "" {
+		service = service.Id(id)
+	}
+	put, err := service.Do(ctx)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot save the list")
+	}
+	return put.Id, nil
+}
+
+// listJSON encodes a list together with its id.
+func listJSON(id string, list *ReadingList) (string, error) {
+	buf, err := json.Marshal(map[string]interface{}{"id": id, "list": list})
+	if err != nil {
+		return "", errors.Wrap(err, "cannot create json result of list")
+	}
+	return string(buf), nil
+}
+
+// searchLists finds lists matching q in their name or description, restricted to a query.
+func searchLists(client *elastic.Client, ctx context.Context, filter elastic.Query, q string, offset int, limit int) (string, error) {
+	query := elastic.NewBoolQuery().Filter(filter)
+	if q != "" {
+		query = query.Must(elastic.NewMultiMatchQuery(q, "name^2", "description", "entries.note"))
+	}
+	lists := make([]map[string]interface{}, 0)
+	var total int64
+	searchResult, err := client.Search().Index(LISTS_INDEX).Query(query).Sort("updated_at", false).Sort(idSortField(), true).
+		From(offset).Size(limit).Do(ctx)
+	if err != nil && !elastic.IsNotFound(err) {
+		return "", errors.Wrap(err, "cannot search lists")
+	}
+	if err == nil {
+		total = searchResult.Hits.TotalHits
+		for _, hit := range searchResult.Hits.Hits {
+			lists = append(lists, map[string]interface{}{"id": hit.Id, "list": hit.Source})
+		}
+	}
+	buf, err := json.Marshal(map[string]interface{}{"total": total, "offset": offset, "limit": limit, "lists": lists})
+	if err != nil {
+		return "", errors.Wrap(err, "cannot create json result of lists")
+	}
+	return string(buf), nil
+}
+
+// setListFields applies the name, description and public params present in the request.
+func setListFields(req *http.Request, list *ReadingList) error {
+	if name := strings.TrimSpace(getParamValue(req, "name")); name != "" {
+		list.Name = name
+	}
+	if description := getParamValue(req, "description"); description != "" {
+		list.Description = description
+	}
+	if public := getParamValue(req, "public"); public != "" {
+		var err error
+		if list.Public, err = strconv.ParseBool(public); err != nil {
+			return errors.Wrap(err, "conversion from string to bool for field public failed")
+		}
+	}
+	if list.Name == "" {
+		return errors.New("name is required")
+	}
+	return nil
+}
+
+// putListEntry adds the book to the list or moves it, at the 0-based position param, or last.
+func putListEntry(req *http.Request, list *ReadingList, bookID string) error {
+	entry := ListEntry{BookID: bookID, Note: getParamValue(req, "note")}
+	entries := make([]ListEntry, 0, len(list.Entries)+1)
+	for _, e := range list.Entries {
+		if e.BookID == bookID {
+			if entry.Note == "" {
+				entry.Note = e.Note
+			}
+			continue
+		}
+		entries = append(entries, e)
+	}
+	if len(entries) >= maxListEntries {
+		return errors.New("a list has at most " + strconv.Itoa(maxListEntries) + " books")
+	}
+	position := len(entries)
+	if value := getParamValue(req, "position"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			return errors.New("position must be a non-negative integer")
+		}
+		if parsed < position {
+			position = parsed
+		}
+	}
+	entries = append(entries, ListEntry{})
+	copy(entries[position+1:], entries[position:])
+	entries[position] = entry
+	list.Entries = entries
+	return nil
+}
+
+// userLists handles the reading lists of a user: GET and POST on /users/{id}/lists, GET, PUT and
+// DELETE on /users/{id}/lists/{list_id}, and PUT ?position=&note= and DELETE on
+// /users/{id}/lists/{list_id}/books/{book_id} to add, move and remove books.
+func userLists(w http.ResponseWriter, req *http.Request, userID string, rest []string) {
+	if !requireElasticsearch(w, req) {
+		return
+	}
+	var err error
+	var result string
+	client, ctx, err := connectElasticSearch()
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	var list *ReadingList
+	switch {
+	case len(rest) == 0 && req.Method == "GET":
+		var offset, limit int64
+		offset, limit, err = parsePage(req, 20)
+		if err == nil {
+			result, err = searchLists(client, ctx, elastic.NewTermQuery("user_id", userID), getParamValue(req, "q"), int(offset), int(limit))
+		}
+	case len(rest) == 0 && req.Method == "POST":
+		now := time.Now().UTC()
+		list = &ReadingList{UserID: userID, Entries: make([]ListEntry, 0), CreatedAt: now, Tenant: requestTenant(req)}
+		if err = setListFields(req, list); err != nil {
+			break
+		}
+		if list.ShareToken, err = randomToken(16); err != nil {
+			break
+		}
+		var id string
+		if id, err = saveList(client, ctx, "", list); err == nil {
+			result, err = listJSON(id, list)
+		}
+	case len(rest) == 1 && req.Method == "GET":
+		if list, err = getOwnList(client, ctx, userID, rest[0]); err == nil {
+			result, err = listJSON(rest[0], list)
+		}
+	case len(rest) == 1 && req.Method == "PUT":
+		if list, err = getOwnList(client, ctx, userID, rest[0]); err != nil {
+			break
+		}
+		if err = setListFields(req, list); err != nil {
+			break
+		}
+		if _, err = saveList(client, ctx, rest[0], list); err == nil {
+			result, err = listJSON(rest[0], list)
+		}
+	case len(rest) == 1 && req.Method == "DELETE":
+		if _, err = getOwnList(client, ctx, userID, rest[0]); err != nil {
+			break
+		}
+		if _, err = client.Delete().Index(LISTS_INDEX).Type(typeName(LIST_TYPE)).Id(rest[0]).Refresh("wait_for").Do(ctx); err != nil {
+			err = errors.Wrap(err, "cannot delete the list")
+			break
+		}
+		result = fmt.Sprintf("Deleted list %s\n", rest[0])
+	case len(rest) == 3 && rest[1] == "books" && (req.Method == "PUT" || req.Method == "DELETE"):
+		if list, err = getOwnList(client, ctx, userID, rest[0]); err != nil {
+			break
+		}
+		bookID := tenantID(requestTenant(req), rest[2])
+		if req.Method == "PUT" {
+			err = putListEntry(req, list, bookID)
+		} else {
+			entries := make([]ListEntry, 0, len(list.Entries))
+			for _, e := range list.Entries {
+				if e.BookID != bookID {
+					entries = append(entries, e)
+				}
+			}
+			list.Entries = entries
+		}
+		if err != nil {
+			break
+		}
+		if _, err = saveList(client, ctx, rest[0], list); err == nil {
+			result, err = listJSON(rest[0], list)
+		}
+	default:
+		msg := "Unsupported request for " + req.URL.Path + " " + req.Method
+		err = errors.New(msg)
+	}
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+	} else {
+		fmt.Fprintf(w, "%s", result)
+	}
+}
+
+// lists handles GET /lists?q= searching the public lists, and GET /lists/shared/{token} reading
+// a list through its share token, both within the tenant's catalog.
+func lists(w http.ResponseWriter, req *http.Request) {
+	if !requireElasticsearch(w, req) {
+		return
+	}
+	if req.Method != "GET" {
+		msg := "Unsupported request for /lists " + req.Method
+		fmt.Fprintf(w, "%s", errors.New(msg))
+		return
+	}
+	client, ctx, err := connectElasticSearch()
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, "/lists"), "/"), "/")
+	tenant := requestTenant(req)
+	var result string
+	switch {
+	case len(parts) == 1 && parts[0] == "":
+		var offset, limit int64
+		offset, limit, err = parsePage(req, 20)
+		if err == nil {
+			result, err = searchLists(client, ctx, elastic.NewBoolQuery().Filter(elastic.NewTermQuery("public", true), tenantQuery(tenant)), getParamValue(req, "q"), int(offset), int(limit))
+		}
+	case len(parts) == 2 && parts[0] == "shared" && parts[1] != "":
+		var searchResult *elastic.SearchResult
+		searchResult, err = client.Search().Index(LISTS_INDEX).Query(elastic.NewBoolQuery().Filter(elastic.NewTermQuery("share_token", parts[1]), tenantQuery(tenant))).Size(1).Do(ctx)
+		if err != nil && !elastic.IsNotFound(err) {
+			err = errors.Wrap(err, "cannot search lists")
+			break
+		}
+		if err != nil || len(searchResult.Hits.Hits) == 0 {
+			http.NotFound(w, req)
+			return
+		}
+		hit := searchResult.Hits.Hits[0]
+		var buf []byte
+		buf, err = json.Marshal(map[string]interface{}{"id": hit.Id, "list": hit.Source})
+		result = string(buf)
+	default:
+		err = errors.New("Unsupported route " + req.URL.Path)
+	}
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+	} else {
+		fmt.Fprintf(w, "%s", result)
+	}
+}
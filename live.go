@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	errors "github.com/fiverr/go_errors"
+	"github.com/gorilla/websocket"
+	"gopkg.in/olivere/elastic.v5"
+	"net/http"
+	"sync"
+)
+
+// LiveSearchQuery is sent by a /search/live client to start or replace its subscription.
+type LiveSearchQuery struct {
+	Title      string `json:"title"`
+	AuthorName string `json:"author_name"`
+	PriceRange string `json:"price_range"`
+}
+
+// LiveSearchMessage is pushed to a /search/live client for every matching book.
+type LiveSearchMessage struct {
+	Type  string          `json:"type"`
+	ID    string          `json:"id,omitempty"`
+	Book  json.RawMessage `json:"book,omitempty"`
+	Error string          `json:"error,omitempty"`
+}
+
+var upgrader = websocket.Upgrader{ReadBufferSize: 1024, WriteBufferSize: 1024}
+
+// liveSearch upgrades the connection to a WebSocket and pushes books matching the client's
+// query whenever a catalog event reports a created or updated book.
+func liveSearch(w http.ResponseWriter, req *http.Request) {
+	if !requireElasticsearch(w, req) {
+		return
+	}
+	// only books of the tenant the connection was opened for are pushed
+	tenant := requestTenant(req)
+	conn, err := upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		fmt.Println(errors.Wrap(err, "cannot upgrade to WebSocket"))
+		return
+	}
+	defer conn.Close()
+
+	client, ctx, err := connectElasticSearch()
+	if err != nil {
+		conn.WriteJSON(LiveSearchMessage{Type: "error", Error: err.Error()})
+		return
+	}
+	redisClient, err := connectRedis()
+	if err != nil {
+		conn.WriteJSON(LiveSearchMessage{Type: "error", Error: errors.Wrap(err, "cannot connect to Redis").Error()})
+		return
+	}
+	defer redisClient.Close()
+	pubsub, err := redisClient.Subscribe(catalogEventsChannel)
+	if err != nil {
+		conn.WriteJSON(LiveSearchMessage{Type: "error", Error: errors.Wrap(err, "cannot subscribe to catalog events").Error()})
+		return
+	}
+	defer pubsub.Close()
+
+	var mu sync.Mutex
+	var query *elastic.BoolQuery
+	// read queries from the client until it disconnects
+	go func() {
+		defer pubsub.Close()
+		for {
+			_, message, err := conn.NextReader()
+			if err != nil {
+				return
+			}
+			var q LiveSearchQuery
+			var r Range
+			if err = decodeStrictJSON(message, &q); err != nil {
+				err = errors.Wrap(err, "cannot decode live search query")
+			} else {
+				r, err = parsePriceRange(q.PriceRange)
+			}
+			mu.Lock()
+			if err != nil {
+				conn.WriteJSON(LiveSearchMessage{Type: "error", Error: err.Error()})
+			} else {
+				query = buildSearchQuery(SearchParams{Title: q.Title, AuthorName: q.AuthorName, PriceRange: r, Tenant: tenant})
+				conn.WriteJSON(LiveSearchMessage{Type: "subscribed"})
+			}
+			mu.Unlock()
+		}
+	}()
+
+	for {
+		msg, err := pubsub.ReceiveMessage()
+		if err != nil {
+			return
+		}
+		var event CatalogEvent
+		if err = json.Unmarshal([]byte(msg.Payload), &event); err != nil || event.Type == "deleted" {
+			continue
+		}
+		mu.Lock()
+		if query != nil {
+			// delta query: does the changed book match the subscription?
+			matchQuery := elastic.NewBoolQuery().Must(query).Filter(elastic.NewIdsQuery(typeName(USER_TYPE)).Ids(event.ID))
+			searchResult, err := client.Search().Index(booksIndex()).Query(matchQuery).Size(1).Do(ctx)
+			if err != nil {
+				conn.WriteJSON(LiveSearchMessage{Type: "error", Error: errors.Wrap(err, "cannot run live search").Error()})
+			} else if len(searchResult.Hits.Hits) > 0 {
+				conn.WriteJSON(LiveSearchMessage{Type: event.Type, ID: event.ID, Book: *searchResult.Hits.Hits[0].Source})
+			}
+		}
+		mu.Unlock()
+	}
+}
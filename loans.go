@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	errors "github.com/fiverr/go_errors"
+	"gopkg.in/olivere/elastic.v5"
+	"gopkg.in/redis.v5"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	loansMapping = `
+{
+	"settings":{
+		"number_of_shards": 1,
+		"number_of_replicas": 0
+	},
+	"mappings":{
+		"loan":{
+			"properties": {
+				"book_id": { "type": "keyword" },
+				"user_id": { "type": "keyword" },
+				"borrowed_at": { "type": "date" },
+				"due_at": { "type": "date" },
+				"returned_at": { "type": "date" }
+			}
+		}
+	}
+}`
+	LOANS_INDEX = "loans"
+	LOAN_TYPE   = "loan"
+
+	defaultLoanDays = 14
+	maxLoanDays     = 60
+)
+
+// Loan is a library copy of a book lent to a user. ReturnedAt is nil while the copy is out.
+type Loan struct {
+	BookID     string     `json:"book_id"`
+	UserID     string     `json:"user_id"`
+	BorrowedAt time.Time  `json:"borrowed_at"`
+	DueAt      time.Time  `json:"due_at"`
+	ReturnedAt *time.Time `json:"returned_at,omitempty"`
+}
+
+// libraryCopiesKey holds the number of copies the library owns of a book, libraryLentKey the
+// number of them currently lent.
+func libraryCopiesKey(bookID string) string {
+	return "library_copies:" + bookID
+}
+
+func libraryLentKey(bookID string) string {
+	return "library_lent:" + bookID
+}
+
+// takeCopyScript lends a copy when one is available, returning 1, or 0 when all are lent and -1
+// when the library has no copies of the book.
+const takeCopyScript = `
+local copies = redis.call('GET', KEYS[1])
+if not copies then
+	return -1
+end
+local lent = tonumber(redis.call('GET', KEYS[2]) or '0')
+if lent >= tonumber(copies) then
+	return 0
+end
+redis.call('INCR', KEYS[2])
+return 1`
+
+var errNoCopyAvailable = errors.New("no copy is available, place a hold to be next in line")
+
+// takeCopy reserves a copy of the book for a new loan.
+func takeCopy(client *redis.Client, bookID string) error {
+	taken, err := client.Eval(takeCopyScript, []string{libraryCopiesKey(bookID), libraryLentKey(bookID)}).Int64()
+	if err != nil {
+		return errors.Wrap(err, "cannot reserve a copy in Redis")
+	}
+	switch taken {
+	case -1:
+		return errors.New("the library has no copies of book " + bookID)
+	case 0:
+		return errNoCopyAvailable
+	}
+	return nil
+}
+
+// putCopyBack makes a returned copy available again.
+func putCopyBack(client *redis.Client, bookID string) error {
+	lent, err := client.Decr(libraryLentKey(bookID)).Result()
+	if err != nil {
+		return errors.Wrap(err, "cannot release a copy in Redis")
+	}
+	if lent < 0 {
+		client.Set(libraryLentKey(bookID), 0, 0)
+	}
+	return nil
+}
+
+func ensureLoansIndex(client *elastic.Client, ctx context.Context) error {
+	exists, err := client.IndexExists(LOANS_INDEX).Do(ctx)
+	if err != nil {
+		return errors.Wrap(err, "cannot check loans index")
+	}
+	if !exists {
+		if _, err = client.CreateIndex(LOANS_INDEX).BodyString(loansMapping).Do(ctx); err != nil {
+			return errors.Wrap(err, "cannot create loans index")
+		}
+	}
+	return nil
+}
+
+// openLoanQuery matches the loans of a book by a user that were not returned yet.
+func openLoanQuery(bookID string, userID string) elastic.Query {
+	return elastic.NewBoolQuery().Filter(elastic.NewTermQuery("book_id", bookID), elastic.NewTermQuery("user_id", userID)).
+		MustNot(elastic.NewExistsQuery("returned_at"))
+}
+
+// findOpenLoan returns the id of the user's current loan of the book, or "" when there is none.
+func findOpenLoan(client *elastic.Client, ctx context.Context, bookID string, userID string) (string, *Loan, error) {
+	searchResult, err := client.Search().Index(LOANS_INDEX).Query(openLoanQuery(bookID, userID)).Size(1).Do(ctx)
+	if err != nil {
+		if elastic.IsNotFound(err) {
+			return "", nil, nil
+		}
+		return "", nil, errors.Wrap(err, "cannot search loans")
+	}
+	if len(searchResult.Hits.Hits) == 0 {
+		return "", nil, nil
+	}
+	hit := searchResult.Hits.Hits[0]
+	var loan Loan
+	if err = json.Unmarshal(*hit.Source, &loan); err != nil {
+		return "", nil, errors.Wrap(err, "cannot decode the loan")
+	}
+	return hit.Id, &loan, nil
+}
+
+// borrowBook lends a copy of the book to the user for the given number of days.
+func borrowBook(client *elastic.Client, ctx context.Context, redisClient *redis.Client, bookID string, userID string, days int) (string, error) {
+	if err := ensureLoansIndex(client, ctx); err != nil {
+		return "", err
+	}
+	id, _, err := findOpenLoan(client, ctx, bookID, userID)
+	if err != nil {
+		return "", err
+	}
+	if id != "" {
+		return "", errors.New("user " + userID + " already borrowed book " + bookID)
+	}
+	if err = takeCopy(redisClient, bookID); err != nil {
+		return "", err
+	}
+	now := time.Now().UTC()
+	loan := Loan{BookID: bookID, UserID: userID, BorrowedAt: now, DueAt: now.AddDate(0, 0, days)}
+	put, err := client.Index().Index(LOANS_INDEX).Type(typeName(LOAN_TYPE)).BodyJson(loan).Refresh("wait_for").Do(ctx)
+	if err != nil {
+		if releaseErr := putCopyBack(redisClient, bookID); releaseErr != nil {
+			fmt.Println(releaseErr)
+		}
+		return "", errors.Wrap(err, "cannot store the loan")
+	}
+	buf, err := json.Marshal(map[string]interface{}{"id": put.Id, "loan": loan})
+	if err != nil {
+		return "", errors.Wrap(err, "cannot create json result of loan")
+	}
+	return string(buf), nil
+}
+
+// returnBook closes the user's loan of the book and makes the copy available again.
+func returnBook(client *elastic.Client, ctx context.Context, redisClient *redis.Client, bookID string, userID string) (string, error) {
+	id, _, err := findOpenLoan(client, ctx, bookID, userID)
+	if err != nil {
+		return "", err
+	}
+	if id == "" {
+		return "", errors.New("user " + userID + " has not borrowed book " + bookID)
+	}
+	_, err = client.Update().Index(LOANS_INDEX).Type(typeName(LOAN_TYPE)).Id(id).
+		Doc(map[string]interface{}{"returned_at": time.Now().UTC()}).Refresh("wait_for").Do(ctx)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot update the loan")
+	}
+	if err = putCopyBack(redisClient, bookID); err != nil {
+		return "", err
+	}
+	// the returned copy goes straight to the first user holding the book
+	if err = assignNextHolder(client, ctx, redisClient, bookID); err != nil {
+		fmt.Println(err)
+	}
+	return fmt.Sprintf("User %s returned book %s\n", userID, bookID), nil
+}
+
+// lending handles POST /books/{id}/borrow?user_id=&days= and POST /books/{id}/return?user_id=.
+func lending(w http.ResponseWriter, req *http.Request, bookID string, action string) {
+	if !requireElasticsearch(w, req) {
+		return
+	}
+	if req.Method != "POST" {
+		msg := "Unsupported request for /books/{id}/" + action + " " + req.Method
+		fmt.Fprintf(w, "%s", errors.New(msg))
+		return
+	}
+	userID := tenantParam(req, "user_id")
+	if userID == "" {
+		fmt.Fprintf(w, "%s", errors.New("user_id is required"))
+		return
+	}
+	days := defaultLoanDays
+	if value := getParamValue(req, "days"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 || parsed > maxLoanDays {
+			fmt.Fprintf(w, "%s", errors.New("days must be between 1 and "+strconv.Itoa(maxLoanDays)))
+			return
+		}
+		days = parsed
+	}
+	client, ctx, err := connectElasticSearch()
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	redisClient, err := connectRedis()
+	if err != nil {
+		fmt.Fprintf(w, "%s", errors.Wrap(err, "cannot connect to Redis"))
+		return
+	}
+	defer redisClient.Close()
+	var result string
+	if action == "borrow" {
+		result, err = borrowBook(client, ctx, redisClient, bookID, userID, days)
+	} else {
+		result, err = returnBook(client, ctx, redisClient, bookID, userID)
+	}
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	fmt.Fprintf(w, "%s", result)
+}
+
+// userLoans handles GET /users/{id}/loans?offset=&limit=, the user's borrow history newest first.
+func userLoans(w http.ResponseWriter, req *http.Request, userID string) {
+	if !requireElasticsearch(w, req) {
+		return
+	}
+	if req.Method != "GET" {
+		msg := "Unsupported request for " + req.URL.Path + " " + req.Method
+		fmt.Fprintf(w, "%s", errors.New(msg))
+		return
+	}
+	offset, limit, err := parsePage(req, 20)
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	client, ctx, err := connectElasticSearch()
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	loans := make([]map[string]interface{}, 0)
+	var total int64
+	searchResult, err := client.Search().Index(LOANS_INDEX).Query(elastic.NewTermQuery("user_id", userID)).
+		Sort("borrowed_at", false).Sort(idSortField(), true).From(int(offset)).Size(int(limit)).Do(ctx)
+	if err != nil && !elastic.IsNotFound(err) {
+		fmt.Fprintf(w, "%s", errors.Wrap(err, "cannot search loans"))
+		return
+	}
+	if err == nil {
+		total = searchResult.Hits.TotalHits
+		for _, hit := range searchResult.Hits.Hits {
+			loans = append(loans, map[string]interface{}{"id": hit.Id, "loan": hit.Source})
+		}
+	}
+	buf, err := json.Marshal(map[string]interface{}{"total": total, "offset": offset, "limit": limit, "loans": loans})
+	if err != nil {
+		fmt.Fprintf(w, "%s", errors.Wrap(err, "cannot create json result of loans"))
+		return
+	}
+	fmt.Fprintf(w, "%s", buf)
+}
+
+// adminCopies handles /admin/copies?book_id=: GET returns the copies owned and lent, PUT
+// &copies= sets the number of copies the library owns.
+func adminCopies(w http.ResponseWriter, req *http.Request) {
+	if !isAdmin(req) {
+		http.Error(w, "admin token required", http.StatusUnauthorized)
+		return
+	}
+	bookID := tenantParam(req, "book_id")
+	if bookID == "" {
+		fmt.Fprintf(w, "%s", errors.New("book_id is required"))
+		return
+	}
+	client, err := connectRedis()
+	if err != nil {
+		fmt.Fprintf(w, "%s", errors.Wrap(err, "cannot connect to Redis"))
+		return
+	}
+	defer client.Close()
+	switch req.Method {
+	case "GET":
+		copies, err := client.Get(libraryCopiesKey(bookID)).Int64()
+		if err != nil && err != redis.Nil {
+			fmt.Fprintf(w, "%s", errors.Wrap(err, "cannot get key from Redis"))
+			return
+		}
+		lent, err := client.Get(libraryLentKey(bookID)).Int64()
+		if err != nil && err != redis.Nil {
+			fmt.Fprintf(w, "%s", errors.Wrap(err, "cannot get key from Redis"))
+			return
+		}
+		buf, err := json.Marshal(map[string]interface{}{"book_id": bookID, "copies": copies, "lent": lent})
+		if err != nil {
+			fmt.Fprintf(w, "%s", errors.Wrap(err, "cannot create json result of copies"))
+			return
+		}
+		fmt.Fprintf(w, "%s", buf)
+	case "PUT":
+		copies, err := strconv.ParseInt(getParamValue(req, "copies"), 10, 64)
+		if err != nil || copies < 0 {
+			fmt.Fprintf(w, "%s", errors.New("copies must be a non-negative integer"))
+			return
+		}
+		if err = client.Set(libraryCopiesKey(bookID), copies, 0).Err(); err != nil {
+			fmt.Fprintf(w, "%s", errors.Wrap(err, "cannot set key in Redis"))
+			return
+		}
+		fmt.Fprintf(w, "The library owns %d copies of book %s\n", copies, bookID)
+	default:
+		msg := "Unsupported request for /admin/copies " + req.Method
+		fmt.Fprintf(w, "%s", errors.New(msg))
+	}
+}
@@ -2,15 +2,19 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"flag"
 	"fmt"
 	errors "github.com/fiverr/go_errors"
 	"gopkg.in/olivere/elastic.v5"
 	"gopkg.in/redis.v5"
-	"math"
+	"io/ioutil"
 	"net/http"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -18,19 +22,40 @@ import (
 type Book struct {
 	Title          string    `json:"title"`
 	AuthorName     string    `json:"author_name"`
-	Price          int       `json:"price"`
+	AuthorID       string    `json:"author_id"`
+	Price          Price     `json:"price"`
+	Currency       string    `json:"currency"`
+	BasePrice      Price     `json:"base_price"`
 	EbookAvailable bool      `json:"ebook_available"`
+	Formats        []string  `json:"formats"`
 	PublishDate    time.Time `json:"publish_date"`
+	Genre          string    `json:"genre"`
+	Publisher      string    `json:"publisher"`
+	ISBN           string    `json:"isbn"`
+	Description    string    `json:"description"`
+	CoverURL       string    `json:"cover_url"`
+	PageCount      int       `json:"page_count"`
+	Language       string    `json:"language"`
+	WorkID         string    `json:"work_id"`
+	RatingAvg      float64   `json:"rating_avg"`
+	RatingCount    int64     `json:"rating_count"`
+	IndexedAt      time.Time `json:"indexed_at"`
+	// Tenant is the catalog the book belongs to, empty for the default one
+	Tenant string `json:"tenant,omitempty"`
 }
 
 type AggsRes struct {
-	Books   int `json:"total books"`
-	Authors int `json:"distinct authors"`
+	Books    int    `json:"total books"`
+	Authors  int    `json:"distinct authors"`
+	AvgPrice Price  `json:"average price"`
+	Currency string `json:"currency"`
+	// BooksRelation is "gte" when Books is a lower bound, see TrackTotalHits
+	BooksRelation string `json:"total books relation"`
 }
 
 type Range struct {
-	From int
-	To   int
+	From Price
+	To   Price
 }
 
 const (
@@ -45,125 +70,577 @@ const (
 			"properties": { 
 				"title":    { "type": "text"  , "fielddata": true}, 
 				"author_name":     { "type": "text"  , "fielddata": true}, 
-				"price":      { "type": "float" },
+				"author_id": {"type": "keyword"},
+				"price":      { "type": "scaled_float", "scaling_factor": 100 },
+				"currency": {"type": "keyword"},
+				"base_price": {"type": "scaled_float", "scaling_factor": 100},
 				"ebook_available": {"type": "boolean"},
-				"publish_date": {"type": "date"}
+				"formats": {"type": "keyword"},
+				"publish_date": {"type": "date"},
+				"genre": {"type": "keyword"},
+				"publisher": {"type": "keyword"},
+				"isbn": {"type": "keyword"},
+				"description": {"type": "text"},
+				"cover_url": {"type": "keyword", "index": false},
+				"page_count": {"type": "integer"},
+				"language": {"type": "keyword"},
+				"work_id": {"type": "keyword"},
+				"rating_avg": {"type": "float"},
+				"rating_count": {"type": "integer"},
+				"indexed_at": {"type": "date"},
+				"tenant": {"type": "keyword"}
 			  }
 		}
 	}
 }`
-	URL        string = "http://10.200.10.1:9200"
-	USER_INDEX        = "books"
-	USER_TYPE         = "book"
+	USER_TYPE = "book"
 )
 
+// esHttpClient bridges API differences of newer clusters, see compatTransport. main replaces it
+// with one authenticating as configured.
+var esHttpClient = &http.Client{Transport: compatTransport{http.DefaultTransport}}
+
+var (
+	esClientMu sync.Mutex
+	esClient   *elastic.Client
+)
+
+// connectElasticSearch returns the client of the configured nodes. It is created on first use
+// and shared, so the health checks and sniffing keeping track of live nodes run once in the
+// background instead of per call; a failed creation is retried on the next call.
 func connectElasticSearch() (*elastic.Client, context.Context, error) {
 	// Starting with elastic.v5, you must pass a context to execute each service
 	ctx := context.Background()
-	// Obtain a client and connect to the  Elasticsearch installation on URL
-	client, err := elastic.NewSimpleClient(elastic.SetURL(URL))
+	esClientMu.Lock()
+	defer esClientMu.Unlock()
+	if esClient != nil {
+		return esClient, ctx, nil
+	}
+	c := config.Elasticsearch
+	urls := c.nodes()
+	// with several nodes, requests failing on a node are retried on the others while the
+	// health checks take it out of rotation
+	client, err := elastic.NewClient(elastic.SetURL(urls...), elastic.SetHttpClient(esHttpClient),
+		elastic.SetSniff(c.Sniff), elastic.SetHealthcheck(len(urls) > 1 || c.Sniff),
+		elastic.SetHealthcheckInterval(parseDuration(c.HealthcheckInterval, time.Minute)),
+		elastic.SetSnifferInterval(parseDuration(c.SniffInterval, 15*time.Minute)),
+		elastic.SetMaxRetries(len(urls)-1))
 	if err != nil {
 		return client, ctx, errors.Wrap(err, "cannot connect to elastic search")
 	}
+	esClient = client
 	return client, ctx, nil
 }
+
+// redisTLSConfig is set up in main when the Redis connection uses TLS.
+var redisTLSConfig *tls.Config
+
+// redisOptions returns the connection options of the configured Redis server.
+func redisOptions() *redis.Options {
+	c := config.Redis
+	return &redis.Options{Addr: c.Addr, Password: c.Password, DB: c.DB, PoolSize: c.PoolSize,
+		DialTimeout: parseDuration(c.DialTimeout, 5*time.Second), ReadTimeout: parseDuration(c.ReadTimeout, 3*time.Second),
+		WriteTimeout: parseDuration(c.WriteTimeout, 3*time.Second), TLSConfig: redisTLSConfig}
+}
+
 func connectRedis() (*redis.Client, error) {
-	client := redis.NewClient(&redis.Options{Addr: "localhost:6379", Password: "", DB: 0})
-	pong, err := client.Ping().Result()
-	fmt.Println(pong, err)
+	client := redis.NewClient(redisOptions())
+	err := client.Ping().Err()
 	return client, err
 }
 
-func addBook(client *elastic.Client, ctx context.Context, id string, book Book) (string, error) {
-	put, err := client.Index().Index("books").Type("book").Id(id).BodyJson(book).Do(ctx)
-	if err != nil {
-		return "", errors.Wrap(err, "cannot add the book")
-	}
-	s := fmt.Sprintf("Indexed book %s to index %s, type %s\n", put.Id, put.Index, put.Type)
-	return s, nil
+var (
+	sharedRedisOnce   sync.Once
+	sharedRedisClient *redis.Client
+)
+
+// sharedRedis returns a long-lived client for hot paths, reusing its connection pool across
+// requests instead of connecting per call. It must not be closed.
+func sharedRedis() *redis.Client {
+	sharedRedisOnce.Do(func() {
+		sharedRedisClient = redis.NewClient(redisOptions())
+	})
+	return sharedRedisClient
+}
+
+// addBook stores the book in the repository.
+func addBook(id string, book Book) (string, error) {
+	return bookRepo.Put(id, book)
 }
 
-func deleteBook(client *elastic.Client, ctx context.Context, id string) (string, error) {
-	del, err := client.Delete().Index("books").Type("book").Id(id).Do(ctx)
+func deleteBook(id string) (string, error) {
+	return bookRepo.Delete(id)
+}
+
+func getBook(id string, displayCurrency string, coupon string) (string, error) {
+	source, err := bookRepo.Get(id)
 	if err != nil {
-		return "", errors.Wrap(err, "cannot delete the book")
+		return "", err
 	}
-	if del.Found {
-		s := fmt.Sprintf("Delete document %s in version %d from index %s, type %s\n", del.Id, del.Version, del.Index, del.Type)
-		return s, nil
+	if source != "" {
+		discounts, err := activeDiscounts(coupon)
+		if err != nil {
+			return "", err
+		}
+		source, err := applyDiscounts(id, source, discounts)
+		if err != nil {
+			return "", err
+		}
+		if displayCurrency != "" {
+			rate, updatedAt, err := getExchangeRate(displayCurrency)
+			if err != nil {
+				return "", err
+			}
+			return displayPrice(source, displayCurrency, rate, updatedAt)
+		}
+		return source, nil
 	}
+
 	return "", nil
 }
 
-func getBook(client *elastic.Client, ctx context.Context, id string) (string, error) {
-	get, err := client.Get().Index("books").Type("book").Id(id).Do(ctx)
+// writeToRedis adds a batch of activity entries to the users' sorted sets and applies the
+// retention policy, all in one pipeline on the shared client.
+func writeToRedis(batch []pendingActivity) error {
+	retention, err := activityRetention()
 	if err != nil {
-		return "", errors.Wrap(err, "Cannot GET a book")
+		return err
 	}
-	if get.Found {
-		return string(*get.Source), nil
+	_, err = sharedRedis().Pipelined(func(pipe *redis.Pipeline) error {
+		users := make(map[string]bool)
+		for _, p := range batch {
+			value, err := json.Marshal(p.entry)
+			if err != nil {
+				return errors.Wrap(err, "cannot create json activity entry")
+			}
+			score := float64(p.entry.Time.UnixNano())
+			// add userId request to ordered set in redis, scored by the full request time
+			pipe.ZAdd(activityKey(p.userID), redis.Z{score, string(value)})
+			users[p.userID] = true
+		}
+		for userID := range users {
+			addActivityRetention(pipe, userID, retention)
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "cannot set key in Redis")
 	}
+	return nil
+}
 
-	return "", nil
+func updateBook(id string, title string) (string, error) {
+	return bookRepo.UpdateTitle(id, title)
 }
 
-func writeToRedis(userID string, route string, method string) error {
-	client, err := connectRedis()
+// putBook creates or replaces the book with the fields given by the client, filling in the
+// derived ones. Secondary effects go through the outbox, so they only happen once the write did.
+func putBook(id string, book Book) (string, error) {
+	if err := checkRequiredFields(book); err != nil {
+		return "", err
+	}
+	if err := checkBookRules(book, ""); err != nil {
+		return "", err
+	}
+	book.IndexedAt = time.Now().UTC()
+	if book.WorkID == "" {
+		// a book without other editions is a work of its own, so collapsing keeps it
+		book.WorkID = id
+	}
+	// base_price lets price filters and stats compare books sold in different currencies
+	var err error
+	book.BasePrice, err = toBaseCurrency(book.Price, book.Currency)
 	if err != nil {
-		return errors.Wrap(err, "cannot connect to Redis")
-
-	} else {
-		value := "route=" + route + ", method=" + method
-		score := float64(time.Now().Nanosecond())
-		// add userId request to ordered set in redis, score according to time
-		_, err = client.ZAdd(userID, redis.Z{score, value}).Result()
-		if err != nil {
-			return errors.Wrap(err, "cannot set key in Redis")
+		return "", err
+	}
+	if demoMode {
+		return addBook(id, book)
+	}
+	// authors and reviews are kept in their own indexes, which deployments keeping books in
+	// PostgreSQL do without
+	var client *elastic.Client
+	ctx := context.Background()
+	if !booksInPostgres() {
+		if client, ctx, err = connectElasticSearch(); err != nil {
+			return "", err
 		}
-		return nil
 	}
+	var existed bool
+	if book.AuthorID != "" {
+		if client != nil {
+			author, err := getAuthor(client, ctx, book.AuthorID)
+			if err == nil && author == nil {
+				err = errors.New("author " + book.AuthorID + " does not exist")
+			}
+			if err != nil {
+				return "", err
+			}
+			if book.AuthorName == "" {
+				book.AuthorName = author.Name
+			}
+		} else if book.AuthorName == "" {
+			return "", errors.New("author_name is required, authors are " + errElasticsearchOnly.Error())
+		}
+		if existed, err = bookRepo.Exists(id); err != nil {
+			return "", err
+		}
+	}
+	if bulkIndexer != nil && client != nil {
+		// queued writes land later, so carry the rating kept from the reviews in the document
+		if book.RatingAvg, book.RatingCount, err = bookRating(client, ctx, id); err != nil {
+			return "", err
+		}
+	}
+	// saved search alerts, price checks and, for books not indexed before, the author's
+	// followers are notified by the outbox relay
+	event := OutboxEvent{Type: "created", BookID: id, Book: &book, NotifyFollowers: book.AuthorID != "" && !existed}
+	if err = appendOutbox(event); err != nil {
+		return "", err
+	}
+	result, err := addBook(id, book)
+	// reindexing replaces the whole document, so restore the rating kept from the reviews
+	if err == nil && bulkIndexer == nil && client != nil {
+		if ratingErr := refreshBookRating(client, ctx, id); ratingErr != nil {
+			fmt.Println(ratingErr)
+		}
+	}
+	return result, err
 }
 
-func updateBook(client *elastic.Client, ctx context.Context, id string, title string) (string, error) {
-	update, err := client.Update().Index(USER_INDEX).Type(USER_TYPE).Id(id).Doc(map[string]interface{}{"title": title}).Do(ctx)
-	if err != nil {
+// retitleBook changes the title of the book, through the outbox like putBook.
+func retitleBook(id string, title string) (string, error) {
+	title = normalizeText(title)
+	if err := checkBookRules(Book{Title: title}, "title"); err != nil {
+		return "", err
+	}
+	if err := appendOutbox(OutboxEvent{Type: "updated", BookID: id, Title: title}); err != nil {
+		return "", err
+	}
+	return updateBook(id, title)
+}
+
+// removeBook deletes the book, through the outbox like putBook.
+func removeBook(id string) (string, error) {
+	if err := appendOutbox(OutboxEvent{Type: "deleted", BookID: id}); err != nil {
 		return "", err
 	}
-	s := fmt.Sprintf("New version of book %q is now %d\n", update.Id, update.Version)
-	return s, nil
+	return deleteBook(id)
+}
+
+// maxPageCount is the largest page_count accepted on write.
+const maxPageCount = 100000
+
+var languagePattern = regexp.MustCompile(`^[a-z]{2,3}$`)
+
+// normalizeLanguage validates a language as an ISO 639 code, stored in lower case.
+func normalizeLanguage(language string) (string, error) {
+	language = strings.ToLower(strings.TrimSpace(language))
+	if !languagePattern.MatchString(language) {
+		return "", errors.New("language must be an ISO 639 code such as en or fra")
+	}
+	return language, nil
+}
+
+// SearchParams holds the parsed parameters of a book search.
+type SearchParams struct {
+	// Query is free text matched against title, author and description
+	Query           string
+	Title           string
+	AuthorName      string
+	PriceRange      Range
+	DisplayCurrency string
+	// Coupon is a discount code applied to the returned prices on top of the automatic discounts
+	Coupon string
+	// PriceRate converts base currency prices to the currency of PriceRange, set from the
+	// price_currency param. 0 means PriceRange filters the stored price as is.
+	PriceRate float64
+	// PagesMin and PagesMax bound page_count, 0 means unbounded
+	PagesMin int
+	PagesMax int
+	Language string
+	// Publisher matches the publisher name exactly
+	Publisher string
+	// Formats matches books available in any of the given formats
+	Formats []string
+	// Highlight adds matching snippets of the title and description to each hit
+	Highlight bool
+	// Sort is "rating" to order by rating_avg, otherwise hits are ordered by relevance with q and
+	// by title without
+	Sort string
+	// MinRating filters out books rated lower on average, 0 means no filter
+	MinRating float64
+	// CollapseEditions returns only the best matching edition of each work
+	CollapseEditions bool
+	// From is the offset of the first hit, taken from the cursor param
+	From int
+	// Size is the number of books per page, config.Search.DefaultPageSize when 0
+	Size int
+	// Tenant limits the search to the books of a tenant, "" to the default catalog
+	Tenant string
+}
+
+// pageSize returns the number of books per page of the search.
+func (p SearchParams) pageSize() int {
+	if p.Size > 0 {
+		return p.Size
+	}
+	return config.Search.DefaultPageSize
 }
 
-func searchBook(client *elastic.Client, ctx context.Context, title string, authorName string, priceRange Range) (string, error) {
+// checkSearchOffset refuses search cursors beyond config.Search.MaxOffset.
+func checkSearchOffset(from int) error {
+	if max := config.Search.MaxOffset; max > 0 && from > max {
+		return errors.New(fmt.Sprintf("cursor must be at most %d", max))
+	}
+	return nil
+}
+
+// parseSearchParams extracts the search parameters from the request query.
+func parseSearchParams(req *http.Request) (SearchParams, error) {
+	p := SearchParams{
+		Query:           getParamValue(req, "q"),
+		Title:           getParamValue(req, "title"),
+		AuthorName:      getParamValue(req, "author_name"),
+		DisplayCurrency: getParamValue(req, "display_currency"),
+		Publisher:       strings.TrimSpace(getParamValue(req, "publisher")),
+		Coupon:          getParamValue(req, "coupon"),
+		Tenant:          requestTenant(req),
+	}
+	var err error
+	if language := getParamValue(req, "language"); language != "" {
+		p.Language, err = normalizeLanguage(language)
+		if err != nil {
+			return p, err
+		}
+	}
+	p.Formats, err = parseFormats(getParamValue(req, "format"))
+	if err != nil {
+		return p, err
+	}
+	for param, bound := range map[string]*int{"pages_min": &p.PagesMin, "pages_max": &p.PagesMax} {
+		if value := getParamValue(req, param); value != "" {
+			*bound, err = strconv.Atoi(value)
+			if err != nil || *bound <= 0 {
+				return p, errors.New(param + " must be a positive integer")
+			}
+		}
+	}
+	if highlight := getParamValue(req, "highlight"); highlight != "" {
+		p.Highlight, err = strconv.ParseBool(highlight)
+		if err != nil {
+			return p, errors.Wrap(err, "conversion from string to bool for field highlight failed")
+		}
+	}
+	p.Sort = getParamValue(req, "sort")
+	if p.Sort != "" && p.Sort != "rating" {
+		return p, errors.New("sort must be rating")
+	}
+	if minRating := getParamValue(req, "min_rating"); minRating != "" {
+		p.MinRating, err = strconv.ParseFloat(minRating, 64)
+		if err != nil || p.MinRating < 1 || p.MinRating > 5 {
+			return p, errors.New("min_rating must be a number between 1 and 5")
+		}
+	}
+	if collapse := getParamValue(req, "collapse_editions"); collapse != "" {
+		p.CollapseEditions, err = strconv.ParseBool(collapse)
+		if err != nil {
+			return p, errors.Wrap(err, "conversion from string to bool for field collapse_editions failed")
+		}
+	}
+	// extract from and to from price_range param
+	p.PriceRange, err = parsePriceRange(getParamValue(req, "price_range"))
+	if err != nil {
+		return p, err
+	}
+	if priceCurrency := getParamValue(req, "price_currency"); priceCurrency != "" {
+		if priceCurrency, err = normalizeCurrency(priceCurrency); err != nil {
+			return p, err
+		}
+		p.PriceRate, _, err = getExchangeRate(priceCurrency)
+		if err != nil {
+			return p, err
+		}
+	}
+	if cursor := getParamValue(req, "cursor"); cursor != "" {
+		p.From, err = strconv.Atoi(cursor)
+		if err != nil || p.From < 0 {
+			return p, errors.New("invalid cursor " + cursor)
+		}
+		if err = checkSearchOffset(p.From); err != nil {
+			return p, err
+		}
+	}
+	if limit := getParamValue(req, "limit"); limit != "" {
+		p.Size, err = strconv.Atoi(limit)
+		if err != nil || p.Size <= 0 {
+			return p, errors.New("limit must be a positive integer")
+		}
+		if max := config.Search.MaxPageSize; max > 0 && p.Size > max {
+			p.Size = max
+		}
+	}
+	return p, nil
+}
+
+// buildSearchQuery combines the non-empty search parameters into a single bool query.
+func buildSearchQuery(p SearchParams) *elastic.BoolQuery {
 	q := make([]elastic.Query, 0)
-	if title != "" {
-		q = append(q, elastic.NewMatchQuery("title", title))
+	if p.Query != "" {
+		// description matches count less than title and author matches
+		q = append(q, elastic.NewMultiMatchQuery(p.Query, "title^3", "author_name^2", "description"))
+	}
+	if p.Title != "" {
+		q = append(q, elastic.NewMatchQuery("title", p.Title))
 	}
-	if authorName != "" {
-		q = append(q, elastic.NewMatchQuery("author_name", authorName))
+	if p.AuthorName != "" {
+		q = append(q, elastic.NewMatchQuery("author_name", p.AuthorName))
+	}
+	if !(p.PriceRange.From == -1 && p.PriceRange.To == -1) {
+		if p.PriceRate > 0 {
+			from, to := p.PriceRange.From.Float()/p.PriceRate, p.PriceRange.To.Float()/p.PriceRate
+			q = append(q, elastic.NewRangeQuery("base_price").From(from).To(to))
+		} else {
+			q = append(q, elastic.NewRangeQuery("price").From(p.PriceRange.From.Float()).To(p.PriceRange.To.Float()))
+		}
+	}
+	if p.PagesMin > 0 || p.PagesMax > 0 {
+		pages := elastic.NewRangeQuery("page_count")
+		if p.PagesMin > 0 {
+			pages = pages.Gte(p.PagesMin)
+		}
+		if p.PagesMax > 0 {
+			pages = pages.Lte(p.PagesMax)
+		}
+		q = append(q, pages)
 	}
-	if !(priceRange.From == -1 && priceRange.To == -1) {
-		q = append(q, elastic.NewRangeQuery("price").From(priceRange.From).To(priceRange.To))
+	if p.Language != "" {
+		q = append(q, elastic.NewTermQuery("language", p.Language))
 	}
-	query := elastic.NewBoolQuery().Must(q...)
+	if p.Publisher != "" {
+		q = append(q, elastic.NewTermQuery("publisher", p.Publisher))
+	}
+	if len(p.Formats) > 0 {
+		q = append(q, formatsQuery(p.Formats))
+	}
+	if p.MinRating > 0 {
+		q = append(q, elastic.NewRangeQuery("rating_avg").Gte(p.MinRating))
+	}
+	return elastic.NewBoolQuery().Must(q...).Filter(tenantQuery(p.Tenant))
+}
 
-	searchResult, _ := client.Search().Index("books").Query(query).Sort("title", true).
-		From(0).Size(10).Pretty(true).Do(ctx)
+// tenantQuery matches the books of the tenant. Books of the default catalog have no tenant.
+func tenantQuery(tenant string) elastic.Query {
+	if tenant == "" {
+		return elastic.NewBoolQuery().MustNot(elastic.NewExistsQuery("tenant"))
+	}
+	return elastic.NewTermQuery("tenant", tenant)
+}
+
+// addHighlights adds the highlighted snippets of a hit to its book source.
+func addHighlights(source string, highlight map[string][]string) (string, error) {
+	doc := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(source), &doc); err != nil {
+		return "", errors.Wrap(err, "cannot decode book for highlighting")
+	}
+	doc["highlight"] = highlight
+	buf, err := json.Marshal(doc)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot encode book with highlights")
+	}
+	return string(buf), nil
+}
+
+// errResponseTruncated is returned by searchBook together with a partial page that was cut at
+// the configured response size limit.
+var errResponseTruncated = errors.New("response truncated")
+
+// searchBook runs the search and returns a page of results together with the cursor of the next
+// page, or -1 when there is none, and the total of the hits without their books. The page is cut
+// short when it would exceed maxResponseBytes.
+func searchBook(p SearchParams) (string, int, SearchHits, error) {
+	searchResult, err := bookRepo.Search(p)
+	if err != nil {
+		return "", -1, SearchHits{}, err
+	}
+	total := SearchHits{Total: searchResult.Total, TotalRelation: searchResult.TotalRelation}
+
+	var rate float64
+	var ratesUpdatedAt string
+	if p.DisplayCurrency != "" {
+		rate, ratesUpdatedAt, err = getExchangeRate(p.DisplayCurrency)
+		if err != nil {
+			return "", -1, SearchHits{}, err
+		}
+	}
+
+	discounts, err := activeDiscounts(p.Coupon)
+	if err != nil {
+		return "", -1, SearchHits{}, err
+	}
 
 	var booksResult = make([]string, 0)
-	if len(searchResult.Hits.Hits) > 0 {
-		fmt.Printf("Found a total of %d books\n", searchResult.Hits.TotalHits)
+	if len(searchResult.Hits) > 0 {
+		if searchResult.TotalRelation == totalLowerBound {
+			fmt.Printf("Found at least %d books\n", searchResult.Total)
+		} else {
+			fmt.Printf("Found a total of %d books\n", searchResult.Total)
+		}
+		size := 0
 		// Iterate through results
-		for _, hit := range searchResult.Hits.Hits {
-			booksResult = append(booksResult, string(*hit.Source))
+		for _, hit := range searchResult.Hits {
+			source, err := applyDiscounts(hit.ID, hit.Source, discounts)
+			if err != nil {
+				return "", -1, SearchHits{}, err
+			}
+			if p.Highlight && len(hit.Highlight) > 0 {
+				source, err = addHighlights(source, hit.Highlight)
+				if err != nil {
+					return "", -1, SearchHits{}, err
+				}
+			}
+			if p.DisplayCurrency != "" {
+				source, err = displayPrice(source, p.DisplayCurrency, rate, ratesUpdatedAt)
+				if err != nil {
+					return "", -1, SearchHits{}, err
+				}
+			}
+			size += len(source) + 1
+			if config.MaxResponseBytes > 0 && size > config.MaxResponseBytes && len(booksResult) > 0 {
+				// truncated: the next page starts at the first book left out
+				return fmt.Sprintf("%s", booksResult), p.From + len(booksResult), total, errResponseTruncated
+			}
+			booksResult = append(booksResult, source)
+		}
+		next := -1
+		if int64(p.From+len(booksResult)) < searchResult.Total && checkSearchOffset(p.From+len(booksResult)) == nil {
+			next = p.From + len(booksResult)
 		}
 		s := fmt.Sprintf("%s", booksResult)
-		return s, nil
+		return s, next, total, nil
 	} else {
 		// No hits
-		return "", nil
+		return "", -1, total, nil
 	}
 }
 
+// parsePriceRange parses a "from-to" price range such as 5-12.99, returning {-1, -1} when no
+// range is given.
+func parsePriceRange(priceRange string) (Range, error) {
+	r := strings.Split(priceRange, "-")
+	if len(r) != 2 {
+		return Range{-1, -1}, nil
+	}
+	from, err := parsePrice(r[0])
+	if err != nil {
+		return Range{}, errors.Wrap(err, "price range conversion failed")
+	}
+	to, err := parsePrice(r[1])
+	if err != nil {
+		return Range{}, errors.Wrap(err, "price range conversion failed")
+	}
+	return Range{from, to}, nil
+}
+
 func getParamValue(req *http.Request, paramName string) string {
 	if len(req.URL.Query()[paramName]) >= 1 {
 		return req.URL.Query()[paramName][0]
@@ -173,6 +650,9 @@ func getParamValue(req *http.Request, paramName string) string {
 
 }
 
+// activity handles GET /activity?user_id=&offset=&limit=, a page of the user's requests newest
+// first, optionally filtered by route=, method= and a from=/to= time range. The limit defaults to
+// the configured activity default_limit. DELETE /activity?user_id= clears the user's history.
 func activity(w http.ResponseWriter, req *http.Request) {
 	var err error
 	client, err := connectRedis()
@@ -181,23 +661,57 @@ func activity(w http.ResponseWriter, req *http.Request) {
 		fmt.Fprintf(w, "%s", err)
 		return
 	} else {
+		defer client.Close()
 		switch req.Method {
 		case "GET":
 			userId := getParamValue(req, "user_id")
-			// range on top 3 requests of the user from redis according to userId key
-			if userId != "" {
-				resultSet, err := client.ZRevRangeWithScores(userId, 0, 2).Result()
-				if err != nil {
-					err = errors.Wrap(err, "cannot get key from Redis")
-					fmt.Fprintf(w, "%s", err)
+			if userId == "" {
+				fmt.Fprintf(w, "%s", errors.New("user_id is required"))
+				return
+			}
+			offset, limit, err := parsePage(req, int64(config.Activity.DefaultLimit))
+			if err != nil {
+				fmt.Fprintf(w, "%s", err)
+				return
+			}
+			if max := int64(config.Activity.MaxLimit); max > 0 && limit > max {
+				limit = max
+			}
+			filter, err := parseActivityFilter(req)
+			if err != nil {
+				fmt.Fprintf(w, "%s", err)
+				return
+			}
+			result, err := activityPage(tenantID(requestTenant(req), userId), filter, offset, limit)
+			if err != nil {
+				fmt.Fprintf(w, "%s", err)
+				return
+			}
+			fmt.Fprintf(w, "%s", result)
+		case "DELETE":
+			userId := getParamValue(req, "user_id")
+			if userId == "" {
+				fmt.Fprintf(w, "%s", errors.New("user_id is required"))
+				return
+			}
+			// only an admin or the user's own API key may clear the history
+			actor := "admin@" + clientIP(req)
+			if !isAdmin(req) {
+				caller, err := authenticateAPIKey(client, req)
+				if err != nil || caller == nil || caller.UserID != userId {
+					http.Error(w, "admin token or the user's API key required", http.StatusUnauthorized)
 					return
-				} else {
-					// iterate the three items in the ordered set
-					for _, zItem := range resultSet {
-						fmt.Fprintf(w, "%v\n", zItem.Member)
-					}
 				}
+				actor = "api_key:" + caller.ID
+			}
+			if err = activities.Clear(tenantID(requestTenant(req), userId)); err != nil {
+				fmt.Fprintf(w, "%s", err)
+				return
 			}
+			if err = recordAudit(AuditEntry{Action: "clear_activity", Target: userId, Actor: actor}); err != nil {
+				fmt.Println(err)
+			}
+			fmt.Fprintf(w, "Cleared activity of user %s\n", userId)
 		default:
 			msg := "Unsupported request for /activity " + req.Method
 			err = errors.New(msg)
@@ -208,50 +722,38 @@ func activity(w http.ResponseWriter, req *http.Request) {
 
 func book(w http.ResponseWriter, req *http.Request) {
 	var err error
-	var id, title, authorName, result, userId string
-	var price int
-	var publishDate time.Time
-	var ebookAvailable bool
+	var id, title, result, userId string
+	var newBook Book
 
-	client, ctx, err := connectElasticSearch()
-	if err != nil {
-		errors.Wrap(err, "error in connecting to ES")
-		fmt.Fprintf(w, "%s", err)
-		return
-	}
 	// extract param values to variables and parse to the correct data type
-	id = getParamValue(req, "id")
+	// books and users of a tenant are kept under ids scoped to it
+	tenant := requestTenant(req)
+	id = tenantID(tenant, getParamValue(req, "id"))
 	title = getParamValue(req, "title")
-	authorName = getParamValue(req, "author_name")
-	userId = getParamValue(req, "user_id")
-	tempeBookAvailable := getParamValue(req, "ebook_available")
-
-	if tempeBookAvailable != "" {
-		ebookAvailable, err = strconv.ParseBool(tempeBookAvailable)
+	userId = tenantID(tenant, getParamValue(req, "user_id"))
+	displayCurrency := getParamValue(req, "display_currency")
+	if req.Method == "PUT" {
+		newBook, err = bookFromParams(func(name string) string { return getParamValue(req, name) })
 		if err != nil {
-			fmt.Println("conversion from string to bool for field ebookAvailable failed")
-			err = errors.Wrap(err, "conversion from string to bool for field ebookAvailable failed")
-			fmt.Fprintf(w, "%s", err)
-			return
-		}
-	}
-	tempPrice := getParamValue(req, "price")
-	if tempPrice != "" {
-		price, err = strconv.Atoi(tempPrice)
-		if err != nil {
-			fmt.Println("conversion from string to int for field price failed")
-			err = errors.Wrap(err, "conversion from string to int for field price failed")
-			fmt.Fprintf(w, "%s", err)
+			fmt.Println("validation of book fields failed")
+			writeValidationError(w, err)
 			return
 		}
+		newBook.Tenant = tenant
+		newBook.AuthorID = tenantID(tenant, newBook.AuthorID)
+		newBook.WorkID = tenantID(tenant, newBook.WorkID)
 	}
-	tempPublishDate := getParamValue(req, "publish_date")
-	if tempPublishDate != "" {
-		publishDate, err = time.Parse(time.RFC3339, tempPublishDate)
+
+	// collapse identical writes sent by the same user within the dedup window
+	isWrite := req.Method == "PUT" || req.Method == "POST" || req.Method == "DELETE"
+	dedup := isWrite && dedupEnabled(userId)
+	if dedup {
+		previous, duplicate, err := claimWrite(userId, req)
 		if err != nil {
-			fmt.Println("conversion from string to time for field publishDate failed")
-			err = errors.Wrap(err, "conversion from string to time for field publishDate failed")
-			fmt.Fprintf(w, "%s", err)
+			fmt.Println(err)
+			dedup = false
+		} else if duplicate {
+			fmt.Fprintf(w, "%s", previous)
 			return
 		}
 	}
@@ -259,41 +761,73 @@ func book(w http.ResponseWriter, req *http.Request) {
 	// handle different request types
 	switch req.Method {
 	case "GET":
-		result, err = getBook(client, ctx, id)
+		result, err = getBook(id, displayCurrency, getParamValue(req, "coupon"))
 	case "DELETE":
-		result, err = deleteBook(client, ctx, id)
+		result, err = removeBook(id)
 	case "POST":
-		result, err = updateBook(client, ctx, id, title)
+		result, err = retitleBook(id, title)
 	case "PUT":
-		result, err = addBook(client, ctx, id, Book{Title: title, AuthorName: authorName, Price: price, EbookAvailable: ebookAvailable, PublishDate: publishDate})
+		var candidates []string
+		candidates, err = checkDuplicates(id, newBook, getParamValue(req, "duplicates"))
+		if len(candidates) > 0 {
+			w.Header().Set("X-Duplicate-Candidates", strings.Join(candidates, ","))
+		}
+		if err == nil {
+			result, err = putBook(id, newBook)
+		}
 	default:
 		msg := "Unsupported request for /book " + req.Method
 		err = errors.New(msg)
 	}
+	if dedup {
+		var dedupErr error
+		if err != nil {
+			dedupErr = releaseWrite(userId, req)
+		} else {
+			dedupErr = completeWrite(userId, req, result)
+		}
+		if dedupErr != nil {
+			fmt.Println(dedupErr)
+		}
+	}
 	if err != nil {
-		fmt.Fprintf(w, "%s", err)
+		if !writeValidationError(w, err) {
+			fmt.Fprintf(w, "%s", err)
+		}
 	} else {
 		fmt.Fprintf(w, "%s", result)
-		// handle write to redis
-		if userId != "" {
-			err = writeToRedis(userId, "book", req.Method)
-			if err != nil {
-				fmt.Fprintf(w, "%s", err)
+		// record book views for the heatmap and the user's recently viewed list
+		if req.Method == "GET" && result != "" {
+			if err = countView(id); err != nil {
+				fmt.Println(err)
+			}
+			if userId != "" {
+				if err = recordRecentlyViewed(userId, id); err != nil {
+					fmt.Println(err)
+				}
 			}
 		}
 	}
 }
 
-func storeBook(client *elastic.Client, ctx context.Context) (string, error) {
-	cardinalityAgg := elastic.NewCardinalityAggregation().Field("author_name")
-	searchResult, err := client.Search().Index(USER_INDEX).Pretty(true).Aggregation("distinctAuthors", cardinalityAgg).Do(ctx)
-	distinctAuthors, found := searchResult.Aggregations.Cardinality("distinctAuthors")
-	if !found {
-		return "", nil
+// storeBook aggregates the store stats of the tenant, with the average price converted to
+// currency.
+func storeBook(currency string, tenant string) (string, error) {
+	rate, _, err := getExchangeRate(currency)
+	if err != nil {
+		return "", err
+	}
+	stats, err := bookRepo.Stats(tenant)
+	if err != nil {
+		return "", err
+	}
+	var avgPrice Price
+	if stats.AvgBasePrice != nil {
+		avgPrice = priceFromFloat(*stats.AvgBasePrice * rate)
 	}
-	numOfBooks := searchResult.Hits.TotalHits
 
-	buf, err := json.Marshal(AggsRes{Books: int(numOfBooks), Authors: int(math.Round(*distinctAuthors.Value))})
+	buf, err := json.Marshal(AggsRes{Books: int(stats.Books), Authors: int(stats.Authors), AvgPrice: avgPrice, Currency: currency,
+		BooksRelation: stats.BooksRelation})
 	if err != nil {
 		return "", errors.Wrap(err, "cannot create json result of aggregation query")
 	}
@@ -303,16 +837,13 @@ func storeBook(client *elastic.Client, ctx context.Context) (string, error) {
 func store(w http.ResponseWriter, req *http.Request) {
 	var err error
 	var result string
-	client, ctx, err := connectElasticSearch()
-	if err != nil {
-		errors.Wrap(err, "error in connecting to ES")
-		fmt.Fprintf(w, "%s", err)
-		return
-	}
-	userId := getParamValue(req, "user_id")
 	switch req.Method {
 	case "GET":
-		result, err = storeBook(client, ctx)
+		var currency string
+		currency, err = normalizeCurrency(getParamValue(req, "currency"))
+		if err == nil {
+			result, err = storeBook(currency, requestTenant(req))
+		}
 	default:
 		msg := "Unsupported request for /store " + req.Method
 		err = errors.New(msg)
@@ -321,53 +852,37 @@ func store(w http.ResponseWriter, req *http.Request) {
 		fmt.Fprintf(w, "%s", err)
 
 	} else {
-		if userId != "" {
-			err = writeToRedis(userId, "store", req.Method)
-			if err != nil {
-				fmt.Fprintf(w, "%s", err)
-			}
-		}
 		fmt.Fprintf(w, "%s", result)
 	}
 }
 func search(w http.ResponseWriter, req *http.Request) {
 	var err error
 	var result string
-	client, ctx, err := connectElasticSearch()
+	// extract param values and parse them to the correct data type
+	params, err := parseSearchParams(req)
 	if err != nil {
-		errors.Wrap(err, "error in connecting to ES")
+		fmt.Println("search params conversion failed")
 		fmt.Fprintf(w, "%s", err)
 		return
 	}
-	// extract param values and parse them to the correct data type
-	title, authorName, priceRange := getParamValue(req, "title"), getParamValue(req, "author_name"), getParamValue(req, "price_range")
-	userId := getParamValue(req, "user_id")
-
-	// extract from and to from price_range param
-	var from, to int
-	r := strings.Split(priceRange, "-")
-	if len(r) == 2 {
-		from, err = strconv.Atoi(r[0])
-		if err != nil {
-			fmt.Println("price range conversion failed")
-			err = errors.Wrap(err, "price range conversion failed")
-			fmt.Fprintf(w, "%s", err)
-			return
-		}
-		to, err = strconv.Atoi(r[1])
-		if err != nil {
-			fmt.Println("price range conversion failed")
-			err = errors.Wrap(err, "price range conversion failed")
-			fmt.Fprintf(w, "%s", err)
-			return
-		}
-	} else {
-		from, to = -1, -1
-	}
+	userId := tenantID(params.Tenant, getParamValue(req, "user_id"))
 	// handle different requests
 	switch req.Method {
 	case "GET":
-		result, err = searchBook(client, ctx, title, authorName, Range{from, to})
+		var next int
+		var total SearchHits
+		result, next, total, err = searchBook(params)
+		if err == errResponseTruncated {
+			w.Header().Set("Warning", fmt.Sprintf(`199 - "response truncated to %d bytes, continue with the next cursor"`, config.MaxResponseBytes))
+			err = nil
+		}
+		if next >= 0 {
+			w.Header().Set("X-Next-Cursor", strconv.Itoa(next))
+		}
+		if err == nil {
+			w.Header().Set("X-Total-Count", strconv.FormatInt(total.Total, 10))
+			w.Header().Set("X-Total-Relation", total.TotalRelation)
+		}
 	default:
 		msg := "Unsupported request for /search " + req.Method
 		err = errors.New(msg)
@@ -375,22 +890,194 @@ func search(w http.ResponseWriter, req *http.Request) {
 	if err != nil {
 		fmt.Fprintf(w, "%s", err)
 	} else {
-		// handle write to redis
 		if userId != "" {
-			err = writeToRedis(userId, "search", req.Method)
-			if err != nil {
-				fmt.Fprintf(w, "%s", err)
+			entry := SearchHistoryEntry{Query: params.Query, Title: params.Title, AuthorName: params.AuthorName, PriceRange: getParamValue(req, "price_range"), DisplayCurrency: params.DisplayCurrency, Time: time.Now().UTC()}
+			if err = recordSearch(userId, entry); err != nil {
+				fmt.Println(err)
 			}
 		}
 		fmt.Fprintf(w, "%s", result)
 	}
 }
 func main() {
+	configPath := flag.String("config", "", "path to a JSON config file")
+	seed := flag.Bool("seed", false, "load the bundled sample books on startup")
+	synthetic := flag.Int("seed-synthetic", 0, "number of synthetic books to generate with -seed")
+	flag.BoolVar(&demoMode, "demo", false, "run on in-memory backends with a sample catalog, without Elasticsearch or Redis")
+	migrate := flag.Bool("migrate", false, "migrate the books index to a new mapping, swap the alias and exit")
+	migrateMapping := flag.String("migrate-mapping", "", "path to the target mapping of -migrate, the mapping of the code by default")
+	migrateTransforms := flag.String("migrate-transforms", "", "comma separated field transforms applied by -migrate, such as price_to_float,add_isbn")
+	flag.Parse()
+	var err error
+	var report *DiagnosticsReport
+	config, err = loadConfig(*configPath)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if *synthetic < 0 || *synthetic > maxSyntheticBooks {
+		fmt.Println("seed-synthetic must be between 0 and " + strconv.Itoa(maxSyntheticBooks))
+		return
+	}
+	if demoMode {
+		config = demoConfig(config)
+		*seed = true
+		if *synthetic == 0 {
+			*synthetic = demoSyntheticBooks
+		}
+	}
+	blobs, err = newBlobStore(context.Background(), config.Storage)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if esHttpClient, err = newElasticsearchHTTPClient(config.Elasticsearch); err != nil {
+		fmt.Println(err)
+		return
+	}
+	if config.Redis.TLS {
+		redisTLSConfig, err = loadTLSConfig(config.Redis.CACert, config.Redis.ClientCert, config.Redis.ClientKey, config.Redis.InsecureSkipVerify)
+		if err != nil {
+			fmt.Println(errors.Wrap(err, "cannot configure Redis TLS"))
+			return
+		}
+	}
+	backupBlobs = blobs
+	if config.Backups.Storage.Backend != "" {
+		if backupBlobs, err = newBlobStore(context.Background(), config.Backups.Storage); err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+	bookRepo, err = newBookRepository(config.Books)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	activities, err = newActivityStore(config.Activity.Backend)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if bookRules, err = compileBookRules(config.Validation.Rules); err != nil {
+		fmt.Println(err)
+		return
+	}
+	if graphqlSchema, err = newGraphQLSchema(); err != nil {
+		fmt.Println(err)
+		return
+	}
+	if !demoMode {
+		if dialect, err = detectDialect(); err != nil {
+			fmt.Println(err)
+		}
+		report = logDiagnostics()
+	}
+	if *migrate {
+		var target []byte
+		if *migrateMapping != "" {
+			if target, err = ioutil.ReadFile(*migrateMapping); err != nil {
+				fmt.Println(errors.Wrap(err, "cannot read target mapping"))
+				return
+			}
+		}
+		result, err := migrateBooksIndex(string(target), splitList(*migrateTransforms), false)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Printf("migrated %d books from %s to %s, %s now points at %s\n", result.Books, result.From, result.To, result.Alias, result.To)
+		return
+	}
+	if err = checkMappingDrift(report); err != nil {
+		fmt.Println(err)
+		return
+	}
+	if err = startBulkIndexer(); err != nil {
+		fmt.Println(err)
+		return
+	}
+	if *seed {
+		written, err := loadSeed(*synthetic, 1)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Printf("seeded %d books\n", written)
+	}
+	startMaintenance()
+	// start background jobs; in demo mode only activity is recorded, the others work on Redis
+	startActivityWorkers()
+	if !demoMode {
+		if err = startScheduler(); err != nil {
+			fmt.Println(err)
+			return
+		}
+		startNotificationWorker()
+		startThumbnailWorker()
+		startPriceDropWorker()
+		startOutboxRelay()
+		startUsageWorker()
+	}
+	if config.GRPC.Addr != "" {
+		go func() {
+			if err := serveGRPC(config.GRPC.Addr); err != nil {
+				fmt.Println(err)
+			}
+		}()
+	}
 	// handle different routes
-	http.HandleFunc("/book", book)
-	http.HandleFunc("/search", search)
-	http.HandleFunc("/store", store)
-	http.HandleFunc("/activity", activity)
+	http.HandleFunc("/book", withAPIKey(withCache("/book", book)))
+	http.HandleFunc("/search", withAPIKey(withCache("/search", search)))
+	http.HandleFunc("/search/live", liveSearch)
+	http.HandleFunc("/store", withAPIKey(withCache("/store", store)))
+	http.HandleFunc("/store/history", storeHistory)
+	http.HandleFunc("/activity", withAPIKey(activity))
+	http.HandleFunc("/sessions", sessions)
+	http.HandleFunc("/events", events)
+	http.HandleFunc("/graphql", graphqlQuery)
+	http.HandleFunc("/admin/heatmap", heatmap)
+	http.HandleFunc("/admin/diagnostics", diagnostics)
+	http.HandleFunc("/admin/workers", adminWorkers)
+	http.HandleFunc("/admin/import/openlibrary", openLibraryImport)
+	http.HandleFunc("/admin/seed", adminSeed)
+	http.HandleFunc("/admin/maintenance", adminMaintenance)
+	http.HandleFunc("/admin/flags", adminFlags)
+	http.HandleFunc("/admin/rules", adminRules)
+	http.HandleFunc("/admin/data-quality", adminDataQuality)
+	http.HandleFunc("/admin/snapshots", adminSnapshots)
+	http.HandleFunc("/admin/snapshots/", adminSnapshots)
+	http.HandleFunc("/admin/backups", adminBackups)
+	http.HandleFunc("/admin/migrations", adminMigrations)
+	http.HandleFunc("/alerts", alerts)
+	http.HandleFunc("/users/", users)
+	http.HandleFunc("/books/", books)
+	http.HandleFunc("/works/", works)
+	http.HandleFunc("/publishers/", publishers)
+	http.HandleFunc("/authors/", withAPIKey(authors))
+	http.HandleFunc("/admin/discounts", adminDiscounts)
+	http.HandleFunc("/coupons/", coupons)
+	http.HandleFunc("/orders", withAPIKey(orders))
+	http.HandleFunc("/admin/stock", adminStock)
+	http.HandleFunc("/admin/reviews", adminReviews)
+	http.HandleFunc("/admin/copies", adminCopies)
+	http.HandleFunc("/admin/overdue", overdue)
+	http.HandleFunc("/admin/audit", auditLog)
+	http.HandleFunc("/admin/top-users", topUsers)
+	http.HandleFunc("/admin/usage", usage)
+	http.HandleFunc("/admin/activity/stream", activityStream)
+	http.HandleFunc("/admin/consistency", consistency)
+	http.HandleFunc("/lists", lists)
+	http.HandleFunc("/lists/", lists)
+	http.HandleFunc("/sales", sales)
+	http.HandleFunc("/assets/", assets)
+	http.HandleFunc("/docs", docs)
+	http.HandleFunc("/docs/", docs)
+	http.HandleFunc("/admin/ui/", dashboard)
 	// listen and serve
-	http.ListenAndServe(":8080", nil)
+	handler := withTenant(withSession(withActivity(withMaintenance(withInputLimits(http.DefaultServeMux)))))
+	if !demoMode {
+		handler = withUsage(handler)
+	}
+	http.ListenAndServe(":8080", handler)
 }
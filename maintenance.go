@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	errors "github.com/fiverr/go_errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const maintenanceMessage = "the service is in read-only maintenance, retry later"
+
+// MaintenanceStatus is the read-only maintenance state of this instance.
+type MaintenanceStatus struct {
+	Enabled    bool      `json:"enabled"`
+	Since      time.Time `json:"since,omitempty"`
+	RetryAfter string    `json:"retry_after"`
+}
+
+var (
+	maintenanceMu sync.Mutex
+	maintenance   MaintenanceStatus
+)
+
+// startMaintenance applies the configured maintenance state on startup.
+func startMaintenance() {
+	setMaintenance(config.Maintenance.Enabled, config.Maintenance.RetryAfter)
+}
+
+func setMaintenance(enabled bool, retryAfter string) {
+	maintenanceMu.Lock()
+	defer maintenanceMu.Unlock()
+	if enabled && !maintenance.Enabled {
+		maintenance.Since = time.Now().UTC()
+	}
+	if !enabled {
+		maintenance.Since = time.Time{}
+	}
+	maintenance.Enabled, maintenance.RetryAfter = enabled, retryAfter
+}
+
+func maintenanceStatus() MaintenanceStatus {
+	maintenanceMu.Lock()
+	defer maintenanceMu.Unlock()
+	return maintenance
+}
+
+// maintenanceRetrySeconds returns the Retry-After value of rejected writes, in seconds.
+func maintenanceRetrySeconds(status MaintenanceStatus) string {
+	return strconv.Itoa(int(parseDuration(status.RetryAfter, 5*time.Minute).Seconds()))
+}
+
+// maintenanceExempt are routes whose non-GET requests do not write to the catalog.
+var maintenanceExempt = map[string]bool{
+	"/admin/maintenance": true,
+	"/admin/ui/login":    true,
+	"/graphql":           true,
+	"/sessions":          true,
+}
+
+// withMaintenance rejects writes with 503 and Retry-After while in maintenance mode, still
+// serving reads. Requests with the admin token, as a header or the dashboard cookie, pass so
+// operators can work on the service.
+func withMaintenance(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "GET", "HEAD", "OPTIONS":
+			next.ServeHTTP(w, req)
+			return
+		}
+		status := maintenanceStatus()
+		if !status.Enabled || maintenanceExempt[req.URL.Path] || dashboardAdmin(req) {
+			next.ServeHTTP(w, req)
+			return
+		}
+		w.Header().Set("Retry-After", maintenanceRetrySeconds(status))
+		http.Error(w, maintenanceMessage, http.StatusServiceUnavailable)
+	})
+}
+
+// adminMaintenance handles /admin/maintenance: GET returns the maintenance state and
+// POST ?action=enable|disable&retry_after=10m switches it. The state is per instance, so every
+// instance behind a load balancer must be switched.
+func adminMaintenance(w http.ResponseWriter, req *http.Request) {
+	if !isAdmin(req) {
+		http.Error(w, "admin token required", http.StatusUnauthorized)
+		return
+	}
+	switch req.Method {
+	case "GET":
+	case "POST":
+		retryAfter := getParamValue(req, "retry_after")
+		if retryAfter == "" {
+			retryAfter = config.Maintenance.RetryAfter
+		} else if d, err := time.ParseDuration(retryAfter); err != nil || d <= 0 {
+			fmt.Fprintf(w, "%s", errors.New("retry_after must be a positive duration such as 10m"))
+			return
+		}
+		switch getParamValue(req, "action") {
+		case "enable":
+			setMaintenance(true, retryAfter)
+		case "disable":
+			setMaintenance(false, retryAfter)
+		default:
+			fmt.Fprintf(w, "%s", errors.New("action must be enable or disable"))
+			return
+		}
+	default:
+		msg := "Unsupported request for /admin/maintenance " + req.Method
+		fmt.Fprintf(w, "%s", errors.New(msg))
+		return
+	}
+	buf, err := json.Marshal(maintenanceStatus())
+	if err != nil {
+		fmt.Fprintf(w, "%s", errors.Wrap(err, "cannot create json result of maintenance"))
+		return
+	}
+	fmt.Fprintf(w, "%s", buf)
+}
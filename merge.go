@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	errors "github.com/fiverr/go_errors"
+	"gopkg.in/olivere/elastic.v5"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// MergeResult reports what a merge of duplicate books moved to the canonical book.
+type MergeResult struct {
+	CanonicalID  string   `json:"canonical_id"`
+	Merged       []string `json:"merged"`
+	Reviews      int      `json:"reviews"`
+	Favorites    int      `json:"favorites"`
+	FilledFields []string `json:"filled_fields"`
+}
+
+// consolidateBook fills the fields left empty on the canonical book from a duplicate, and
+// returns the names of the fields filled. Formats are combined.
+func consolidateBook(canonical *Book, duplicate Book) []string {
+	var filled []string
+	fill := func(name string, value *string, from string) {
+		if *value == "" && from != "" {
+			*value = from
+			filled = append(filled, name)
+		}
+	}
+	fill("author_id", &canonical.AuthorID, duplicate.AuthorID)
+	fill("genre", &canonical.Genre, duplicate.Genre)
+	fill("publisher", &canonical.Publisher, duplicate.Publisher)
+	fill("isbn", &canonical.ISBN, duplicate.ISBN)
+	fill("description", &canonical.Description, duplicate.Description)
+	fill("cover_url", &canonical.CoverURL, duplicate.CoverURL)
+	fill("language", &canonical.Language, duplicate.Language)
+	if canonical.PageCount == 0 && duplicate.PageCount > 0 {
+		canonical.PageCount = duplicate.PageCount
+		filled = append(filled, "page_count")
+	}
+	if canonical.PublishDate.IsZero() && !duplicate.PublishDate.IsZero() {
+		canonical.PublishDate = duplicate.PublishDate
+		filled = append(filled, "publish_date")
+	}
+	for _, format := range duplicate.Formats {
+		if !hasFormat(canonical.Formats, format) {
+			canonical.Formats = append(canonical.Formats, format)
+			filled = append(filled, "formats")
+		}
+	}
+	canonical.EbookAvailable = hasFormat(canonical.Formats, "ebook")
+	return filled
+}
+
+// moveReviews repoints the reviews of a duplicate to the canonical book. A user who reviewed
+// both keeps the canonical review and the other is dropped.
+func moveReviews(client *elastic.Client, ctx context.Context, duplicateID string, canonicalID string) (int, error) {
+	moved := 0
+	scroll := client.Scroll(REVIEWS_INDEX).Query(elastic.NewTermQuery("book_id", duplicateID)).Size(500)
+	defer scroll.Clear(ctx)
+	for {
+		res, err := scroll.Do(ctx)
+		if err == io.EOF || elastic.IsNotFound(err) {
+			return moved, nil
+		}
+		if err != nil {
+			return moved, errors.Wrap(err, "cannot scroll reviews")
+		}
+		for _, hit := range res.Hits.Hits {
+			var review Review
+			if err = json.Unmarshal(*hit.Source, &review); err != nil {
+				return moved, errors.Wrap(err, "cannot parse review")
+			}
+			review.BookID = canonicalID
+			_, err = client.Index().Index(REVIEWS_INDEX).Type(typeName(REVIEW_TYPE)).Id(reviewID(canonicalID, review.UserID)).
+				OpType("create").BodyJson(review).Do(ctx)
+			if err != nil && !elastic.IsConflict(err) {
+				return moved, errors.Wrap(err, "cannot move review "+hit.Id)
+			}
+			if err == nil {
+				moved++
+			}
+			if _, err = client.Delete().Index(REVIEWS_INDEX).Type(typeName(REVIEW_TYPE)).Id(hit.Id).Do(ctx); err != nil {
+				return moved, errors.Wrap(err, "cannot delete review "+hit.Id)
+			}
+		}
+	}
+}
+
+// moveFavorites repoints the favorites of duplicates to the canonical book, keeping the
+// favorite counts right for users who favorited several of them.
+func moveFavorites(duplicateIDs []string, canonicalID string) (int, error) {
+	client, err := connectRedis()
+	if err != nil {
+		return 0, errors.Wrap(err, "cannot connect to Redis")
+	}
+	defer client.Close()
+	moved := 0
+	var cursor uint64
+	for {
+		var keys []string
+		keys, cursor, err = client.Scan(cursor, favoritesKey("*"), 500).Result()
+		if err != nil {
+			return moved, errors.Wrap(err, "cannot get key from Redis")
+		}
+		for _, key := range keys {
+			userID := strings.TrimPrefix(key, favoritesKey(""))
+			for _, id := range duplicateIDs {
+				favorited, err := client.SIsMember(key, id).Result()
+				if err != nil {
+					return moved, errors.Wrap(err, "cannot get key from Redis")
+				}
+				if !favorited {
+					continue
+				}
+				if _, err = removeFavorite(client, userID, id); err != nil {
+					return moved, err
+				}
+				if _, err = addFavorite(client, userID, canonicalID); err != nil {
+					return moved, err
+				}
+				moved++
+			}
+		}
+		if cursor == 0 {
+			break
+		}
+	}
+	for _, id := range duplicateIDs {
+		client.HDel(favoriteCountsKey, id)
+	}
+	return moved, nil
+}
+
+// mergeBooks folds the duplicates into the canonical book: empty fields are filled from them,
+// their reviews and favorites are moved and they are deleted.
+func mergeBooks(canonicalID string, duplicateIDs []string) (*MergeResult, error) {
+	source, err := bookRepo.Get(canonicalID)
+	if err != nil {
+		return nil, err
+	}
+	if source == "" {
+		return nil, errors.New("book " + canonicalID + " does not exist")
+	}
+	canonical, err := decodeBook(source)
+	if err != nil {
+		return nil, err
+	}
+	result := &MergeResult{CanonicalID: canonicalID, Merged: make([]string, 0, len(duplicateIDs)), FilledFields: make([]string, 0)}
+	duplicates := make([]Book, 0, len(duplicateIDs))
+	for _, id := range duplicateIDs {
+		if id == canonicalID {
+			return nil, errors.New("book " + id + " cannot be merged into itself")
+		}
+		if idTenant(id) != idTenant(canonicalID) {
+			return nil, errors.New("book " + id + " is not in the catalog of " + canonicalID)
+		}
+		source, err := bookRepo.Get(id)
+		if err != nil {
+			return nil, err
+		}
+		if source == "" {
+			return nil, errors.New("book " + id + " does not exist")
+		}
+		duplicate, err := decodeBook(source)
+		if err != nil {
+			return nil, err
+		}
+		duplicates = append(duplicates, duplicate)
+	}
+	filled := make(map[string]bool)
+	for _, duplicate := range duplicates {
+		for _, field := range consolidateBook(&canonical, duplicate) {
+			if !filled[field] {
+				filled[field] = true
+				result.FilledFields = append(result.FilledFields, field)
+			}
+		}
+	}
+	if len(result.FilledFields) > 0 {
+		if _, err = putBook(canonicalID, canonical); err != nil {
+			return nil, err
+		}
+	}
+
+	client, ctx, err := connectElasticSearch()
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range duplicateIDs {
+		moved, err := moveReviews(client, ctx, id, canonicalID)
+		result.Reviews += moved
+		if err != nil {
+			return result, err
+		}
+	}
+	if result.Reviews > 0 {
+		client.Refresh(REVIEWS_INDEX).Do(ctx)
+		if err = refreshBookRating(client, ctx, canonicalID); err != nil {
+			return result, err
+		}
+	}
+	if result.Favorites, err = moveFavorites(duplicateIDs, canonicalID); err != nil {
+		return result, err
+	}
+	for _, id := range duplicateIDs {
+		if _, err = removeBook(id); err != nil {
+			return result, err
+		}
+		result.Merged = append(result.Merged, id)
+	}
+	return result, nil
+}
+
+// mergeDuplicates handles POST /books/merge?canonical_id=&duplicate_ids=, merging the comma
+// separated duplicates into the canonical book. Admin only, and recorded in the audit log.
+func mergeDuplicates(w http.ResponseWriter, req *http.Request) {
+	if !requireElasticsearch(w, req) {
+		return
+	}
+	if !isAdmin(req) {
+		http.Error(w, "admin token required", http.StatusUnauthorized)
+		return
+	}
+	if req.Method != "POST" {
+		msg := "Unsupported request for /books/merge " + req.Method
+		fmt.Fprintf(w, "%s", errors.New(msg))
+		return
+	}
+	tenant := requestTenant(req)
+	canonicalID := tenantID(tenant, strings.TrimSpace(getParamValue(req, "canonical_id")))
+	var duplicateIDs []string
+	seen := make(map[string]bool)
+	for _, id := range strings.Split(getParamValue(req, "duplicate_ids"), ",") {
+		if id = tenantID(tenant, strings.TrimSpace(id)); id != "" && !seen[id] {
+			seen[id] = true
+			duplicateIDs = append(duplicateIDs, id)
+		}
+	}
+	var verr ValidationError
+	if canonicalID == "" {
+		verr.Add("canonical_id", "is required")
+	}
+	if len(duplicateIDs) == 0 {
+		verr.Add("duplicate_ids", "is required")
+	}
+	if writeValidationError(w, verr.Err()) {
+		return
+	}
+	result, err := mergeBooks(canonicalID, duplicateIDs)
+	if result != nil && len(result.Merged) > 0 {
+		// partial merges are audited too, the merged books are gone
+		details := map[string]interface{}{"merged": result.Merged, "reviews": result.Reviews,
+			"favorites": result.Favorites, "filled_fields": result.FilledFields}
+		if auditErr := recordAudit(AuditEntry{Action: "merge_books", Target: canonicalID, Actor: "admin@" + clientIP(req), Details: details}); auditErr != nil {
+			fmt.Println(auditErr)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	buf, err := json.Marshal(result)
+	if err != nil {
+		fmt.Fprintf(w, "%s", errors.Wrap(err, "cannot create json result of merge"))
+		return
+	}
+	fmt.Fprintf(w, "%s", buf)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	errors "github.com/fiverr/go_errors"
+	"gopkg.in/olivere/elastic.v5"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// migrationTransforms are the field transforms a migration can apply to each book while it is
+// reindexed, as painless scripts by name.
+var migrationTransforms = map[string]string{
+	// prices indexed as integer units before decimal prices became floats
+	"price_to_float": "if (ctx._source.price instanceof Number) { ctx._source.price = ((Number) ctx._source.price).doubleValue() }",
+	// books indexed before ISBNs were kept
+	"add_isbn": "if (ctx._source.isbn == null) { ctx._source.isbn = '' }",
+	// books indexed before currencies, whose price is in the base currency
+	"add_base_price": "if (ctx._source.base_price == null) { ctx._source.base_price = ctx._source.price }",
+}
+
+// MigrationResult reports a migration of the books index.
+type MigrationResult struct {
+	Alias      string   `json:"alias"`
+	From       string   `json:"from"`
+	To         string   `json:"to"`
+	Transforms []string `json:"transforms"`
+	Books      int64    `json:"books"`
+	Took       string   `json:"took"`
+}
+
+// migrationScript joins the named transforms into one script, nil when there are none.
+func migrationScript(transforms []string) (*elastic.Script, error) {
+	sources := make([]string, 0, len(transforms))
+	for _, name := range transforms {
+		source, ok := migrationTransforms[name]
+		if !ok {
+			known := make([]string, 0, len(migrationTransforms))
+			for k := range migrationTransforms {
+				known = append(known, k)
+			}
+			sort.Strings(known)
+			return nil, errors.New("unknown transform " + name + ", must be one of " + strings.Join(known, ", "))
+		}
+		sources = append(sources, source)
+	}
+	if len(sources) == 0 {
+		return nil, nil
+	}
+	return elastic.NewScript(strings.Join(sources, "; ")).Lang("painless"), nil
+}
+
+// aliasTarget returns the index behind the alias, or "" when name is a concrete index.
+func aliasTarget(client *elastic.Client, ctx context.Context, name string) (string, error) {
+	res, err := client.Aliases().Index(name).Do(ctx)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot get aliases of "+name)
+	}
+	for index, info := range res.Indices {
+		if index == name {
+			return "", nil
+		}
+		for _, alias := range info.Aliases {
+			if alias.AliasName == name {
+				return index, nil
+			}
+		}
+	}
+	return "", errors.New("index " + name + " does not exist")
+}
+
+// migrateBooksIndex creates a new books index with the target mapping, or the mapping of the
+// code when empty, reindexes the books into it through the transforms, checks every book made
+// it and points the books alias at it. A books index that is not an alias yet is replaced by the
+// alias in the same step. The old index is kept for rollback unless deleteOld is set. Writes
+// during the migration would be lost, so it is run in maintenance mode.
+func migrateBooksIndex(targetMapping string, transforms []string, deleteOld bool) (*MigrationResult, error) {
+	started := time.Now()
+	if targetMapping == "" {
+		targetMapping = mapping
+	}
+	if !json.Valid([]byte(targetMapping)) {
+		return nil, errors.New("target mapping is not valid JSON")
+	}
+	script, err := migrationScript(transforms)
+	if err != nil {
+		return nil, err
+	}
+	client, ctx, err := connectElasticSearch()
+	if err != nil {
+		return nil, err
+	}
+	alias := booksIndex()
+	from, err := aliasTarget(client, ctx, alias)
+	if err != nil {
+		return nil, err
+	}
+	concrete := from == ""
+	if concrete {
+		from = alias
+	}
+	result := &MigrationResult{Alias: alias, From: from, To: alias + "_" + started.UTC().Format("20060102150405"), Transforms: transforms}
+
+	if _, err = client.CreateIndex(result.To).BodyString(targetMapping).Do(ctx); err != nil {
+		return nil, errors.Wrap(err, "cannot create index "+result.To)
+	}
+	// the new index is dropped on failure, leaving the alias on the old one
+	abort := func(err error) (*MigrationResult, error) {
+		client.DeleteIndex(result.To).Do(ctx)
+		return nil, err
+	}
+	if _, err = client.Refresh(from).Do(ctx); err != nil {
+		return abort(errors.Wrap(err, "cannot refresh "+from))
+	}
+	if result.Books, err = client.Count(from).Do(ctx); err != nil {
+		return abort(errors.Wrap(err, "cannot count books of "+from))
+	}
+	reindex := client.Reindex().SourceIndex(from).DestinationIndex(result.To).WaitForCompletion(true).Refresh("true")
+	if script != nil {
+		reindex = reindex.Script(script)
+	}
+	res, err := reindex.Do(ctx)
+	if err != nil {
+		return abort(errors.Wrap(err, "cannot reindex "+from+" into "+result.To))
+	}
+	if len(res.Failures) > 0 {
+		return abort(errors.New(fmt.Sprintf("%d books failed to reindex into %s", len(res.Failures), result.To)))
+	}
+	migrated, err := client.Count(result.To).Do(ctx)
+	if err != nil {
+		return abort(errors.Wrap(err, "cannot count books of "+result.To))
+	}
+	if migrated != result.Books {
+		return abort(errors.New(fmt.Sprintf("%s has %d books instead of %d", result.To, migrated, result.Books)))
+	}
+
+	// one atomic aliases call, so readers never find the books missing
+	actions := []map[string]interface{}{{"add": map[string]string{"index": result.To, "alias": alias}}}
+	if concrete {
+		actions = append(actions, map[string]interface{}{"remove_index": map[string]string{"index": from}})
+	} else {
+		actions = append(actions, map[string]interface{}{"remove": map[string]string{"index": from, "alias": alias}})
+	}
+	if _, err = client.PerformRequest(ctx, "POST", "/_aliases", nil, map[string]interface{}{"actions": actions}); err != nil {
+		return abort(errors.Wrap(err, "cannot point alias "+alias+" at "+result.To))
+	}
+	if deleteOld && !concrete {
+		if _, err = client.DeleteIndex(from).Do(ctx); err != nil {
+			fmt.Println(errors.Wrap(err, "cannot delete old index "+from))
+		}
+	}
+	result.Took = time.Since(started).String()
+	return result, nil
+}
+
+// adminMigrations handles POST /admin/migrations?transforms=&delete_old=, migrating the books
+// index to the mapping sent as JSON body, or to the mapping of the code without one. It is only
+// run in maintenance mode, unless force is set.
+func adminMigrations(w http.ResponseWriter, req *http.Request) {
+	if !requireElasticsearch(w, req) {
+		return
+	}
+	if !isAdmin(req) {
+		http.Error(w, "admin token required", http.StatusUnauthorized)
+		return
+	}
+	if req.Method != "POST" {
+		msg := "Unsupported request for /admin/migrations " + req.Method
+		fmt.Fprintf(w, "%s", errors.New(msg))
+		return
+	}
+	if !maintenanceStatus().Enabled && getParamValue(req, "force") != "true" {
+		http.Error(w, "enable maintenance mode before migrating, or set force", http.StatusConflict)
+		return
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		fmt.Fprintf(w, "%s", errors.Wrap(err, "cannot read target mapping"))
+		return
+	}
+	if len(bytes.TrimSpace(body)) > 0 {
+		// the mappings themselves are free-form, but the index body only has these sections
+		var target struct {
+			Settings json.RawMessage `json:"settings"`
+			Mappings json.RawMessage `json:"mappings"`
+			Aliases  json.RawMessage `json:"aliases"`
+		}
+		if err = decodeStrictJSON(bytes.NewReader(body), &target); err != nil {
+			fmt.Fprintf(w, "%s", errors.Wrap(err, "cannot decode target mapping"))
+			return
+		}
+	}
+	result, err := migrateBooksIndex(strings.TrimSpace(string(body)), splitList(getParamValue(req, "transforms")),
+		getParamValue(req, "delete_old") == "true")
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	if err = recordAudit(AuditEntry{Action: "migrate_index", Target: result.Alias, Actor: "admin@" + clientIP(req),
+		Details: map[string]interface{}{"from": result.From, "to": result.To, "transforms": result.Transforms}}); err != nil {
+		fmt.Println(err)
+	}
+	buf, err := json.Marshal(result)
+	if err != nil {
+		fmt.Fprintf(w, "%s", errors.Wrap(err, "cannot create json result of migration"))
+		return
+	}
+	fmt.Fprintf(w, "%s", buf)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	errors "github.com/fiverr/go_errors"
+	"gopkg.in/olivere/elastic.v5"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const maxRecentLimit = 100
+
+// BookHit is a book document returned together with its id.
+type BookHit struct {
+	ID   string          `json:"id"`
+	Book json.RawMessage `json:"book"`
+}
+
+// bookHits converts search hits into id/document pairs.
+func bookHits(searchResult *elastic.SearchResult) []BookHit {
+	hits := make([]BookHit, 0, len(searchResult.Hits.Hits))
+	for _, hit := range searchResult.Hits.Hits {
+		hits = append(hits, BookHit{ID: hit.Id, Book: *hit.Source})
+	}
+	return hits
+}
+
+// recentBooks returns the newest books of the tenant indexed within window, newest first.
+func recentBooks(client *elastic.Client, ctx context.Context, tenant string, window time.Duration, limit int) ([]BookHit, error) {
+	query := elastic.NewBoolQuery().Must(elastic.NewRangeQuery("indexed_at").Gte(time.Now().Add(-window).UTC().Format(time.RFC3339))).
+		Filter(tenantQuery(tenant))
+	searchResult, err := client.Search().Index(booksIndex()).Query(query).Sort("indexed_at", false).Sort(idSortField(), true).
+		Size(limit).Do(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot search recent books")
+	}
+	return bookHits(searchResult), nil
+}
+
+// recent handles GET /books/recent?window=7d&limit=10.
+func recent(w http.ResponseWriter, req *http.Request) {
+	if !requireElasticsearch(w, req) {
+		return
+	}
+	if req.Method != "GET" {
+		msg := "Unsupported request for /books/recent " + req.Method
+		fmt.Fprintf(w, "%s", errors.New(msg))
+		return
+	}
+	window := 7 * 24 * time.Hour
+	if value := getParamValue(req, "window"); value != "" {
+		d, err := parseWindow(value)
+		if err != nil || d <= 0 {
+			fmt.Fprintf(w, "%s", errors.New("window must be a positive duration such as 24h or 7d"))
+			return
+		}
+		window = d
+	}
+	limit := 10
+	if value := getParamValue(req, "limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 || parsed > maxRecentLimit {
+			fmt.Fprintf(w, "%s", errors.New("limit must be between 1 and "+strconv.Itoa(maxRecentLimit)))
+			return
+		}
+		limit = parsed
+	}
+	client, ctx, err := connectElasticSearch()
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	hits, err := recentBooks(client, ctx, requestTenant(req), window, limit)
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	buf, err := json.Marshal(hits)
+	if err != nil {
+		fmt.Fprintf(w, "%s", errors.Wrap(err, "cannot create json result of recent books"))
+		return
+	}
+	fmt.Fprintf(w, "%s", buf)
+}
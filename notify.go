@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	errors "github.com/fiverr/go_errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Notification is delivered to a subscriber's webhook when something they follow happens.
+type Notification struct {
+	Type       string      `json:"type"`
+	UserID     string      `json:"user_id"`
+	WebhookURL string      `json:"-"`
+	Payload    interface{} `json:"payload"`
+	Time       time.Time   `json:"time"`
+}
+
+// webhookClient delivers notifications, dialing only the addresses allowed by webhookAddrs so a
+// webhook whose host resolves to the internal network later on is not reached either. Redirects
+// are not followed, as they could lead there too.
+var webhookClient = &http.Client{
+	Timeout:   10 * time.Second,
+	Transport: &http.Transport{DialContext: dialWebhook},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// publicIP reports whether ip is neither loopback, link-local, private nor otherwise local.
+func publicIP(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() &&
+		!ip.IsPrivate() && !ip.IsUnspecified() && !ip.IsMulticast()
+}
+
+// webhookHostAllowed reports whether host is listed in webhooks.allowed_hosts.
+func webhookHostAllowed(host string) bool {
+	for _, allowed := range config.Webhooks.AllowedHosts {
+		if strings.EqualFold(host, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// webhookAddrs resolves the host of a webhook, refusing hosts with a loopback, link-local or
+// private address unless they are allowed by config.
+func webhookAddrs(ctx context.Context, host string) ([]net.IPAddr, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot resolve webhook host "+host)
+	}
+	if len(addrs) == 0 {
+		return nil, errors.New("cannot resolve webhook host " + host)
+	}
+	if webhookHostAllowed(host) {
+		return addrs, nil
+	}
+	for _, addr := range addrs {
+		if !publicIP(addr.IP) {
+			return nil, errors.New("webhook host " + host + " has the internal address " + addr.IP.String())
+		}
+	}
+	return addrs, nil
+}
+
+func dialWebhook(ctx context.Context, network string, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := webhookAddrs(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, network, net.JoinHostPort(addrs[0].IP.String(), port))
+}
+
+// checkWebhookURL validates a webhook given by a user: an http or https URL whose host does not
+// resolve to the service's own network.
+func checkWebhookURL(webhookURL string) error {
+	u, err := url.Parse(webhookURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return errors.New("webhook_url must be an http or https URL")
+	}
+	if _, err = webhookAddrs(context.Background(), u.Hostname()); err != nil {
+		return err
+	}
+	return nil
+}
+
+// sendNotification posts the notification as JSON to the subscriber's webhook.
+func sendNotification(n Notification) error {
+	if n.WebhookURL == "" {
+		return nil
+	}
+	if n.Time.IsZero() {
+		n.Time = time.Now().UTC()
+	}
+	buf, err := json.Marshal(n)
+	if err != nil {
+		return errors.Wrap(err, "cannot create json notification")
+	}
+	resp, err := webhookClient.Post(n.WebhookURL, "application/json", bytes.NewReader(buf))
+	if err != nil {
+		return errors.Wrap(err, "cannot deliver notification")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return errors.New("webhook " + n.WebhookURL + " returned " + resp.Status)
+	}
+	return nil
+}
+
+// notificationQueue buffers notifications for the webhook delivery worker.
+var notificationQueue = make(chan Notification, 1000)
+
+// notifyAsync queues the notifications for background delivery, dropping them when the queue is full.
+func notifyAsync(notifications []Notification) {
+	for _, n := range notifications {
+		select {
+		case notificationQueue <- n:
+		default:
+			fmt.Println(errors.New("notification queue is full, dropping notification for user " + n.UserID))
+		}
+	}
+}
+
+// startNotificationWorker delivers queued notifications until the process exits.
+func startNotificationWorker() {
+	worker := registerWorker("webhook_delivery", func() int { return len(notificationQueue) })
+	go func() {
+		for n := range notificationQueue {
+			worker.WaitWhilePaused()
+			err := sendNotification(n)
+			if err != nil {
+				fmt.Println(err)
+			}
+			worker.Done(err)
+		}
+	}()
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestCheckWebhookURL(t *testing.T) {
+	useMemoryRepository(t)
+	tests := map[string]bool{
+		"https://93.184.216.34/hooks/books":  true,
+		"http://93.184.216.34:8080/hook":     true,
+		"http://127.0.0.1/hook":              false,
+		"http://10.0.0.7/hook":               false,
+		"http://192.168.1.1/hook":            false,
+		"http://169.254.169.254/latest/meta": false,
+		"http://[::1]:8080/hook":             false,
+		"http://0.0.0.0/hook":                false,
+		"ftp://93.184.216.34/hook":           false,
+		"/hook":                              false,
+		"http://":                            false,
+	}
+	for webhookURL, valid := range tests {
+		if err := checkWebhookURL(webhookURL); (err == nil) != valid {
+			t.Errorf("checkWebhookURL(%q) = %v, want valid %v", webhookURL, err, valid)
+		}
+	}
+
+	config.Webhooks.AllowedHosts = []string{"127.0.0.1"}
+	if err := checkWebhookURL("http://127.0.0.1/hook"); err != nil {
+		t.Errorf("checkWebhookURL of an allowed host = %v", err)
+	}
+}
+
+func TestAlertsRequireTheUser(t *testing.T) {
+	useMemoryRepository(t)
+	w := serve(http.HandlerFunc(alerts), "GET", "/alerts?user_id=alice", nil)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("GET /alerts without credentials = %d %q", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	errors "github.com/fiverr/go_errors"
+	"gopkg.in/olivere/elastic.v5"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const maxOpenLibraryImport = 1000
+
+// openLibrarySearch is the part of the Open Library search.json response we use.
+type openLibrarySearch struct {
+	NumFound int `json:"numFound"`
+	Docs     []struct {
+		Key              string   `json:"key"`
+		Title            string   `json:"title"`
+		AuthorName       []string `json:"author_name"`
+		FirstPublishYear int      `json:"first_publish_year"`
+		ISBN             []string `json:"isbn"`
+		Subject          []string `json:"subject"`
+	} `json:"docs"`
+}
+
+var openLibraryClient = &http.Client{Timeout: 30 * time.Second}
+
+// fetchOpenLibraryWorks searches Open Library works by subject and/or author.
+func fetchOpenLibraryWorks(subject string, author string, limit int) (*openLibrarySearch, error) {
+	params := url.Values{"limit": {strconv.Itoa(limit)}}
+	if subject != "" {
+		params.Set("subject", subject)
+	}
+	if author != "" {
+		params.Set("author", author)
+	}
+	resp, err := openLibraryClient.Get(config.OpenLibrary.URL + "?" + params.Encode())
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot query Open Library")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("Open Library returned " + resp.Status)
+	}
+	var works openLibrarySearch
+	if err = json.NewDecoder(resp.Body).Decode(&works); err != nil {
+		return nil, errors.Wrap(err, "cannot decode Open Library response")
+	}
+	return &works, nil
+}
+
+// importOpenLibraryWorks maps the works to books of the tenant's catalog and bulk-indexes them,
+// keyed by Open Library work id.
+func importOpenLibraryWorks(client *elastic.Client, ctx context.Context, tenant string, works *openLibrarySearch) (string, error) {
+	bulk := client.Bulk()
+	now := time.Now().UTC()
+	for _, doc := range works.Docs {
+		id := tenantID(tenant, strings.TrimPrefix(doc.Key, "/works/"))
+		if id == "" || doc.Title == "" {
+			continue
+		}
+		book := Book{Title: doc.Title, AuthorName: strings.Join(doc.AuthorName, ", "), WorkID: id, IndexedAt: now, Tenant: tenant}
+		if doc.FirstPublishYear > 0 {
+			book.PublishDate = time.Date(doc.FirstPublishYear, time.January, 1, 0, 0, 0, 0, time.UTC)
+		}
+		for _, isbn := range doc.ISBN {
+			if normalized, err := normalizeISBN(isbn); err == nil {
+				book.ISBN = normalized
+				break
+			}
+		}
+		if len(doc.Subject) > 0 {
+			book.Genre = strings.ToLower(doc.Subject[0])
+		}
+		bulk = bulk.Add(elastic.NewBulkIndexRequest().Index(booksIndex()).Type(typeName(USER_TYPE)).Id(id).Doc(book))
+	}
+	if bulk.NumberOfActions() == 0 {
+		return "No works to import\n", nil
+	}
+	res, err := bulk.Refresh("wait_for").Do(ctx)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot bulk index Open Library works")
+	}
+	// the bulk request waited for the refresh, so the works are already visible to the relay
+	if err = appendOutbox(OutboxEvent{Type: "imported"}); err != nil {
+		fmt.Println(err)
+	}
+	return fmt.Sprintf("Imported %d works from Open Library, %d failed\n", len(res.Succeeded()), len(res.Failed())), nil
+}
+
+// openLibraryImport handles POST /admin/import/openlibrary?subject=&author=&limit=100.
+func openLibraryImport(w http.ResponseWriter, req *http.Request) {
+	if !requireElasticsearch(w, req) {
+		return
+	}
+	if !isAdmin(req) {
+		http.Error(w, "admin token required", http.StatusUnauthorized)
+		return
+	}
+	if req.Method != "POST" {
+		msg := "Unsupported request for /admin/import/openlibrary " + req.Method
+		fmt.Fprintf(w, "%s", errors.New(msg))
+		return
+	}
+	subject, author := getParamValue(req, "subject"), getParamValue(req, "author")
+	if subject == "" && author == "" {
+		fmt.Fprintf(w, "%s", errors.New("subject or author is required"))
+		return
+	}
+	limit := 100
+	if value := getParamValue(req, "limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 || parsed > maxOpenLibraryImport {
+			fmt.Fprintf(w, "%s", errors.New("limit must be between 1 and "+strconv.Itoa(maxOpenLibraryImport)))
+			return
+		}
+		limit = parsed
+	}
+	works, err := fetchOpenLibraryWorks(subject, author, limit)
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	client, ctx, err := connectElasticSearch()
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	result, err := importOpenLibraryWorks(client, ctx, requestTenant(req), works)
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	fmt.Fprintf(w, "%s", result)
+}
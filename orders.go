@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	errors "github.com/fiverr/go_errors"
+	"gopkg.in/olivere/elastic.v5"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ordersMapping = `
+{
+	"settings":{
+		"number_of_shards": 1,
+		"number_of_replicas": 0
+	},
+	"mappings":{
+		"order":{
+			"properties": {
+				"user_id": { "type": "keyword" },
+				"status": { "type": "keyword" },
+				"coupon": { "type": "keyword" },
+				"total": { "type": "scaled_float", "scaling_factor": 100 },
+				"currency": { "type": "keyword" },
+				"items": {
+					"properties": {
+						"book_id": { "type": "keyword" },
+						"title": { "type": "text" },
+						"quantity": { "type": "integer" },
+						"unit_price": { "type": "scaled_float", "scaling_factor": 100 },
+						"currency": { "type": "keyword" },
+						"discount_id": { "type": "keyword" },
+						"base_unit_price": { "type": "scaled_float", "scaling_factor": 100 }
+					}
+				},
+				"created_at": { "type": "date" }
+			}
+		}
+	}
+}`
+	ORDERS_INDEX = "orders"
+	ORDER_TYPE   = "order"
+
+	orderEventsChannel = "order_events"
+	maxOrderItems      = 50
+)
+
+// OrderItem is a book of an order, with its price snapshotted when the order was placed.
+type OrderItem struct {
+	BookID     string `json:"book_id"`
+	Title      string `json:"title"`
+	Quantity   int64  `json:"quantity"`
+	UnitPrice  Price  `json:"unit_price"`
+	Currency   string `json:"currency"`
+	DiscountID string `json:"discount_id,omitempty"`
+	// BaseUnitPrice is the unit price in the base currency, which the order total is in
+	BaseUnitPrice Price `json:"base_unit_price"`
+}
+
+// Order is stored in the orders index when a user checks out.
+type Order struct {
+	UserID    string      `json:"user_id"`
+	Status    string      `json:"status"`
+	Items     []OrderItem `json:"items"`
+	Coupon    string      `json:"coupon,omitempty"`
+	Total     Price       `json:"total"`
+	Currency  string      `json:"currency"`
+	CreatedAt time.Time   `json:"created_at"`
+}
+
+// OrderEvent is published on the order_events Redis channel for fulfillment systems.
+type OrderEvent struct {
+	Type  string    `json:"type"`
+	ID    string    `json:"id"`
+	Order Order     `json:"order"`
+	Time  time.Time `json:"time"`
+}
+
+func ensureOrdersIndex(client *elastic.Client, ctx context.Context) error {
+	exists, err := client.IndexExists(ORDERS_INDEX).Do(ctx)
+	if err != nil {
+		return errors.Wrap(err, "cannot check orders index")
+	}
+	if !exists {
+		if _, err = client.CreateIndex(ORDERS_INDEX).BodyString(ordersMapping).Do(ctx); err != nil {
+			return errors.Wrap(err, "cannot create orders index")
+		}
+	}
+	return nil
+}
+
+// parseOrderItems parses the items param, a comma separated list of book_id:quantity where the
+// quantity defaults to 1. Repeated books are merged.
+func parseOrderItems(value string) ([]OrderItem, error) {
+	items := make([]OrderItem, 0)
+	index := make(map[string]int)
+	for _, entry := range splitList(value) {
+		// the quantity follows the last colon, as the ids of a tenant's books contain one too
+		parts := []string{entry}
+		if i := strings.LastIndex(entry, ":"); i >= 0 && (idTenant(entry) == "" || strings.Count(entry, ":") > 1) {
+			parts = []string{entry[:i], entry[i+1:]}
+		}
+		quantity := int64(1)
+		if len(parts) == 2 {
+			parsed, err := strconv.ParseInt(parts[1], 10, 64)
+			if err != nil || parsed <= 0 {
+				return nil, errors.New("invalid quantity in item " + entry)
+			}
+			quantity = parsed
+		}
+		if i, ok := index[parts[0]]; ok {
+			items[i].Quantity += quantity
+			continue
+		}
+		index[parts[0]] = len(items)
+		items = append(items, OrderItem{BookID: parts[0], Quantity: quantity})
+	}
+	if len(items) == 0 {
+		return nil, errors.New("items is required, as book_id:quantity pairs")
+	}
+	if len(items) > maxOrderItems {
+		return nil, errors.New("an order has at most " + strconv.Itoa(maxOrderItems) + " books")
+	}
+	return items, nil
+}
+
+// priceOrderItems snapshots the current title and discounted price of every item.
+func priceOrderItems(items []OrderItem, coupon string) error {
+	discounts, err := activeDiscounts(coupon)
+	if err != nil {
+		return err
+	}
+	ids := make([]string, 0, len(items))
+	for _, item := range items {
+		ids = append(ids, item.BookID)
+	}
+	docs, err := getBooks(ids)
+	if err != nil {
+		return err
+	}
+	for i := range items {
+		doc, ok := docs[items[i].BookID]
+		if !ok {
+			return errors.New("book " + items[i].BookID + " does not exist")
+		}
+		var book Book
+		fields := make(map[string]interface{})
+		if err = json.Unmarshal(doc, &book); err == nil {
+			err = json.Unmarshal(doc, &fields)
+		}
+		if err != nil {
+			return errors.Wrap(err, "cannot decode book "+items[i].BookID)
+		}
+		if book.Currency == "" {
+			// indexed before currencies, so priced in the base currency
+			book.Currency, book.BasePrice = strings.ToUpper(config.ExchangeRates.BaseCurrency), book.Price
+		}
+		items[i].Title, items[i].Currency = book.Title, book.Currency
+		items[i].UnitPrice, items[i].DiscountID = bestDiscount(items[i].BookID, fields, book.Price, discounts)
+		items[i].BaseUnitPrice = book.BasePrice
+		if book.Price > 0 {
+			items[i].BaseUnitPrice = priceFromFloat(book.BasePrice.Float() * items[i].UnitPrice.Float() / book.Price.Float())
+		}
+	}
+	return nil
+}
+
+func publishOrderEvent(eventType string, id string, order Order) error {
+	client, err := connectRedis()
+	if err != nil {
+		return errors.Wrap(err, "cannot connect to Redis")
+	}
+	defer client.Close()
+	buf, err := json.Marshal(OrderEvent{Type: eventType, ID: id, Order: order, Time: time.Now().UTC()})
+	if err != nil {
+		return errors.Wrap(err, "cannot create json order event")
+	}
+	if err = client.Publish(orderEventsChannel, string(buf)).Err(); err != nil {
+		return errors.Wrap(err, "cannot publish order event")
+	}
+	return nil
+}
+
+// placeOrder prices the items, reserves their stock and stores the order. Stock is given back
+// when the order cannot be stored.
+func placeOrder(client *elastic.Client, ctx context.Context, userID string, items []OrderItem, coupon string) (string, error) {
+	if err := priceOrderItems(items, coupon); err != nil {
+		return "", err
+	}
+	order := Order{UserID: userID, Status: "placed", Items: items, Coupon: coupon,
+		Currency: strings.ToUpper(config.ExchangeRates.BaseCurrency), CreatedAt: time.Now().UTC()}
+	for _, item := range items {
+		order.Total += item.BaseUnitPrice * Price(item.Quantity)
+	}
+	if err := ensureOrdersIndex(client, ctx); err != nil {
+		return "", err
+	}
+
+	redisClient, err := connectRedis()
+	if err != nil {
+		return "", errors.Wrap(err, "cannot connect to Redis")
+	}
+	defer redisClient.Close()
+	if err = reserveStock(redisClient, items); err != nil {
+		return "", err
+	}
+	put, err := client.Index().Index(ORDERS_INDEX).Type(typeName(ORDER_TYPE)).BodyJson(order).Refresh("wait_for").Do(ctx)
+	if err != nil {
+		releaseStock(redisClient, items)
+		return "", errors.Wrap(err, "cannot store the order")
+	}
+	for _, item := range items {
+		if err = recordSale(redisClient, item.BookID, item.Quantity); err != nil {
+			fmt.Println(err)
+		}
+	}
+	if err = publishOrderEvent("placed", put.Id, order); err != nil {
+		fmt.Println(err)
+	}
+	buf, err := json.Marshal(map[string]interface{}{"id": put.Id, "order": order})
+	if err != nil {
+		return "", errors.Wrap(err, "cannot create json result of order")
+	}
+	return string(buf), nil
+}
+
+// listOrders returns a page of the user's orders, newest first.
+func listOrders(client *elastic.Client, ctx context.Context, userID string, offset int, limit int) (string, error) {
+	searchResult, err := client.Search().Index(ORDERS_INDEX).Query(elastic.NewTermQuery("user_id", userID)).
+		Sort("created_at", false).Sort(idSortField(), true).From(offset).Size(limit).Do(ctx)
+	orders := make([]map[string]interface{}, 0)
+	var total int64
+	if err != nil && !elastic.IsNotFound(err) {
+		return "", errors.Wrap(err, "cannot search orders")
+	}
+	if err == nil {
+		total = searchResult.Hits.TotalHits
+		for _, hit := range searchResult.Hits.Hits {
+			orders = append(orders, map[string]interface{}{"id": hit.Id, "order": hit.Source})
+		}
+	}
+	buf, err := json.Marshal(map[string]interface{}{"total": total, "offset": offset, "limit": limit, "orders": orders})
+	if err != nil {
+		return "", errors.Wrap(err, "cannot create json result of orders")
+	}
+	return string(buf), nil
+}
+
+// orders handles POST /orders?user_id=&items=book_id:quantity,...&coupon=.
+func orders(w http.ResponseWriter, req *http.Request) {
+	if !requireElasticsearch(w, req) {
+		return
+	}
+	if req.Method != "POST" {
+		msg := "Unsupported request for /orders " + req.Method
+		fmt.Fprintf(w, "%s", errors.New(msg))
+		return
+	}
+	userID := tenantParam(req, "user_id")
+	if userID == "" {
+		fmt.Fprintf(w, "%s", errors.New("user_id is required"))
+		return
+	}
+	items, err := parseOrderItems(getParamValue(req, "items"))
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	for i := range items {
+		if idTenant(items[i].BookID) != "" && requestTenant(req) == "" {
+			fmt.Fprintf(w, "%s", errors.New("unknown book "+items[i].BookID))
+			return
+		}
+		items[i].BookID = tenantID(requestTenant(req), items[i].BookID)
+	}
+	client, ctx, err := connectElasticSearch()
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	result, err := placeOrder(client, ctx, userID, items, strings.ToUpper(getParamValue(req, "coupon")))
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	fmt.Fprintf(w, "%s", result)
+}
+
+// userOrders handles GET /users/{id}/orders?offset=&limit=.
+func userOrders(w http.ResponseWriter, req *http.Request, userID string) {
+	if !requireElasticsearch(w, req) {
+		return
+	}
+	if req.Method != "GET" {
+		msg := "Unsupported request for " + req.URL.Path + " " + req.Method
+		fmt.Fprintf(w, "%s", errors.New(msg))
+		return
+	}
+	offset, limit, err := parsePage(req, 20)
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	client, ctx, err := connectElasticSearch()
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	result, err := listOrders(client, ctx, userID, int(offset), int(limit))
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	fmt.Fprintf(w, "%s", result)
+}
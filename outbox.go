@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	errors "github.com/fiverr/go_errors"
+	"gopkg.in/olivere/elastic.v5"
+	"gopkg.in/redis.v5"
+	"time"
+)
+
+const (
+	// outboxKey holds the book writes whose secondary effects are pending, outboxProcessingKey
+	// the one the relay is working on, so it survives a crash of the relay.
+	outboxKey           = "outbox"
+	outboxProcessingKey = "outbox:processing"
+	// outboxConfirmWindow is how long the relay waits for a write to show up in the index before
+	// deciding it never happened.
+	outboxConfirmWindow = 2 * time.Minute
+	// outboxEffectTTL is how long applied effects are remembered to skip them on a retry.
+	outboxEffectTTL = 24 * time.Hour
+)
+
+// OutboxEvent is a book write recorded before it is sent to the index. The relay applies its
+// secondary effects once the write is confirmed in the index, and never for writes that failed.
+// Imports writing many books at once record an "imported" event without a book once they are done.
+type OutboxEvent struct {
+	ID     string `json:"id"`
+	Type   string `json:"type"`
+	BookID string `json:"book_id"`
+	// Book is the indexed document of created books, Title the new title of updated ones
+	Book            *Book     `json:"book,omitempty"`
+	Title           string    `json:"title,omitempty"`
+	NotifyFollowers bool      `json:"notify_followers,omitempty"`
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+// appendOutbox records a book write about to be sent to the index.
+func appendOutbox(event OutboxEvent) error {
+	if demoMode {
+		// no relay runs in demo mode, so writes have no side effects
+		return nil
+	}
+	var err error
+	if event.ID, err = randomToken(16); err != nil {
+		return err
+	}
+	event.CreatedAt = time.Now().UTC()
+	buf, err := json.Marshal(event)
+	if err != nil {
+		return errors.Wrap(err, "cannot create json outbox event")
+	}
+	if err = sharedRedis().LPush(outboxKey, string(buf)).Err(); err != nil {
+		return errors.Wrap(err, "cannot set key in Redis")
+	}
+	return nil
+}
+
+// confirmWrite reports whether the event's write reached the book repository.
+func confirmWrite(event OutboxEvent) (bool, error) {
+	if event.Type == "imported" {
+		return true, nil
+	}
+	source, err := bookRepo.Get(event.BookID)
+	if err != nil {
+		return false, err
+	}
+	found := source != ""
+	if event.Type == "deleted" {
+		return !found, nil
+	}
+	if !found {
+		return false, nil
+	}
+	var book Book
+	if err = json.Unmarshal([]byte(source), &book); err != nil {
+		return false, errors.Wrap(err, "cannot decode the book")
+	}
+	if event.Type == "updated" {
+		return book.Title == event.Title, nil
+	}
+	return !book.IndexedAt.Before(event.Book.IndexedAt), nil
+}
+
+// applyEffect runs an effect of the event unless a previous attempt already applied it.
+func applyEffect(event OutboxEvent, name string, effect func() error) error {
+	key := "outbox_done:" + event.ID + ":" + name
+	claimed, err := sharedRedis().SetNX(key, 1, outboxEffectTTL).Result()
+	if err != nil {
+		return errors.Wrap(err, "cannot set key in Redis")
+	}
+	if !claimed {
+		return nil
+	}
+	if err = effect(); err != nil {
+		sharedRedis().Del(key)
+		return err
+	}
+	return nil
+}
+
+// outboxEffect is a secondary effect of a book write, named to remember it was applied.
+type outboxEffect struct {
+	name string
+	run  func() error
+}
+
+// applyOutboxEvent applies the secondary effects of a confirmed write: the response cache
+// invalidation, the /events broadcast, and for created books saved search alerts, price drop
+// checks and follower notifications.
+func applyOutboxEvent(client *elastic.Client, ctx context.Context, event OutboxEvent) error {
+	effects := []outboxEffect{
+		{"cache", func() error { return invalidateCacheTags(bookWriteCacheTags()) }},
+	}
+	if event.Type != "imported" {
+		effects = append(effects, outboxEffect{"catalog_event", func() error { return publishCatalogEvent(event.Type, event.BookID) }})
+	}
+	if event.Type == "created" && event.Book != nil {
+		// saved search alerts are kept in Elasticsearch
+		if !booksInPostgres() {
+			effects = append(effects, outboxEffect{"percolate", func() error { return percolateBook(client, ctx, event.BookID, *event.Book) }})
+		}
+		effects = append(effects, outboxEffect{"price_check", func() error { queuePriceCheck(event.BookID, *event.Book); return nil }})
+		if event.NotifyFollowers {
+			effects = append(effects, outboxEffect{"followers", func() error { return notifyFollowers(event.BookID, *event.Book) }})
+		}
+	}
+	for _, effect := range effects {
+		if err := applyEffect(event, effect.name, effect.run); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// relayOutboxEvent processes the event taken from the outbox and reports whether it went back
+// to the outbox: writes not yet visible are retried until the confirm window passes, and failed
+// effects the same way.
+func relayOutboxEvent(client *elastic.Client, ctx context.Context, raw string) (bool, error) {
+	var event OutboxEvent
+	if err := json.Unmarshal([]byte(raw), &event); err != nil {
+		return false, errors.Wrap(err, "cannot decode outbox event")
+	}
+	confirmed, err := confirmWrite(event)
+	if err == nil && confirmed {
+		err = applyOutboxEvent(client, ctx, event)
+		if err == nil {
+			return false, nil
+		}
+	}
+	if time.Since(event.CreatedAt) > outboxConfirmWindow {
+		if err == nil {
+			err = errors.New("book " + event.BookID + " was never " + event.Type + ", dropping outbox event " + event.ID)
+		}
+		return false, err
+	}
+	if pushErr := sharedRedis().LPush(outboxKey, raw).Err(); pushErr != nil {
+		return false, errors.Wrap(pushErr, "cannot set key in Redis")
+	}
+	return true, err
+}
+
+// startOutboxRelay starts the worker applying the outbox, first returning the event a previous
+// run was processing when it stopped.
+func startOutboxRelay() {
+	worker := registerWorker("outbox", func() int {
+		depth, _ := sharedRedis().LLen(outboxKey).Result()
+		return int(depth)
+	})
+	go func() {
+		redisClient := sharedRedis()
+		for {
+			if err := redisClient.RPopLPush(outboxProcessingKey, outboxKey).Err(); err != nil {
+				break
+			}
+		}
+		for {
+			worker.WaitWhilePaused()
+			raw, err := redisClient.BRPopLPush(outboxKey, outboxProcessingKey, 5*time.Second).Result()
+			if err == redis.Nil {
+				continue
+			}
+			if err != nil {
+				fmt.Println(errors.Wrap(err, "cannot get key from Redis"))
+				time.Sleep(time.Second)
+				continue
+			}
+			requeued := true
+			// the postgres books backend runs without Elasticsearch, whose alerts it skips
+			var client *elastic.Client
+			ctx := context.Background()
+			if !booksInPostgres() {
+				client, ctx, err = connectElasticSearch()
+			}
+			if err == nil {
+				requeued, err = relayOutboxEvent(client, ctx, raw)
+			} else {
+				redisClient.LPush(outboxKey, raw)
+			}
+			redisClient.LRem(outboxProcessingKey, 1, raw)
+			if err != nil {
+				fmt.Println(err)
+			}
+			worker.Done(err)
+			// give the index time to catch up before looking at the event again
+			if requeued {
+				time.Sleep(time.Second)
+			}
+		}
+	}()
+}
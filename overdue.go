@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	errors "github.com/fiverr/go_errors"
+	"gopkg.in/olivere/elastic.v5"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const maxOverdueLoans = 10000
+
+// OverdueLoan is a loan past its due date that was not returned.
+type OverdueLoan struct {
+	LoanID      string    `json:"loan_id"`
+	UserID      string    `json:"user_id"`
+	BookID      string    `json:"book_id"`
+	Title       string    `json:"title"`
+	DueAt       time.Time `json:"due_at"`
+	DaysOverdue int       `json:"days_overdue"`
+}
+
+// overdueLoans returns the open loans due before now, most overdue first.
+func overdueLoans(client *elastic.Client, ctx context.Context, now time.Time) ([]OverdueLoan, error) {
+	query := elastic.NewBoolQuery().Filter(elastic.NewRangeQuery("due_at").Lt(now.Format(time.RFC3339))).
+		MustNot(elastic.NewExistsQuery("returned_at"))
+	searchResult, err := client.Search().Index(LOANS_INDEX).Query(query).Sort("due_at", true).Sort(idSortField(), true).
+		Size(maxOverdueLoans).Do(ctx)
+	loans := make([]OverdueLoan, 0)
+	if err != nil {
+		if elastic.IsNotFound(err) {
+			return loans, nil
+		}
+		return nil, errors.Wrap(err, "cannot search overdue loans")
+	}
+	ids := make([]string, 0, len(searchResult.Hits.Hits))
+	for _, hit := range searchResult.Hits.Hits {
+		var loan Loan
+		if err = json.Unmarshal(*hit.Source, &loan); err != nil {
+			return nil, errors.Wrap(err, "cannot decode the loan")
+		}
+		loans = append(loans, OverdueLoan{LoanID: hit.Id, UserID: loan.UserID, BookID: loan.BookID, DueAt: loan.DueAt,
+			DaysOverdue: int(now.Sub(loan.DueAt).Hours() / 24)})
+		ids = append(ids, loan.BookID)
+	}
+	titles, err := bookTitles(ids)
+	if err != nil {
+		return nil, err
+	}
+	for i := range loans {
+		loans[i].Title = titles[loans[i].BookID]
+	}
+	return loans, nil
+}
+
+// overdue handles GET /admin/overdue?format=json|csv.
+func overdue(w http.ResponseWriter, req *http.Request) {
+	if !requireElasticsearch(w, req) {
+		return
+	}
+	if !isAdmin(req) {
+		http.Error(w, "admin token required", http.StatusUnauthorized)
+		return
+	}
+	if req.Method != "GET" {
+		msg := "Unsupported request for /admin/overdue " + req.Method
+		fmt.Fprintf(w, "%s", errors.New(msg))
+		return
+	}
+	format := getParamValue(req, "format")
+	if format != "" && format != "json" && format != "csv" {
+		fmt.Fprintf(w, "%s", errors.New("format must be json or csv"))
+		return
+	}
+	client, ctx, err := connectElasticSearch()
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	loans, err := overdueLoans(client, ctx, time.Now().UTC())
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="overdue.csv"`)
+		out := csv.NewWriter(w)
+		out.Write([]string{"loan_id", "user_id", "book_id", "title", "due_at", "days_overdue"})
+		for _, loan := range loans {
+			out.Write([]string{loan.LoanID, loan.UserID, loan.BookID, loan.Title, loan.DueAt.Format(time.RFC3339), strconv.Itoa(loan.DaysOverdue)})
+		}
+		out.Flush()
+		if err = out.Error(); err != nil {
+			fmt.Println(errors.Wrap(err, "cannot write overdue report"))
+		}
+		return
+	}
+	buf, err := json.Marshal(loans)
+	if err != nil {
+		fmt.Fprintf(w, "%s", errors.Wrap(err, "cannot create json result of overdue loans"))
+		return
+	}
+	fmt.Fprintf(w, "%s", buf)
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	errors "github.com/fiverr/go_errors"
+	"github.com/lib/pq"
+	"net/http"
+	"strings"
+)
+
+// errElasticsearchOnly is returned by the features kept in Elasticsearch indexes of their own,
+// such as authors, reviews, alerts, lists, loans and orders, when books are kept in PostgreSQL.
+// Deployments on the postgres backend run without Elasticsearch, so only the books themselves are
+// served: /book, /search, /store and the routes reading books through the repository.
+var errElasticsearchOnly = errors.New("not available with the postgres books backend, it needs Elasticsearch")
+
+// booksInPostgres reports whether books are kept in PostgreSQL.
+func booksInPostgres() bool {
+	return config.Books.Backend == "postgres"
+}
+
+// requireElasticsearch answers 501 on routes needing Elasticsearch when books are kept in
+// PostgreSQL, and reports whether the route may go on.
+func requireElasticsearch(w http.ResponseWriter, req *http.Request) bool {
+	if !booksInPostgres() {
+		return true
+	}
+	http.Error(w, req.URL.Path+" is "+errElasticsearchOnly.Error(), http.StatusNotImplemented)
+	return false
+}
+
+// booksSchema creates the books table. The document is kept as json, which preserves it as
+// written, next to the columns searched and sorted on. search weighs title over author over
+// description like the multi_match of buildSearchQuery, and the trigram indexes serve misspelled
+// title and author queries.
+const booksSchema = `
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+CREATE TABLE IF NOT EXISTS books (
+	id text PRIMARY KEY,
+	doc json NOT NULL,
+	title text NOT NULL DEFAULT '',
+	author_name text NOT NULL DEFAULT '',
+	price bigint NOT NULL DEFAULT 0,
+	base_price bigint NOT NULL DEFAULT 0,
+	ebook_available boolean NOT NULL DEFAULT false,
+	formats text[] NOT NULL DEFAULT '{}',
+	page_count integer NOT NULL DEFAULT 0,
+	language text NOT NULL DEFAULT '',
+	publisher text NOT NULL DEFAULT '',
+	work_id text NOT NULL DEFAULT '',
+	rating_avg double precision NOT NULL DEFAULT 0,
+	rating_count bigint NOT NULL DEFAULT 0,
+	search tsvector NOT NULL,
+	version bigint NOT NULL DEFAULT 1
+);
+CREATE INDEX IF NOT EXISTS books_search_idx ON books USING gin (search);
+CREATE INDEX IF NOT EXISTS books_title_trgm_idx ON books USING gin (title gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS books_author_trgm_idx ON books USING gin (author_name gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS books_work_idx ON books (work_id);`
+
+// upsertBookSQL writes a book, computing its search vector and bumping the version of an
+// existing row.
+const upsertBookSQL = `
+INSERT INTO books (id, doc, title, author_name, price, base_price, ebook_available, formats, page_count,
+	language, publisher, work_id, rating_avg, rating_count, search)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14,
+	setweight(to_tsvector('simple', $3), 'A') || setweight(to_tsvector('simple', $4), 'B') ||
+	setweight(to_tsvector('simple', $15), 'C'))
+ON CONFLICT (id) DO UPDATE SET doc = EXCLUDED.doc, title = EXCLUDED.title, author_name = EXCLUDED.author_name,
+	price = EXCLUDED.price, base_price = EXCLUDED.base_price, ebook_available = EXCLUDED.ebook_available,
+	formats = EXCLUDED.formats, page_count = EXCLUDED.page_count, language = EXCLUDED.language,
+	publisher = EXCLUDED.publisher, work_id = EXCLUDED.work_id, rating_avg = EXCLUDED.rating_avg,
+	rating_count = EXCLUDED.rating_count, search = EXCLUDED.search, version = books.version + 1
+RETURNING version`
+
+// anyWordQuery turns the text param $n into a tsquery matching any of its words, like the OR
+// operator of an Elasticsearch match query.
+func anyWordQuery(n int) string {
+	return fmt.Sprintf("to_tsquery('simple', array_to_string(tsvector_to_array(to_tsvector('simple', $%d)), ' | '))", n)
+}
+
+// pgBookRepository keeps books in PostgreSQL, for deployments without Elasticsearch.
+type pgBookRepository struct {
+	db *sql.DB
+}
+
+func newPgBookRepository(url string) (*pgBookRepository, error) {
+	if url == "" {
+		return nil, errors.New("books.postgres_url is required by the postgres backend")
+	}
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot connect to Postgres")
+	}
+	if _, err = db.Exec(booksSchema); err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "cannot create books table")
+	}
+	return &pgBookRepository{db: db}, nil
+}
+
+// write stores the book within tx and returns its new version.
+func (r *pgBookRepository) write(tx *sql.Tx, id string, book Book) (int64, error) {
+	doc, err := json.Marshal(book)
+	if err != nil {
+		return 0, errors.Wrap(err, "cannot create json book")
+	}
+	formats := book.Formats
+	if formats == nil {
+		formats = []string{}
+	}
+	var version int64
+	err = tx.QueryRow(upsertBookSQL, id, string(doc), book.Title, book.AuthorName, int64(book.Price), int64(book.BasePrice),
+		book.EbookAvailable, pq.Array(formats), book.PageCount, book.Language, book.Publisher, book.WorkID,
+		book.RatingAvg, book.RatingCount, book.Description).Scan(&version)
+	if err != nil {
+		return 0, errors.Wrap(err, "cannot add the book")
+	}
+	return version, nil
+}
+
+// modify applies change to the stored book under a row lock. It returns 0 when the book does not
+// exist.
+func (r *pgBookRepository) modify(id string, change func(book *Book)) (int64, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return 0, errors.Wrap(err, "cannot begin a transaction")
+	}
+	defer tx.Rollback()
+	var doc string
+	err = tx.QueryRow("SELECT doc FROM books WHERE id = $1 FOR UPDATE", id).Scan(&doc)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, errors.Wrap(err, "cannot get the book")
+	}
+	var book Book
+	if err = json.Unmarshal([]byte(doc), &book); err != nil {
+		return 0, errors.Wrap(err, "cannot decode the book")
+	}
+	change(&book)
+	version, err := r.write(tx, id, book)
+	if err != nil {
+		return 0, err
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, errors.Wrap(err, "cannot commit the book")
+	}
+	return version, nil
+}
+
+func (r *pgBookRepository) Get(id string) (string, error) {
+	var doc string
+	err := r.db.QueryRow("SELECT doc FROM books WHERE id = $1", id).Scan(&doc)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", errors.Wrap(err, "Cannot GET a book")
+	}
+	return doc, nil
+}
+
+func (r *pgBookRepository) Exists(id string) (bool, error) {
+	var exists bool
+	if err := r.db.QueryRow("SELECT EXISTS (SELECT 1 FROM books WHERE id = $1)", id).Scan(&exists); err != nil {
+		return false, errors.Wrap(err, "cannot check if the book exists")
+	}
+	return exists, nil
+}
+
+func (r *pgBookRepository) Put(id string, book Book) (string, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return "", errors.Wrap(err, "cannot begin a transaction")
+	}
+	defer tx.Rollback()
+	version, err := r.write(tx, id, book)
+	if err != nil {
+		return "", err
+	}
+	if err = tx.Commit(); err != nil {
+		return "", errors.Wrap(err, "cannot commit the book")
+	}
+	return fmt.Sprintf("Stored book %s in version %d\n", id, version), nil
+}
+
+func (r *pgBookRepository) UpdateTitle(id string, title string) (string, error) {
+	version, err := r.modify(id, func(book *Book) { book.Title = title })
+	if err != nil {
+		return "", err
+	}
+	if version == 0 {
+		return "", errors.New("book " + id + " does not exist")
+	}
+	return fmt.Sprintf("New version of book %q is now %d\n", id, version), nil
+}
+
+func (r *pgBookRepository) SetRating(id string, avg float64, count int64) error {
+	_, err := r.modify(id, func(book *Book) { book.RatingAvg, book.RatingCount = avg, count })
+	return err
+}
+
+func (r *pgBookRepository) Delete(id string) (string, error) {
+	var version int64
+	err := r.db.QueryRow("DELETE FROM books WHERE id = $1 RETURNING version", id).Scan(&version)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", errors.Wrap(err, "cannot delete the book")
+	}
+	return fmt.Sprintf("Deleted book %s in version %d\n", id, version), nil
+}
+
+// searchSQL translates the search params into a query and its arguments. Hits are ordered like
+// the Elasticsearch search: by rating, by rank with q, otherwise by title. The count query
+// counts every match and takes the arguments without the last two, the offset and limit.
+func searchSQL(p SearchParams) (string, string, []interface{}) {
+	args := make([]interface{}, 0)
+	arg := func(value interface{}) int {
+		args = append(args, value)
+		return len(args)
+	}
+	where := []string{fmt.Sprintf("coalesce(doc->>'tenant', '') = $%d", arg(p.Tenant))}
+	rank, highlight := "0", "NULL, NULL"
+	if p.Query != "" {
+		n := arg(p.Query)
+		// weights of the D, C, B and A labels, the title^3 author_name^2 boosts of the multi_match
+		rank = fmt.Sprintf("ts_rank('{0.1, 0.33, 0.67, 1.0}', search, %s)", anyWordQuery(n))
+		where = append(where, fmt.Sprintf("(search @@ %s OR title %% $%d OR author_name %% $%d)", anyWordQuery(n), n, n))
+		if p.Highlight {
+			highlight = fmt.Sprintf("ts_headline('simple', title, %s, 'StartSel=<em>, StopSel=</em>, HighlightAll=true'), "+
+				"ts_headline('simple', doc->>'description', %s, 'StartSel=<em>, StopSel=</em>, MaxFragments=3')",
+				anyWordQuery(n), anyWordQuery(n))
+		}
+	}
+	if p.Title != "" {
+		n := arg(p.Title)
+		where = append(where, fmt.Sprintf("(to_tsvector('simple', title) @@ %s OR title %% $%d)", anyWordQuery(n), n))
+	}
+	if p.AuthorName != "" {
+		n := arg(p.AuthorName)
+		where = append(where, fmt.Sprintf("(to_tsvector('simple', author_name) @@ %s OR author_name %% $%d)", anyWordQuery(n), n))
+	}
+	if !(p.PriceRange.From == -1 && p.PriceRange.To == -1) {
+		column, from, to := "price", p.PriceRange.From.Float(), p.PriceRange.To.Float()
+		if p.PriceRate > 0 {
+			column, from, to = "base_price", from/p.PriceRate, to/p.PriceRate
+		}
+		where = append(where, fmt.Sprintf("%s BETWEEN $%d AND $%d", column, arg(from*100), arg(to*100)))
+	}
+	if p.PagesMin > 0 {
+		where = append(where, fmt.Sprintf("page_count >= $%d", arg(p.PagesMin)))
+	}
+	if p.PagesMax > 0 {
+		where = append(where, fmt.Sprintf("page_count <= $%d", arg(p.PagesMax)))
+	}
+	if p.Language != "" {
+		where = append(where, fmt.Sprintf("language = $%d", arg(p.Language)))
+	}
+	if p.Publisher != "" {
+		where = append(where, fmt.Sprintf("publisher = $%d", arg(p.Publisher)))
+	}
+	if len(p.Formats) > 0 {
+		condition := fmt.Sprintf("formats && $%d", arg(pq.Array(p.Formats)))
+		if hasFormat(p.Formats, "ebook") {
+			condition = "(" + condition + " OR ebook_available)"
+		}
+		where = append(where, condition)
+	}
+	if p.MinRating > 0 {
+		where = append(where, fmt.Sprintf("rating_avg >= $%d", arg(p.MinRating)))
+	}
+	order := "lower(title), id"
+	if p.Sort == "rating" {
+		order = "rating_avg DESC, rating_count DESC, id"
+	} else if p.Query != "" {
+		order = "rank DESC, id"
+	}
+	matched := fmt.Sprintf("SELECT id, doc, title, rating_avg, rating_count, work_id, %s AS rank FROM books WHERE %s",
+		rank, strings.Join(where, " AND "))
+	if p.CollapseEditions {
+		// keep the edition that would come first of each work
+		matched = fmt.Sprintf("SELECT DISTINCT ON (work_id) * FROM (%s) editions ORDER BY work_id, %s", matched, order)
+	}
+	count := fmt.Sprintf("SELECT count(*) FROM (%s) matched", matched)
+	query := fmt.Sprintf("SELECT id, doc::text, count(*) OVER (), %s FROM (%s) matched ORDER BY %s OFFSET $%d LIMIT $%d",
+		highlight, matched, order, arg(p.From), arg(p.pageSize()))
+	return query, count, args
+}
+
+func (r *pgBookRepository) Search(p SearchParams) (SearchHits, error) {
+	query, count, args := searchSQL(p)
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return SearchHits{}, errors.Wrap(err, "cannot search books")
+	}
+	defer rows.Close()
+	hits := SearchHits{TotalRelation: totalExact, Hits: make([]SearchHit, 0)}
+	for rows.Next() {
+		var hit SearchHit
+		var title, description sql.NullString
+		if err = rows.Scan(&hit.ID, &hit.Source, &hits.Total, &title, &description); err != nil {
+			return SearchHits{}, errors.Wrap(err, "cannot read search results")
+		}
+		if title.Valid || description.Valid {
+			hit.Highlight = make(map[string][]string)
+			if title.Valid && strings.Contains(title.String, "<em>") {
+				hit.Highlight["title"] = []string{title.String}
+			}
+			if description.Valid && strings.Contains(description.String, "<em>") {
+				hit.Highlight["description"] = strings.Split(description.String, " ... ")
+			}
+		}
+		hits.Hits = append(hits.Hits, hit)
+	}
+	if err = rows.Err(); err != nil {
+		return SearchHits{}, errors.Wrap(err, "cannot read search results")
+	}
+	if len(hits.Hits) == 0 && p.From > 0 {
+		// past the last match the window count has no row to come with
+		if err = r.db.QueryRow(count, args[:len(args)-2]...).Scan(&hits.Total); err != nil {
+			return SearchHits{}, errors.Wrap(err, "cannot count search results")
+		}
+	}
+	return hits, nil
+}
+
+func (r *pgBookRepository) Stats(tenant string) (BookStats, error) {
+	stats := BookStats{BooksRelation: totalExact}
+	var avg sql.NullFloat64
+	err := r.db.QueryRow(`SELECT count(*), count(DISTINCT lower(nullif(author_name, ''))),
+		avg(CASE WHEN base_price = 0 THEN price ELSE base_price END) / 100 FROM books
+		WHERE coalesce(doc->>'tenant', '') = $1`, tenant).Scan(&stats.Books, &stats.Authors, &avg)
+	if err != nil {
+		return BookStats{}, errors.Wrap(err, "cannot aggregate store stats")
+	}
+	if avg.Valid {
+		stats.AvgBasePrice = &avg.Float64
+	}
+	return stats, nil
+}
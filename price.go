@@ -0,0 +1,76 @@
+package main
+
+import (
+	errors "github.com/fiverr/go_errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Price is an amount in cents, so decimal prices such as 12.99 are parsed, stored and compared
+// exactly. It is encoded in JSON as a decimal number and mapped as a scaled_float in Elasticsearch.
+type Price int64
+
+// parsePrice parses a non-negative decimal amount with at most two decimal places.
+func parsePrice(value string) (Price, error) {
+	value = strings.TrimSpace(value)
+	units, cents := value, ""
+	if i := strings.Index(value, "."); i >= 0 {
+		units, cents = value[:i], value[i+1:]
+	}
+	if units == "" || len(cents) > 2 || strings.HasPrefix(units, "-") || strings.HasPrefix(units, "+") {
+		return 0, errors.New("invalid price " + value + ", expected an amount such as 12.99")
+	}
+	u, err := strconv.ParseInt(units, 10, 64)
+	if err != nil {
+		return 0, errors.Wrap(err, "invalid price "+value)
+	}
+	c := int64(0)
+	if cents != "" {
+		if c, err = strconv.ParseInt(cents, 10, 64); err != nil || c < 0 {
+			return 0, errors.New("invalid price " + value + ", expected an amount such as 12.99")
+		}
+		if len(cents) == 1 {
+			c *= 10
+		}
+	}
+	return Price(u*100 + c), nil
+}
+
+// priceFromFloat rounds an amount such as an aggregation result or a conversion to cents.
+func priceFromFloat(amount float64) Price {
+	return Price(math.Round(amount * 100))
+}
+
+// Float returns the price in units, as used in Elasticsearch queries.
+func (p Price) Float() float64 {
+	return float64(p) / 100
+}
+
+func (p Price) String() string {
+	s := strconv.FormatInt(int64(p)/100, 10)
+	if c := int64(p) % 100; c != 0 {
+		s += "." + strconv.FormatInt(c/10, 10)
+		if c%10 != 0 {
+			s += strconv.FormatInt(c%10, 10)
+		}
+	}
+	return s
+}
+
+func (p Price) MarshalJSON() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+func (p *Price) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+	// books indexed before decimal prices hold plain integers, which parse the same way
+	amount, err := strconv.ParseFloat(string(data), 64)
+	if err != nil {
+		return errors.Wrap(err, "invalid price "+string(data))
+	}
+	*p = priceFromFloat(amount)
+	return nil
+}
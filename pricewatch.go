@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	errors "github.com/fiverr/go_errors"
+	"gopkg.in/redis.v5"
+	"net/http"
+)
+
+// PriceWatch is a user's subscription to a book price dropping to a target.
+type PriceWatch struct {
+	// TargetPrice is in the base currency, so it compares with the book's base_price
+	TargetPrice Price  `json:"target_price"`
+	WebhookURL  string `json:"webhook_url,omitempty"`
+}
+
+func priceWatchesKey(bookID string) string {
+	return "price_watches:" + bookID
+}
+
+func userPriceWatchesKey(userID string) string {
+	return "price_watching:" + userID
+}
+
+func watchPrice(client *redis.Client, userID string, bookID string, watch PriceWatch) (string, error) {
+	buf, err := json.Marshal(watch)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot create json price watch")
+	}
+	_, err = client.TxPipelined(func(pipe *redis.Pipeline) error {
+		pipe.HSet(priceWatchesKey(bookID), userID, string(buf))
+		pipe.SAdd(userPriceWatchesKey(userID), bookID)
+		return nil
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "cannot set key in Redis")
+	}
+	return fmt.Sprintf("User %s watches book %s for a price of %s or less\n", userID, bookID, watch.TargetPrice), nil
+}
+
+func unwatchPrice(client *redis.Client, userID string, bookID string) error {
+	_, err := client.TxPipelined(func(pipe *redis.Pipeline) error {
+		pipe.HDel(priceWatchesKey(bookID), userID)
+		pipe.SRem(userPriceWatchesKey(userID), bookID)
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "cannot delete key in Redis")
+	}
+	return nil
+}
+
+func listPriceWatches(client *redis.Client, userID string) (string, error) {
+	bookIDs, err := client.SMembers(userPriceWatchesKey(userID)).Result()
+	if err != nil {
+		return "", errors.Wrap(err, "cannot get key from Redis")
+	}
+	watches := make(map[string]json.RawMessage, len(bookIDs))
+	for _, bookID := range bookIDs {
+		value, err := client.HGet(priceWatchesKey(bookID), userID).Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return "", errors.Wrap(err, "cannot get key from Redis")
+		}
+		watches[bookID] = json.RawMessage(value)
+	}
+	buf, err := json.Marshal(watches)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot create json result of price watches")
+	}
+	return string(buf), nil
+}
+
+// priceCheck is a book whose price was written and must be compared against the watches.
+type priceCheck struct {
+	BookID string
+	Book   Book
+}
+
+// priceCheckQueue buffers the written books for the price drop worker.
+var priceCheckQueue = make(chan priceCheck, 1000)
+
+// queuePriceCheck schedules the comparison of a written book against its watches.
+func queuePriceCheck(bookID string, book Book) {
+	select {
+	case priceCheckQueue <- priceCheck{BookID: bookID, Book: book}:
+	default:
+		fmt.Println(errors.New("price check queue is full, dropping book " + bookID))
+	}
+}
+
+// checkPriceWatches notifies the users whose target the book price has reached. A watch fires
+// once and is removed.
+func checkPriceWatches(check priceCheck) error {
+	client, err := connectRedis()
+	if err != nil {
+		return errors.Wrap(err, "cannot connect to Redis")
+	}
+	defer client.Close()
+	values, err := client.HGetAll(priceWatchesKey(check.BookID)).Result()
+	if err != nil {
+		return errors.Wrap(err, "cannot get key from Redis")
+	}
+	notifications := make([]Notification, 0)
+	for userID, value := range values {
+		var watch PriceWatch
+		if err = json.Unmarshal([]byte(value), &watch); err != nil {
+			continue
+		}
+		if check.Book.BasePrice > watch.TargetPrice {
+			continue
+		}
+		notifications = append(notifications, Notification{
+			Type:       "price_drop",
+			UserID:     userID,
+			WebhookURL: watch.WebhookURL,
+			Payload:    map[string]interface{}{"book_id": check.BookID, "target_price": watch.TargetPrice, "book": check.Book},
+		})
+		if err = unwatchPrice(client, userID, check.BookID); err != nil {
+			return err
+		}
+	}
+	notifyAsync(notifications)
+	return nil
+}
+
+// startPriceDropWorker compares the queued books against the price watches until the process exits.
+func startPriceDropWorker() {
+	worker := registerWorker("price_drop_alerts", func() int { return len(priceCheckQueue) })
+	go func() {
+		for check := range priceCheckQueue {
+			worker.WaitWhilePaused()
+			err := checkPriceWatches(check)
+			if err != nil {
+				fmt.Println(err)
+			}
+			worker.Done(err)
+		}
+	}()
+}
+
+// priceAlerts handles /users/{id}/price-alerts: GET lists the watches, PUT and DELETE on
+// /users/{id}/price-alerts/{book_id}?target_price=&currency=&webhook_url= manage one.
+func priceAlerts(w http.ResponseWriter, req *http.Request, userID string, rest []string) {
+	var err error
+	var result string
+	client, err := connectRedis()
+	if err != nil {
+		err = errors.Wrap(err, "cannot connect to Redis")
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	defer client.Close()
+	bookID := ""
+	if len(rest) > 0 {
+		bookID = rest[0]
+	}
+	switch {
+	case req.Method == "GET" && bookID == "":
+		result, err = listPriceWatches(client, userID)
+	case req.Method == "PUT" && bookID != "":
+		var target Price
+		var currency string
+		target, err = parsePrice(getParamValue(req, "target_price"))
+		if err != nil {
+			break
+		}
+		currency, err = normalizeCurrency(getParamValue(req, "currency"))
+		if err != nil {
+			break
+		}
+		if target, err = toBaseCurrency(target, currency); err != nil {
+			break
+		}
+		result, err = watchPrice(client, userID, bookID, PriceWatch{TargetPrice: target, WebhookURL: getParamValue(req, "webhook_url")})
+	case req.Method == "DELETE" && bookID != "":
+		if err = unwatchPrice(client, userID, bookID); err == nil {
+			result = fmt.Sprintf("User %s no longer watches the price of book %s\n", userID, bookID)
+		}
+	default:
+		msg := "Unsupported request for " + req.URL.Path + " " + req.Method
+		err = errors.New(msg)
+	}
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+	} else {
+		fmt.Fprintf(w, "%s", result)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	errors "github.com/fiverr/go_errors"
+	"gopkg.in/olivere/elastic.v5"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// PublisherStats summarizes the books of a publisher.
+type PublisherStats struct {
+	Publisher string `json:"publisher"`
+	Books     int64  `json:"books"`
+	AvgPrice  Price  `json:"avg_price"`
+	// PublishedPerYear counts the books by publication year
+	PublishedPerYear map[string]int64 `json:"published_per_year"`
+}
+
+// publisherStats aggregates the book count, average price and publication histogram of a publisher
+// in the tenant's catalog.
+func publisherStats(client *elastic.Client, ctx context.Context, tenant string, publisher string) (*PublisherStats, error) {
+	query := elastic.NewBoolQuery().Must(elastic.NewTermQuery("publisher", publisher)).Filter(tenantQuery(tenant))
+	searchResult, err := client.Search().Index(booksIndex()).Query(query).
+		Aggregation("avg_price", elastic.NewAvgAggregation().Field("price")).
+		Aggregation("per_year", elastic.NewDateHistogramAggregation().Field("publish_date").Interval("year").Format("yyyy")).
+		Size(0).Do(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot aggregate books of publisher "+publisher)
+	}
+	stats := &PublisherStats{Publisher: publisher, Books: searchResult.Hits.TotalHits, PublishedPerYear: make(map[string]int64)}
+	if avg, found := searchResult.Aggregations.Avg("avg_price"); found && avg.Value != nil {
+		stats.AvgPrice = priceFromFloat(*avg.Value)
+	}
+	if histogram, found := searchResult.Aggregations.DateHistogram("per_year"); found {
+		for _, bucket := range histogram.Buckets {
+			if bucket.KeyAsString != nil && bucket.DocCount > 0 {
+				stats.PublishedPerYear[*bucket.KeyAsString] = bucket.DocCount
+			}
+		}
+	}
+	return stats, nil
+}
+
+// publishers dispatches GET /publishers/{name}/stats.
+func publishers(w http.ResponseWriter, req *http.Request) {
+	if !requireElasticsearch(w, req) {
+		return
+	}
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.EscapedPath(), "/publishers/"), "/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] != "stats" {
+		fmt.Fprintf(w, "%s", errors.New("Unsupported route "+req.URL.Path))
+		return
+	}
+	if req.Method != "GET" {
+		msg := "Unsupported request for /publishers " + req.Method
+		fmt.Fprintf(w, "%s", errors.New(msg))
+		return
+	}
+	// publisher names may contain an escaped slash
+	publisher, err := url.PathUnescape(parts[0])
+	if err != nil {
+		fmt.Fprintf(w, "%s", errors.Wrap(err, "invalid publisher name"))
+		return
+	}
+	client, ctx, err := connectElasticSearch()
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	stats, err := publisherStats(client, ctx, requestTenant(req), publisher)
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	if stats.Books == 0 {
+		http.NotFound(w, req)
+		return
+	}
+	buf, err := json.Marshal(stats)
+	if err != nil {
+		fmt.Fprintf(w, "%s", errors.Wrap(err, "cannot create json result of publisher stats"))
+		return
+	}
+	fmt.Fprintf(w, "%s", buf)
+}
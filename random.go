@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	errors "github.com/fiverr/go_errors"
+	"gopkg.in/olivere/elastic.v5"
+	"net/http"
+	"strconv"
+)
+
+const maxRandomBooks = 20
+
+// randomBooks picks n books at random among those matching the optional filters. A non-zero seed
+// makes the pick reproducible, e.g. for a "book of the day".
+func randomBooks(client *elastic.Client, ctx context.Context, tenant string, authorName string, priceRange Range, genre string, seed int64, n int) ([]BookHit, error) {
+	filter := buildSearchQuery(SearchParams{AuthorName: authorName, PriceRange: priceRange, Tenant: tenant})
+	if genre != "" {
+		filter = filter.Filter(elastic.NewTermQuery("genre", genre))
+	}
+	scoreFunc := elastic.NewRandomFunction()
+	if seed != 0 {
+		scoreFunc = scoreFunc.Seed(seed)
+	}
+	query := elastic.NewFunctionScoreQuery().Query(filter).AddScoreFunc(scoreFunc).BoostMode("replace")
+	searchResult, err := client.Search().Index(booksIndex()).Query(query).Size(n).Do(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot search random books")
+	}
+	return bookHits(searchResult), nil
+}
+
+// random handles GET /books/random?author_name=&price_range=&genre=&n=1&seed=.
+func random(w http.ResponseWriter, req *http.Request) {
+	if !requireElasticsearch(w, req) {
+		return
+	}
+	if req.Method != "GET" {
+		msg := "Unsupported request for /books/random " + req.Method
+		fmt.Fprintf(w, "%s", errors.New(msg))
+		return
+	}
+	r, err := parsePriceRange(getParamValue(req, "price_range"))
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	n := 1
+	if value := getParamValue(req, "n"); value != "" {
+		n, err = strconv.Atoi(value)
+		if err != nil || n <= 0 || n > maxRandomBooks {
+			fmt.Fprintf(w, "%s", errors.New("n must be between 1 and "+strconv.Itoa(maxRandomBooks)))
+			return
+		}
+	}
+	var seed int64
+	if value := getParamValue(req, "seed"); value != "" {
+		seed, err = strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			fmt.Fprintf(w, "%s", errors.Wrap(err, "seed must be an integer"))
+			return
+		}
+	}
+	client, ctx, err := connectElasticSearch()
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	hits, err := randomBooks(client, ctx, requestTenant(req), getParamValue(req, "author_name"), r, getParamValue(req, "genre"), seed, n)
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	buf, err := json.Marshal(hits)
+	if err != nil {
+		fmt.Fprintf(w, "%s", errors.Wrap(err, "cannot create json result of random books"))
+		return
+	}
+	fmt.Fprintf(w, "%s", buf)
+}
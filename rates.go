@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	errors "github.com/fiverr/go_errors"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ratesKey          = "exchange_rates"
+	ratesUpdatedAtKey = "exchange_rates:updated_at"
+)
+
+// ratesResponse is the payload returned by the exchange rate provider.
+type ratesResponse struct {
+	Base  string             `json:"base_code"`
+	Rates map[string]float64 `json:"rates"`
+}
+
+// fetchExchangeRates returns the configured static rate table, or the latest rates from the provider.
+func fetchExchangeRates() (map[string]float64, error) {
+	if len(config.ExchangeRates.StaticRates) > 0 {
+		return config.ExchangeRates.StaticRates, nil
+	}
+	resp, err := http.Get(config.ExchangeRates.ProviderURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot fetch exchange rates")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("exchange rate provider returned " + resp.Status)
+	}
+	var rates ratesResponse
+	if err = json.NewDecoder(resp.Body).Decode(&rates); err != nil {
+		return nil, errors.Wrap(err, "cannot decode exchange rates")
+	}
+	if rates.Base != "" && !strings.EqualFold(rates.Base, config.ExchangeRates.BaseCurrency) {
+		return nil, errors.New("exchange rate provider returned base currency " + rates.Base)
+	}
+	return rates.Rates, nil
+}
+
+// refreshExchangeRates stores the latest rates in Redis.
+func refreshExchangeRates() error {
+	rates, err := fetchExchangeRates()
+	if err != nil {
+		return err
+	}
+
+	client := sharedRedis()
+	fields := make(map[string]string, len(rates))
+	for currency, rate := range rates {
+		fields[strings.ToUpper(currency)] = strconv.FormatFloat(rate, 'f', -1, 64)
+	}
+	if err = client.HMSet(ratesKey, fields).Err(); err != nil {
+		return errors.Wrap(err, "cannot store exchange rates in Redis")
+	}
+	if err = client.Set(ratesUpdatedAtKey, time.Now().UTC().Format(time.RFC3339), 0).Err(); err != nil {
+		return errors.Wrap(err, "cannot store exchange rates timestamp in Redis")
+	}
+	return nil
+}
+
+// getExchangeRate returns the rate from the base currency to currency and when it was refreshed.
+// Demo mode has no rates in Redis, so only the base currency is known.
+func getExchangeRate(currency string) (float64, string, error) {
+	if demoMode && strings.EqualFold(currency, config.ExchangeRates.BaseCurrency) {
+		return 1, "", nil
+	}
+	client := sharedRedis()
+	currency = strings.ToUpper(currency)
+	updatedAt, _ := client.Get(ratesUpdatedAtKey).Result()
+	if currency == strings.ToUpper(config.ExchangeRates.BaseCurrency) {
+		return 1, updatedAt, nil
+	}
+	value, err := client.HGet(ratesKey, currency).Result()
+	if err != nil {
+		return 0, "", errors.New("unknown currency " + currency)
+	}
+	rate, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, "", errors.Wrap(err, "invalid exchange rate stored for "+currency)
+	}
+	return rate, updatedAt, nil
+}
+
+var currencyPattern = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// normalizeCurrency validates an ISO 4217 currency code, returning the base currency when empty.
+func normalizeCurrency(currency string) (string, error) {
+	if currency == "" {
+		return strings.ToUpper(config.ExchangeRates.BaseCurrency), nil
+	}
+	currency = strings.ToUpper(strings.TrimSpace(currency))
+	if !currencyPattern.MatchString(currency) {
+		return "", errors.New("currency must be an ISO 4217 code such as USD")
+	}
+	return currency, nil
+}
+
+// toBaseCurrency converts a price in currency to the base currency, rounded to cents.
+func toBaseCurrency(price Price, currency string) (Price, error) {
+	rate, _, err := getExchangeRate(currency)
+	if err != nil {
+		return 0, err
+	}
+	if rate <= 0 {
+		return 0, errors.New("invalid exchange rate for " + currency)
+	}
+	return priceFromFloat(price.Float() / rate), nil
+}
+
+// displayPrice adds the price converted to currency, and the conversion timestamp, to a book source.
+func displayPrice(source string, currency string, rate float64, updatedAt string) (string, error) {
+	doc := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(source), &doc); err != nil {
+		return "", errors.Wrap(err, "cannot decode book for price conversion")
+	}
+	// base_price is missing on books indexed before currencies, whose price is in the base currency
+	price, ok := doc["base_price"].(float64)
+	if !ok {
+		price, ok = doc["price"].(float64)
+	}
+	if ok {
+		doc["display_price"] = math.Round(price*rate*100) / 100
+		// the discount is in the book's currency, so it carries over as the same fraction of the price
+		discounted, hasDiscount := doc["discounted_price"].(float64)
+		if original, _ := doc["price"].(float64); hasDiscount && original > 0 {
+			doc["display_discounted_price"] = math.Round(price*rate*discounted/original*100) / 100
+		}
+	}
+	doc["display_currency"] = strings.ToUpper(currency)
+	doc["rates_updated_at"] = updatedAt
+	buf, err := json.Marshal(doc)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot encode book with converted price")
+	}
+	return string(buf), nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	errors "github.com/fiverr/go_errors"
+	"gopkg.in/olivere/elastic.v5"
+	"net/http"
+)
+
+// recentlyViewedCap is how many books are kept in a user's recently viewed list.
+const recentlyViewedCap = 20
+
+func recentlyViewedKey(userID string) string {
+	return "recently_viewed:" + userID
+}
+
+// recordRecentlyViewed moves the book to the front of the user's capped recently viewed list.
+func recordRecentlyViewed(userID string, id string) error {
+	client, err := connectRedis()
+	if err != nil {
+		return errors.Wrap(err, "cannot connect to Redis")
+	}
+	defer client.Close()
+	key := recentlyViewedKey(userID)
+	if err = client.LRem(key, 0, id).Err(); err != nil {
+		return errors.Wrap(err, "cannot update key in Redis")
+	}
+	if err = client.LPush(key, id).Err(); err != nil {
+		return errors.Wrap(err, "cannot update key in Redis")
+	}
+	if err = client.LTrim(key, 0, recentlyViewedCap-1).Err(); err != nil {
+		return errors.Wrap(err, "cannot update key in Redis")
+	}
+	return nil
+}
+
+// getBooks returns the documents of the existing books among ids, keyed by id: with a single
+// multi-get from the books index, limited to fields when given, or one by one from the other
+// repositories.
+func getBooks(ids []string, fields ...string) (map[string]json.RawMessage, error) {
+	docs := make(map[string]json.RawMessage, len(ids))
+	if len(ids) == 0 {
+		return docs, nil
+	}
+	if _, ok := bookRepo.(esBookRepository); !ok {
+		for _, id := range ids {
+			source, err := bookRepo.Get(id)
+			if err != nil {
+				return nil, err
+			}
+			if source != "" {
+				docs[id] = json.RawMessage(source)
+			}
+		}
+		return docs, nil
+	}
+	client, ctx, err := connectElasticSearch()
+	if err != nil {
+		return nil, err
+	}
+	mget := client.MultiGet()
+	for _, id := range ids {
+		item := elastic.NewMultiGetItem().Index(booksIndex()).Type(typeName(USER_TYPE)).Id(id)
+		if len(fields) > 0 {
+			item = item.FetchSource(elastic.NewFetchSourceContext(true).Include(fields...))
+		}
+		mget = mget.Add(item)
+	}
+	res, err := mget.Do(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot get books")
+	}
+	for _, doc := range res.Docs {
+		if doc.Found && doc.Source != nil {
+			docs[doc.Id] = *doc.Source
+		}
+	}
+	return docs, nil
+}
+
+// hydrateBooks fetches the book documents for ids in their order, skipping missing ones.
+func hydrateBooks(ids []string) ([]json.RawMessage, error) {
+	docs, err := getBooks(ids)
+	if err != nil {
+		return nil, err
+	}
+	books := make([]json.RawMessage, 0, len(docs))
+	for _, id := range ids {
+		if doc, ok := docs[id]; ok {
+			books = append(books, doc)
+		}
+	}
+	return books, nil
+}
+
+// bookTitles looks up the titles of the given books, fetching only the title field.
+func bookTitles(ids []string) (map[string]string, error) {
+	docs, err := getBooks(ids, "title")
+	if err != nil {
+		return nil, err
+	}
+	titles := make(map[string]string, len(docs))
+	for id, doc := range docs {
+		var book Book
+		if json.Unmarshal(doc, &book) == nil {
+			titles[id] = book.Title
+		}
+	}
+	return titles, nil
+}
+
+// recentlyViewed handles GET /users/{id}/recently-viewed.
+func recentlyViewed(w http.ResponseWriter, req *http.Request, userID string) {
+	if req.Method != "GET" {
+		msg := "Unsupported request for " + req.URL.Path + " " + req.Method
+		fmt.Fprintf(w, "%s", errors.New(msg))
+		return
+	}
+	client, err := connectRedis()
+	if err != nil {
+		err = errors.Wrap(err, "cannot connect to Redis")
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	defer client.Close()
+	ids, err := client.LRange(recentlyViewedKey(userID), 0, recentlyViewedCap-1).Result()
+	if err != nil {
+		fmt.Fprintf(w, "%s", errors.Wrap(err, "cannot get key from Redis"))
+		return
+	}
+	books, err := hydrateBooks(ids)
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	buf, err := json.Marshal(books)
+	if err != nil {
+		fmt.Fprintf(w, "%s", errors.Wrap(err, "cannot create json result of recently viewed books"))
+		return
+	}
+	fmt.Fprintf(w, "%s", buf)
+}
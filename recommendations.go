@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	errors "github.com/fiverr/go_errors"
+	"gopkg.in/olivere/elastic.v5"
+	"net/http"
+	"strconv"
+)
+
+const maxRecommendations = 50
+
+// recommendBooks suggests books similar to the ones the user viewed (more_like_this), boosted
+// towards the authors the user views most, never returning a book the user already viewed nor one
+// of another tenant's catalog.
+func recommendBooks(client *elastic.Client, ctx context.Context, tenant string, viewed []string, n int) ([]BookHit, error) {
+	if len(viewed) == 0 {
+		return make([]BookHit, 0), nil
+	}
+	sources, err := hydrateBooks(viewed)
+	if err != nil {
+		return nil, err
+	}
+	// author affinity: how many of the viewed books each author wrote
+	affinity := make(map[string]int)
+	for _, source := range sources {
+		var book Book
+		if json.Unmarshal(source, &book) == nil && book.AuthorName != "" {
+			affinity[book.AuthorName]++
+		}
+	}
+
+	items := make([]*elastic.MoreLikeThisQueryItem, 0, len(viewed))
+	for _, id := range viewed {
+		items = append(items, elastic.NewMoreLikeThisQueryItem().Index(booksIndex()).Type(typeName(USER_TYPE)).Id(id))
+	}
+	similar := elastic.NewMoreLikeThisQuery().Field("title", "author_name").LikeItems(items...).
+		MinTermFreq(1).MinDocFreq(1)
+	query := elastic.NewBoolQuery().Should(similar).MinimumNumberShouldMatch(1).
+		MustNot(elastic.NewIdsQuery(typeName(USER_TYPE)).Ids(viewed...)).Filter(tenantQuery(tenant))
+	for author, count := range affinity {
+		query = query.Should(elastic.NewMatchPhraseQuery("author_name", author).Boost(float64(count)))
+	}
+	searchResult, err := client.Search().Index(booksIndex()).Query(query).Size(n).Do(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot search recommendations")
+	}
+	return bookHits(searchResult), nil
+}
+
+// recommendations handles GET /users/{id}/recommendations?n=10.
+func recommendations(w http.ResponseWriter, req *http.Request, userID string) {
+	if !requireElasticsearch(w, req) {
+		return
+	}
+	if req.Method != "GET" {
+		msg := "Unsupported request for " + req.URL.Path + " " + req.Method
+		fmt.Fprintf(w, "%s", errors.New(msg))
+		return
+	}
+	n := 10
+	if value := getParamValue(req, "n"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 || parsed > maxRecommendations {
+			fmt.Fprintf(w, "%s", errors.New("n must be between 1 and "+strconv.Itoa(maxRecommendations)))
+			return
+		}
+		n = parsed
+	}
+	redisClient, err := connectRedis()
+	if err != nil {
+		err = errors.Wrap(err, "cannot connect to Redis")
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	defer redisClient.Close()
+	viewed, err := redisClient.LRange(recentlyViewedKey(userID), 0, recentlyViewedCap-1).Result()
+	if err != nil {
+		fmt.Fprintf(w, "%s", errors.Wrap(err, "cannot get key from Redis"))
+		return
+	}
+	client, ctx, err := connectElasticSearch()
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	hits, err := recommendBooks(client, ctx, requestTenant(req), viewed, n)
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	buf, err := json.Marshal(hits)
+	if err != nil {
+		fmt.Fprintf(w, "%s", errors.Wrap(err, "cannot create json result of recommendations"))
+		return
+	}
+	fmt.Fprintf(w, "%s", buf)
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	errors "github.com/fiverr/go_errors"
+	"gopkg.in/olivere/elastic.v5"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// SearchHit is a book matched by a search, with its stored document.
+type SearchHit struct {
+	ID     string
+	Source string
+	// Highlight holds the matching snippets by field, when the search asked for them
+	Highlight map[string][]string
+}
+
+// Relations of a total to the number of matching books, named as by Elasticsearch 7+.
+const (
+	totalExact      = "eq"
+	totalLowerBound = "gte"
+)
+
+// SearchHits is a page of search results with the total number of matching books. TotalRelation
+// is totalLowerBound when the backend stopped counting at Total.
+type SearchHits struct {
+	Total         int64
+	TotalRelation string
+	Hits          []SearchHit
+}
+
+// BookStats are the catalog aggregates served by /store. AvgBasePrice is nil for an empty
+// catalog.
+type BookStats struct {
+	Books         int64
+	BooksRelation string
+	Authors       int64
+	AvgBasePrice  *float64
+}
+
+// BookRepository stores the books served by /book, /search and /store. Documents are returned
+// as stored, discounts and display currencies are applied by the handlers.
+type BookRepository interface {
+	// Get returns the stored document of the book, "" when it does not exist.
+	Get(id string) (string, error)
+	Exists(id string) (bool, error)
+	Put(id string, book Book) (string, error)
+	UpdateTitle(id string, title string) (string, error)
+	// SetRating stores the rating computed from the reviews, ignoring unknown books.
+	SetRating(id string, avg float64, count int64) error
+	// Delete returns "" when the book did not exist.
+	Delete(id string) (string, error)
+	Search(p SearchParams) (SearchHits, error)
+	// Stats aggregates the books of the tenant, "" for the default catalog.
+	Stats(tenant string) (BookStats, error)
+}
+
+// bookRepo is the repository selected by config, set up in main.
+var bookRepo BookRepository
+
+// newBookRepository creates the book backend selected by config: "elasticsearch", "postgres" or
+// "memory".
+func newBookRepository(c BooksConfig) (BookRepository, error) {
+	switch c.Backend {
+	case "", "elasticsearch":
+		return esBookRepository{}, nil
+	case "postgres":
+		return newPgBookRepository(c.PostgresURL)
+	case "memory":
+		return newMemoryBookRepository(), nil
+	default:
+		return nil, errors.New("unknown books backend " + c.Backend)
+	}
+}
+
+// esBookRepository keeps books in the books index. Writes go through the bulk indexer when bulk
+// indexing is enabled.
+type esBookRepository struct{}
+
+func (esBookRepository) Get(id string) (string, error) {
+	client, ctx, err := connectElasticSearch()
+	if err != nil {
+		return "", err
+	}
+	get, err := client.Get().Index(booksIndex()).Type(typeName(USER_TYPE)).Id(id).Do(ctx)
+	if err != nil {
+		return "", errors.Wrap(err, "Cannot GET a book")
+	}
+	if !get.Found {
+		return "", nil
+	}
+	return string(*get.Source), nil
+}
+
+func (esBookRepository) Exists(id string) (bool, error) {
+	client, ctx, err := connectElasticSearch()
+	if err != nil {
+		return false, err
+	}
+	exists, err := client.Exists().Index(booksIndex()).Type(typeName(USER_TYPE)).Id(id).Do(ctx)
+	if err != nil {
+		return false, errors.Wrap(err, "cannot check if the book exists")
+	}
+	return exists, nil
+}
+
+func (esBookRepository) Put(id string, book Book) (string, error) {
+	if bulkIndexer != nil {
+		bulkIndexer.Add(elastic.NewBulkIndexRequest().Index(booksIndex()).Type(typeName(USER_TYPE)).Id(id).Doc(book))
+		return fmt.Sprintf("Queued book %s for indexing\n", id), nil
+	}
+	client, ctx, err := connectElasticSearch()
+	if err != nil {
+		return "", err
+	}
+	put, err := client.Index().Index(booksIndex()).Type(typeName(USER_TYPE)).Id(id).BodyJson(book).Refresh("wait_for").Do(ctx)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot add the book")
+	}
+	s := fmt.Sprintf("Indexed book %s to index %s, type %s\n", put.Id, put.Index, put.Type)
+	return s, nil
+}
+
+func (esBookRepository) UpdateTitle(id string, title string) (string, error) {
+	client, ctx, err := connectElasticSearch()
+	if err != nil {
+		return "", err
+	}
+	update, err := client.Update().Index(booksIndex()).Type(typeName(USER_TYPE)).Id(id).Doc(map[string]interface{}{"title": title}).Refresh("wait_for").Do(ctx)
+	if err != nil {
+		return "", err
+	}
+	s := fmt.Sprintf("New version of book %q is now %d\n", update.Id, update.Version)
+	return s, nil
+}
+
+func (esBookRepository) SetRating(id string, avg float64, count int64) error {
+	client, ctx, err := connectElasticSearch()
+	if err != nil {
+		return err
+	}
+	_, err = client.Update().Index(booksIndex()).Type(typeName(USER_TYPE)).Id(id).
+		Doc(map[string]interface{}{"rating_avg": avg, "rating_count": count}).Refresh("wait_for").Do(ctx)
+	if err != nil && !elastic.IsNotFound(err) {
+		return errors.Wrap(err, "cannot update the rating of book "+id)
+	}
+	return nil
+}
+
+func (esBookRepository) Delete(id string) (string, error) {
+	client, ctx, err := connectElasticSearch()
+	if err != nil {
+		return "", err
+	}
+	del, err := client.Delete().Index(booksIndex()).Type(typeName(USER_TYPE)).Id(id).Do(ctx)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot delete the book")
+	}
+	if del.Found {
+		s := fmt.Sprintf("Delete document %s in version %d from index %s, type %s\n", del.Id, del.Version, del.Index, del.Type)
+		return s, nil
+	}
+	return "", nil
+}
+
+func (esBookRepository) Search(p SearchParams) (SearchHits, error) {
+	client, ctx, err := connectElasticSearch()
+	if err != nil {
+		return SearchHits{}, err
+	}
+	service := client.Search().Index(booksIndex()).Query(buildSearchQuery(p))
+	if p.Sort == "rating" {
+		service = service.Sort("rating_avg", false).Sort("rating_count", false)
+	} else if p.Query != "" {
+		service = service.SortBy(elastic.NewScoreSort())
+	} else {
+		service = service.Sort("title", true)
+	}
+	// books sharing the sort values keep their order between pages
+	service = service.Sort(idSortField(), true)
+	if p.Highlight {
+		service = service.Highlight(elastic.NewHighlight().Fields(
+			elastic.NewHighlighterField("title").NumOfFragments(0),
+			elastic.NewHighlighterField("description").FragmentSize(150).NumOfFragments(3)))
+	}
+	if p.CollapseEditions {
+		service = service.Collapse(elastic.NewCollapseBuilder("work_id"))
+	}
+	searchResult, err := service.From(p.From).Size(p.pageSize()).Pretty(true).Do(ctx)
+	if err != nil {
+		return SearchHits{}, errors.Wrap(err, "cannot search books")
+	}
+	hits := SearchHits{Total: searchResult.Hits.TotalHits, TotalRelation: totalRelation(searchResult.Hits.TotalHits),
+		Hits: make([]SearchHit, 0, len(searchResult.Hits.Hits))}
+	for _, hit := range searchResult.Hits.Hits {
+		hits.Hits = append(hits.Hits, SearchHit{ID: hit.Id, Source: string(*hit.Source), Highlight: hit.Highlight})
+	}
+	return hits, nil
+}
+
+func (esBookRepository) Stats(tenant string) (BookStats, error) {
+	client, ctx, err := connectElasticSearch()
+	if err != nil {
+		return BookStats{}, err
+	}
+	cardinalityAgg := elastic.NewCardinalityAggregation().Field("author_name")
+	// books indexed before currencies have no base_price, their price is in the base currency
+	avgAgg := elastic.NewAvgAggregation().Script(elastic.NewScript("doc['base_price'].empty ? doc['price'].value : doc['base_price'].value"))
+	searchResult, err := client.Search().Index(booksIndex()).Query(tenantQuery(tenant)).Pretty(true).Aggregation("distinctAuthors", cardinalityAgg).
+		Aggregation("avgPrice", avgAgg).Do(ctx)
+	if err != nil {
+		return BookStats{}, errors.Wrap(err, "cannot aggregate store stats")
+	}
+	stats := BookStats{Books: searchResult.Hits.TotalHits, BooksRelation: totalRelation(searchResult.Hits.TotalHits)}
+	if distinctAuthors, found := searchResult.Aggregations.Cardinality("distinctAuthors"); found && distinctAuthors.Value != nil {
+		stats.Authors = int64(*distinctAuthors.Value + 0.5)
+	}
+	if avg, found := searchResult.Aggregations.Avg("avgPrice"); found {
+		stats.AvgBasePrice = avg.Value
+	}
+	return stats, nil
+}
+
+// memoryBookRepository keeps books in process memory. It serves development and tests without
+// Elasticsearch: search matches any word of the text params as a substring, and orders q
+// matches by title rather than by relevance.
+type memoryBookRepository struct {
+	mu       sync.RWMutex
+	books    map[string]Book
+	versions map[string]int64
+}
+
+func newMemoryBookRepository() *memoryBookRepository {
+	return &memoryBookRepository{books: make(map[string]Book), versions: make(map[string]int64)}
+}
+
+func (r *memoryBookRepository) Get(id string) (string, error) {
+	r.mu.RLock()
+	book, ok := r.books[id]
+	r.mu.RUnlock()
+	if !ok {
+		return "", nil
+	}
+	buf, err := json.Marshal(book)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot create json book")
+	}
+	return string(buf), nil
+}
+
+func (r *memoryBookRepository) Exists(id string) (bool, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, ok := r.books[id]
+	return ok, nil
+}
+
+func (r *memoryBookRepository) Put(id string, book Book) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.books[id] = book
+	r.versions[id]++
+	return fmt.Sprintf("Stored book %s in version %d\n", id, r.versions[id]), nil
+}
+
+func (r *memoryBookRepository) UpdateTitle(id string, title string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	book, ok := r.books[id]
+	if !ok {
+		return "", errors.New("book " + id + " does not exist")
+	}
+	book.Title = title
+	r.books[id] = book
+	r.versions[id]++
+	return fmt.Sprintf("New version of book %q is now %d\n", id, r.versions[id]), nil
+}
+
+func (r *memoryBookRepository) SetRating(id string, avg float64, count int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if book, ok := r.books[id]; ok {
+		book.RatingAvg, book.RatingCount = avg, count
+		r.books[id] = book
+	}
+	return nil
+}
+
+func (r *memoryBookRepository) Delete(id string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.books[id]; !ok {
+		return "", nil
+	}
+	delete(r.books, id)
+	version := r.versions[id]
+	delete(r.versions, id)
+	return fmt.Sprintf("Deleted book %s in version %d\n", id, version), nil
+}
+
+// matchesAnyWord reports whether any word of query appears in one of the fields, ignoring case.
+func matchesAnyWord(query string, fields ...string) bool {
+	for _, word := range strings.Fields(strings.ToLower(query)) {
+		for _, field := range fields {
+			if strings.Contains(strings.ToLower(field), word) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchesSearch applies the filters of buildSearchQuery to a book.
+func matchesSearch(book Book, p SearchParams) bool {
+	if book.Tenant != p.Tenant {
+		return false
+	}
+	if p.Query != "" && !matchesAnyWord(p.Query, book.Title, book.AuthorName, book.Description) {
+		return false
+	}
+	if p.Title != "" && !matchesAnyWord(p.Title, book.Title) {
+		return false
+	}
+	if p.AuthorName != "" && !matchesAnyWord(p.AuthorName, book.AuthorName) {
+		return false
+	}
+	if !(p.PriceRange.From == -1 && p.PriceRange.To == -1) {
+		price, from, to := book.Price.Float(), p.PriceRange.From.Float(), p.PriceRange.To.Float()
+		if p.PriceRate > 0 {
+			price, from, to = book.BasePrice.Float(), from/p.PriceRate, to/p.PriceRate
+		}
+		if price < from || price > to {
+			return false
+		}
+	}
+	if (p.PagesMin > 0 && book.PageCount < p.PagesMin) || (p.PagesMax > 0 && book.PageCount > p.PagesMax) {
+		return false
+	}
+	if (p.Language != "" && book.Language != p.Language) || (p.Publisher != "" && book.Publisher != p.Publisher) {
+		return false
+	}
+	if len(p.Formats) > 0 {
+		found := false
+		for _, format := range p.Formats {
+			found = found || hasFormat(book.Formats, format)
+		}
+		if !found {
+			return false
+		}
+	}
+	return p.MinRating <= 0 || book.RatingAvg >= p.MinRating
+}
+
+func (r *memoryBookRepository) Search(p SearchParams) (SearchHits, error) {
+	r.mu.RLock()
+	ids := make([]string, 0)
+	matched := make(map[string]Book)
+	for id, book := range r.books {
+		if matchesSearch(book, p) {
+			ids = append(ids, id)
+			matched[id] = book
+		}
+	}
+	r.mu.RUnlock()
+	sort.Slice(ids, func(i, j int) bool {
+		a, b := matched[ids[i]], matched[ids[j]]
+		if p.Sort == "rating" && (a.RatingAvg != b.RatingAvg || a.RatingCount != b.RatingCount) {
+			if a.RatingAvg != b.RatingAvg {
+				return a.RatingAvg > b.RatingAvg
+			}
+			return a.RatingCount > b.RatingCount
+		}
+		if a.Title != b.Title {
+			return a.Title < b.Title
+		}
+		return ids[i] < ids[j]
+	})
+	if p.CollapseEditions {
+		works := make(map[string]bool)
+		collapsed := ids[:0]
+		for _, id := range ids {
+			if work := matched[id].WorkID; !works[work] {
+				works[work] = true
+				collapsed = append(collapsed, id)
+			}
+		}
+		ids = collapsed
+	}
+	hits := SearchHits{Total: int64(len(ids)), TotalRelation: totalExact, Hits: make([]SearchHit, 0)}
+	for i := p.From; i < len(ids) && i < p.From+p.pageSize(); i++ {
+		buf, err := json.Marshal(matched[ids[i]])
+		if err != nil {
+			return SearchHits{}, errors.Wrap(err, "cannot create json book")
+		}
+		hits.Hits = append(hits.Hits, SearchHit{ID: ids[i], Source: string(buf)})
+	}
+	return hits, nil
+}
+
+func (r *memoryBookRepository) Stats(tenant string) (BookStats, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	stats := BookStats{BooksRelation: totalExact}
+	authors := make(map[string]bool)
+	var sum float64
+	for _, book := range r.books {
+		if book.Tenant != tenant {
+			continue
+		}
+		stats.Books++
+		if book.AuthorName != "" {
+			authors[strings.ToLower(book.AuthorName)] = true
+		}
+		// books stored before currencies have no base_price, their price is in the base currency
+		if book.BasePrice != 0 {
+			sum += book.BasePrice.Float()
+		} else {
+			sum += book.Price.Float()
+		}
+	}
+	stats.Authors = int64(len(authors))
+	if stats.Books > 0 {
+		avg := sum / float64(stats.Books)
+		stats.AvgBasePrice = &avg
+	}
+	return stats, nil
+}
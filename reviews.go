@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	errors "github.com/fiverr/go_errors"
+	"gopkg.in/olivere/elastic.v5"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+const (
+	reviewsMapping = `
+{
+	"settings":{
+		"number_of_shards": 1,
+		"number_of_replicas": 0
+	},
+	"mappings":{
+		"review":{
+			"properties": {
+				"book_id": { "type": "keyword" },
+				"user_id": { "type": "keyword" },
+				"rating": { "type": "integer" },
+				"text": { "type": "text" },
+				"status": { "type": "keyword" },
+				"flagged_terms": { "type": "keyword" },
+				"created_at": { "type": "date" },
+				"moderated_at": { "type": "date" }
+			}
+		}
+	}
+}`
+	REVIEWS_INDEX = "reviews"
+	REVIEW_TYPE   = "review"
+
+	maxReviewLength = 10000
+	// maxReviewsLimit caps the reviews of a book listed in one GraphQL field
+	maxReviewsLimit = 100
+)
+
+// Review is a user's rating and text about a book. A user reviews a book at most once.
+type Review struct {
+	BookID string `json:"book_id"`
+	UserID string `json:"user_id"`
+	Rating int    `json:"rating"`
+	Text   string `json:"text"`
+	// Status is pending, approved or rejected; only approved reviews are listed and rated
+	Status       string     `json:"status"`
+	FlaggedTerms []string   `json:"flagged_terms,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+	ModeratedAt  *time.Time `json:"moderated_at,omitempty"`
+}
+
+const (
+	reviewPending  = "pending"
+	reviewApproved = "approved"
+	reviewRejected = "rejected"
+)
+
+// visibleReviews matches the approved reviews of a book. Reviews written before moderation have
+// no status and count as approved.
+func visibleReviews(bookID string) elastic.Query {
+	return elastic.NewBoolQuery().Filter(elastic.NewTermQuery("book_id", bookID)).
+		MustNot(elastic.NewTermsQuery("status", reviewPending, reviewRejected))
+}
+
+// bannedTerms returns the configured banned terms found in text as whole words.
+func bannedTerms(text string) []string {
+	found := make([]string, 0)
+	for _, term := range config.Moderation.BannedTerms {
+		if term == "" {
+			continue
+		}
+		pattern, err := regexp.Compile(`(?i)\b` + regexp.QuoteMeta(term) + `\b`)
+		if err == nil && pattern.MatchString(text) {
+			found = append(found, term)
+		}
+	}
+	return found
+}
+
+// moderate sets the initial status of a new review, holding flagged reviews for a moderator.
+func moderate(review *Review) {
+	review.FlaggedTerms = bannedTerms(review.Text)
+	if len(review.FlaggedTerms) > 0 || config.Moderation.RequireApproval {
+		review.Status = reviewPending
+	} else {
+		review.Status = reviewApproved
+	}
+}
+
+// reviewSorts maps the sort param of GET /books/{id}/reviews to the sort field and order.
+var reviewSorts = map[string]struct {
+	field     string
+	ascending bool
+}{
+	"newest":  {"created_at", false},
+	"oldest":  {"created_at", true},
+	"highest": {"rating", false},
+	"lowest":  {"rating", true},
+}
+
+// reviewID keys a review by book and user, which enforces one review per user.
+func reviewID(bookID string, userID string) string {
+	return bookID + ":" + userID
+}
+
+func ensureReviewsIndex(client *elastic.Client, ctx context.Context) error {
+	exists, err := client.IndexExists(REVIEWS_INDEX).Do(ctx)
+	if err != nil {
+		return errors.Wrap(err, "cannot check reviews index")
+	}
+	if !exists {
+		if _, err = client.CreateIndex(REVIEWS_INDEX).BodyString(reviewsMapping).Do(ctx); err != nil {
+			return errors.Wrap(err, "cannot create reviews index")
+		}
+	}
+	return nil
+}
+
+func addReview(client *elastic.Client, ctx context.Context, review Review) (string, error) {
+	if err := ensureReviewsIndex(client, ctx); err != nil {
+		return "", err
+	}
+	exists, err := client.Exists().Index(booksIndex()).Type(typeName(USER_TYPE)).Id(review.BookID).Do(ctx)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot check if the book exists")
+	}
+	if !exists {
+		return "", errors.New("book " + review.BookID + " does not exist")
+	}
+	id := reviewID(review.BookID, review.UserID)
+	moderate(&review)
+	_, err = client.Index().Index(REVIEWS_INDEX).Type(typeName(REVIEW_TYPE)).Id(id).OpType("create").
+		BodyJson(review).Refresh("wait_for").Do(ctx)
+	if elastic.IsConflict(err) {
+		return "", errors.New("user " + review.UserID + " already reviewed book " + review.BookID)
+	}
+	if err != nil {
+		return "", errors.Wrap(err, "cannot add the review")
+	}
+	if review.Status == reviewPending {
+		return fmt.Sprintf("Review %s is awaiting moderation\n", id), nil
+	}
+	if err = refreshBookRating(client, ctx, review.BookID); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Added review %s\n", id), nil
+}
+
+func deleteReview(client *elastic.Client, ctx context.Context, bookID string, userID string) (string, error) {
+	id := reviewID(bookID, userID)
+	_, err := client.Delete().Index(REVIEWS_INDEX).Type(typeName(REVIEW_TYPE)).Id(id).Refresh("wait_for").Do(ctx)
+	if elastic.IsNotFound(err) {
+		return "", errors.New("user " + userID + " has not reviewed book " + bookID)
+	}
+	if err != nil {
+		return "", errors.Wrap(err, "cannot delete the review")
+	}
+	if err = refreshBookRating(client, ctx, bookID); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Deleted review %s\n", id), nil
+}
+
+// bookRating computes the average rating and number of visible reviews of a book.
+func bookRating(client *elastic.Client, ctx context.Context, bookID string) (float64, int64, error) {
+	var avg float64
+	var count int64
+	searchResult, err := client.Search().Index(REVIEWS_INDEX).Query(visibleReviews(bookID)).
+		Aggregation("rating_avg", elastic.NewAvgAggregation().Field("rating")).Size(0).Do(ctx)
+	if err != nil && !elastic.IsNotFound(err) {
+		return 0, 0, errors.Wrap(err, "cannot aggregate reviews of book "+bookID)
+	}
+	if err == nil {
+		count = searchResult.Hits.TotalHits
+		if agg, found := searchResult.Aggregations.Avg("rating_avg"); found && agg.Value != nil {
+			avg = math.Round(*agg.Value*100) / 100
+		}
+	}
+	return avg, count, nil
+}
+
+// refreshBookRating recomputes the denormalized rating_avg and rating_count of a book from its
+// reviews.
+func refreshBookRating(client *elastic.Client, ctx context.Context, bookID string) error {
+	avg, count, err := bookRating(client, ctx, bookID)
+	if err != nil {
+		return err
+	}
+	return bookRepo.SetRating(bookID, avg, count)
+}
+
+// listReviews returns a page of the reviews of a book in the given sort order.
+func listReviews(client *elastic.Client, ctx context.Context, bookID string, sort string, offset int, limit int) (string, error) {
+	order, ok := reviewSorts[sort]
+	if !ok {
+		return "", errors.New("sort must be newest, oldest, highest or lowest")
+	}
+	reviews := make([]json.RawMessage, 0)
+	var total int64
+	searchResult, err := client.Search().Index(REVIEWS_INDEX).Query(visibleReviews(bookID)).
+		Sort(order.field, order.ascending).Sort("created_at", false).Sort(idSortField(), true).From(offset).Size(limit).Do(ctx)
+	if err != nil && !elastic.IsNotFound(err) {
+		return "", errors.Wrap(err, "cannot search reviews")
+	}
+	if err == nil {
+		total = searchResult.Hits.TotalHits
+		for _, hit := range searchResult.Hits.Hits {
+			reviews = append(reviews, *hit.Source)
+		}
+	}
+	buf, err := json.Marshal(map[string]interface{}{"total": total, "offset": offset, "limit": limit, "reviews": reviews})
+	if err != nil {
+		return "", errors.Wrap(err, "cannot create json result of reviews")
+	}
+	return string(buf), nil
+}
+
+// reviews handles /books/{id}/reviews: GET ?sort=&offset=&limit= lists the reviews, POST
+// ?user_id=&rating=&text= adds the user's review and DELETE ?user_id= removes it.
+func reviews(w http.ResponseWriter, req *http.Request, bookID string) {
+	if !requireElasticsearch(w, req) {
+		return
+	}
+	var err error
+	var result string
+	client, ctx, err := connectElasticSearch()
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	userID := tenantParam(req, "user_id")
+	switch req.Method {
+	case "GET":
+		var offset, limit int64
+		offset, limit, err = parsePage(req, 20)
+		if err != nil {
+			break
+		}
+		sort := getParamValue(req, "sort")
+		if sort == "" {
+			sort = "newest"
+		}
+		result, err = listReviews(client, ctx, bookID, sort, int(offset), int(limit))
+	case "POST":
+		review := Review{BookID: bookID, UserID: userID, Text: getParamValue(req, "text"), CreatedAt: time.Now().UTC()}
+		if userID == "" {
+			err = errors.New("user_id is required")
+			break
+		}
+		review.Rating, err = strconv.Atoi(getParamValue(req, "rating"))
+		if err != nil || review.Rating < 1 || review.Rating > 5 {
+			err = errors.New("rating must be an integer between 1 and 5")
+			break
+		}
+		if len(review.Text) > maxReviewLength {
+			err = errors.New("text must be at most " + strconv.Itoa(maxReviewLength) + " bytes")
+			break
+		}
+		result, err = addReview(client, ctx, review)
+	case "DELETE":
+		if userID == "" {
+			err = errors.New("user_id is required")
+			break
+		}
+		result, err = deleteReview(client, ctx, bookID, userID)
+	default:
+		msg := "Unsupported request for /books/{id}/reviews " + req.Method
+		err = errors.New(msg)
+	}
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+	} else {
+		fmt.Fprintf(w, "%s", result)
+	}
+}
+
+// moderationQueue returns a page of the reviews in a status, oldest first.
+func moderationQueue(client *elastic.Client, ctx context.Context, status string, offset int, limit int) (string, error) {
+	reviews := make([]map[string]interface{}, 0)
+	var total int64
+	searchResult, err := client.Search().Index(REVIEWS_INDEX).Query(elastic.NewTermQuery("status", status)).
+		Sort("created_at", true).Sort(idSortField(), true).From(offset).Size(limit).Do(ctx)
+	if err != nil && !elastic.IsNotFound(err) {
+		return "", errors.Wrap(err, "cannot search reviews")
+	}
+	if err == nil {
+		total = searchResult.Hits.TotalHits
+		for _, hit := range searchResult.Hits.Hits {
+			reviews = append(reviews, map[string]interface{}{"id": hit.Id, "review": hit.Source})
+		}
+	}
+	buf, err := json.Marshal(map[string]interface{}{"total": total, "offset": offset, "limit": limit, "reviews": reviews})
+	if err != nil {
+		return "", errors.Wrap(err, "cannot create json result of moderation queue")
+	}
+	return string(buf), nil
+}
+
+// setReviewStatus approves or rejects a review and updates the rating of its book.
+func setReviewStatus(client *elastic.Client, ctx context.Context, id string, status string) (string, error) {
+	get, err := client.Get().Index(REVIEWS_INDEX).Type(typeName(REVIEW_TYPE)).Id(id).Do(ctx)
+	if elastic.IsNotFound(err) {
+		return "", errors.New("review " + id + " does not exist")
+	}
+	if err != nil {
+		return "", errors.Wrap(err, "cannot get the review")
+	}
+	var review Review
+	if err = json.Unmarshal(*get.Source, &review); err != nil {
+		return "", errors.Wrap(err, "cannot decode the review")
+	}
+	_, err = client.Update().Index(REVIEWS_INDEX).Type(typeName(REVIEW_TYPE)).Id(id).
+		Doc(map[string]interface{}{"status": status, "moderated_at": time.Now().UTC()}).Refresh("wait_for").Do(ctx)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot update the review")
+	}
+	if err = refreshBookRating(client, ctx, review.BookID); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Review %s is now %s\n", id, status), nil
+}
+
+// adminReviews handles /admin/reviews: GET ?status=pending&offset=&limit= lists the moderation
+// queue and POST ?id=&action=approve|reject moderates a review.
+func adminReviews(w http.ResponseWriter, req *http.Request) {
+	if !requireElasticsearch(w, req) {
+		return
+	}
+	if !isAdmin(req) {
+		http.Error(w, "admin token required", http.StatusUnauthorized)
+		return
+	}
+	var err error
+	var result string
+	client, ctx, err := connectElasticSearch()
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	switch req.Method {
+	case "GET":
+		status := getParamValue(req, "status")
+		if status == "" {
+			status = reviewPending
+		}
+		if status != reviewPending && status != reviewApproved && status != reviewRejected {
+			err = errors.New("status must be pending, approved or rejected")
+			break
+		}
+		var offset, limit int64
+		if offset, limit, err = parsePage(req, 20); err == nil {
+			result, err = moderationQueue(client, ctx, status, int(offset), int(limit))
+		}
+	case "POST":
+		switch getParamValue(req, "action") {
+		case "approve":
+			result, err = setReviewStatus(client, ctx, getParamValue(req, "id"), reviewApproved)
+		case "reject":
+			result, err = setReviewStatus(client, ctx, getParamValue(req, "id"), reviewRejected)
+		default:
+			err = errors.New("action must be approve or reject")
+		}
+	default:
+		msg := "Unsupported request for /admin/reviews " + req.Method
+		err = errors.New(msg)
+	}
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+	} else {
+		fmt.Fprintf(w, "%s", result)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	errors "github.com/fiverr/go_errors"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+// BookRule is a business rule checked on every book write. On numeric fields Min and Max bound
+// the value, on text fields its length. Pattern is a regular expression text fields must match,
+// and MaxAhead, such as "730d", how far in the future publish_date may be. Fields left empty are
+// not checked, and Message replaces the generated violation message.
+type BookRule struct {
+	Name     string   `json:"name"`
+	Field    string   `json:"field"`
+	Min      *float64 `json:"min,omitempty"`
+	Max      *float64 `json:"max,omitempty"`
+	Pattern  string   `json:"pattern,omitempty"`
+	MaxAhead string   `json:"max_ahead,omitempty"`
+	Message  string   `json:"message,omitempty"`
+}
+
+// bookRuleNumbers and bookRuleTexts read the fields rules can check.
+var (
+	bookRuleNumbers = map[string]func(Book) float64{
+		"price":      func(b Book) float64 { return b.Price.Float() },
+		"page_count": func(b Book) float64 { return float64(b.PageCount) },
+	}
+	bookRuleTexts = map[string]func(Book) string{
+		"title":       func(b Book) string { return b.Title },
+		"author_name": func(b Book) string { return b.AuthorName },
+		"genre":       func(b Book) string { return b.Genre },
+		"publisher":   func(b Book) string { return b.Publisher },
+		"description": func(b Book) string { return b.Description },
+	}
+)
+
+// compiledRule is a rule ready to be checked.
+type compiledRule struct {
+	BookRule
+	pattern  *regexp.Regexp
+	maxAhead time.Duration
+}
+
+// bookRules are the active rules, compiled from config in main.
+var bookRules []compiledRule
+
+func formatBound(v *float64) string {
+	return strconv.FormatFloat(*v, 'f', -1, 64)
+}
+
+// describe returns the violation message of the rule.
+func (r compiledRule) describe() string {
+	if r.Message != "" {
+		return r.Message
+	}
+	var limits string
+	switch {
+	case r.maxAhead > 0:
+		return "may not be more than " + r.MaxAhead + " in the future"
+	case r.pattern != nil:
+		return "must match " + r.Pattern
+	case r.Min != nil && r.Max != nil:
+		limits = "between " + formatBound(r.Min) + " and " + formatBound(r.Max)
+	case r.Min != nil:
+		limits = "at least " + formatBound(r.Min)
+	case r.Max != nil:
+		limits = "at most " + formatBound(r.Max)
+	}
+	if _, ok := bookRuleTexts[r.Field]; ok {
+		return "length must be " + limits
+	}
+	return "must be " + limits
+}
+
+// compileBookRules checks the configured rules, failing on unknown fields or bad patterns.
+func compileBookRules(rules []BookRule) ([]compiledRule, error) {
+	compiled := make([]compiledRule, 0, len(rules))
+	for _, rule := range rules {
+		c := compiledRule{BookRule: rule}
+		_, numeric := bookRuleNumbers[rule.Field]
+		_, text := bookRuleTexts[rule.Field]
+		switch {
+		case rule.Field == "publish_date":
+			d, err := parseWindow(rule.MaxAhead)
+			if err != nil {
+				return nil, errors.Wrap(err, "invalid max_ahead of rule "+rule.Name)
+			}
+			c.maxAhead = d
+		case !numeric && !text:
+			return nil, errors.New("rule " + rule.Name + " checks unknown field " + rule.Field)
+		case rule.Pattern != "" && text:
+			pattern, err := regexp.Compile(rule.Pattern)
+			if err != nil {
+				return nil, errors.Wrap(err, "invalid pattern of rule "+rule.Name)
+			}
+			c.pattern = pattern
+		case rule.Min == nil && rule.Max == nil:
+			return nil, errors.New("rule " + rule.Name + " needs min, max or pattern")
+		}
+		compiled = append(compiled, c)
+	}
+	return compiled, nil
+}
+
+// violates reports whether the book breaks the rule.
+func (r compiledRule) violates(book Book, now time.Time) bool {
+	if r.Field == "publish_date" {
+		return !book.PublishDate.IsZero() && book.PublishDate.After(now.Add(r.maxAhead))
+	}
+	var value float64
+	if number, ok := bookRuleNumbers[r.Field]; ok {
+		value = number(book)
+	} else {
+		text := bookRuleTexts[r.Field](book)
+		if r.pattern != nil {
+			return text != "" && !r.pattern.MatchString(text)
+		}
+		value = float64(utf8.RuneCountInString(text))
+	}
+	return (r.Min != nil && value < *r.Min) || (r.Max != nil && value > *r.Max)
+}
+
+// checkBookRules returns the violations of the active rules as a *ValidationError. When field
+// is set, only the rules on it are checked, for partial updates.
+func checkBookRules(book Book, field string) error {
+	var verr ValidationError
+	now := time.Now()
+	for _, rule := range bookRules {
+		if field != "" && rule.Field != field {
+			continue
+		}
+		if rule.violates(book, now) {
+			verr.Add(rule.Field, rule.describe())
+		}
+	}
+	return verr.Err()
+}
+
+// adminRules handles GET /admin/rules, the active business rules with their messages.
+func adminRules(w http.ResponseWriter, req *http.Request) {
+	if !isAdmin(req) {
+		http.Error(w, "admin token required", http.StatusUnauthorized)
+		return
+	}
+	if req.Method != "GET" {
+		msg := "Unsupported request for /admin/rules " + req.Method
+		fmt.Fprintf(w, "%s", errors.New(msg))
+		return
+	}
+	type ruleStatus struct {
+		BookRule
+		Violation string `json:"violation"`
+	}
+	statuses := make([]ruleStatus, 0, len(bookRules))
+	for _, rule := range bookRules {
+		statuses = append(statuses, ruleStatus{BookRule: rule.BookRule, Violation: rule.Field + " " + rule.describe()})
+	}
+	buf, err := json.Marshal(statuses)
+	if err != nil {
+		fmt.Fprintf(w, "%s", errors.Wrap(err, "cannot create json result of rules"))
+		return
+	}
+	fmt.Fprintf(w, "%s", buf)
+}
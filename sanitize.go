@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	errors "github.com/fiverr/go_errors"
+	"golang.org/x/text/unicode/norm"
+	"io"
+	"net/http"
+	"strings"
+	"unicode"
+)
+
+// bodyLimitExempt are route prefixes enforcing their own, larger, body limit.
+var bodyLimitExempt = []string{"/assets/"}
+
+// sanitizeText strips control characters, which have no place in catalog text and break
+// terminals, logs and CSV exports. Newlines and tabs are kept for descriptions and reviews.
+func sanitizeText(value string) string {
+	clean := true
+	for _, r := range value {
+		if unicode.IsControl(r) && r != '\n' && r != '\t' {
+			clean = false
+			break
+		}
+	}
+	if clean {
+		return value
+	}
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) && r != '\n' && r != '\t' {
+			return -1
+		}
+		return r
+	}, value)
+}
+
+// decodeStrictJSON decodes the single JSON value of a request body into v. Unknown fields and
+// trailing data are rejected, so a misspelled field fails instead of being silently ignored.
+func decodeStrictJSON(r io.Reader, v interface{}) error {
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return errors.New("unexpected data after the JSON value")
+	}
+	return nil
+}
+
+// withInputLimits caps the body of write requests at MaxBodyBytes and strips control characters
+// from their query params, before any handler reads them.
+func withInputLimits(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "GET", "HEAD", "OPTIONS":
+			next.ServeHTTP(w, req)
+			return
+		}
+		exempt := false
+		for _, prefix := range bodyLimitExempt {
+			exempt = exempt || strings.HasPrefix(req.URL.Path, prefix)
+		}
+		if config.MaxBodyBytes > 0 && !exempt {
+			req.Body = http.MaxBytesReader(w, req.Body, config.MaxBodyBytes)
+		}
+		query := req.URL.Query()
+		changed := false
+		for name, values := range query {
+			for i, value := range values {
+				if clean := sanitizeText(value); clean != value {
+					values[i], changed = clean, true
+				}
+			}
+			query[name] = values
+		}
+		if changed {
+			req.URL.RawQuery = query.Encode()
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// quoteFolds maps typographic quotes and apostrophes to their ASCII forms.
+var quoteFolds = strings.NewReplacer("‘", "'", "’", "'", "‚", "'", "‛", "'", "′", "'",
+	"“", "\"", "”", "\"", "„", "\"", "‟", "\"", "″", "\"", "«", "\"", "»", "\"")
+
+// normalizeText brings a name or title to one form before indexing, so "Café" typed with a
+// combining accent and with a precomposed é are the same value in aggregations: NFC, trimmed,
+// runs of whitespace collapsed to a space and, when configured, typographic quotes folded.
+func normalizeText(value string) string {
+	value = strings.Join(strings.Fields(norm.NFC.String(value)), " ")
+	if config.Validation.FoldQuotes {
+		value = quoteFolds.Replace(value)
+	}
+	return value
+}
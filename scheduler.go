@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	errors "github.com/fiverr/go_errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule returns the next time a job runs after t.
+type Schedule interface {
+	Next(t time.Time) time.Time
+}
+
+// everySchedule runs a job at a fixed interval, written "@every 1h".
+type everySchedule struct {
+	interval time.Duration
+}
+
+func (s everySchedule) Next(t time.Time) time.Time {
+	return t.Add(s.interval)
+}
+
+// cronSchedule runs a job on the minutes matching a five field cron expression: minute, hour,
+// day of month, month and day of week. Each field accepts *, numbers, lists, ranges and steps
+// such as */15 or 1-5.
+type cronSchedule struct {
+	fields [5]map[int]bool
+}
+
+var cronBounds = [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 6}}
+
+// maxCronSearch bounds the search for the next matching minute, for expressions such as Feb 30.
+const maxCronSearch = 366 * 24 * time.Hour
+
+func (s cronSchedule) Next(t time.Time) time.Time {
+	next := t.Truncate(time.Minute).Add(time.Minute)
+	for limit := t.Add(maxCronSearch); next.Before(limit); next = next.Add(time.Minute) {
+		if s.fields[0][next.Minute()] && s.fields[1][next.Hour()] && s.fields[2][next.Day()] &&
+			s.fields[3][int(next.Month())] && s.fields[4][int(next.Weekday())] {
+			return next
+		}
+	}
+	return time.Time{}
+}
+
+// parseCronField expands one cron field into the set of values it matches.
+func parseCronField(field string, min int, max int) (map[int]bool, error) {
+	values := make(map[int]bool)
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			parsed, err := strconv.Atoi(part[i+1:])
+			if err != nil || parsed <= 0 {
+				return nil, errors.New("invalid step in cron field " + field)
+			}
+			step, part = parsed, part[:i]
+		}
+		from, to := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if from, err = strconv.Atoi(bounds[0]); err != nil {
+				return nil, errors.New("invalid cron field " + field)
+			}
+			to = from
+			if len(bounds) == 2 {
+				if to, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, errors.New("invalid cron field " + field)
+				}
+			} else if step > 1 {
+				to = max
+			}
+		}
+		if from < min || to > max || from > to {
+			return nil, errors.New("cron field " + field + " is out of range " + strconv.Itoa(min) + "-" + strconv.Itoa(max))
+		}
+		for v := from; v <= to; v += step {
+			values[v] = true
+		}
+	}
+	return values, nil
+}
+
+// parseSchedule parses "@every <duration>", "@hourly", "@daily" or a five field cron expression.
+func parseSchedule(spec string) (Schedule, error) {
+	spec = strings.TrimSpace(spec)
+	switch {
+	case strings.HasPrefix(spec, "@every "):
+		d, err := parseWindow(strings.TrimSpace(strings.TrimPrefix(spec, "@every ")))
+		if err != nil || d <= 0 {
+			return nil, errors.New("invalid schedule " + spec)
+		}
+		return everySchedule{d}, nil
+	case spec == "@hourly":
+		spec = "0 * * * *"
+	case spec == "@daily":
+		spec = "0 0 * * *"
+	}
+	parts := strings.Fields(spec)
+	if len(parts) != 5 {
+		return nil, errors.New("schedule " + spec + " must have five cron fields")
+	}
+	var s cronSchedule
+	for i, part := range parts {
+		values, err := parseCronField(part, cronBounds[i][0], cronBounds[i][1])
+		if err != nil {
+			return nil, err
+		}
+		s.fields[i] = values
+	}
+	return s, nil
+}
+
+// scheduledTask is a recurring job the scheduler can run. defaultSchedule applies when the config
+// file does not schedule the task; runOnStart also runs it once when the service starts.
+type scheduledTask struct {
+	run             func() error
+	defaultSchedule func() string
+	runOnStart      bool
+}
+
+// everySpec is the schedule running a job every interval, 1h when the interval is invalid.
+func everySpec(interval string) string {
+	return "@every " + parseDuration(interval, time.Hour).String()
+}
+
+// scheduledTasks are the jobs known to the scheduler, by the name used in the config file.
+var scheduledTasks = map[string]scheduledTask{
+	"exchange_rates": {
+		run:             refreshExchangeRates,
+		defaultSchedule: func() string { return everySpec(config.ExchangeRates.RefreshInterval) },
+		runOnStart:      true,
+	},
+	"activity_cleanup": {
+		run:             func() error { return activities.Cleanup() },
+		defaultSchedule: func() string { return everySpec(config.Activity.CleanupInterval) },
+	},
+	"cache_consistency": {
+		run:             repairCacheDrift,
+		defaultSchedule: func() string { return "@hourly" },
+	},
+	"stats_snapshot": {
+		run:             snapshotStoreStats,
+		defaultSchedule: func() string { return "@daily" },
+	},
+	"backup": {
+		run: runBackup,
+		defaultSchedule: func() string {
+			if !config.Backups.Enabled {
+				return "off"
+			}
+			return "@daily"
+		},
+	},
+}
+
+// startScheduler runs every known task on its configured schedule. Each task shows up in
+// /admin/workers, where it can be paused; a schedule of "off" disables a task.
+func startScheduler() error {
+	for name, task := range scheduledTasks {
+		spec, ok := config.Scheduler.Jobs[name]
+		if !ok {
+			spec = task.defaultSchedule()
+		}
+		if spec == "off" {
+			continue
+		}
+		schedule, err := parseSchedule(spec)
+		if err != nil {
+			return errors.Wrap(err, "cannot schedule job "+name)
+		}
+		go runScheduled(registerWorker(name, nil), schedule, task)
+	}
+	return nil
+}
+
+func runScheduled(worker *Worker, schedule Schedule, task scheduledTask) {
+	run := func() {
+		worker.WaitWhilePaused()
+		err := task.run()
+		if err != nil {
+			fmt.Println(err)
+		}
+		worker.Done(err)
+	}
+	if task.runOnStart {
+		run()
+	}
+	for {
+		next := schedule.Next(time.Now())
+		if next.IsZero() {
+			fmt.Println(errors.New("job " + worker.name + " has no upcoming run"))
+			return
+		}
+		time.Sleep(time.Until(next))
+		run()
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	errors "github.com/fiverr/go_errors"
+	"gopkg.in/redis.v5"
+	"net/http"
+)
+
+// SavedSearch is a named search definition stored per user in Redis.
+type SavedSearch struct {
+	Query      string `json:"q,omitempty"`
+	Title      string `json:"title,omitempty"`
+	AuthorName string `json:"author_name,omitempty"`
+	PriceRange string `json:"price_range,omitempty"`
+}
+
+func savedSearchesKey(userID string) string {
+	return "searches:" + userID
+}
+
+func saveSearch(client *redis.Client, userID string, name string, search SavedSearch) (string, error) {
+	if _, err := parsePriceRange(search.PriceRange); err != nil {
+		return "", err
+	}
+	buf, err := json.Marshal(search)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot create json saved search")
+	}
+	if err = client.HSet(savedSearchesKey(userID), name, string(buf)).Err(); err != nil {
+		return "", errors.Wrap(err, "cannot set key in Redis")
+	}
+	return fmt.Sprintf("Saved search %q for user %s\n", name, userID), nil
+}
+
+func getSavedSearch(client *redis.Client, userID string, name string) (SavedSearch, error) {
+	var search SavedSearch
+	value, err := client.HGet(savedSearchesKey(userID), name).Result()
+	if err == redis.Nil {
+		return search, errors.New("no saved search named " + name)
+	}
+	if err != nil {
+		return search, errors.Wrap(err, "cannot get key from Redis")
+	}
+	if err = json.Unmarshal([]byte(value), &search); err != nil {
+		return search, errors.Wrap(err, "cannot decode saved search")
+	}
+	return search, nil
+}
+
+func listSavedSearches(client *redis.Client, userID string) (string, error) {
+	values, err := client.HGetAll(savedSearchesKey(userID)).Result()
+	if err != nil {
+		return "", errors.Wrap(err, "cannot get key from Redis")
+	}
+	searches := make(map[string]json.RawMessage, len(values))
+	for name, value := range values {
+		searches[name] = json.RawMessage(value)
+	}
+	buf, err := json.Marshal(searches)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot create json result of saved searches")
+	}
+	return string(buf), nil
+}
+
+func deleteSavedSearch(client *redis.Client, userID string, name string) (string, error) {
+	deleted, err := client.HDel(savedSearchesKey(userID), name).Result()
+	if err != nil {
+		return "", errors.Wrap(err, "cannot delete key in Redis")
+	}
+	if deleted == 0 {
+		return "", nil
+	}
+	return fmt.Sprintf("Deleted saved search %q for user %s\n", name, userID), nil
+}
+
+// runSavedSearch executes the named saved search against the book repository.
+func runSavedSearch(client *redis.Client, userID string, name string, displayCurrency string) (string, error) {
+	search, err := getSavedSearch(client, userID, name)
+	if err != nil {
+		return "", err
+	}
+	r, err := parsePriceRange(search.PriceRange)
+	if err != nil {
+		return "", err
+	}
+	result, _, _, err := searchBook(SearchParams{Query: search.Query, Title: search.Title, AuthorName: search.AuthorName, PriceRange: r,
+		DisplayCurrency: displayCurrency, Tenant: idTenant(userID)})
+	if err == errResponseTruncated {
+		err = nil
+	}
+	return result, err
+}
+
+// savedSearches handles /users/{id}/searches[/{name}[/run]].
+func savedSearches(w http.ResponseWriter, req *http.Request, userID string, rest []string) {
+	var err error
+	var result string
+	client, err := connectRedis()
+	if err != nil {
+		err = errors.Wrap(err, "cannot connect to Redis")
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	defer client.Close()
+	switch {
+	case len(rest) == 0 && req.Method == "GET":
+		result, err = listSavedSearches(client, userID)
+	case len(rest) == 1 && req.Method == "GET":
+		var search SavedSearch
+		search, err = getSavedSearch(client, userID, rest[0])
+		if err == nil {
+			buf, _ := json.Marshal(search)
+			result = string(buf)
+		}
+	case len(rest) == 1 && req.Method == "PUT":
+		search := SavedSearch{
+			Query:      getParamValue(req, "q"),
+			Title:      getParamValue(req, "title"),
+			AuthorName: getParamValue(req, "author_name"),
+			PriceRange: getParamValue(req, "price_range"),
+		}
+		result, err = saveSearch(client, userID, rest[0], search)
+	case len(rest) == 1 && req.Method == "DELETE":
+		result, err = deleteSavedSearch(client, userID, rest[0])
+	case len(rest) == 2 && rest[1] == "run" && req.Method == "GET":
+		result, err = runSavedSearch(client, userID, rest[0], getParamValue(req, "display_currency"))
+	default:
+		msg := "Unsupported request for " + req.URL.Path + " " + req.Method
+		err = errors.New(msg)
+	}
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+	} else {
+		fmt.Fprintf(w, "%s", result)
+	}
+}
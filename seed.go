@@ -0,0 +1,147 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	errors "github.com/fiverr/go_errors"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const maxSyntheticBooks = 100000
+
+// seedBooks is the bundled sample catalog, priced in the base currency.
+//
+//go:embed seed/books.json
+var seedBooks []byte
+
+// seedRecord is a sample book with its id.
+type seedRecord struct {
+	ID string `json:"id"`
+	Book
+}
+
+var (
+	syntheticAdjectives = []string{"Silent", "Burning", "Hidden", "Last", "Golden", "Broken", "Distant", "Forgotten", "Crimson", "Endless"}
+	syntheticNouns      = []string{"River", "Garden", "Empire", "Winter", "Harbor", "Mirror", "Forest", "Letter", "Island", "Machine"}
+	syntheticFirstNames = []string{"Ada", "Ben", "Clara", "David", "Elena", "Felix", "Grace", "Hugo", "Iris", "Jonas"}
+	syntheticLastNames  = []string{"Adler", "Brooks", "Castell", "Doyle", "Ellis", "Fontaine", "Greer", "Hale", "Ibarra", "Jensen"}
+	syntheticGenres     = []string{"Fiction", "Fantasy", "Mystery", "Romance", "Science fiction", "Historical", "Thriller", "Horror"}
+	syntheticPublishers = []string{"Northwind Press", "Harbor House", "Blue Lantern", "Meridian Books", "Oakleaf"}
+	syntheticLanguages  = []string{"en", "en", "en", "fr", "de", "es"}
+)
+
+// syntheticBooks generates n books, the same ones for the same seed so demos are reproducible.
+func syntheticBooks(n int, seed int64) []seedRecord {
+	r := rand.New(rand.NewSource(seed))
+	pick := func(values []string) string {
+		return values[r.Intn(len(values))]
+	}
+	records := make([]seedRecord, 0, n)
+	for i := 0; i < n; i++ {
+		formats := []string{"paperback"}
+		if r.Intn(2) == 0 {
+			formats = append(formats, "ebook")
+		}
+		if r.Intn(4) == 0 {
+			formats = append(formats, "hardcover")
+		}
+		title := "The " + pick(syntheticAdjectives) + " " + pick(syntheticNouns)
+		genre := pick(syntheticGenres)
+		book := Book{
+			Title:          title,
+			AuthorName:     pick(syntheticFirstNames) + " " + pick(syntheticLastNames),
+			Price:          Price(299 + r.Intn(3700)),
+			EbookAvailable: hasFormat(formats, "ebook"),
+			Formats:        formats,
+			PublishDate:    time.Date(1950+r.Intn(75), time.Month(1+r.Intn(12)), 1+r.Intn(28), 0, 0, 0, 0, time.UTC),
+			Genre:          genre,
+			Publisher:      pick(syntheticPublishers),
+			Description:    "A " + strings.ToLower(genre) + " novel: " + title + ".",
+			PageCount:      80 + r.Intn(900),
+			Language:       pick(syntheticLanguages),
+		}
+		records = append(records, seedRecord{ID: "synthetic-" + strconv.Itoa(i+1), Book: book})
+	}
+	return records
+}
+
+// loadSeed writes the bundled sample books and n synthetic ones straight to the repository,
+// skipping the outbox so fixtures do not notify followers or alert users. It returns the number
+// of books written.
+func loadSeed(n int, seed int64) (int, error) {
+	var records []seedRecord
+	if err := json.Unmarshal(seedBooks, &records); err != nil {
+		return 0, errors.Wrap(err, "cannot decode the bundled sample books")
+	}
+	records = append(records, syntheticBooks(n, seed)...)
+	base := strings.ToUpper(config.ExchangeRates.BaseCurrency)
+	now := time.Now().UTC()
+	for i, record := range records {
+		book := record.Book
+		book.Currency, book.BasePrice, book.IndexedAt = base, book.Price, now
+		if book.WorkID == "" {
+			book.WorkID = record.ID
+		}
+		if _, err := addBook(record.ID, book); err != nil {
+			return i, errors.Wrap(err, "cannot seed book "+record.ID)
+		}
+	}
+	if err := appendOutbox(OutboxEvent{Type: "imported"}); err != nil {
+		fmt.Println(err)
+	}
+	return len(records), nil
+}
+
+// parseSyntheticCount validates the number of synthetic books to generate.
+func parseSyntheticCount(value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 || n > maxSyntheticBooks {
+		return 0, errors.New("synthetic must be an integer between 0 and " + strconv.Itoa(maxSyntheticBooks))
+	}
+	return n, nil
+}
+
+// adminSeed handles POST /admin/seed?synthetic=&seed=, loading the bundled sample books and
+// optionally synthetic ones, generated from seed, so new environments start non-empty.
+func adminSeed(w http.ResponseWriter, req *http.Request) {
+	if !isAdmin(req) {
+		http.Error(w, "admin token required", http.StatusUnauthorized)
+		return
+	}
+	if req.Method != "POST" {
+		msg := "Unsupported request for /admin/seed " + req.Method
+		fmt.Fprintf(w, "%s", errors.New(msg))
+		return
+	}
+	n, err := parseSyntheticCount(getParamValue(req, "synthetic"))
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	seed := int64(1)
+	if value := getParamValue(req, "seed"); value != "" {
+		if seed, err = strconv.ParseInt(value, 10, 64); err != nil {
+			fmt.Fprintf(w, "%s", errors.New("seed must be an integer"))
+			return
+		}
+	}
+	written, err := loadSeed(n, seed)
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	buf, err := json.Marshal(map[string]int{"books": written})
+	if err != nil {
+		fmt.Fprintf(w, "%s", errors.Wrap(err, "cannot create json result of seed"))
+		return
+	}
+	fmt.Fprintf(w, "%s", buf)
+}
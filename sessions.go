@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	errors "github.com/fiverr/go_errors"
+	"gopkg.in/redis.v5"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	sessionCookie = "session"
+	sessionHeader = "X-Session-Token"
+)
+
+// Session is a signed-in user of a tenant, stored in Redis under the hash of its token.
+type Session struct {
+	UserID    string    `json:"user_id"`
+	Tenant    string    `json:"tenant,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func sessionKey(tokenHash string) string {
+	return "session:" + tokenHash
+}
+
+// sessionToken returns the session token sent in the header or the session cookie.
+func sessionToken(req *http.Request) string {
+	if token := req.Header.Get(sessionHeader); token != "" {
+		return token
+	}
+	if cookie, err := req.Cookie(sessionCookie); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+// lookupSession returns the session of the token, or nil when it is unknown or expired. Each
+// lookup extends the session by the configured TTL.
+func lookupSession(client *redis.Client, token string) (*Session, error) {
+	key := sessionKey(hashSecret(token))
+	value, err := client.Get(key).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot get key from Redis")
+	}
+	var session Session
+	if err = json.Unmarshal([]byte(value), &session); err != nil {
+		return nil, errors.Wrap(err, "cannot decode the session")
+	}
+	client.Expire(key, parseDuration(config.Sessions.TTL, 24*time.Hour))
+	return &session, nil
+}
+
+// requestSession returns the session of the request, or nil when there is none.
+func requestSession(req *http.Request) *Session {
+	token := sessionToken(req)
+	if token == "" {
+		return nil
+	}
+	session, err := lookupSession(sharedRedis(), token)
+	if err != nil {
+		return nil
+	}
+	return session
+}
+
+// sessionUserID returns the user of the request's session scoped to its tenant, or "" when there
+// is none.
+func sessionUserID(req *http.Request) string {
+	session := requestSession(req)
+	if session == nil {
+		return ""
+	}
+	return tenantID(session.Tenant, session.UserID)
+}
+
+// usersPathID returns the {id} of a /users/{id}/... path, or "" for other paths.
+func usersPathID(path string) string {
+	if !strings.HasPrefix(path, "/users/") {
+		return ""
+	}
+	return strings.SplitN(strings.TrimPrefix(path, "/users/"), "/", 2)[0]
+}
+
+// withSession attributes requests to the user of their session by replacing the user_id param
+// with the session's user. When sessions are required, a user_id param sent without a session
+// is dropped rather than trusted. A session only reaches the /users/{id} routes of its own user,
+// and when sessions are required those routes also need the user's API key or the admin token
+// in its absence.
+func withSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		userID := sessionUserID(req)
+		if pathUser := tenantID(requestTenant(req), usersPathID(req.URL.Path)); pathUser != "" {
+			if config.Sessions.Required {
+				if !authorizeUser(w, req, pathUser) {
+					return
+				}
+			} else if userID != "" && userID != pathUser && !isAdmin(req) {
+				http.Error(w, "session cannot access user "+pathUser, http.StatusForbidden)
+				return
+			}
+		}
+		if userID != "" || config.Sessions.Required {
+			query := req.URL.Query()
+			if userID != "" {
+				query.Set("user_id", userID)
+			} else {
+				query.Del("user_id")
+			}
+			req.URL.RawQuery = query.Encode()
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// createSession signs the user of the tenant in, returning the new session token.
+func createSession(client *redis.Client, userID string, tenant string) (string, error) {
+	token, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	buf, err := json.Marshal(Session{UserID: userID, Tenant: tenant, CreatedAt: time.Now().UTC()})
+	if err != nil {
+		return "", errors.Wrap(err, "cannot create json session")
+	}
+	ttl := parseDuration(config.Sessions.TTL, 24*time.Hour)
+	if err = client.Set(sessionKey(hashSecret(token)), string(buf), ttl).Err(); err != nil {
+		return "", errors.Wrap(err, "cannot set key in Redis")
+	}
+	return token, nil
+}
+
+// sessions handles /sessions: POST signs in with an API key, or with the admin token and a
+// user_id param of the X-Tenant tenant, and returns a session token also set as a cookie. GET
+// returns the current session's user and DELETE signs out.
+func sessions(w http.ResponseWriter, req *http.Request) {
+	var err error
+	var result string
+	client := sharedRedis()
+	switch req.Method {
+	case "POST":
+		var userID, tenant string
+		if isAdmin(req) {
+			userID, tenant = getParamValue(req, "user_id"), requestTenant(req)
+		} else if key, keyErr := authenticateAPIKey(client, req); keyErr == nil && key != nil {
+			userID, tenant = key.UserID, key.Tenant
+		}
+		if userID == "" {
+			http.Error(w, "an API key, or the admin token and user_id, is required", http.StatusUnauthorized)
+			return
+		}
+		var token string
+		if token, err = createSession(client, userID, tenant); err != nil {
+			break
+		}
+		ttl := parseDuration(config.Sessions.TTL, 24*time.Hour)
+		http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: token, Path: "/", MaxAge: int(ttl.Seconds()),
+			HttpOnly: true, Secure: req.TLS != nil, SameSite: http.SameSiteLaxMode})
+		var buf []byte
+		buf, err = json.Marshal(map[string]interface{}{"token": token, "user_id": userID, "expires_in": int(ttl.Seconds())})
+		result = string(buf)
+	case "GET":
+		var session *Session
+		if session, err = lookupSession(client, sessionToken(req)); err == nil && session == nil {
+			http.Error(w, "no valid session", http.StatusUnauthorized)
+			return
+		}
+		if err == nil {
+			var buf []byte
+			buf, err = json.Marshal(session)
+			result = string(buf)
+		}
+	case "DELETE":
+		if token := sessionToken(req); token != "" {
+			if err = client.Del(sessionKey(hashSecret(token))).Err(); err != nil {
+				err = errors.Wrap(err, "cannot delete key in Redis")
+				break
+			}
+		}
+		http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: "", Path: "/", MaxAge: -1})
+		result = "Signed out\n"
+	default:
+		msg := "Unsupported request for /sessions " + req.Method
+		err = errors.New(msg)
+	}
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+	} else {
+		fmt.Fprintf(w, "%s", result)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	errors "github.com/fiverr/go_errors"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// storeSnapshotsKey is a hash of date (2006-01-02) to the /store stats of that day.
+const storeSnapshotsKey = "store_snapshots"
+
+// tenantSnapshotsKey is the storeSnapshotsKey of a tenant's catalog.
+func tenantSnapshotsKey(tenant string) string {
+	return tenantID(tenant, storeSnapshotsKey)
+}
+
+// StoreSnapshot is the /store stats as computed on a date, in the base currency.
+type StoreSnapshot struct {
+	Date  string          `json:"date"`
+	Stats json.RawMessage `json:"stats"`
+}
+
+// snapshotStoreStats stores today's /store stats of the default catalog and of every tenant's,
+// replacing an earlier snapshot of the same day.
+func snapshotStoreStats() error {
+	redisClient, err := connectRedis()
+	if err != nil {
+		return errors.Wrap(err, "cannot connect to Redis")
+	}
+	defer redisClient.Close()
+	date := time.Now().UTC().Format("2006-01-02")
+	for _, tenant := range append([]string{""}, config.Tenants...) {
+		stats, err := storeBook(strings.ToUpper(config.ExchangeRates.BaseCurrency), tenant)
+		if err != nil {
+			return err
+		}
+		if stats == "" {
+			continue
+		}
+		if err = redisClient.HSet(tenantSnapshotsKey(tenant), date, stats).Err(); err != nil {
+			return errors.Wrap(err, "cannot set key in Redis")
+		}
+	}
+	return nil
+}
+
+// storeHistory handles GET /store/history?from=&to=, the daily /store snapshots of the tenant's
+// catalog between the two dates, oldest first.
+func storeHistory(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		msg := "Unsupported request for /store/history " + req.Method
+		fmt.Fprintf(w, "%s", errors.New(msg))
+		return
+	}
+	from, to := getParamValue(req, "from"), getParamValue(req, "to")
+	for _, date := range []string{from, to} {
+		if _, err := time.Parse("2006-01-02", date); date != "" && err != nil {
+			fmt.Fprintf(w, "%s", errors.New("from and to must be dates such as 2006-01-02"))
+			return
+		}
+	}
+	client, err := connectRedis()
+	if err != nil {
+		fmt.Fprintf(w, "%s", errors.Wrap(err, "cannot connect to Redis"))
+		return
+	}
+	defer client.Close()
+	all, err := client.HGetAll(tenantSnapshotsKey(requestTenant(req))).Result()
+	if err != nil {
+		fmt.Fprintf(w, "%s", errors.Wrap(err, "cannot get key from Redis"))
+		return
+	}
+	snapshots := make([]StoreSnapshot, 0, len(all))
+	for date, stats := range all {
+		// dates in this format order the same as strings
+		if (from != "" && date < from) || (to != "" && date > to) {
+			continue
+		}
+		snapshots = append(snapshots, StoreSnapshot{Date: date, Stats: json.RawMessage(stats)})
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Date < snapshots[j].Date })
+	buf, err := json.Marshal(snapshots)
+	if err != nil {
+		fmt.Fprintf(w, "%s", errors.Wrap(err, "cannot create json result of store history"))
+		return
+	}
+	fmt.Fprintf(w, "%s", buf)
+}
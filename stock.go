@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	errors "github.com/fiverr/go_errors"
+	"gopkg.in/redis.v5"
+	"net/http"
+	"strconv"
+)
+
+// stockKey holds the copies of a book left for sale. Books without the key are not stock tracked
+// and can always be ordered.
+func stockKey(bookID string) string {
+	return "stock:" + bookID
+}
+
+// reserveStockScript decrements the stock of every tracked book, or of none when one of them has
+// fewer copies than requested, in which case it returns the 1-based index of that book.
+const reserveStockScript = `
+for i, key in ipairs(KEYS) do
+	local stock = redis.call('GET', key)
+	if stock and tonumber(stock) < tonumber(ARGV[i]) then
+		return i
+	end
+end
+for i, key in ipairs(KEYS) do
+	if redis.call('EXISTS', key) == 1 then
+		redis.call('DECRBY', key, ARGV[i])
+	end
+end
+return 0`
+
+// reserveStock atomically takes the ordered quantities out of stock.
+func reserveStock(client *redis.Client, items []OrderItem) error {
+	keys := make([]string, 0, len(items))
+	args := make([]interface{}, 0, len(items))
+	for _, item := range items {
+		keys = append(keys, stockKey(item.BookID))
+		args = append(args, item.Quantity)
+	}
+	short, err := client.Eval(reserveStockScript, keys, args...).Int64()
+	if err != nil {
+		return errors.Wrap(err, "cannot reserve stock in Redis")
+	}
+	if short > 0 {
+		return errors.New("not enough copies of book " + items[short-1].BookID + " in stock")
+	}
+	return nil
+}
+
+// releaseStock puts the quantities of an order that could not be placed back in stock.
+func releaseStock(client *redis.Client, items []OrderItem) {
+	for _, item := range items {
+		// only tracked books were decremented
+		if client.Exists(stockKey(item.BookID)).Val() {
+			if err := client.IncrBy(stockKey(item.BookID), item.Quantity).Err(); err != nil {
+				fmt.Println(errors.Wrap(err, "cannot release stock of book "+item.BookID))
+			}
+		}
+	}
+}
+
+// adminStock handles /admin/stock?book_id=: GET returns the copies left, PUT &quantity= sets
+// them and DELETE stops tracking the stock of the book.
+func adminStock(w http.ResponseWriter, req *http.Request) {
+	if !isAdmin(req) {
+		http.Error(w, "admin token required", http.StatusUnauthorized)
+		return
+	}
+	var err error
+	var result string
+	bookID := tenantParam(req, "book_id")
+	if bookID == "" {
+		fmt.Fprintf(w, "%s", errors.New("book_id is required"))
+		return
+	}
+	client, err := connectRedis()
+	if err != nil {
+		err = errors.Wrap(err, "cannot connect to Redis")
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	defer client.Close()
+	switch req.Method {
+	case "GET":
+		var quantity string
+		quantity, err = client.Get(stockKey(bookID)).Result()
+		if err == redis.Nil {
+			err = nil
+			quantity = "untracked"
+		} else if err != nil {
+			err = errors.Wrap(err, "cannot get key from Redis")
+		}
+		result = fmt.Sprintf("Stock of book %s: %s\n", bookID, quantity)
+	case "PUT":
+		var quantity int64
+		quantity, err = strconv.ParseInt(getParamValue(req, "quantity"), 10, 64)
+		if err != nil || quantity < 0 {
+			err = errors.New("quantity must be a non-negative integer")
+			break
+		}
+		if err = client.Set(stockKey(bookID), quantity, 0).Err(); err != nil {
+			err = errors.Wrap(err, "cannot set key in Redis")
+			break
+		}
+		result = fmt.Sprintf("Stock of book %s set to %d\n", bookID, quantity)
+	case "DELETE":
+		if err = client.Del(stockKey(bookID)).Err(); err != nil {
+			err = errors.Wrap(err, "cannot delete key in Redis")
+			break
+		}
+		result = fmt.Sprintf("Stock of book %s is no longer tracked\n", bookID)
+	default:
+		msg := "Unsupported request for /admin/stock " + req.Method
+		err = errors.New(msg)
+	}
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+	} else {
+		fmt.Fprintf(w, "%s", result)
+	}
+}
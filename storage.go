@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"cloud.google.com/go/storage"
+	"context"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	errors "github.com/fiverr/go_errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// Blob is a stored binary artifact opened for reading.
+type Blob struct {
+	Content     io.ReadSeeker
+	Size        int64
+	ModTime     time.Time
+	ContentType string
+	closer      io.Closer
+}
+
+// Close releases the resources held by the blob.
+func (b *Blob) Close() error {
+	if b.closer == nil {
+		return nil
+	}
+	return b.closer.Close()
+}
+
+// BlobStore stores binary artifacts such as covers, exports and invoices by name.
+type BlobStore interface {
+	Put(ctx context.Context, name string, r io.Reader, contentType string) error
+	Get(ctx context.Context, name string) (*Blob, error)
+	Delete(ctx context.Context, name string) error
+}
+
+var errBlobNotFound = errors.New("blob not found")
+
+// blobs is the store selected by config, set up in main.
+var blobs BlobStore
+
+// newBlobStore creates the storage backend selected by config.
+func newBlobStore(ctx context.Context, c StorageConfig) (BlobStore, error) {
+	switch c.Backend {
+	case "", "local":
+		return &localBlobStore{dir: c.Dir}, nil
+	case "s3":
+		sess, err := session.NewSession(&aws.Config{
+			Region:           aws.String(c.Region),
+			Endpoint:         aws.String(c.Endpoint),
+			S3ForcePathStyle: aws.Bool(c.Endpoint != ""),
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot create S3 session")
+		}
+		return &s3BlobStore{client: s3.New(sess), uploader: s3manager.NewUploader(sess), bucket: c.Bucket, prefix: c.Prefix}, nil
+	case "gcs":
+		client, err := storage.NewClient(ctx)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot create GCS client")
+		}
+		return &gcsBlobStore{bucket: client.Bucket(c.Bucket), prefix: c.Prefix}, nil
+	default:
+		return nil, errors.New("unknown storage backend " + c.Backend)
+	}
+}
+
+// localBlobStore keeps blobs as files below a directory.
+type localBlobStore struct {
+	dir string
+}
+
+func (s *localBlobStore) path(name string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(path.Clean("/"+name)))
+}
+
+func (s *localBlobStore) Put(ctx context.Context, name string, r io.Reader, contentType string) error {
+	p := s.path(name)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return errors.Wrap(err, "cannot create blob directory")
+	}
+	f, err := ioutil.TempFile(filepath.Dir(p), ".upload-")
+	if err != nil {
+		return errors.Wrap(err, "cannot create blob file")
+	}
+	if _, err = io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return errors.Wrap(err, "cannot write blob file")
+	}
+	if err = f.Close(); err != nil {
+		os.Remove(f.Name())
+		return errors.Wrap(err, "cannot write blob file")
+	}
+	// rename so readers never see a partially written file
+	if err = os.Rename(f.Name(), p); err != nil {
+		return errors.Wrap(err, "cannot write blob file")
+	}
+	return nil
+}
+
+func (s *localBlobStore) Get(ctx context.Context, name string) (*Blob, error) {
+	f, err := os.Open(s.path(name))
+	if os.IsNotExist(err) {
+		return nil, errBlobNotFound
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot open blob file")
+	}
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		f.Close()
+		return nil, errBlobNotFound
+	}
+	return &Blob{Content: f, Size: info.Size(), ModTime: info.ModTime(), closer: f}, nil
+}
+
+func (s *localBlobStore) Delete(ctx context.Context, name string) error {
+	err := os.Remove(s.path(name))
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "cannot delete blob file")
+	}
+	return nil
+}
+
+// s3BlobStore keeps blobs in an S3 (or S3-compatible) bucket.
+type s3BlobStore struct {
+	client   *s3.S3
+	uploader *s3manager.Uploader
+	bucket   string
+	prefix   string
+}
+
+func (s *s3BlobStore) Put(ctx context.Context, name string, r io.Reader, contentType string) error {
+	_, err := s.uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(s.prefix + name),
+		Body:        r,
+		ContentType: aws.String(contentType),
+	})
+	if err != nil {
+		return errors.Wrap(err, "cannot upload blob to S3")
+	}
+	return nil
+}
+
+func (s *s3BlobStore) Get(ctx context.Context, name string) (*Blob, error) {
+	out, err := s.client.GetObjectWithContext(ctx, &s3.GetObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(s.prefix + name)})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+		return nil, errBlobNotFound
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot get blob from S3")
+	}
+	defer out.Body.Close()
+	buf, err := ioutil.ReadAll(out.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot read blob from S3")
+	}
+	return &Blob{Content: bytes.NewReader(buf), Size: int64(len(buf)), ModTime: aws.TimeValue(out.LastModified), ContentType: aws.StringValue(out.ContentType)}, nil
+}
+
+func (s *s3BlobStore) Delete(ctx context.Context, name string) error {
+	_, err := s.client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(s.prefix + name)})
+	if err != nil {
+		return errors.Wrap(err, "cannot delete blob from S3")
+	}
+	return nil
+}
+
+// gcsBlobStore keeps blobs in a Google Cloud Storage bucket.
+type gcsBlobStore struct {
+	bucket *storage.BucketHandle
+	prefix string
+}
+
+func (s *gcsBlobStore) Put(ctx context.Context, name string, r io.Reader, contentType string) error {
+	w := s.bucket.Object(s.prefix + name).NewWriter(ctx)
+	w.ContentType = contentType
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return errors.Wrap(err, "cannot upload blob to GCS")
+	}
+	if err := w.Close(); err != nil {
+		return errors.Wrap(err, "cannot upload blob to GCS")
+	}
+	return nil
+}
+
+func (s *gcsBlobStore) Get(ctx context.Context, name string) (*Blob, error) {
+	obj := s.bucket.Object(s.prefix + name)
+	attrs, err := obj.Attrs(ctx)
+	if err == storage.ErrObjectNotExist {
+		return nil, errBlobNotFound
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot get blob from GCS")
+	}
+	r, err := obj.NewReader(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot get blob from GCS")
+	}
+	defer r.Close()
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot read blob from GCS")
+	}
+	return &Blob{Content: bytes.NewReader(buf), Size: int64(len(buf)), ModTime: attrs.Updated, ContentType: attrs.ContentType}, nil
+}
+
+func (s *gcsBlobStore) Delete(ctx context.Context, name string) error {
+	err := s.bucket.Object(s.prefix + name).Delete(ctx)
+	if err != nil && err != storage.ErrObjectNotExist {
+		return errors.Wrap(err, "cannot delete blob from GCS")
+	}
+	return nil
+}
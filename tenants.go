@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// tenantHeader selects the catalog a request is served from. Only admin requests may pick it
+// freely: API keys and sessions of a tenant always use their own, and the others the default.
+const tenantHeader = "X-Tenant"
+
+// tenantContextKey holds the tenant resolved by withTenant in the request context.
+type tenantContextKey struct{}
+
+// knownTenant reports whether tenant is one of the configured tenants.
+func knownTenant(tenant string) bool {
+	for _, t := range config.Tenants {
+		if t == tenant {
+			return true
+		}
+	}
+	return false
+}
+
+// headerTenant returns the tenant named by the request's X-Tenant header, lower cased.
+func headerTenant(req *http.Request) string {
+	return strings.ToLower(strings.TrimSpace(req.Header.Get(tenantHeader)))
+}
+
+// requestTenant returns the tenant the request is served for, "" for the default catalog.
+func requestTenant(req *http.Request) string {
+	if tenant, ok := req.Context().Value(tenantContextKey{}).(string); ok {
+		return tenant
+	}
+	// requests that did not go through withTenant, such as gRPC, only trust the admin
+	if tenant := headerTenant(req); isAdmin(req) && knownTenant(tenant) {
+		return tenant
+	}
+	return ""
+}
+
+// tenantID scopes a book, user or author id to the tenant, so tenants sharing the indexes and
+// Redis never see each other's books, views or activity. Ids of the default catalog are left as
+// they are, and ids already scoped to the tenant are returned unchanged.
+func tenantID(tenant string, id string) string {
+	if tenant == "" || id == "" || strings.HasPrefix(id, tenant+":") {
+		return id
+	}
+	return tenant + ":" + id
+}
+
+// tenantParam returns the id param scoped to the request's tenant.
+func tenantParam(req *http.Request, name string) string {
+	return tenantID(requestTenant(req), getParamValue(req, name))
+}
+
+// idTenant returns the tenant an id is scoped to, "" for ids of the default catalog.
+func idTenant(id string) string {
+	if i := strings.Index(id, ":"); i > 0 && knownTenant(id[:i]) {
+		return id[:i]
+	}
+	return ""
+}
+
+// tenantOwns reports whether the id belongs to the tenant's catalog.
+func tenantOwns(tenant string, id string) bool {
+	return idTenant(id) == tenant
+}
+
+// namesTenantID reports whether a path segment or an id param of the request, such as id, user_id
+// or the comma separated duplicate_ids, is an id scoped to a tenant, which requests of the
+// default catalog must not reach.
+func namesTenantID(req *http.Request) bool {
+	for _, segment := range strings.Split(req.URL.Path, "/") {
+		if idTenant(segment) != "" {
+			return true
+		}
+	}
+	for name, values := range req.URL.Query() {
+		if name != "id" && !strings.HasSuffix(name, "_id") && !strings.HasSuffix(name, "_ids") {
+			continue
+		}
+		for _, value := range values {
+			for _, id := range strings.Split(value, ",") {
+				if idTenant(strings.TrimSpace(id)) != "" {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// withTenant resolves the tenant of the request: the tenant of its API key, else of its session,
+// else the X-Tenant header for admin requests. A header naming an unknown tenant is rejected,
+// and so is one naming another tenant than the resolved one, rather than serving the default
+// catalog. Requests of the default catalog cannot name the ids of a tenant.
+func withTenant(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		header := headerTenant(req)
+		if header != "" && !knownTenant(header) {
+			http.Error(w, "unknown tenant "+header, http.StatusBadRequest)
+			return
+		}
+		tenant := ""
+		if secret := req.Header.Get(apiKeyHeader); secret != "" {
+			if key, err := lookupAPIKey(sharedRedis(), hashSecret(secret)); err == nil {
+				tenant = key.Tenant
+			}
+		} else if session := requestSession(req); session != nil {
+			tenant = session.Tenant
+		} else if isAdmin(req) {
+			tenant = header
+		}
+		if header != "" && header != tenant {
+			http.Error(w, "tenant "+header+" requires one of its API keys or sessions, or the admin token", http.StatusForbidden)
+			return
+		}
+		if tenant == "" && namesTenantID(req) {
+			http.Error(w, "ids of a tenant require one of its API keys or sessions", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), tenantContextKey{}, tenant)))
+	})
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/orensul/book_service/bookservicepb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gopkg.in/olivere/elastic.v5"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// useTenants serves the test from the memory repository with the acme and globex tenants, each
+// with a book of id 1 next to the default catalog's.
+func useTenants(t *testing.T) {
+	t.Helper()
+	useMemoryRepository(t)
+	config.Tenants = []string{"acme", "globex"}
+	putTestBook(t, "1", Book{Title: "Ulysses", AuthorName: "James Joyce", Price: priceFromFloat(10)})
+	putTestBook(t, "acme:1", Book{Title: "Dune", AuthorName: "Frank Herbert", Price: priceFromFloat(20), Tenant: "acme"})
+	putTestBook(t, "globex:1", Book{Title: "Emma", AuthorName: "Jane Austen", Price: priceFromFloat(30), Tenant: "globex"})
+}
+
+// asTenant returns the headers of an admin request for the tenant's catalog.
+func asTenant(tenant string) map[string]string {
+	return map[string]string{adminTokenHdr: testAdminToken, tenantHeader: tenant}
+}
+
+func TestTenantID(t *testing.T) {
+	useTenants(t)
+	tests := []struct {
+		tenant, id, want string
+	}{
+		{"", "1", "1"},
+		{"acme", "1", "acme:1"},
+		{"acme", "acme:1", "acme:1"},
+		{"acme", "globex:1", "acme:globex:1"},
+		{"acme", "", ""},
+	}
+	for _, test := range tests {
+		if got := tenantID(test.tenant, test.id); got != test.want {
+			t.Errorf("tenantID(%q, %q) = %q, want %q", test.tenant, test.id, got, test.want)
+		}
+	}
+	for id, want := range map[string]string{"1": "", "acme:1": "acme", "globex:acme:1": "globex", "other:1": ""} {
+		if got := idTenant(id); got != want {
+			t.Errorf("idTenant(%q) = %q, want %q", id, got, want)
+		}
+	}
+}
+
+func TestWithTenant(t *testing.T) {
+	useTenants(t)
+	var got string
+	handler := withTenant(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got = requestTenant(req)
+	}))
+	tests := []struct {
+		name   string
+		target string
+		header map[string]string
+		code   int
+		tenant string
+	}{
+		{"default catalog", "/book?id=1", nil, http.StatusOK, ""},
+		{"admin picks the tenant", "/book?id=1", asTenant("ACME"), http.StatusOK, "acme"},
+		{"unknown tenant", "/book?id=1", asTenant("initech"), http.StatusBadRequest, ""},
+		{"tenant without credentials", "/book?id=1", map[string]string{tenantHeader: "acme"}, http.StatusForbidden, ""},
+		{"tenant id param", "/book?id=acme:1", nil, http.StatusForbidden, ""},
+		{"tenant id in path", "/books/acme:1/reviews", nil, http.StatusForbidden, ""},
+		{"tenant user", "/users/globex:u1/cart", nil, http.StatusForbidden, ""},
+		{"tenant id in a list", "/books/merge?canonical_id=1&duplicate_ids=2,acme:1", nil, http.StatusForbidden, ""},
+	}
+	for _, test := range tests {
+		got = "unset"
+		w := serve(handler, "GET", test.target, test.header)
+		if w.Code != test.code {
+			t.Errorf("%s: status %d, want %d", test.name, w.Code, test.code)
+			continue
+		}
+		if test.code == http.StatusOK && got != test.tenant {
+			t.Errorf("%s: tenant %q, want %q", test.name, got, test.tenant)
+		}
+	}
+}
+
+func TestTenantBooks(t *testing.T) {
+	useTenants(t)
+	handler := withTenant(http.HandlerFunc(book))
+	for tenant, want := range map[string]string{"": "Ulysses", "acme": "Dune", "globex": "Emma"} {
+		var header map[string]string
+		if tenant != "" {
+			header = asTenant(tenant)
+		}
+		w := serve(handler, "GET", "/book?id=1", header)
+		var got Book
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil || got.Title != want {
+			t.Errorf("GET /book?id=1 for %q = %q, want %s", tenant, w.Body.String(), want)
+		}
+	}
+	if w := serve(handler, "GET", "/book?id=globex:1", asTenant("acme")); w.Body.String() != "" {
+		t.Errorf("acme read the book of globex: %q", w.Body.String())
+	}
+
+	w := serve(handler, "PUT", "/book?id=2&title=Neuromancer&author_name=William+Gibson&author_id=gibson", asTenant("acme"))
+	if !strings.Contains(w.Body.String(), "Stored book acme:2") {
+		t.Fatalf("PUT /book for acme = %q", w.Body.String())
+	}
+	source, _ := bookRepo.Get("acme:2")
+	var stored Book
+	if err := json.Unmarshal([]byte(source), &stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored.Tenant != "acme" || stored.AuthorID != "acme:gibson" || stored.WorkID != "acme:2" {
+		t.Errorf("book stored for acme = %+v", stored)
+	}
+	if source, _ = bookRepo.Get("2"); source != "" {
+		t.Errorf("book of acme stored in the default catalog: %q", source)
+	}
+	if w = serve(handler, "DELETE", "/book?id=2", asTenant("globex")); strings.Contains(w.Body.String(), "Deleted") {
+		t.Errorf("globex deleted the book of acme: %q", w.Body.String())
+	}
+}
+
+func TestTenantSearchAndStore(t *testing.T) {
+	useTenants(t)
+	w := serve(withTenant(http.HandlerFunc(search)), "GET", "/search?q=dune+emma+ulysses", asTenant("acme"))
+	if body := w.Body.String(); !strings.Contains(body, "Dune") || strings.Contains(body, "Emma") || strings.Contains(body, "Ulysses") {
+		t.Errorf("GET /search for acme = %q", body)
+	}
+	if total := w.Header().Get("X-Total-Count"); total != "1" {
+		t.Errorf("X-Total-Count for acme = %q, want 1", total)
+	}
+
+	for tenant, want := range map[string]Price{"": priceFromFloat(10), "acme": priceFromFloat(20), "globex": priceFromFloat(30)} {
+		var header map[string]string
+		if tenant != "" {
+			header = asTenant(tenant)
+		}
+		w = serve(withTenant(http.HandlerFunc(store)), "GET", "/store", header)
+		var stats AggsRes
+		if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil || stats.Books != 1 || stats.AvgPrice != want {
+			t.Errorf("GET /store for %q = %q", tenant, w.Body.String())
+		}
+	}
+}
+
+func TestTenantGraphQL(t *testing.T) {
+	useTenants(t)
+	schema, err := newGraphQLSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+	savedSchema := graphqlSchema
+	graphqlSchema = schema
+	defer func() { graphqlSchema = savedSchema }()
+
+	query := url.QueryEscape(`{ book(id: "1") { title } search(q: "dune emma ulysses") { total books { title } } }`)
+	w := serve(withTenant(http.HandlerFunc(graphqlQuery)), "GET", "/graphql?query="+query, asTenant("globex"))
+	body := w.Body.String()
+	if !strings.Contains(body, `"title":"Emma"`) || strings.Contains(body, "Dune") || strings.Contains(body, "Ulysses") {
+		t.Errorf("graphql for globex = %q", body)
+	}
+}
+
+// fakeElasticsearch points the shared client at a server answering every search with no hits
+// and every get with a found document, and returns the bodies of the searches it received.
+func fakeElasticsearch(t *testing.T) func() []string {
+	t.Helper()
+	var mu sync.Mutex
+	var searches []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if strings.Contains(req.URL.Path, "_search") {
+			body, _ := ioutil.ReadAll(req.Body)
+			mu.Lock()
+			searches = append(searches, string(body))
+			mu.Unlock()
+			w.Write([]byte(`{"took":1,"timed_out":false,"hits":{"total":0,"max_score":null,"hits":[]}}`))
+			return
+		}
+		w.Write([]byte(`{"_index":"authors","_type":"author","_id":"a1","_version":1,"found":true,"_source":{"name":"Frank Herbert"}}`))
+	}))
+	client, err := elastic.NewClient(elastic.SetURL(server.URL), elastic.SetSniff(false), elastic.SetHealthcheck(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	esClientMu.Lock()
+	savedClient := esClient
+	esClient = client
+	esClientMu.Unlock()
+	t.Cleanup(func() {
+		esClientMu.Lock()
+		esClient = savedClient
+		esClientMu.Unlock()
+		server.Close()
+	})
+	return func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), searches...)
+	}
+}
+
+func TestTenantFilterOnElasticsearchRoutes(t *testing.T) {
+	useTenants(t)
+	routes := []struct {
+		target  string
+		handler http.HandlerFunc
+		// want are fragments the search must contain besides the tenant filter
+		want []string
+	}{
+		{"/books/isbn/9780441013593", books, []string{`"isbn":"9780441013593"`}},
+		{"/books/random?n=3", books, nil},
+		{"/books/recent", books, nil},
+		{"/books/facets?q=dune", books, nil},
+		{"/works/w1/editions", works, []string{`"work_id":"acme:w1"`}},
+		{"/publishers/Ace/stats", publishers, []string{`"publisher":"Ace"`}},
+		{"/authors/a1", authors, []string{`"author_id":"acme:a1"`}},
+		{"/lists", lists, []string{`"public":true`}},
+		{"/lists/shared/token", lists, []string{`"share_token":"token"`}},
+		{"/admin/data-quality", adminDataQuality, nil},
+	}
+	for _, route := range routes {
+		searches := fakeElasticsearch(t)
+		serve(withTenant(route.handler), "GET", route.target, asTenant("acme"))
+		got := searches()
+		if len(got) != 1 {
+			t.Errorf("GET %s sent %d searches, want 1", route.target, len(got))
+			continue
+		}
+		for _, fragment := range append(route.want, `{"term":{"tenant":"acme"}}`) {
+			if !strings.Contains(got[0], fragment) {
+				t.Errorf("GET %s searched %s, missing %s", route.target, got[0], fragment)
+			}
+		}
+	}
+
+	// the default catalog is the books without a tenant
+	searches := fakeElasticsearch(t)
+	serve(withTenant(http.HandlerFunc(books)), "GET", "/books/recent", nil)
+	if got := searches(); len(got) != 1 || !strings.Contains(got[0], `"must_not":{"exists":{"field":"tenant"}}`) {
+		t.Errorf("GET /books/recent for the default catalog searched %q", got)
+	}
+}
+
+func TestTenantRedisKeys(t *testing.T) {
+	useTenants(t)
+	now := time.Now()
+	keys := map[string]bool{}
+	for _, tenant := range []string{"", "acme", "globex"} {
+		for _, key := range []string{viewsKey(tenant, now), salesKey(tenant, now), tenantSnapshotsKey(tenant)} {
+			if keys[key] {
+				t.Errorf("key %s is shared by tenants", key)
+			}
+			keys[key] = true
+		}
+	}
+	if got := viewsKey("", now); got != viewsKeyPrefix+now.UTC().Format("2006010215") {
+		t.Errorf("views key of the default catalog changed: %s", got)
+	}
+}
+
+func TestGRPCServesDefaultCatalogOnly(t *testing.T) {
+	useTenants(t)
+	info := &grpc.UnaryServerInfo{FullMethod: "/bookservice.BookService/GetBook"}
+	called := false
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		called = true
+		return nil, nil
+	}
+	requests := []interface{}{
+		&bookservicepb.GetBookRequest{Id: "acme:1"},
+		&bookservicepb.DeleteBookRequest{Id: "globex:1"},
+		&bookservicepb.PutBookRequest{Book: &bookservicepb.Book{Id: "2", AuthorId: "acme:a1"}},
+		&bookservicepb.ListActivityRequest{UserId: "acme:u1"},
+	}
+	for _, req := range requests {
+		if _, err := tenantInterceptor(context.Background(), req, info, handler); status.Code(err) != codes.PermissionDenied {
+			t.Errorf("%T %v: %v, want PermissionDenied", req, req, err)
+		}
+	}
+	if called {
+		t.Error("a request naming the ids of a tenant reached the handler")
+	}
+	if _, err := tenantInterceptor(context.Background(), &bookservicepb.GetBookRequest{Id: "1"}, info, handler); err != nil || !called {
+		t.Errorf("GetBook of the default catalog: %v", err)
+	}
+}
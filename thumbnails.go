@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	errors "github.com/fiverr/go_errors"
+	"golang.org/x/image/draw"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"strings"
+)
+
+// thumbnailWidths are the widths of the resized cover variants, served with ?size= on the cover.
+var thumbnailWidths = map[string]int{"small": 100, "medium": 300, "large": 600}
+
+// thumbnailName is the blob name of a cover variant, covers/x.jpg becoming thumbnails/small/x.jpg.
+func thumbnailName(cover string, size string) string {
+	return "thumbnails/" + size + "/" + strings.TrimPrefix(cover, "covers/")
+}
+
+// thumbnailQueue holds the names of the uploaded covers waiting for their variants.
+var thumbnailQueue = make(chan string, 1000)
+
+// queueThumbnails schedules the variants of an uploaded cover, dropping the job when the queue is full.
+func queueThumbnails(cover string) {
+	select {
+	case thumbnailQueue <- cover:
+	default:
+		fmt.Println(errors.New("thumbnail queue is full, dropping cover " + cover))
+	}
+}
+
+// generateThumbnails resizes the cover to every variant width and stores the variants as JPEG.
+// Covers narrower than a variant are stored at their original width.
+func generateThumbnails(ctx context.Context, cover string) error {
+	blob, err := blobs.Get(ctx, cover)
+	if err != nil {
+		return errors.Wrap(err, "cannot read cover "+cover)
+	}
+	src, _, err := image.Decode(blob.Content)
+	blob.Close()
+	if err != nil {
+		return errors.Wrap(err, "cannot decode cover "+cover)
+	}
+	bounds := src.Bounds()
+	for size, width := range thumbnailWidths {
+		if width > bounds.Dx() {
+			width = bounds.Dx()
+		}
+		height := bounds.Dy() * width / bounds.Dx()
+		dst := image.NewRGBA(image.Rect(0, 0, width, height))
+		draw.CatmullRom.Scale(dst, dst.Bounds(), src, bounds, draw.Over, nil)
+		var buf bytes.Buffer
+		if err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 85}); err != nil {
+			return errors.Wrap(err, "cannot encode "+size+" thumbnail of "+cover)
+		}
+		if err = blobs.Put(ctx, thumbnailName(cover, size), &buf, "image/jpeg"); err != nil {
+			return errors.Wrap(err, "cannot store "+size+" thumbnail of "+cover)
+		}
+	}
+	return nil
+}
+
+// startThumbnailWorker generates the queued cover variants until the process exits.
+func startThumbnailWorker() {
+	worker := registerWorker("cover_thumbnails", func() int { return len(thumbnailQueue) })
+	go func() {
+		for cover := range thumbnailQueue {
+			worker.WaitWhilePaused()
+			err := generateThumbnails(context.Background(), cover)
+			if err != nil {
+				fmt.Println(err)
+			}
+			worker.Done(err)
+		}
+	}()
+}
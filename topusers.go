@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	errors "github.com/fiverr/go_errors"
+	"gopkg.in/redis.v5"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	userRequestsKeyPrefix = "user_requests:"
+	// daily request buckets are kept long enough to cover the largest supported window
+	userRequestsRetention = 30 * 24 * time.Hour
+)
+
+// UserRequests is the number of requests a user made over a window.
+type UserRequests struct {
+	UserID   string `json:"user_id"`
+	Requests int64  `json:"requests"`
+}
+
+func userRequestsKey(t time.Time) string {
+	return userRequestsKeyPrefix + t.UTC().Format("20060102")
+}
+
+// topUsersByRequests sums the daily buckets covering window and returns the n most active users.
+func topUsersByRequests(client *redis.Client, window time.Duration, n int64) ([]UserRequests, error) {
+	keys := make([]string, 0)
+	now := time.Now().UTC()
+	for t := now.Add(-window).Truncate(24 * time.Hour); !t.After(now); t = t.Add(24 * time.Hour) {
+		keys = append(keys, userRequestsKey(t))
+	}
+	dest := fmt.Sprintf("user_requests:union:%d", time.Now().UnixNano())
+	if err := client.ZUnionStore(dest, redis.ZStore{}, keys...).Err(); err != nil {
+		return nil, errors.Wrap(err, "cannot sum request counters in Redis")
+	}
+	defer client.Del(dest)
+	resultSet, err := client.ZRevRangeWithScores(dest, 0, n-1).Result()
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot get key from Redis")
+	}
+	users := make([]UserRequests, 0, len(resultSet))
+	for _, zItem := range resultSet {
+		users = append(users, UserRequests{UserID: fmt.Sprintf("%v", zItem.Member), Requests: int64(zItem.Score)})
+	}
+	return users, nil
+}
+
+// topUsers handles GET /admin/top-users?window=7d&n=10, the users making the most requests.
+func topUsers(w http.ResponseWriter, req *http.Request) {
+	if !isAdmin(req) {
+		http.Error(w, "admin token required", http.StatusUnauthorized)
+		return
+	}
+	if req.Method != "GET" {
+		msg := "Unsupported request for /admin/top-users " + req.Method
+		fmt.Fprintf(w, "%s", errors.New(msg))
+		return
+	}
+	window, n := 7*24*time.Hour, int64(10)
+	if value := getParamValue(req, "window"); value != "" {
+		d, err := parseWindow(value)
+		if err != nil || d <= 0 || d > userRequestsRetention {
+			fmt.Fprintf(w, "%s", errors.New("window must be a duration up to 30d"))
+			return
+		}
+		window = d
+	}
+	if value := getParamValue(req, "n"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed <= 0 {
+			fmt.Fprintf(w, "%s", errors.New("n must be a positive integer"))
+			return
+		}
+		n = parsed
+	}
+	client, err := connectRedis()
+	if err != nil {
+		fmt.Fprintf(w, "%s", errors.Wrap(err, "cannot connect to Redis"))
+		return
+	}
+	defer client.Close()
+	users, err := topUsersByRequests(client, window, n)
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	buf, err := json.Marshal(map[string]interface{}{"window": window.String(), "users": users})
+	if err != nil {
+		fmt.Fprintf(w, "%s", errors.Wrap(err, "cannot create json result of top users"))
+		return
+	}
+	fmt.Fprintf(w, "%s", buf)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	errors "github.com/fiverr/go_errors"
+	"math"
+	"net/http"
+	"time"
+)
+
+// trendingHalfLife is the age at which a view counts half as much towards a book's trend score.
+const trendingHalfLife = 6 * time.Hour
+
+// TrendingBook is a book ranked by its time-decayed views over a window.
+type TrendingBook struct {
+	ID    string  `json:"id"`
+	Title string  `json:"title"`
+	Views int64   `json:"views"`
+	Score float64 `json:"score"`
+}
+
+func decay(age time.Duration) float64 {
+	return math.Pow(0.5, float64(age)/float64(trendingHalfLife))
+}
+
+// trendingBooks ranks the tenant's books viewed within window by decayed score and attaches their
+// raw counts.
+func trendingBooks(tenant string, window time.Duration, n int64) ([]TrendingBook, error) {
+	client, err := connectRedis()
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot connect to Redis")
+	}
+	defer client.Close()
+	now := time.Now().UnixNano()
+	scoresKey, countsKey := fmt.Sprintf("views:trending:%d", now), fmt.Sprintf("views:union:%d", now)
+	if err = unionViews(client, scoresKey, tenant, window, decay); err != nil {
+		return nil, err
+	}
+	defer client.Del(scoresKey)
+	if err = unionViews(client, countsKey, tenant, window, nil); err != nil {
+		return nil, err
+	}
+	defer client.Del(countsKey)
+
+	resultSet, err := client.ZRevRangeWithScores(scoresKey, 0, n-1).Result()
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot get key from Redis")
+	}
+	books := make([]TrendingBook, 0, len(resultSet))
+	ids := make([]string, 0, len(resultSet))
+	for _, zItem := range resultSet {
+		id := fmt.Sprintf("%v", zItem.Member)
+		count, _ := client.ZScore(countsKey, id).Result()
+		books = append(books, TrendingBook{ID: id, Views: int64(count), Score: zItem.Score})
+		ids = append(ids, id)
+	}
+	titles, err := bookTitles(ids)
+	if err != nil {
+		return nil, err
+	}
+	for i := range books {
+		books[i].Title = titles[books[i].ID]
+	}
+	return books, nil
+}
+
+// trending handles GET /books/trending?window=24h&n=10.
+func trending(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		msg := "Unsupported request for /books/trending " + req.Method
+		fmt.Fprintf(w, "%s", errors.New(msg))
+		return
+	}
+	window, n, err := parseWindowAndN(req)
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	result, err := trendingBooks(requestTenant(req), window, n)
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	buf, err := json.Marshal(result)
+	if err != nil {
+		fmt.Fprintf(w, "%s", errors.Wrap(err, "cannot create json result of trending books"))
+		return
+	}
+	fmt.Fprintf(w, "%s", buf)
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	errors "github.com/fiverr/go_errors"
+	"gopkg.in/redis.v5"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	usageKeyPrefix = "usage:"
+	// hourly usage buckets are kept long enough to cover the largest supported window
+	usageRetention = 7 * 24 * time.Hour
+)
+
+// UsageBucket is the request volume of one hour, keyed by "route method status".
+type UsageBucket struct {
+	Hour     time.Time        `json:"hour"`
+	Requests map[string]int64 `json:"requests"`
+}
+
+func usageKey(t time.Time) string {
+	return usageKeyPrefix + t.UTC().Format("2006010215")
+}
+
+// statusRecorder captures the status written by a handler. It keeps streaming and websocket
+// upgrades working by passing Flush and Hijack through.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("the response writer does not support hijacking")
+	}
+	return hijacker.Hijack()
+}
+
+// countUsage adds the counts, keyed by "route method status", to the current hourly bucket in
+// one pipeline on the shared client.
+func countUsage(counts map[string]int64) error {
+	key := usageKey(time.Now())
+	_, err := sharedRedis().Pipelined(func(pipe *redis.Pipeline) error {
+		for field, count := range counts {
+			pipe.HIncrBy(key, field, count)
+		}
+		pipe.Expire(key, usageRetention+time.Hour)
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "cannot increment usage counters in Redis")
+	}
+	return nil
+}
+
+// usageQueue buffers the "route method status" of served requests for the usage worker.
+var usageQueue = make(chan string, 10000)
+
+var usageWorker *Worker
+
+// startUsageWorker counts the queued requests until the process exits, adding up those queued
+// meanwhile so a busy service writes one pipeline per batch instead of one per request.
+func startUsageWorker() {
+	usageWorker = registerWorker("usage", func() int { return len(usageQueue) })
+	go func() {
+		for field := range usageQueue {
+			usageWorker.WaitWhilePaused()
+			counts := map[string]int64{field: 1}
+		drain:
+			for len(counts) < 1000 {
+				select {
+				case field = <-usageQueue:
+					counts[field]++
+				default:
+					break drain
+				}
+			}
+			err := countUsage(counts)
+			if err != nil {
+				fmt.Println(err)
+			}
+			usageWorker.Done(err)
+		}
+	}()
+}
+
+// routePattern returns the pattern of the registered route serving req, so counters do not grow
+// with the number of distinct ids in paths.
+func routePattern(req *http.Request) string {
+	_, route := http.DefaultServeMux.Handler(req)
+	if route == "" {
+		return "unmatched"
+	}
+	return route
+}
+
+// withUsage counts every request under the route pattern that matched it. Requests are queued
+// for the usage worker; when the queue is full they are dropped and counted on the worker rather
+// than blocking the request.
+func withUsage(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		route := routePattern(req)
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, req)
+		select {
+		case usageQueue <- route + " " + req.Method + " " + strconv.Itoa(recorder.status):
+		default:
+			usageWorker.Drop()
+		}
+	})
+}
+
+// usageBuckets returns the hourly buckets covering window, oldest first, keeping only the
+// counters of route when it is set.
+func usageBuckets(window time.Duration, route string) ([]UsageBucket, map[string]int64, error) {
+	client, err := connectRedis()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "cannot connect to Redis")
+	}
+	defer client.Close()
+	buckets := make([]UsageBucket, 0)
+	totals := make(map[string]int64)
+	now := time.Now().UTC()
+	for t := now.Add(-window).Truncate(time.Hour); !t.After(now); t = t.Add(time.Hour) {
+		fields, err := client.HGetAll(usageKey(t)).Result()
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "cannot get key from Redis")
+		}
+		bucket := UsageBucket{Hour: t, Requests: make(map[string]int64)}
+		for field, value := range fields {
+			if route != "" && !strings.HasPrefix(field, route+" ") {
+				continue
+			}
+			count, _ := strconv.ParseInt(value, 10, 64)
+			bucket.Requests[field] = count
+			totals[field] += count
+		}
+		buckets = append(buckets, bucket)
+	}
+	return buckets, totals, nil
+}
+
+// usage handles GET /admin/usage?window=24h&route=, the request volume per route, method and
+// status in hourly buckets together with the totals over the window.
+func usage(w http.ResponseWriter, req *http.Request) {
+	if !isAdmin(req) {
+		http.Error(w, "admin token required", http.StatusUnauthorized)
+		return
+	}
+	if req.Method != "GET" {
+		msg := "Unsupported request for /admin/usage " + req.Method
+		fmt.Fprintf(w, "%s", errors.New(msg))
+		return
+	}
+	window := 24 * time.Hour
+	if value := getParamValue(req, "window"); value != "" {
+		d, err := parseWindow(value)
+		if err != nil || d <= 0 || d > usageRetention {
+			fmt.Fprintf(w, "%s", errors.New("window must be a duration up to "+usageRetention.String()))
+			return
+		}
+		window = d
+	}
+	buckets, totals, err := usageBuckets(window, getParamValue(req, "route"))
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	keys := make([]string, 0, len(totals))
+	for key := range totals {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return totals[keys[i]] > totals[keys[j]] })
+	top := make([]map[string]interface{}, 0, len(keys))
+	for _, key := range keys {
+		top = append(top, map[string]interface{}{"key": key, "requests": totals[key]})
+	}
+	buf, err := json.Marshal(map[string]interface{}{"window": window.String(), "totals": top, "buckets": buckets})
+	if err != nil {
+		fmt.Fprintf(w, "%s", errors.Wrap(err, "cannot create json result of usage"))
+		return
+	}
+	fmt.Fprintf(w, "%s", buf)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	errors "github.com/fiverr/go_errors"
+	"net/http"
+	"strings"
+)
+
+// users dispatches the /users/{id}/... routes to their handlers.
+func users(w http.ResponseWriter, req *http.Request) {
+	// path is /users/{id}/{resource}[/...]
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, "/users/"), "/"), "/")
+	if len(parts) < 2 || parts[0] == "" {
+		fmt.Fprintf(w, "%s", errors.New("Unsupported route "+req.URL.Path))
+		return
+	}
+	// the data of a tenant's users is kept under user ids scoped to it, API keys carry their own
+	rawUserId, resource, rest := parts[0], parts[1], parts[2:]
+	userId := tenantID(requestTenant(req), rawUserId)
+	switch resource {
+	case "searches":
+		savedSearches(w, req, userId, rest)
+	case "api-keys":
+		apiKeys(w, req, rawUserId, rest)
+	case "search-history":
+		searchHistory(w, req, userId)
+	case "recently-viewed":
+		recentlyViewed(w, req, userId)
+	case "recommendations":
+		recommendations(w, req, userId)
+	case "following":
+		following(w, req, userId, rest)
+	case "price-alerts":
+		priceAlerts(w, req, userId, rest)
+	case "orders":
+		userOrders(w, req, userId)
+	case "cart":
+		cart(w, req, userId, rest)
+	case "favorites":
+		favorites(w, req, userId, rest)
+	case "lists":
+		userLists(w, req, userId, rest)
+	case "loans":
+		userLoans(w, req, userId)
+	case "activity":
+		userActivity(w, req, userId, rest)
+	case "data":
+		userData(w, req, userId)
+	default:
+		fmt.Fprintf(w, "%s", errors.New("Unsupported route "+req.URL.Path))
+	}
+}
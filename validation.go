@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"golang.org/x/text/unicode/norm"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FieldError is a problem with one field of a payload, named like the param.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError collects every field error of a payload, so clients can fix them all at once
+// instead of one per request.
+type ValidationError struct {
+	Errors []FieldError `json:"errors"`
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, 0, len(e.Errors))
+	for _, fe := range e.Errors {
+		messages = append(messages, fe.Field+": "+fe.Message)
+	}
+	return "invalid fields: " + strings.Join(messages, "; ")
+}
+
+// Add records a problem with field.
+func (e *ValidationError) Add(field string, message string) {
+	e.Errors = append(e.Errors, FieldError{Field: field, Message: message})
+}
+
+// Err returns the collected errors, or nil when there are none.
+func (e *ValidationError) Err() error {
+	if len(e.Errors) == 0 {
+		return nil
+	}
+	return e
+}
+
+// writeValidationError answers with the field errors as JSON and status 400. Other errors are
+// written as plain text like elsewhere, and false is returned when err is not a validation error.
+func writeValidationError(w http.ResponseWriter, err error) bool {
+	verr, ok := err.(*ValidationError)
+	if !ok {
+		return false
+	}
+	buf, jsonErr := json.Marshal(verr)
+	if jsonErr != nil {
+		http.Error(w, verr.Error(), http.StatusBadRequest)
+		return true
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	fmt.Fprintf(w, "%s", buf)
+	return true
+}
+
+// bookFieldSet reports whether each field that can be made required is set on a book. An
+// author_id stands for author_name, which is filled in from the author.
+var bookFieldSet = map[string]func(Book) bool{
+	"title":        func(b Book) bool { return strings.TrimSpace(b.Title) != "" },
+	"author_name":  func(b Book) bool { return strings.TrimSpace(b.AuthorName) != "" || b.AuthorID != "" },
+	"author_id":    func(b Book) bool { return b.AuthorID != "" },
+	"price":        func(b Book) bool { return b.Price > 0 },
+	"formats":      func(b Book) bool { return len(b.Formats) > 0 },
+	"publish_date": func(b Book) bool { return !b.PublishDate.IsZero() },
+	"genre":        func(b Book) bool { return strings.TrimSpace(b.Genre) != "" },
+	"publisher":    func(b Book) bool { return b.Publisher != "" },
+	"isbn":         func(b Book) bool { return b.ISBN != "" },
+	"description":  func(b Book) bool { return strings.TrimSpace(b.Description) != "" },
+	"cover_url":    func(b Book) bool { return b.CoverURL != "" },
+	"page_count":   func(b Book) bool { return b.PageCount > 0 },
+	"language":     func(b Book) bool { return b.Language != "" },
+}
+
+// checkRequiredFields rejects a book missing any of the configured required fields.
+func checkRequiredFields(book Book) error {
+	var verr ValidationError
+	for _, field := range config.Validation.RequiredFields {
+		if set, ok := bookFieldSet[field]; ok && !set(book) {
+			verr.Add(field, "is required")
+		}
+	}
+	return verr.Err()
+}
+
+// bookFromParams validates the client fields of a book, read by name with param, and returns
+// all problems found as a *ValidationError.
+func bookFromParams(param func(name string) string) (Book, error) {
+	var verr ValidationError
+	book := Book{Title: normalizeText(param("title")), AuthorName: normalizeText(param("author_name")),
+		AuthorID: param("author_id"), Genre: normalizeText(param("genre")), Publisher: normalizeText(param("publisher")),
+		Description: strings.TrimSpace(norm.NFC.String(param("description"))), CoverURL: param("cover_url"), WorkID: param("work_id")}
+	var err error
+	if book.Formats, err = parseFormats(param("formats")); err != nil {
+		verr.Add("formats", err.Error())
+	}
+	if value := param("ebook_available"); value != "" {
+		ebookAvailable, err := strconv.ParseBool(value)
+		if err != nil {
+			verr.Add("ebook_available", "must be true or false")
+		}
+		// ebook_available is kept in sync with the ebook format for older clients
+		if ebookAvailable && !hasFormat(book.Formats, "ebook") {
+			book.Formats = append(book.Formats, "ebook")
+		}
+	}
+	book.EbookAvailable = hasFormat(book.Formats, "ebook")
+	if value := param("price"); value != "" {
+		if book.Price, err = parsePrice(value); err != nil {
+			verr.Add("price", err.Error())
+		}
+	}
+	if book.Currency, err = normalizeCurrency(param("currency")); err != nil {
+		verr.Add("currency", err.Error())
+	}
+	if value := param("isbn"); value != "" {
+		if book.ISBN, err = normalizeISBN(value); err != nil {
+			verr.Add("isbn", err.Error())
+		}
+	}
+	if value := param("page_count"); value != "" {
+		book.PageCount, err = strconv.Atoi(value)
+		if err != nil || book.PageCount <= 0 || book.PageCount > maxPageCount {
+			verr.Add("page_count", "must be an integer between 1 and "+strconv.Itoa(maxPageCount))
+		}
+	}
+	if value := param("language"); value != "" {
+		if book.Language, err = normalizeLanguage(value); err != nil {
+			verr.Add("language", err.Error())
+		}
+	}
+	if value := param("publish_date"); value != "" {
+		if book.PublishDate, err = time.Parse(time.RFC3339, value); err != nil {
+			verr.Add("publish_date", "must be an RFC 3339 time such as 2006-01-02T15:04:05Z")
+		}
+	}
+	return book, verr.Err()
+}
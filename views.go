@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	errors "github.com/fiverr/go_errors"
+	"gopkg.in/redis.v5"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	viewsKeyPrefix = "views:"
+	// hourly view buckets are kept long enough to cover the largest supported window
+	viewsRetention = 7 * 24 * time.Hour
+)
+
+// BookViews is the number of requests a book received over a window.
+type BookViews struct {
+	ID    string `json:"id"`
+	Views int64  `json:"views"`
+}
+
+// viewsKey is the hourly bucket of the views of a tenant's books, each tenant counting its own.
+func viewsKey(tenant string, t time.Time) string {
+	return viewsKeyPrefix + tenantID(tenant, t.UTC().Format("2006010215"))
+}
+
+// countView increments the view counter of the book in the current hourly bucket of its catalog.
+func countView(id string) error {
+	client := sharedRedis()
+	key := viewsKey(idTenant(id), time.Now())
+	if err := client.ZIncrBy(key, 1, id).Err(); err != nil {
+		return errors.Wrap(err, "cannot increment view counter in Redis")
+	}
+	if err := client.Expire(key, viewsRetention+time.Hour).Err(); err != nil {
+		return errors.Wrap(err, "cannot set view counter expiry in Redis")
+	}
+	return nil
+}
+
+// unionViews stores into dest the sum of the tenant's hourly buckets covering window. When weight
+// is not nil each bucket is multiplied by weight(age of the bucket).
+func unionViews(client *redis.Client, dest string, tenant string, window time.Duration, weight func(age time.Duration) float64) error {
+	keys := make([]string, 0)
+	weights := make([]float64, 0)
+	now := time.Now()
+	for t := now.Add(-window).Truncate(time.Hour); !t.After(now); t = t.Add(time.Hour) {
+		keys = append(keys, viewsKey(tenant, t))
+		if weight != nil {
+			weights = append(weights, weight(now.Sub(t)))
+		}
+	}
+	if err := client.ZUnionStore(dest, redis.ZStore{Weights: weights}, keys...).Err(); err != nil {
+		return errors.Wrap(err, "cannot sum view counters in Redis")
+	}
+	client.Expire(dest, time.Minute)
+	return nil
+}
+
+// topViewedBooks sums the tenant's hourly buckets covering window and returns the n most viewed
+// books.
+func topViewedBooks(client *redis.Client, tenant string, window time.Duration, n int64) ([]BookViews, error) {
+	dest := fmt.Sprintf("views:union:%d", time.Now().UnixNano())
+	if err := unionViews(client, dest, tenant, window, nil); err != nil {
+		return nil, err
+	}
+	defer client.Del(dest)
+	resultSet, err := client.ZRevRangeWithScores(dest, 0, n-1).Result()
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot get key from Redis")
+	}
+	views := make([]BookViews, 0, len(resultSet))
+	for _, zItem := range resultSet {
+		views = append(views, BookViews{ID: fmt.Sprintf("%v", zItem.Member), Views: int64(zItem.Score)})
+	}
+	return views, nil
+}
+
+// parseWindowAndN reads the window (default 24h) and n (default 10) params of view-based rankings.
+func parseWindowAndN(req *http.Request) (time.Duration, int64, error) {
+	window, n := 24*time.Hour, int64(10)
+	if value := getParamValue(req, "window"); value != "" {
+		d, err := parseWindow(value)
+		if err != nil || d <= 0 || d > viewsRetention {
+			return 0, 0, errors.New("window must be a duration up to " + viewsRetention.String())
+		}
+		window = d
+	}
+	if value := getParamValue(req, "n"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed <= 0 {
+			return 0, 0, errors.New("n must be a positive integer")
+		}
+		n = parsed
+	}
+	return window, n, nil
+}
+
+// heatmap returns the hottest books by request volume over a window.
+func heatmap(w http.ResponseWriter, req *http.Request) {
+	if !isAdmin(req) {
+		http.Error(w, "admin token required", http.StatusUnauthorized)
+		return
+	}
+	if req.Method != "GET" {
+		msg := "Unsupported request for /admin/heatmap " + req.Method
+		fmt.Fprintf(w, "%s", errors.New(msg))
+		return
+	}
+	window, n, err := parseWindowAndN(req)
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	client := sharedRedis()
+	views, err := topViewedBooks(client, requestTenant(req), window, n)
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	buf, err := json.Marshal(views)
+	if err != nil {
+		fmt.Fprintf(w, "%s", errors.Wrap(err, "cannot create json result of heatmap"))
+		return
+	}
+	fmt.Fprintf(w, "%s", buf)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	errors "github.com/fiverr/go_errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Worker tracks the health of a background subsystem and lets admins pause it.
+type Worker struct {
+	name       string
+	queueDepth func() int
+
+	mu          sync.Mutex
+	paused      bool
+	processed   int64
+	failed      int64
+	dropped     int64
+	lastError   string
+	lastErrorAt time.Time
+	startedAt   time.Time
+}
+
+// WorkerStatus is the /admin/workers view of a worker.
+type WorkerStatus struct {
+	Name          string    `json:"name"`
+	Paused        bool      `json:"paused"`
+	QueueDepth    int       `json:"queue_depth"`
+	Processed     int64     `json:"processed"`
+	Failed        int64     `json:"failed"`
+	Dropped       int64     `json:"dropped,omitempty"`
+	RatePerMinute float64   `json:"rate_per_minute"`
+	LastError     string    `json:"last_error,omitempty"`
+	LastErrorAt   time.Time `json:"last_error_at,omitempty"`
+}
+
+var (
+	workersMu sync.Mutex
+	workers   = make(map[string]*Worker)
+)
+
+// registerWorker adds a background subsystem to /admin/workers. queueDepth may be nil for
+// workers without a queue.
+func registerWorker(name string, queueDepth func() int) *Worker {
+	w := &Worker{name: name, queueDepth: queueDepth, startedAt: time.Now()}
+	workersMu.Lock()
+	workers[name] = w
+	workersMu.Unlock()
+	return w
+}
+
+// Done records the outcome of one unit of work.
+func (w *Worker) Done(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.processed++
+	if err != nil {
+		w.failed++
+		w.lastError = err.Error()
+		w.lastErrorAt = time.Now().UTC()
+	}
+}
+
+// Drop records a unit of work discarded because the worker's queue was full.
+func (w *Worker) Drop() {
+	w.mu.Lock()
+	w.dropped++
+	w.mu.Unlock()
+}
+
+// Paused reports whether an admin paused the worker.
+func (w *Worker) Paused() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.paused
+}
+
+// WaitWhilePaused blocks the calling worker loop until the worker is resumed.
+func (w *Worker) WaitWhilePaused() {
+	for w.Paused() {
+		time.Sleep(time.Second)
+	}
+}
+
+func (w *Worker) setPaused(paused bool) {
+	w.mu.Lock()
+	w.paused = paused
+	w.mu.Unlock()
+}
+
+func (w *Worker) status() WorkerStatus {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	s := WorkerStatus{
+		Name:        w.name,
+		Paused:      w.paused,
+		Processed:   w.processed,
+		Failed:      w.failed,
+		Dropped:     w.dropped,
+		LastError:   w.lastError,
+		LastErrorAt: w.lastErrorAt,
+	}
+	if minutes := time.Since(w.startedAt).Minutes(); minutes > 0 {
+		s.RatePerMinute = float64(w.processed) / minutes
+	}
+	if w.queueDepth != nil {
+		s.QueueDepth = w.queueDepth()
+	}
+	return s
+}
+
+// adminWorkers lists the background workers, and pauses or resumes one with
+// POST /admin/workers?name=X&action=pause|resume.
+func adminWorkers(w http.ResponseWriter, req *http.Request) {
+	if !isAdmin(req) {
+		http.Error(w, "admin token required", http.StatusUnauthorized)
+		return
+	}
+	switch req.Method {
+	case "GET":
+		workersMu.Lock()
+		statuses := make([]WorkerStatus, 0, len(workers))
+		for _, worker := range workers {
+			statuses = append(statuses, worker.status())
+		}
+		workersMu.Unlock()
+		sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+		buf, err := json.Marshal(statuses)
+		if err != nil {
+			fmt.Fprintf(w, "%s", errors.Wrap(err, "cannot create json result of workers"))
+			return
+		}
+		fmt.Fprintf(w, "%s", buf)
+	case "POST":
+		name, action := getParamValue(req, "name"), getParamValue(req, "action")
+		workersMu.Lock()
+		worker, ok := workers[name]
+		workersMu.Unlock()
+		if !ok {
+			fmt.Fprintf(w, "%s", errors.New("unknown worker "+name))
+			return
+		}
+		switch action {
+		case "pause":
+			worker.setPaused(true)
+		case "resume":
+			worker.setPaused(false)
+		default:
+			fmt.Fprintf(w, "%s", errors.New("action must be pause or resume"))
+			return
+		}
+		fmt.Fprintf(w, "Worker %s %sd\n", name, action)
+	default:
+		msg := "Unsupported request for /admin/workers " + req.Method
+		fmt.Fprintf(w, "%s", errors.New(msg))
+	}
+}
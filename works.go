@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	errors "github.com/fiverr/go_errors"
+	"gopkg.in/olivere/elastic.v5"
+	"net/http"
+	"strings"
+)
+
+// workEditions returns a page of the editions of a work of the tenant, oldest first.
+func workEditions(client *elastic.Client, ctx context.Context, tenant string, workID string, offset int, limit int) ([]BookHit, int64, error) {
+	query := elastic.NewBoolQuery().Must(elastic.NewTermQuery("work_id", tenantID(tenant, workID))).Filter(tenantQuery(tenant))
+	searchResult, err := client.Search().Index(booksIndex()).Query(query).
+		Sort("publish_date", true).Sort(idSortField(), true).From(offset).Size(limit).Do(ctx)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "cannot search editions of work "+workID)
+	}
+	return bookHits(searchResult), searchResult.Hits.TotalHits, nil
+}
+
+// works dispatches GET /works/{id}/editions?offset=&limit=.
+func works(w http.ResponseWriter, req *http.Request) {
+	if !requireElasticsearch(w, req) {
+		return
+	}
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, "/works/"), "/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] != "editions" {
+		fmt.Fprintf(w, "%s", errors.New("Unsupported route "+req.URL.Path))
+		return
+	}
+	if req.Method != "GET" {
+		msg := "Unsupported request for /works " + req.Method
+		fmt.Fprintf(w, "%s", errors.New(msg))
+		return
+	}
+	offset, limit, err := parsePage(req, 20)
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	client, ctx, err := connectElasticSearch()
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	editions, total, err := workEditions(client, ctx, requestTenant(req), parts[0], int(offset), int(limit))
+	if err != nil {
+		fmt.Fprintf(w, "%s", err)
+		return
+	}
+	if total == 0 {
+		http.NotFound(w, req)
+		return
+	}
+	buf, err := json.Marshal(map[string]interface{}{"work_id": parts[0], "total": total, "editions": editions})
+	if err != nil {
+		fmt.Fprintf(w, "%s", errors.Wrap(err, "cannot create json result of editions"))
+		return
+	}
+	fmt.Fprintf(w, "%s", buf)
+}